@@ -53,7 +53,15 @@ func GetConnection(User string, Password string, DBName string, serverURI string
 	return conn, err
 }
 
+// rows sharing the same sinks.RowID, e.g. retried ones, are merged
+// into one by ClickHouse, keeping the most recently inserted
+const ReplacingEngine = "ReplacingMergeTree"
+
 func NewClickHouseReceiver(User string, Password string, DBName string, serverURI string, isTest bool) (*ClickHouseReceiver, error) {
+	return NewClickHouseReceiverWithEngine(User, Password, DBName, serverURI, isTest, "MergeTree")
+}
+
+func NewClickHouseReceiverWithEngine(User string, Password string, DBName string, serverURI string, isTest bool, engine string) (*ClickHouseReceiver, error) {
 	conn, err := GetConnection(User, Password, DBName, serverURI, isTest)
 	if err != nil {
 		return nil, err
@@ -62,7 +70,7 @@ func NewClickHouseReceiver(User string, Password string, DBName string, serverUR
 	chr := &ClickHouseReceiver{
 		Conn:              conn,
 		SyncMetricHandler: sinks.NewSyncMetricHandler(1024),
-		Engine:            "MergeTree",
+		Engine:            engine,
 	}
 
 	err = chr.SetupTables()
@@ -75,20 +83,49 @@ func NewClickHouseReceiver(User string, Password string, DBName string, serverUR
 }
 
 func (r *ClickHouseReceiver) SetupTables() error {
-	query := fmt.Sprintf(`CREATE TABLE IF NOT EXISTS Measurements(dbname String, metric_name String, custom_tags Map(String, String), data JSON, timestamp DateTime DEFAULT now(), PRIMARY KEY (dbname, timestamp)) ENGINE=%s`, r.Engine)
+	rowID, key, engine := "", "PRIMARY KEY (tenant, dbname, timestamp)", r.Engine
+	if r.Engine == ReplacingEngine {
+		rowID, key, engine = "row_id String, ", "ORDER BY (tenant, dbname, metric_name, row_id)", ReplacingEngine+"(timestamp)"
+	}
+
+	query := fmt.Sprintf(`CREATE TABLE IF NOT EXISTS Measurements(%stenant String DEFAULT '', dbname String, metric_name String, custom_tags Map(String, String), data JSON, timestamp DateTime DEFAULT now(), %s) ENGINE=%s`, rowID, key, engine)
 	err := r.Conn.Exec(context.TODO(), query)
 
 	if err != nil {
 		log.Println("[INFO]: Unable to enforce JSON object. Will use string for storing Measurements data")
-		query = fmt.Sprintf(`CREATE TABLE IF NOT EXISTS Measurements(dbname String, metric_name String, custom_tags Map(String, String), data String, timestamp DateTime DEFAULT now(),PRIMARY KEY (dbname, timestamp)) ENGINE=%s`, r.Engine)
+		query = fmt.Sprintf(`CREATE TABLE IF NOT EXISTS Measurements(%stenant String DEFAULT '', dbname String, metric_name String, custom_tags Map(String, String), data String, timestamp DateTime DEFAULT now(),%s) ENGINE=%s`, rowID, key, engine)
 	}
 
 	err = r.Conn.Exec(context.TODO(), query)
-	return err
+	if err != nil {
+		return err
+	}
+
+	// an existing table keeps its engine, row_id is only in ReplacingMergeTree ones
+	var existing string
+	err = r.Conn.QueryRow(context.TODO(), `SELECT engine FROM system.tables WHERE database = currentDatabase() AND name = 'Measurements'`).Scan(&existing)
+	if err != nil {
+		return err
+	}
+	if (existing == ReplacingEngine) != (r.Engine == ReplacingEngine) {
+		return fmt.Errorf("existing Measurements table uses %s, it has to be recreated, or migrated, to use %s", existing, r.Engine)
+	}
+
+	// tables created before multi-tenancy, rows written without a tenant get ''
+	return r.Conn.Exec(context.TODO(), `ALTER TABLE Measurements ADD COLUMN IF NOT EXISTS tenant String DEFAULT ''`)
 }
 
-func (r *ClickHouseReceiver) InsertMeasurements(ctx context.Context, data *pb.MeasurementEnvelope) error {
-	batch, err := r.Conn.PrepareBatch(ctx, `INSERT INTO Measurements (dbname, metric_name, custom_tags, data) VALUES (?, ?, ?, ?)`)
+func (r *ClickHouseReceiver) InsertMeasurements(ctx context.Context, data *pb.MeasurementEnvelope) (err error) {
+	ctx, span := sinks.StartSpan(ctx, "clickhouse.insert_batch", sinks.MeasurementAttributes(data)...)
+	defer func() { sinks.EndSpan(span, err) }()
+
+	withRowIDs := r.Engine == ReplacingEngine
+	query := `INSERT INTO Measurements (tenant, dbname, metric_name, custom_tags, data) VALUES (?, ?, ?, ?, ?)`
+	if withRowIDs {
+		query = `INSERT INTO Measurements (row_id, tenant, dbname, metric_name, custom_tags, data) VALUES (?, ?, ?, ?, ?, ?)`
+	}
+
+	batch, err := r.Conn.PrepareBatch(ctx, query)
 	if err != nil {
 		return fmt.Errorf("failed to prepare batch: %v", err)
 	}
@@ -96,15 +133,22 @@ func (r *ClickHouseReceiver) InsertMeasurements(ctx context.Context, data *pb.Me
 	for _, measurement := range data.GetData() {
 		measurementJson, err := sinks.GetJson(measurement)
 		if err != nil {
+			sinks.AddDeadLetterRow("clickhouse_receiver", data, measurement, err)
 			continue
 		}
 
-		err = batch.Append(
-			data.GetDBName(), 
+		values := []any{
+			sinks.Tenant(ctx),
+			data.GetDBName(),
 			data.GetMetricName(),
 			data.GetCustomTags(),
 			measurementJson,
-		)
+		}
+		if withRowIDs {
+			values = append([]any{sinks.RowID(data, measurement)}, values...)
+		}
+
+		err = batch.Append(values...)
 
 		if err != nil {
 			msg := "unable to insert data - " + err.Error()
@@ -120,6 +164,9 @@ func (r *ClickHouseReceiver) InsertMeasurements(ctx context.Context, data *pb.Me
 func (r *ClickHouseReceiver) UpdateMeasurements(ctx context.Context, msg *pb.MeasurementEnvelope) (*pb.Reply, error) {
 	err := r.InsertMeasurements(ctx, msg)
 	if err != nil {
+		if sinks.AddDeadLetter("clickhouse_receiver", msg, err) {
+			return sinks.DeadLetteredReply(err), nil
+		}
 		return nil, err
 	}
 	log.Println("[INFO]: Inserted batch at : " + time.Now().String())
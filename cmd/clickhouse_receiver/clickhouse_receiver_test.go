@@ -93,7 +93,7 @@ func TestClickHouseReceiver(t *testing.T) {
 		_, err = recv.UpdateMeasurements(ctx, msg)
 		assert.NoError(t, err)
 
-		rows, err := recv.Conn.Query(ctx, "select * from Measurements;")
+		rows, err := recv.Conn.Query(ctx, "select dbname, metric_name, custom_tags, data, timestamp from Measurements;")
 		assert.NoError(t, err)
 
 		rowCount := 0
@@ -114,4 +114,7 @@ func TestClickHouseReceiver(t *testing.T) {
 		}
 		assert.Equalf(t, rowCount, cnt + 1, "Expected %v rows found %v", cnt + 1, rowCount)
 	}
+	// dedup needs the row_id column of a ReplacingMergeTree table
+	_, err = NewClickHouseReceiverWithEngine(User, Password, DBName, serverURI, true, ReplacingEngine)
+	assert.Error(t, err)
 }
\ No newline at end of file
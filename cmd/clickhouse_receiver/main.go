@@ -21,7 +21,11 @@ func main() {
 	password := os.Getenv("password")
 	serverURI := os.Getenv("server")
 	dbname := os.Getenv("dbname")
-	server, err := NewClickHouseReceiver(user, password, dbname, serverURI, false)
+	engine := "MergeTree"
+	if os.Getenv("dedup") == "true" {
+		engine = ReplacingEngine
+	}
+	server, err := NewClickHouseReceiverWithEngine(user, password, dbname, serverURI, false, engine)
 	if err != nil {
 		log.Fatal("[ERROR]: Unable to create Click house receiver: ", err)
 	}
@@ -5,9 +5,12 @@ import (
 	"encoding/csv"
 	"log"
 	"os"
+	"path/filepath"
 
 	"github.com/destrex271/pgwatch3_rpc_server/sinks"
 	"github.com/destrex271/pgwatch3_rpc_server/sinks/pb"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 )
 
 type CSVReceiver struct {
@@ -34,7 +37,15 @@ func NewCSVReceiver(fullPath string) (tr *CSVReceiver) {
 }
 
 func (r CSVReceiver) UpdateMeasurements(ctx context.Context, msg *pb.MeasurementEnvelope) (*pb.Reply, error) {
-	dbDir := r.FullPath + "/" + msg.GetDBName()
+	// names end up in file paths, they must not escape FullPath
+	for _, name := range []string{msg.GetDBName(), msg.GetMetricName()} {
+		if err := sinks.ValidPathComponent(name); err != nil {
+			return nil, status.Error(codes.InvalidArgument, "invalid name: "+err.Error())
+		}
+	}
+
+	// each tenant gets its own directory
+	dbDir := filepath.Join(r.FullPath, sinks.Tenant(ctx), msg.GetDBName())
 	metricFile := dbDir + msg.GetMetricName() + ".csv"
 
 	// Create Database folder if does not exist
@@ -48,13 +59,15 @@ func (r CSVReceiver) UpdateMeasurements(ctx context.Context, msg *pb.Measurement
 		log.Fatal("Unable to access file. Error: " + err.Error())
 		return nil, err
 	}
-
+	defer func() { _ = file.Close() }()
 	writer := csv.NewWriter(file)
 
 	customTagsJSON, _ := sinks.GetJson(msg.GetCustomTags())
-	for _, measurement := range msg.GetData() {
+	rows := msg.GetData()
+	for i, measurement := range rows {
 		measurementJson, err := sinks.GetJson(measurement)
 		if err != nil {
+			sinks.AddDeadLetterRow("csv_receiver", msg, measurement, err)
 			continue
 		}
 		record := []string{
@@ -63,15 +76,19 @@ func (r CSVReceiver) UpdateMeasurements(ctx context.Context, msg *pb.Measurement
 			customTagsJSON,
 		}
 
-		if err := writer.Write(record); err != nil {
+		// flushed per row, so that only the rows not written are dead-lettered
+		err = writer.Write(record)
+		if err == nil {
+			writer.Flush()
+			err = writer.Error()
+		}
+		if err != nil {
 			log.Println("Unable to write to CSV file " + metricFile + "Error: " + err.Error())
+			if sinks.AddDeadLetterRows("csv_receiver", msg, rows[i:], err) {
+				return sinks.DeadLetteredReply(err), nil
+			}
 			return nil, err
 		}
 	}
-
-	writer.Flush()
-	if err := writer.Error(); err != nil {
-		return nil, err
-	}
 	return &pb.Reply{}, nil
 }
\ No newline at end of file
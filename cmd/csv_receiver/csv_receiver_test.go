@@ -3,24 +3,24 @@ package main
 import (
 	"context"
 	"os"
+	"path/filepath"
 	"testing"
 
+	"github.com/destrex271/pgwatch3_rpc_server/sinks"
 	testutils "github.com/destrex271/pgwatch3_rpc_server/sinks/test_utils"
 	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 )
 
 func TestUpdateMeasurements(t *testing.T) {
-	fullPath, err := os.Getwd()
-	if err != nil {
-		panic(err)
-	}
+	fullPath := t.TempDir()
 	recv := NewCSVReceiver(fullPath)
 
 	// Call Update Measurements with dummy data
 	msg := testutils.GetTestMeasurementEnvelope()
-	_, err = recv.UpdateMeasurements(context.Background(), msg)
+	_, err := recv.UpdateMeasurements(context.Background(), msg)
 	assert.NoError(t, err)
-	defer func() { _ = os.RemoveAll(fullPath + "/" + msg.DBName) }()
 
 	// Check if database folder and metric files are created 
 	dbDir := fullPath + "/" + msg.GetDBName()
@@ -29,4 +29,52 @@ func TestUpdateMeasurements(t *testing.T) {
 
 	metricFile := dbDir + msg.GetMetricName() + ".csv"
 	assert.FileExistsf(t, metricFile, "CSV file for metric %s doesn't exist", msg.GetMetricName())
-}
\ No newline at end of file
+}
+
+func TestUpdateMeasurements_PathTraversal(t *testing.T) {
+	root := t.TempDir()
+	recv := NewCSVReceiver(filepath.Join(root, "measurements"))
+
+	for _, names := range [][2]string{{"../escaped", "testMetric"}, {"..", "testMetric"}, {"test", "/../../escaped"}} {
+		msg := testutils.GetTestMeasurementEnvelope()
+		msg.DBName, msg.MetricName = names[0], names[1]
+		_, err := recv.UpdateMeasurements(context.Background(), msg)
+		assert.Equal(t, codes.InvalidArgument, status.Code(err), names)
+	}
+
+	entries, err := os.ReadDir(root)
+	assert.NoError(t, err)
+	assert.Empty(t, entries, "nothing should be written outside of the storage folder")
+}
+
+func TestUpdateMeasurements_Tenant(t *testing.T) {
+	root := t.TempDir()
+	recv := NewCSVReceiver(root)
+
+	msg := testutils.GetTestMeasurementEnvelope()
+	_, err := recv.UpdateMeasurements(sinks.WithTenant(context.Background(), "acme"), msg)
+	assert.NoError(t, err)
+	assert.FileExists(t, filepath.Join(root, "acme", msg.GetDBName()+msg.GetMetricName()+".csv"))
+	assert.NoFileExists(t, filepath.Join(root, msg.GetDBName()+msg.GetMetricName()+".csv"))
+}
+
+func TestUpdateMeasurements_DeadLetter(t *testing.T) {
+	fullPath := t.TempDir()
+	recv := NewCSVReceiver(fullPath)
+	msg := testutils.GetTestMeasurementEnvelope()
+	// writes to the metric file fail as the disk is full
+	assert.NoError(t, os.MkdirAll(filepath.Join(fullPath, msg.GetDBName()), os.ModePerm))
+	assert.NoError(t, os.Symlink("/dev/full", filepath.Join(fullPath, msg.GetDBName()+msg.GetMetricName()+".csv")))
+
+	defer func(path string) { sinks.SERVER_DEADLETTER_FILE = path }(sinks.SERVER_DEADLETTER_FILE)
+	sinks.SERVER_DEADLETTER_FILE = filepath.Join(t.TempDir(), "deadletters.jsonl")
+	reply, err := recv.UpdateMeasurements(context.Background(), msg)
+	assert.NoError(t, err)
+	assert.True(t, sinks.IsDeadLettered(reply))
+
+	// only the rows, not the whole envelope
+	letters, err := sinks.ReadDeadLetters(sinks.SERVER_DEADLETTER_FILE)
+	assert.NoError(t, err)
+	assert.Len(t, letters, 1)
+	assert.Len(t, letters[0].Envelope.GetData(), len(msg.GetData()))
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"text/tabwriter"
+
+	"github.com/destrex271/pgwatch3_rpc_server/sinks"
+	"github.com/destrex271/pgwatch3_rpc_server/sinks/client"
+	"github.com/destrex271/pgwatch3_rpc_server/sinks/pb"
+)
+
+// List prints a summary of the dead letters stored in path
+func List(w io.Writer, path string, receiver string) error {
+	deadLetters, err := sinks.ReadDeadLetters(path)
+	if err != nil {
+		return err
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	_, _ = fmt.Fprintln(tw, "TIME\tRECEIVER\tDBNAME\tMETRIC\tROWS\tERROR")
+	for _, dl := range deadLetters {
+		if receiver != "" && dl.Receiver != receiver {
+			continue
+		}
+		_, _ = fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%d\t%s\n",
+			dl.Time.Format("2006-01-02 15:04:05"), dl.Receiver, dl.Envelope.GetDBName(),
+			dl.Envelope.GetMetricName(), len(dl.Envelope.GetData()), dl.Error)
+	}
+	return tw.Flush()
+}
+
+type Result struct {
+	Sent   int
+	Failed int
+	// dead letters that failed again and were stored as
+	// dead letters by the receiver itself, part of Failed
+	DeadLettered int
+}
+
+// ErrDeadLettered is returned by send if the receiver acknowledged the
+// envelope by storing it as dead letter, it's not written back to the file
+var ErrDeadLettered = errors.New("stored as dead letter by the receiver")
+
+// Redrive sends the dead letters stored in path using send, only
+// those of receiver if it's not empty. Dead letters that fail again
+// or are filtered out are written back to path.
+//
+// The file is renamed before re-driving it, so receivers can keep
+// adding new dead letters in the meantime. It's renamed under
+// sinks.LockDeadLetters so that no dead letter being appended is lost.
+func Redrive(path string, receiver string, send func(*pb.MeasurementEnvelope) error) (Result, error) {
+	var result Result
+	redrivePath := path + ".redrive"
+	// an existing redrive file was left by an interrupted run, finish it first
+	if _, err := os.Stat(redrivePath); errors.Is(err, fs.ErrNotExist) {
+		unlock, err := sinks.LockDeadLetters(path)
+		if err != nil {
+			return result, err
+		}
+		err = os.Rename(path, redrivePath)
+		if err := errors.Join(err, unlock()); errors.Is(err, fs.ErrNotExist) {
+			// nothing to redrive
+			return result, nil
+		} else if err != nil {
+			return result, err
+		}
+	}
+
+	deadLetters, err := sinks.ReadDeadLetters(redrivePath)
+	if err != nil {
+		return result, err
+	}
+
+	store := sinks.NewDeadLetterStore(path)
+	for _, dl := range deadLetters {
+		if receiver == "" || dl.Receiver == receiver {
+			err = send(dl.Envelope)
+			if err == nil {
+				result.Sent++
+				continue
+			}
+			result.Failed++
+			if errors.Is(err, ErrDeadLettered) {
+				result.DeadLettered++
+				continue
+			}
+			dl.Error = err.Error()
+		}
+
+		if err := store.Append(dl); err != nil {
+			return result, fmt.Errorf("unable to write back dead letters, %s is kept: %w", redrivePath, err)
+		}
+	}
+
+	return result, os.Remove(redrivePath)
+}
+
+type Options struct {
+	Address  string
+	Username string
+	Password string
+	// CAFile enables TLS, the receiver certificate is verified against it
+	CAFile string
+}
+
+// Dial returns a send function for Redrive that
+// writes envelopes to the receiver at opts.Address
+func Dial(opts Options) (func(*pb.MeasurementEnvelope) error, io.Closer, error) {
+	c, err := client.New(opts.Address,
+		client.WithCredentials(opts.Username, opts.Password),
+		client.WithCAFile(opts.CAFile),
+	)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	send := func(msg *pb.MeasurementEnvelope) error {
+		reply, err := c.UpdateMeasurements(context.Background(), msg)
+		if err == nil && sinks.IsDeadLettered(reply) {
+			return fmt.Errorf("%w: %s", ErrDeadLettered, reply.GetLogmsg())
+		}
+		return err
+	}
+	return send, c, nil
+}
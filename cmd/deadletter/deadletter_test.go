@@ -0,0 +1,178 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/destrex271/pgwatch3_rpc_server/sinks"
+	"github.com/destrex271/pgwatch3_rpc_server/sinks/pb"
+	testutils "github.com/destrex271/pgwatch3_rpc_server/sinks/test_utils"
+	"github.com/stretchr/testify/assert"
+)
+
+func writeDeadLetters(t *testing.T) string {
+	path := filepath.Join(t.TempDir(), "deadletters.jsonl")
+	store := sinks.NewDeadLetterStore(path)
+
+	msg := testutils.GetTestMeasurementEnvelope()
+	assert.NoError(t, store.Add("csv_receiver", msg, errors.New("disk full")))
+	msg = testutils.GetTestMeasurementEnvelope()
+	msg.DBName = "other"
+	assert.NoError(t, store.Add("clickhouse_receiver", msg, errors.New("connection refused")))
+	return path
+}
+
+func TestList(t *testing.T) {
+	path := writeDeadLetters(t)
+
+	var out bytes.Buffer
+	assert.NoError(t, List(&out, path, ""))
+	assert.Contains(t, out.String(), "csv_receiver")
+	assert.Contains(t, out.String(), "connection refused")
+
+	out.Reset()
+	assert.NoError(t, List(&out, path, "csv_receiver"))
+	assert.Contains(t, out.String(), "disk full")
+	assert.NotContains(t, out.String(), "clickhouse_receiver")
+
+	assert.Error(t, List(&out, path+".missing", ""))
+}
+
+func TestRedrive(t *testing.T) {
+	path := writeDeadLetters(t)
+
+	var sent []*pb.MeasurementEnvelope
+	send := func(msg *pb.MeasurementEnvelope) error {
+		if msg.GetDBName() == "other" {
+			return errors.New("still down")
+		}
+		sent = append(sent, msg)
+		return nil
+	}
+
+	result, err := Redrive(path, "", send)
+	assert.NoError(t, err)
+	assert.Equal(t, Result{Sent: 1, Failed: 1}, result)
+	assert.Len(t, sent, 1)
+	assert.NoFileExists(t, path+".redrive")
+
+	// only the failed one is kept, with the latest error
+	deadLetters, err := sinks.ReadDeadLetters(path)
+	assert.NoError(t, err)
+	assert.Len(t, deadLetters, 1)
+	assert.Equal(t, "clickhouse_receiver", deadLetters[0].Receiver)
+	assert.Equal(t, "still down", deadLetters[0].Error)
+}
+
+func TestRedrive_ConcurrentAppends(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "deadletters.jsonl")
+	store := sinks.NewDeadLetterStore(path)
+
+	const appended = 200
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for range appended {
+			assert.NoError(t, store.Add("csv_receiver", testutils.GetTestMeasurementEnvelope(), errors.New("disk full")))
+		}
+	}()
+
+	// every dead letter appended while re-driving is either sent or kept
+	sent := 0
+	send := func(msg *pb.MeasurementEnvelope) error { sent++; return nil }
+	for running := true; running; {
+		select {
+		case <-done:
+			running = false
+		default:
+		}
+		if _, err := Redrive(path, "", send); err != nil {
+			assert.ErrorIs(t, err, os.ErrNotExist)
+		}
+	}
+	kept, err := sinks.ReadDeadLetters(path)
+	if err != nil {
+		assert.ErrorIs(t, err, os.ErrNotExist)
+	}
+	assert.Equal(t, appended, sent+len(kept))
+}
+
+func TestRedrive_Receiver(t *testing.T) {
+	path := writeDeadLetters(t)
+
+	result, err := Redrive(path, "clickhouse_receiver", func(msg *pb.MeasurementEnvelope) error { return nil })
+	assert.NoError(t, err)
+	assert.Equal(t, Result{Sent: 1}, result)
+
+	deadLetters, err := sinks.ReadDeadLetters(path)
+	assert.NoError(t, err)
+	assert.Len(t, deadLetters, 1)
+	assert.Equal(t, "csv_receiver", deadLetters[0].Receiver)
+}
+
+func TestRedrive_DeadLetteredAgain(t *testing.T) {
+	path := writeDeadLetters(t)
+
+	// the receiver stored it as dead letter itself, it's not kept twice
+	send := func(msg *pb.MeasurementEnvelope) error {
+		if msg.GetDBName() == "other" {
+			return fmt.Errorf("%w: disk full", ErrDeadLettered)
+		}
+		return nil
+	}
+	result, err := Redrive(path, "", send)
+	assert.NoError(t, err)
+	assert.Equal(t, Result{Sent: 1, Failed: 1, DeadLettered: 1}, result)
+	assert.NoFileExists(t, path)
+}
+
+func TestRedrive_Missing(t *testing.T) {
+	result, err := Redrive(filepath.Join(t.TempDir(), "deadletters.jsonl"), "", func(msg *pb.MeasurementEnvelope) error { return nil })
+	assert.NoError(t, err, "nothing to redrive")
+	assert.Equal(t, Result{}, result)
+}
+
+type Sink struct {
+	received chan *pb.MeasurementEnvelope
+	sinks.SyncMetricHandler
+}
+
+func (s *Sink) UpdateMeasurements(ctx context.Context, msg *pb.MeasurementEnvelope) (*pb.Reply, error) {
+	s.received <- msg
+	if msg.GetDBName() == "other" {
+		return sinks.DeadLetteredReply(errors.New("disk full")), nil
+	}
+	return &pb.Reply{}, nil
+}
+
+func TestDial(t *testing.T) {
+	sink := &Sink{received: make(chan *pb.MeasurementEnvelope, 10)}
+	go func() {
+		if err := sinks.ListenAndServe(sink, "5090"); err != nil {
+			panic(err)
+		}
+	}()
+	time.Sleep(time.Second)
+
+	_, _, err := Dial(Options{Address: "localhost:5090", CAFile: "does-not-exist.crt"})
+	assert.Error(t, err)
+
+	send, conn, err := Dial(Options{Address: "localhost:5090"})
+	assert.NoError(t, err)
+	defer func() { _ = conn.Close() }()
+
+	path := writeDeadLetters(t)
+	result, err := Redrive(path, "", send)
+	assert.NoError(t, err)
+	assert.Equal(t, Result{Sent: 1, Failed: 1, DeadLettered: 1}, result)
+	assert.Len(t, sink.received, 2)
+
+	_, err = os.Stat(path)
+	assert.True(t, os.IsNotExist(err), "dead-letter file should be gone once everything is re-driven")
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"flag"
+	"log"
+	"os"
+)
+
+func main() {
+	file := flag.String("file", os.Getenv("PGWATCH_RPC_SERVER_DEADLETTER_FILE"), "Dead-letter file written by receivers. Defaults to PGWATCH_RPC_SERVER_DEADLETTER_FILE.")
+	receiver := flag.String("receiver", "", "Only list/re-drive dead letters of this receiver (e.g. clickhouse_receiver).")
+	address := flag.String("addr", "localhost:9999", "Address (host:port) of the receiver to re-drive dead letters to.")
+	caFile := flag.String("ca-file", "", "Certificate Authority file path. Enables TLS if set.")
+	flag.Usage = func() {
+		log.Printf("Usage: %s [OPTIONS] list|redrive", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if *file == "" {
+		log.Println("[ERROR]: No Dead-Letter File Specified (--file)")
+		flag.Usage()
+		return
+	}
+
+	switch flag.Arg(0) {
+	case "list":
+		if err := List(os.Stdout, *file, *receiver); err != nil {
+			log.Fatal(err)
+		}
+	case "redrive":
+		send, conn, err := Dial(Options{
+			Address:  *address,
+			Username: os.Getenv("PGWATCH_RPC_SERVER_USERNAME"),
+			Password: os.Getenv("PGWATCH_RPC_SERVER_PASSWORD"),
+			CAFile:   *caFile,
+		})
+		if err != nil {
+			log.Fatal("[ERROR]: Unable to connect to receiver: ", err)
+		}
+
+		result, err := Redrive(*file, *receiver, send)
+		_ = conn.Close()
+		log.Printf("[INFO]: Re-drove %d dead letters, %d failed again, %d of them stored as dead letters by the receiver",
+			result.Sent, result.Failed, result.DeadLettered)
+		if err != nil {
+			log.Fatal(err)
+		}
+	default:
+		flag.Usage()
+	}
+}
@@ -34,6 +34,12 @@ func (dbr *DuckDBReceiver) initializeTable() error {
 	if err != nil {
 		return err
 	}
+
+	// rows are attributed to the tenant of the caller, '' without multi-tenancy
+	_, err = dbr.Conn.Exec(fmt.Sprintf(`ALTER TABLE %s ADD COLUMN IF NOT EXISTS tenant VARCHAR DEFAULT ''`, dbr.TableName))
+	if err != nil {
+		return err
+	}
 	log.Print("Table successfully created")
 	return nil
 }
@@ -46,10 +52,11 @@ func NewDBDuckReceiver(dbPath string, tableName string) (dbr *DuckDBReceiver, er
 	}
 
 	dbr = &DuckDBReceiver{
-		Conn:      db,
-		dbPath:    dbPath,
-		TableName: tableName,
-		Ctx:       context.Background(),
+		Conn:              db,
+		dbPath:            dbPath,
+		TableName:         tableName,
+		Ctx:               context.Background(),
+		SyncMetricHandler: sinks.NewSyncMetricHandler(1024),
 	}
 
 	err = dbr.initializeTable()
@@ -72,7 +79,7 @@ func (r *DuckDBReceiver) InsertMeasurements(ctx context.Context, data *pb.Measur
 	}
 
 	stmt, err := tx.Prepare("INSERT INTO " + r.TableName +
-		" (dbname, metric_name, data, custom_tags, timestamp) VALUES (?, ?, ?, ?, ?)")
+		" (tenant, dbname, metric_name, data, custom_tags, timestamp) VALUES (?, ?, ?, ?, ?, ?)")
 	if err != nil {
 		log.Printf("error from preparing statement: %v", err)
 		_ = tx.Rollback()
@@ -83,9 +90,11 @@ func (r *DuckDBReceiver) InsertMeasurements(ctx context.Context, data *pb.Measur
 	for _, measurement := range data.GetData() {
 		measurementJson, err := sinks.GetJson(measurement)
 		if err != nil {
+			sinks.AddDeadLetterRow("duckdb_receiver", data, measurement, err)
 			continue
 		}
 		_, err = stmt.Exec(
+			sinks.Tenant(ctx),
 			data.GetDBName(),
 			data.GetMetricName(),
 			measurementJson,
@@ -113,6 +122,9 @@ func (r *DuckDBReceiver) UpdateMeasurements(ctx context.Context, msg *pb.Measure
 
 	err := r.InsertMeasurements(ctx, msg)
 	if err != nil {
+		if sinks.AddDeadLetter("duckdb_receiver", msg, err) {
+			return sinks.DeadLetteredReply(err), nil
+		}
 		return nil, err
 	}
 
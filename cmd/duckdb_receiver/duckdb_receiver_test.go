@@ -64,7 +64,7 @@ func TestInitialize(t *testing.T) {
 	}
 
 	// assert required columns exist (in this setting.)
-	requiredColumns := []string{"dbname", "metric_name", "data", "custom_tags", "timestamp"}
+	requiredColumns := []string{"tenant", "dbname", "metric_name", "data", "custom_tags", "timestamp"}
 	for _, col := range requiredColumns {
 		assert.True(t, columnNames[col], fmt.Sprintf("Required column '%s' missing from table", col))
 	}
@@ -105,4 +105,24 @@ func TestUpdateMeasurements(t *testing.T) {
 		}
 		assert.Equalf(t, rowCount, cnt + 1, "Expected %v rows got %v", cnt + 1, rowCount)
 	}
-}
\ No newline at end of file
+}
+func TestUpdateMeasurements_Tenant(t *testing.T) {
+	dbr, err := NewDBDuckReceiver(dbPath, "tenant_measurements")
+	assert.NoError(t, err, "error creating duckdb receiver")
+
+	_, err = dbr.UpdateMeasurements(sinks.WithTenant(context.Background(), "acme"), testutils.GetTestMeasurementEnvelope())
+	assert.NoError(t, err)
+	_, err = dbr.UpdateMeasurements(context.Background(), testutils.GetTestMeasurementEnvelope())
+	assert.NoError(t, err)
+
+	var tenants []string
+	rows, err := dbr.Conn.Query("SELECT tenant FROM tenant_measurements ORDER BY tenant")
+	assert.NoError(t, err, "Failed to query database")
+	defer func() { _ = rows.Close() }()
+	for rows.Next() {
+		var tenant string
+		assert.NoError(t, rows.Scan(&tenant))
+		tenants = append(tenants, tenant)
+	}
+	assert.Equal(t, []string{"", "acme"}, tenants)
+}
@@ -13,6 +13,10 @@ import (
 	"github.com/destrex271/pgwatch3_rpc_server/sinks/pb"
 	"github.com/elastic/go-elasticsearch/v8"
 	"github.com/elastic/go-elasticsearch/v8/esapi"
+	"go.opentelemetry.io/otel/attribute"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/structpb"
 )
 
 type ESReceiver struct {
@@ -54,40 +58,59 @@ func NewESReceiver(addrs []string, username, password, cacertPath string) (*ESRe
 
 func (es *ESReceiver) UpdateMeasurements(ctx context.Context, msg *pb.MeasurementEnvelope) (*pb.Reply, error) {
 	var err error
+	// index names are lowercase, tenants differing only in case would share indices
+	if tenant := sinks.Tenant(ctx); tenant != strings.ToLower(tenant) {
+		return nil, status.Errorf(codes.InvalidArgument, "tenant %q must be lowercase for elasticsearch indices", tenant)
+	}
+	indexName := strings.ToLower(sinks.TenantPrefix(ctx, "-") + msg.GetDBName() + "_" + msg.GetMetricName())
+	// once every failed row is dead-lettered the envelope
+	// is acknowledged, so that retries don't store them again
+	deadLettered := true
 	for _, dataItem := range msg.GetData() {
-		jsonData, err2 := json.Marshal(dataItem)
-		if err2 != nil {
+		if err2 := es.indexDocument(ctx, indexName, sinks.RowID(msg, dataItem), dataItem); err2 != nil {
+			deadLettered = sinks.AddDeadLetterRow("elasticsearch_receiver", msg, dataItem, err2) && deadLettered
 			err = errors.Join(err, err2)
-			continue
 		}
+	}
 
-		indexName := strings.ToLower(msg.GetDBName() + "_" + msg.GetMetricName())
-		req := esapi.IndexRequest{
-			Index: indexName, 
-			Body: bytes.NewReader(jsonData),
+	if err != nil {
+		if deadLettered {
+			return sinks.DeadLetteredReply(err), nil
 		}
+		return nil, err
+	}
+	return &pb.Reply{Logmsg: "Measurement Indexed."}, nil
+}
 
-		res, err2 := req.Do(ctx, es.esClient)
-		if err2 != nil {
-			err = errors.Join(err, err2)
-			continue
-		}
+// documentID is deterministic so that retried rows overwrite
+// the already indexed document instead of duplicating it
+func (es *ESReceiver) indexDocument(ctx context.Context, indexName, documentID string, dataItem *structpb.Struct) (err error) {
+	ctx, span := sinks.StartSpan(ctx, "elasticsearch.index", attribute.String("elasticsearch.index", indexName))
+	defer func() { sinks.EndSpan(span, err) }()
 
-		if res != nil {
-			if res.IsError() {
-				var errorBody map[string]any
-				if err2 = json.NewDecoder(res.Body).Decode(&errorBody); err2 == nil {
-					err = errors.Join(err, fmt.Errorf("elasticsearch error [%s]: %v", res.Status(), errorBody))
-				} else {
-					err = errors.Join(err, fmt.Errorf("elasticsearch error [%s]", res.Status()))
-				}
-			}
-			_ = res.Body.Close()
-		}
+	jsonData, err := json.Marshal(dataItem)
+	if err != nil {
+		return err
+	}
+
+	req := esapi.IndexRequest{
+		Index:      indexName,
+		DocumentID: documentID,
+		Body:       bytes.NewReader(jsonData),
 	}
 
+	res, err := req.Do(ctx, es.esClient)
 	if err != nil {
-		return nil, err
+		return err
 	}
-	return &pb.Reply{Logmsg: "Measurement Indexed."}, nil
-}
\ No newline at end of file
+	defer func() { _ = res.Body.Close() }()
+
+	if res.IsError() {
+		var errorBody map[string]any
+		if err = json.NewDecoder(res.Body).Decode(&errorBody); err == nil {
+			return fmt.Errorf("elasticsearch error [%s]: %v", res.Status(), errorBody)
+		}
+		return fmt.Errorf("elasticsearch error [%s]", res.Status())
+	}
+	return nil
+}
@@ -8,15 +8,21 @@ import (
 	"fmt"
 	"log"
 	"net/http"
+	"net/http/httptest"
 	"os"
+	"path/filepath"
 	"testing"
 	"time"
 
+	"github.com/destrex271/pgwatch3_rpc_server/sinks"
 	testutils "github.com/destrex271/pgwatch3_rpc_server/sinks/test_utils"
+	elasticsearch8 "github.com/elastic/go-elasticsearch/v8"
 	"github.com/stretchr/testify/assert"
 	"github.com/testcontainers/testcontainers-go"
 	"github.com/testcontainers/testcontainers-go/modules/elasticsearch"
 	"github.com/testcontainers/testcontainers-go/wait"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 )
 
 var esContainer *elasticsearch.ElasticsearchContainer
@@ -100,4 +106,38 @@ func TestNewESReceiver(t *testing.T) {
 		_ = json.NewDecoder(resp.Body).Decode(&data)
 		a.Equal(float64(1), data["count"])
 	})
-}
\ No newline at end of file
+}
+func TestESReceiverUppercaseTenant(t *testing.T) {
+	es := &ESReceiver{}
+	ctx := sinks.WithTenant(context.Background(), "Acme")
+	_, err := es.UpdateMeasurements(ctx, testutils.GetTestMeasurementEnvelope())
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+}
+
+func TestESReceiverDeadLetter(t *testing.T) {
+	// rejects every document
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Elastic-Product", "Elasticsearch")
+		w.WriteHeader(http.StatusBadRequest)
+		_, _ = w.Write([]byte(`{"error": "mapper_parsing_exception"}`))
+	}))
+	defer server.Close()
+	client, err := elasticsearch8.NewClient(elasticsearch8.Config{Addresses: []string{server.URL}})
+	assert.NoError(t, err)
+	es := &ESReceiver{esClient: client}
+	msg := testutils.GetTestMeasurementEnvelope()
+
+	// retried by pgwatch if it couldn't be dead-lettered
+	_, err = es.UpdateMeasurements(context.Background(), msg)
+	assert.Error(t, err)
+
+	// acknowledged once dead-lettered, so that it's not stored twice
+	defer func(path string) { sinks.SERVER_DEADLETTER_FILE = path }(sinks.SERVER_DEADLETTER_FILE)
+	sinks.SERVER_DEADLETTER_FILE = filepath.Join(t.TempDir(), "deadletters.jsonl")
+	reply, err := es.UpdateMeasurements(context.Background(), msg)
+	assert.NoError(t, err)
+	assert.Contains(t, reply.GetLogmsg(), "dead-lettered")
+	letters, err := sinks.ReadDeadLetters(sinks.SERVER_DEADLETTER_FILE)
+	assert.NoError(t, err)
+	assert.Len(t, letters, len(msg.GetData()))
+}
@@ -44,12 +44,26 @@ func NewPubsubReceiver(projectID string) (*PubsubReceiver, error) {
 	return pr, nil
 }
 
-func (r *PubsubReceiver) UpdateMeasurements(ctx context.Context, msg *pb.MeasurementEnvelope) (*pb.Reply, error) {
+// NewMessage encodes msg, tagging it with the tenant attribute
+// so that subscriptions of a tenant can filter on it
+func NewMessage(ctx context.Context, msg *pb.MeasurementEnvelope) (*pubsub.Message, error) {
 	data, err := json.Marshal(msg)
 	if err != nil {
 		return nil, err
 	}
+	message := &pubsub.Message{Data: data}
+	if tenant := sinks.Tenant(ctx); tenant != "" {
+		message.Attributes = map[string]string{"tenant": tenant}
+	}
+	return message, nil
+}
+
+func (r *PubsubReceiver) UpdateMeasurements(ctx context.Context, msg *pb.MeasurementEnvelope) (*pb.Reply, error) {
+	message, err := NewMessage(ctx, msg)
+	if err != nil {
+		return nil, err
+	}
 
-	_ = r.publisher.Publish(ctx, &pubsub.Message{Data: data})
+	_ = r.publisher.Publish(ctx, message)
 	return &pb.Reply{Logmsg: "Message published."}, nil
 }
\ No newline at end of file
@@ -10,6 +10,7 @@ import (
 
 	"cloud.google.com/go/pubsub/v2"
 	"cloud.google.com/go/pubsub/v2/apiv1/pubsubpb"
+	"github.com/destrex271/pgwatch3_rpc_server/sinks"
 	testutils "github.com/destrex271/pgwatch3_rpc_server/sinks/test_utils"
 	"github.com/stretchr/testify/assert"
 	"github.com/testcontainers/testcontainers-go"
@@ -88,6 +89,16 @@ func TestPubsubReceiver(t *testing.T) {
 		a.NoError(err)
 	})
 
+	t.Run("Test tenant attribute of messages", func(t *testing.T) {
+		message, err := NewMessage(context.Background(), testutils.GetTestMeasurementEnvelope())
+		a.NoError(err)
+		a.Empty(message.Attributes)
+
+		message, err = NewMessage(sinks.WithTenant(context.Background(), "acme"), testutils.GetTestMeasurementEnvelope())
+		a.NoError(err)
+		a.Equal(map[string]string{"tenant": "acme"}, message.Attributes)
+	})
+
 	t.Run("Test calling SyncMetric() from Pub/Sub Receiver", func(t *testing.T) {
 		req := testutils.GetTestRPCSyncRequest()
 		reply, err := psr.SyncMetric(context.Background(), req)
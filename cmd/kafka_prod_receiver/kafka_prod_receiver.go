@@ -8,8 +8,10 @@ import (
 	"github.com/destrex271/pgwatch3_rpc_server/sinks"
 	"github.com/destrex271/pgwatch3_rpc_server/sinks/pb"
 	"github.com/segmentio/kafka-go"
+	"go.opentelemetry.io/otel/attribute"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
 )
 
 type KafkaProdReceiver struct {
@@ -19,27 +21,25 @@ type KafkaProdReceiver struct {
 	sinks.SyncMetricHandler
 }
 
-// Handle Sync Metric Instructions
-func (r *KafkaProdReceiver) HandleSyncMetric() {
-	for {
-		req, ok := r.GetSyncChannelContent()
-		if !ok {
-			// channel has been closed
-			return
-		}
-
-		var err error
-		switch req.Operation {
-		case pb.SyncOp_AddOp:
-			err = r.AddTopicIfNotExists(req.GetDBName())
-		case pb.SyncOp_DeleteOp:
-			err = r.CloseConnectionForDB(req.GetDBName())
-		}
+// handleSyncMetric creates the topic of added databases
+// and closes the connection of deleted ones
+func (r *KafkaProdReceiver) handleSyncMetric(req *pb.SyncReq) error {
+	switch req.GetOperation() {
+	case pb.SyncOp_AddOp:
+		return r.AddTopicIfNotExists(req.GetDBName())
+	case pb.SyncOp_DeleteOp:
+		return r.CloseConnectionForDB(req.GetDBName())
+	}
+	return nil
+}
 
-		if err != nil {
-			log.Printf("[ERROR] error handling Kafka SyncMetric operation: %s", err)
-		}
+// SyncMetric queues the instruction for the topic of the caller's tenant
+func (r *KafkaProdReceiver) SyncMetric(ctx context.Context, req *pb.SyncReq) (*pb.Reply, error) {
+	if prefix := sinks.TenantPrefix(ctx, "."); prefix != "" {
+		req = proto.Clone(req).(*pb.SyncReq)
+		req.DBName = prefix + req.GetDBName()
 	}
+	return r.SyncMetricHandler.SyncMetric(ctx, req)
 }
 
 func NewKafkaProducer(host string, topics []string, partitions []int, auto_add bool) (kpr *KafkaProdReceiver, err error) {
@@ -65,7 +65,7 @@ func NewKafkaProducer(host string, topics []string, partitions []int, auto_add b
 		auto_add:          auto_add,
 	}
 	// Start sync Handler routine
-	go kpr.HandleSyncMetric()
+	go kpr.HandleSyncMetricFunc(kpr.handleSyncMetric)
 
 	return kpr, nil
 }
@@ -103,8 +103,8 @@ func (r *KafkaProdReceiver) CloseConnectionForDB(dbName string) error {
 }
 
 func (r *KafkaProdReceiver) UpdateMeasurements(ctx context.Context, msg *pb.MeasurementEnvelope) (*pb.Reply, error) {
-	// Get connection for database topic
-	DBName := msg.GetDBName()
+	// Get connection for database topic, namespaced by tenant
+	DBName := sinks.TenantPrefix(ctx, ".") + msg.GetDBName()
 	conn, ok := r.conn_regisrty[DBName]
 	if !ok {
 		log.Println("[WARNING]: Connection does not exist for database " + DBName)
@@ -128,9 +128,12 @@ func (r *KafkaProdReceiver) UpdateMeasurements(ctx context.Context, msg *pb.Meas
 		return nil, status.Error(codes.InvalidArgument, err.Error())
 	}
 
+	_, span := sinks.StartSpan(ctx, "kafka.write", append(sinks.MeasurementAttributes(msg), attribute.String("kafka.topic", DBName))...)
 	_, err = conn.WriteMessages(
-		kafka.Message{Value: json_data},
+		// consumers can drop retried envelopes using the key
+		kafka.Message{Key: []byte(sinks.EnvelopeHash(msg)), Value: json_data},
 	)
+	sinks.EndSpan(span, err)
 
 	if err != nil {
 		log.Println("Failed to write messages!")
@@ -14,6 +14,7 @@ import (
 	"github.com/destrex271/pgwatch3_rpc_server/sinks/pb"
 	"github.com/jackc/pgx/v5/pgxpool"
 	"github.com/rifaideen/talkative"
+	"google.golang.org/protobuf/proto"
 )
 
 const contextString = `
@@ -40,7 +41,7 @@ type LLamaReceiver struct {
 	Ctx       context.Context
 	ServerURI string
 	ConnPool  *pgxpool.Pool
-	MsmtBatch []*pb.MeasurementEnvelope
+	MsmtBatch []batchedMeasurement
 	BatchSize int
 	mu sync.Mutex
 	MsCount   int
@@ -48,6 +49,12 @@ type LLamaReceiver struct {
 	sinks.SyncMetricHandler
 }
 
+// batchedMeasurement keeps the tenant of a measurement until its insights are generated
+type batchedMeasurement struct {
+	tenant string
+	msg    *pb.MeasurementEnvelope
+}
+
 type MeasurementsData struct {
 	metricName string
 	data       string
@@ -83,7 +90,7 @@ func NewLLamaReceiver(LLamaServerURI string, pgURI string, ctx context.Context,
 		Ctx:               ctx,
 		ServerURI:         LLamaServerURI,
 		ConnPool:          pool,
-		MsmtBatch:         make([]*pb.MeasurementEnvelope, 0, batchSize),
+		MsmtBatch:         make([]batchedMeasurement, 0, batchSize),
 		BatchSize:         batchSize,
 		SyncMetricHandler: sinks.NewSyncMetricHandler(1024),
 		MsCount:           0,
@@ -96,38 +103,38 @@ func NewLLamaReceiver(LLamaServerURI string, pgURI string, ctx context.Context,
 		return nil, err
 	}
 
-	go recv.HandleSyncMetric()
+	go recv.HandleSyncMetricFunc(recv.handleSyncMetric)
 
 	return recv, nil
 }
 
-func (r *LLamaReceiver) HandleSyncMetric() {
-	for {
-		req, ok := r.GetSyncChannelContent()
-		if !ok {
-			// channel has been closed
-			return
-		}
-
-		// Acquire connetion
-		conn, err := r.ConnPool.Acquire(r.Ctx)
-		if err != nil {
-			log.Println("[ERROR]: Unable to acquire connection")
-			return
-		}
-		defer conn.Release()
+// SyncMetric queues the instruction for the databases of the caller's tenant,
+// the tenant is carried as "<tenant>/" prefix of DBName
+func (r *LLamaReceiver) SyncMetric(ctx context.Context, req *pb.SyncReq) (*pb.Reply, error) {
+	if req.GetDBName() != "" {
+		req = proto.Clone(req).(*pb.SyncReq)
+		req.DBName = sinks.Tenant(ctx) + "/" + req.GetDBName()
+	}
+	return r.SyncMetricHandler.SyncMetric(ctx, req)
+}
 
-		switch req.Operation {
-		case pb.SyncOp_AddOp:
-			_, err = conn.Exec(r.Ctx, `INSERT INTO db(dbname) VALUES($1)`, req.GetDBName())
-		case pb.SyncOp_DeleteOp:
-			_, err = conn.Exec(r.Ctx, `DELETE FROM db WHERE dbname=$1;`, req.GetDBName())
-		}
+// handleSyncMetric keeps the db table in sync with the monitored databases
+func (r *LLamaReceiver) handleSyncMetric(req *pb.SyncReq) error {
+	// tenants can't contain "/", DBName may
+	tenant, dbname, _ := strings.Cut(req.GetDBName(), "/")
+	conn, err := r.ConnPool.Acquire(r.Ctx)
+	if err != nil {
+		return fmt.Errorf("unable to acquire connection: %w", err)
+	}
+	defer conn.Release()
 
-		if err != nil {
-			log.Printf("[ERROR] error handling LLama SyncMetric operation: %s", err)
-		}
+	switch req.GetOperation() {
+	case pb.SyncOp_AddOp:
+		_, err = conn.Exec(r.Ctx, `INSERT INTO db(tenant, dbname) VALUES($1, $2) ON CONFLICT (tenant, dbname) DO NOTHING`, tenant, dbname)
+	case pb.SyncOp_DeleteOp:
+		_, err = conn.Exec(r.Ctx, `DELETE FROM db WHERE tenant=$1 AND dbname=$2;`, tenant, dbname)
 	}
+	return err
 }
 
 func (r *LLamaReceiver) SetupTables() error {
@@ -166,10 +173,53 @@ func (r *LLamaReceiver) SetupTables() error {
 		return err
 	}
 
+	// databases of different tenants may share a name
+	_, err = conn.Exec(r.Ctx, `ALTER TABLE db ADD COLUMN IF NOT EXISTS tenant TEXT NOT NULL DEFAULT ''`)
+	if err != nil {
+		log.Println("[ERROR]: unable to add tenant column to db table : " + err.Error())
+		return err
+	}
+
+	err = r.dedupDatabases(conn)
+	if err != nil {
+		log.Println("[ERROR]: unable to merge duplicate databases : " + err.Error())
+		return err
+	}
+
+	_, err = conn.Exec(r.Ctx, `CREATE UNIQUE INDEX IF NOT EXISTS db_tenant_dbname ON db(tenant, dbname)`)
+	if err != nil {
+		log.Println("[ERROR]: unable to create unique index on db(tenant, dbname) : " + err.Error())
+		return err
+	}
+
 	return nil
 }
 
-func (r *LLamaReceiver) AddMeasurements(msg *pb.MeasurementEnvelope) error {
+// dedupDatabases merges db rows with the same tenant and dbname, left
+// by earlier versions, into the oldest one so that they can be unique
+func (r *LLamaReceiver) dedupDatabases(conn *pgxpool.Conn) error {
+	tx, err := conn.Begin(r.Ctx)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = tx.Rollback(r.Ctx) }()
+
+	const duplicates = `WITH dup AS (
+		SELECT id, MIN(id) OVER (PARTITION BY tenant, dbname) AS keep_id FROM db
+	)`
+	for _, query := range []string{
+		duplicates + ` UPDATE measurements SET database_id = dup.keep_id FROM dup WHERE measurements.database_id = dup.id AND dup.id <> dup.keep_id`,
+		duplicates + ` UPDATE insights SET database_id = dup.keep_id FROM dup WHERE insights.database_id = dup.id AND dup.id <> dup.keep_id`,
+		duplicates + ` DELETE FROM db USING dup WHERE db.id = dup.id AND dup.id <> dup.keep_id`,
+	} {
+		if _, err = tx.Exec(r.Ctx, query); err != nil {
+			return err
+		}
+	}
+	return tx.Commit(r.Ctx)
+}
+
+func (r *LLamaReceiver) AddMeasurements(tenant string, msg *pb.MeasurementEnvelope) error {
 	conn, err := r.ConnPool.Acquire(r.Ctx)
 	if err != nil {
 		return errors.New("unable to acquire new connection")
@@ -177,23 +227,12 @@ func (r *LLamaReceiver) AddMeasurements(msg *pb.MeasurementEnvelope) error {
 	defer conn.Release()
 
 	var id int
-	// Try to fetch id
-	err = conn.QueryRow(r.Ctx, `SELECT id FROM db WHERE dbname=$1`, msg.GetDBName()).Scan(&id)
+	// add database of the tenant to table if missing and fetch its id
+	query := `INSERT INTO db(tenant, dbname) VALUES($1, $2)
+		ON CONFLICT (tenant, dbname) DO UPDATE SET dbname = EXCLUDED.dbname RETURNING id`
+	err = conn.QueryRow(r.Ctx, query, tenant, msg.GetDBName()).Scan(&id)
 	if err != nil {
-		if err.Error() != "no rows in result set" {
-			return err
-		}
-		// if not found, add database to table
-		_, err := conn.Exec(r.Ctx, `INSERT INTO db(dbname) VALUES($1)`, msg.GetDBName())
-		if err != nil {
-			return err
-		}
-
-		// Get new id
-		err = conn.QueryRow(r.Ctx, `SELECT id FROM db WHERE dbname=$1`, msg.GetDBName()).Scan(&id)
-		if err != nil {
-			return err
-		}
+		return err
 	}
 
 	// insert measurements with current timestamp(default) into table measurements
@@ -210,15 +249,15 @@ func (r *LLamaReceiver) AddMeasurements(msg *pb.MeasurementEnvelope) error {
 	return nil
 }
 
-func (r *LLamaReceiver) GetAllMeasurements(dbname string, metric_name string, context_size uint) ([]MeasurementsData, error) {
+func (r *LLamaReceiver) GetAllMeasurements(tenant string, dbname string, metric_name string, context_size uint) ([]MeasurementsData, error) {
 	conn, err := r.ConnPool.Acquire(r.Ctx)
 	if err != nil {
 		return nil, errors.New("unable to acquire new connection")
 	}
 	defer conn.Release()
 
-	query := "SELECT metric_name, data FROM measurements INNER JOIN db ON measurements.database_id = db.id WHERE db.dbname = $1 ORDER BY created_at DESC LIMIT $2"
-	rows, err := conn.Query(r.Ctx, query, dbname, context_size)
+	query := "SELECT metric_name, data FROM measurements INNER JOIN db ON measurements.database_id = db.id WHERE db.tenant = $1 AND db.dbname = $2 ORDER BY created_at DESC LIMIT $3"
+	rows, err := conn.Query(r.Ctx, query, tenant, dbname, context_size)
 	if err != nil {
 		return nil, err
 	}
@@ -238,8 +277,8 @@ func (r *LLamaReceiver) GetAllMeasurements(dbname string, metric_name string, co
 	return data, nil
 }
 
-func (r *LLamaReceiver) PreparePrompt(dbname string, metric_name string) (string, error) {
-	all_measurements, err := r.GetAllMeasurements(dbname, metric_name, 10)
+func (r *LLamaReceiver) PreparePrompt(tenant string, dbname string, metric_name string) (string, error) {
+	all_measurements, err := r.GetAllMeasurements(tenant, dbname, metric_name, 10)
 	if err != nil {
 		return "", err
 	}
@@ -253,7 +292,7 @@ func (r *LLamaReceiver) PreparePrompt(dbname string, metric_name string) (string
 	return final_msg, nil
 }
 
-func (r *LLamaReceiver) GetDBID(dbname string) (int, error) {
+func (r *LLamaReceiver) GetDBID(tenant string, dbname string) (int, error) {
 	conn, err := r.ConnPool.Acquire(r.Ctx)
 	if err != nil {
 		log.Println("[ERROR]: unable to acquire new connection")
@@ -261,10 +300,10 @@ func (r *LLamaReceiver) GetDBID(dbname string) (int, error) {
 	}
 	defer conn.Release()
 
-	// Get id of database with name = dbname
+	// Get id of database with name = dbname of the tenant
 	id := 0
-	query := `SELECT id FROM db where dbname=$1`
-	err = conn.QueryRow(r.Ctx, query, dbname).Scan(&id)
+	query := `SELECT id FROM db where tenant=$1 AND dbname=$2`
+	err = conn.QueryRow(r.Ctx, query, tenant, dbname).Scan(&id)
 	if err != nil {
 		return 0, err 
 	}
@@ -288,8 +327,8 @@ func (r *LLamaReceiver) AddInsights(dbid int, insights string) error {
 	return nil
 }
 
-func (r *LLamaReceiver) GenerateInsights(msg *pb.MeasurementEnvelope) error {
-	final_msg, err := r.PreparePrompt(msg.GetDBName(), msg.GetMetricName())
+func (r *LLamaReceiver) GenerateInsights(tenant string, msg *pb.MeasurementEnvelope) error {
+	final_msg, err := r.PreparePrompt(tenant, msg.GetDBName(), msg.GetMetricName())
 	if err != nil {
 		return err
 	}
@@ -330,7 +369,7 @@ func (r *LLamaReceiver) GenerateInsights(msg *pb.MeasurementEnvelope) error {
 	}
 
 	<-done // wait for the chat to complete
-	id, err := r.GetDBID(msg.GetDBName())
+	id, err := r.GetDBID(tenant, msg.GetDBName())
 	if err != nil {
 		return errors.New("unable to find database in records")
 	}
@@ -345,7 +384,8 @@ func (r *LLamaReceiver) GenerateInsights(msg *pb.MeasurementEnvelope) error {
 
 func (r *LLamaReceiver) UpdateMeasurements(ctx context.Context, msg *pb.MeasurementEnvelope) (*pb.Reply, error) {
 	// store measurement in pg database
-	err := r.AddMeasurements(msg)
+	tenant := sinks.Tenant(ctx)
+	err := r.AddMeasurements(tenant, msg)
 	if err != nil {
 		return nil, err
 	}
@@ -355,16 +395,16 @@ func (r *LLamaReceiver) UpdateMeasurements(ctx context.Context, msg *pb.Measurem
 
 	// lock to avoid raceing of multiple pgwatch instances
 	r.mu.Lock()
-	r.MsmtBatch = append(r.MsmtBatch, msg)
+	r.MsmtBatch = append(r.MsmtBatch, batchedMeasurement{tenant: tenant, msg: msg})
 	r.MsCount += 1
 
 	if r.MsCount == r.BatchSize {
 		// Generate insights for measurements of batch set
 		for _, val := range r.MsmtBatch {
 			r.InsightsGenerationWg.Add(1)
-			go func(val *pb.MeasurementEnvelope) {
+			go func(val batchedMeasurement) {
 				defer r.InsightsGenerationWg.Done()
-				err = r.GenerateInsights(val)
+				err := r.GenerateInsights(val.tenant, val.msg)
 				if err != nil {
 					log.Printf("Error Generating Insights: %v", err)
 				}
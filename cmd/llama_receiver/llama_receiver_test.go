@@ -8,6 +8,7 @@ import (
 	"testing"
 	"time"
 
+	"github.com/destrex271/pgwatch3_rpc_server/sinks"
 	"github.com/destrex271/pgwatch3_rpc_server/sinks/pb"
 	testutils "github.com/destrex271/pgwatch3_rpc_server/sinks/test_utils"
 	"github.com/stretchr/testify/assert"
@@ -15,6 +16,7 @@ import (
 	tcollama "github.com/testcontainers/testcontainers-go/modules/ollama"
 	"github.com/testcontainers/testcontainers-go/modules/postgres"
 	"github.com/testcontainers/testcontainers-go/wait"
+	"google.golang.org/protobuf/types/known/structpb"
 )
 
 const new_image = "tinyllama_image"
@@ -154,6 +156,52 @@ func TestLLamaReceiver(t *testing.T) {
 		assert.GreaterOrEqual(t, newInsightsCount, 1, "No new entries inserted in insights table")
 	})
 
+	t.Run("Tenant Isolation", func(t *testing.T) {
+		acmeData, err := structpb.NewStruct(map[string]any{"owner": "acme"})
+		assert.NoError(t, err)
+		globexData, err := structpb.NewStruct(map[string]any{"owner": "globex"})
+		assert.NoError(t, err)
+		acmeMsg := &pb.MeasurementEnvelope{DBName: "shared", MetricName: "testMetric", Data: []*structpb.Struct{acmeData}}
+		globexMsg := &pb.MeasurementEnvelope{DBName: "shared", MetricName: "testMetric", Data: []*structpb.Struct{globexData}}
+
+		assert.NoError(t, recv.AddMeasurements("acme", acmeMsg))
+		assert.NoError(t, recv.AddMeasurements("globex", globexMsg))
+		assert.NoError(t, recv.AddMeasurements("acme", acmeMsg))
+
+		// one db row per tenant and dbname
+		var count int
+		err = conn.QueryRow(ctx, "SELECT COUNT(*) FROM db WHERE dbname = 'shared'").Scan(&count)
+		assert.NoError(t, err)
+		assert.Equal(t, 2, count)
+
+		acmeID, err := recv.GetDBID("acme", "shared")
+		assert.NoError(t, err)
+		globexID, err := recv.GetDBID("globex", "shared")
+		assert.NoError(t, err)
+		assert.NotEqual(t, acmeID, globexID)
+		_, err = recv.GetDBID("initech", "shared")
+		assert.Error(t, err)
+
+		// the prompt only contains the tenant's measurements
+		prompt, err := recv.PreparePrompt("acme", "shared", "testMetric")
+		assert.NoError(t, err)
+		assert.Contains(t, prompt, "acme")
+		assert.NotContains(t, prompt, "globex")
+	})
+
+	t.Run("Tenant Measurements", func(t *testing.T) {
+		tenantCtx := sinks.WithTenant(ctx, "acme")
+		_, err := recv.UpdateMeasurements(tenantCtx, msg)
+		assert.NoError(t, err)
+		recv.InsightsGenerationWg.Wait()
+
+		var count int
+		query := `SELECT COUNT(*) FROM insights INNER JOIN db ON insights.database_id = db.id WHERE db.tenant = 'acme' AND db.dbname = $1`
+		err = conn.QueryRow(ctx, query, msg.GetDBName()).Scan(&count)
+		assert.NoError(t, err)
+		assert.Equal(t, 1, count, "insights not stored for the tenant's database")
+	})
+
 	t.Run("LLama SyncMetricHandler", func(t *testing.T) {
 		var exists bool
 		req := testutils.GetTestRPCSyncRequest()
@@ -176,4 +224,57 @@ func TestLLamaReceiver(t *testing.T) {
 		assert.NoError(t, err)
 		assert.False(t, exists)
 	})
-}
\ No newline at end of file
+
+	t.Run("Tenant SyncMetricHandler", func(t *testing.T) {
+		var exists bool
+		req := testutils.GetTestRPCSyncRequest()
+		query := "SELECT EXISTS (SELECT * FROM db WHERE tenant = $1 AND dbname = $2)"
+
+		_, err := recv.SyncMetric(sinks.WithTenant(ctx, "acme"), req)
+		assert.NoError(t, err)
+		_, err = recv.SyncMetric(sinks.WithTenant(ctx, "globex"), req)
+		assert.NoError(t, err)
+		time.Sleep(time.Second) // give some time for handler
+
+		deleteReq := testutils.GetTestRPCSyncRequest()
+		deleteReq.Operation = pb.SyncOp_DeleteOp
+		_, err = recv.SyncMetric(sinks.WithTenant(ctx, "acme"), deleteReq)
+		assert.NoError(t, err)
+		time.Sleep(time.Second) // give some time for handler
+
+		err = conn.QueryRow(ctx, query, "acme", req.GetDBName()).Scan(&exists)
+		assert.NoError(t, err)
+		assert.False(t, exists, "database of the tenant not deleted")
+		err = conn.QueryRow(ctx, query, "globex", req.GetDBName()).Scan(&exists)
+		assert.NoError(t, err)
+		assert.True(t, exists, "database of another tenant deleted")
+	})
+
+	t.Run("Merge Duplicate Databases", func(t *testing.T) {
+		// databases stored twice by earlier versions
+		_, err := conn.Exec(ctx, "DROP INDEX db_tenant_dbname")
+		assert.NoError(t, err)
+		var firstID, secondID int
+		err = conn.QueryRow(ctx, "INSERT INTO db(dbname) VALUES('dup') RETURNING id").Scan(&firstID)
+		assert.NoError(t, err)
+		err = conn.QueryRow(ctx, "INSERT INTO db(dbname) VALUES('dup') RETURNING id").Scan(&secondID)
+		assert.NoError(t, err)
+		_, err = conn.Exec(ctx, "INSERT INTO measurements(data, database_id, metric_name) VALUES('{}', $1, 'm'), ('{}', $2, 'm')", firstID, secondID)
+		assert.NoError(t, err)
+		_, err = conn.Exec(ctx, "INSERT INTO insights(database_id, insight_data) VALUES($1, 'insight')", secondID)
+		assert.NoError(t, err)
+
+		assert.NoError(t, recv.SetupTables())
+
+		var count int
+		err = conn.QueryRow(ctx, "SELECT COUNT(*) FROM db WHERE dbname = 'dup'").Scan(&count)
+		assert.NoError(t, err)
+		assert.Equal(t, 1, count)
+		err = conn.QueryRow(ctx, "SELECT COUNT(*) FROM measurements WHERE database_id = $1", firstID).Scan(&count)
+		assert.NoError(t, err)
+		assert.Equal(t, 2, count)
+		err = conn.QueryRow(ctx, "SELECT COUNT(*) FROM insights WHERE database_id = $1", firstID).Scan(&count)
+		assert.NoError(t, err)
+		assert.Equal(t, 1, count)
+	})
+}
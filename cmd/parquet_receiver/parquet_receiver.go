@@ -4,9 +4,12 @@ import (
 	"context"
 	"log"
 	"os"
+	"path/filepath"
 
 	"github.com/destrex271/pgwatch3_rpc_server/sinks"
 	"github.com/destrex271/pgwatch3_rpc_server/sinks/pb"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 
 	"github.com/parquet-go/parquet-go"
 )
@@ -38,7 +41,17 @@ func NewParquetReceiver(fullPath string) *ParquetReceiver {
 }
 
 func (r ParquetReceiver) UpdateMeasurements(ctx context.Context, msg *pb.MeasurementEnvelope) (*pb.Reply, error) {
-	dbFilePath := r.bufferPath + "/" + msg.GetDBName() + ".parquet"
+	// DBName ends up in the file path, it must not escape bufferPath
+	if err := sinks.ValidPathComponent(msg.GetDBName()); err != nil {
+		return nil, status.Error(codes.InvalidArgument, "invalid database name: "+err.Error())
+	}
+
+	// each tenant gets its own directory
+	dir := filepath.Join(r.bufferPath, sinks.Tenant(ctx))
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		return nil, err
+	}
+	dbFilePath := filepath.Join(dir, msg.GetDBName()+".parquet")
 
 	data_points, err := parquet.ReadFile[ParquetSchema](dbFilePath)
 	if err != nil {
@@ -56,6 +69,7 @@ func (r ParquetReceiver) UpdateMeasurements(ctx context.Context, msg *pb.Measure
 	for _, measurement := range msg.GetData() {
 		data.Data, err = sinks.GetJson(measurement)
 		if err != nil {
+			sinks.AddDeadLetterRow("parquet_receiver", msg, measurement, err)
 			continue
 		}
 		data_points = append(data_points, data)
@@ -64,6 +78,9 @@ func (r ParquetReceiver) UpdateMeasurements(ctx context.Context, msg *pb.Measure
 	err = parquet.WriteFile(dbFilePath, data_points)
 	if err != nil {
 		log.Printf("[ERROR]: Unable to write to parquet file %s.", dbFilePath)
+		if sinks.AddDeadLetter("parquet_receiver", msg, err) {
+			return sinks.DeadLetteredReply(err), nil
+		}
 		return nil, err
 	}
 	log.Println("[INFO]: Updated Measurements for Database: ", msg.GetDBName())
@@ -3,10 +3,14 @@ package main
 import (
 	"context"
 	"os"
+	"path/filepath"
 	"testing"
 
+	"github.com/destrex271/pgwatch3_rpc_server/sinks"
 	testutils "github.com/destrex271/pgwatch3_rpc_server/sinks/test_utils"
 	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 )
 
 func TestUpdateMeasurements(t *testing.T) {
@@ -26,4 +30,47 @@ func TestUpdateMeasurements(t *testing.T) {
 
 	assert.NoError(t, err)
 	assert.FileExists(t, dbFilePath, "Database Parquet file not found")
-}
\ No newline at end of file
+}
+
+func TestUpdateMeasurements_PathTraversal(t *testing.T) {
+	root := t.TempDir()
+	recv := NewParquetReceiver(root)
+
+	msg := testutils.GetTestMeasurementEnvelope()
+	msg.DBName = "../escaped"
+	_, err := recv.UpdateMeasurements(context.Background(), msg)
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+	assert.NoFileExists(t, filepath.Join(root, "escaped.parquet"))
+}
+
+func TestUpdateMeasurements_Tenant(t *testing.T) {
+	root := t.TempDir()
+	recv := NewParquetReceiver(root)
+
+	msg := testutils.GetTestMeasurementEnvelope()
+	_, err := recv.UpdateMeasurements(sinks.WithTenant(context.Background(), "acme"), msg)
+	assert.NoError(t, err)
+	assert.FileExists(t, filepath.Join(root, "parquet_readings", "acme", msg.GetDBName()+".parquet"))
+}
+
+func TestUpdateMeasurements_DeadLetter(t *testing.T) {
+	root := t.TempDir()
+	recv := NewParquetReceiver(root)
+	msg := testutils.GetTestMeasurementEnvelope()
+	// a directory in place of the file makes the write fail
+	assert.NoError(t, os.MkdirAll(filepath.Join(root, "parquet_readings", msg.GetDBName()+".parquet"), os.ModePerm))
+
+	// retried by pgwatch if it couldn't be dead-lettered
+	_, err := recv.UpdateMeasurements(context.Background(), msg)
+	assert.Error(t, err)
+
+	// acknowledged once dead-lettered, so that it's not stored twice
+	defer func(path string) { sinks.SERVER_DEADLETTER_FILE = path }(sinks.SERVER_DEADLETTER_FILE)
+	sinks.SERVER_DEADLETTER_FILE = filepath.Join(root, "deadletters.jsonl")
+	reply, err := recv.UpdateMeasurements(context.Background(), msg)
+	assert.NoError(t, err)
+	assert.Contains(t, reply.GetLogmsg(), "dead-lettered")
+	letters, err := sinks.ReadDeadLetters(sinks.SERVER_DEADLETTER_FILE)
+	assert.NoError(t, err)
+	assert.Len(t, letters, 1)
+}
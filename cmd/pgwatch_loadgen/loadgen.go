@@ -0,0 +1,295 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"math/rand"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/destrex271/pgwatch3_rpc_server/sinks/client"
+	"github.com/destrex271/pgwatch3_rpc_server/sinks/pb"
+	testutils "github.com/destrex271/pgwatch3_rpc_server/sinks/test_utils"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+type Options struct {
+	Address  string
+	Username string
+	Password string
+	// CAFile enables TLS, the receiver certificate is verified against it
+	CAFile string
+	// Rate is the target number of envelopes sent per second
+	Rate float64
+	// SyncRate is the number of SyncMetric delete/add pairs sent per second
+	SyncRate float64
+	Workers  int
+	Duration time.Duration
+	testutils.GeneratorOptions
+}
+
+// rates are ticked at intervals of at least a nanosecond
+const maxRate = float64(time.Second)
+
+// LoadGen sends generated measurements to a receiver
+// the same way pgwatch's gRPC sink does
+type LoadGen struct {
+	opts   Options
+	client *client.Client
+	gen    *testutils.Generator
+
+	mu        sync.Mutex
+	latencies []time.Duration
+	codes     map[codes.Code]int
+	syncCodes map[codes.Code]int
+	// envelopes not sent because all workers were busy
+	skipped int
+	// of calls that reached the receiver but failed
+	failedLatencies []time.Duration
+}
+
+func NewLoadGen(opts Options) (*LoadGen, error) {
+	if opts.Rate <= 0 || opts.Rate > maxRate {
+		return nil, fmt.Errorf("rate must be greater than 0 and at most %g", maxRate)
+	}
+	if opts.SyncRate < 0 || opts.SyncRate > maxRate {
+		return nil, fmt.Errorf("sync rate must be between 0 and %g", maxRate)
+	}
+	if opts.Workers <= 0 {
+		opts.Workers = 1
+	}
+
+	gen, err := testutils.NewGenerator(opts.GeneratorOptions)
+	if err != nil {
+		return nil, err
+	}
+
+	c, err := client.New(opts.Address,
+		client.WithCredentials(opts.Username, opts.Password),
+		client.WithCAFile(opts.CAFile),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	return &LoadGen{
+		opts:      opts,
+		client:    c,
+		gen:       gen,
+		codes:     make(map[codes.Code]int),
+		syncCodes: make(map[codes.Code]int),
+	}, nil
+}
+
+func (l *LoadGen) Close() error {
+	return l.client.Close()
+}
+
+// Run sends envelopes at the configured rate until ctx is
+// cancelled or the configured duration is over
+func (l *LoadGen) Run(ctx context.Context) *Report {
+	if l.opts.Duration > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, l.opts.Duration)
+		defer cancel()
+	}
+
+	// idle workers take a token from ready, so that envelopes
+	// are only generated when there's a worker to send them
+	jobs := make(chan *pb.MeasurementEnvelope)
+	ready := make(chan struct{}, l.opts.Workers)
+	var wg sync.WaitGroup
+	for range l.opts.Workers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				ready <- struct{}{}
+				msg, ok := <-jobs
+				if !ok {
+					return
+				}
+				l.send(ctx, msg)
+			}
+		}()
+	}
+
+	if l.opts.SyncRate > 0 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			l.churn(ctx)
+		}()
+	}
+
+	start := time.Now()
+	ticker := time.NewTicker(time.Duration(float64(time.Second) / l.opts.Rate))
+	defer ticker.Stop()
+
+loop:
+	for {
+		select {
+		case <-ctx.Done():
+			break loop
+		case <-ticker.C:
+			select {
+			case <-ready:
+				jobs <- l.gen.Next()
+			default:
+				// all workers are busy, the receiver can't keep up with the target rate
+				l.mu.Lock()
+				l.skipped++
+				l.mu.Unlock()
+			}
+		}
+	}
+	close(jobs)
+	wg.Wait()
+
+	return l.report(time.Since(start))
+}
+
+func (l *LoadGen) send(ctx context.Context, msg *pb.MeasurementEnvelope) {
+	start := time.Now()
+	_, err := l.client.UpdateMeasurements(ctx, msg)
+	if ctx.Err() != nil && err != nil {
+		// cancelled by the end of the run, not a receiver error
+		return
+	}
+	l.record(l.codes, status.Code(err), time.Since(start))
+}
+
+// churn simulates sources and metrics being removed from and
+// added back to pgwatch monitoring
+func (l *LoadGen) churn(ctx context.Context) {
+	ticker := time.NewTicker(time.Duration(float64(time.Second) / l.opts.SyncRate))
+	defer ticker.Stop()
+
+	sources, metrics := l.gen.Sources(), l.gen.Metrics()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			req := &pb.SyncReq{
+				DBName:     sources[rand.Intn(len(sources))],
+				MetricName: metrics[rand.Intn(len(metrics))],
+			}
+			for _, op := range []pb.SyncOp{pb.SyncOp_DeleteOp, pb.SyncOp_AddOp} {
+				req.Operation = op
+				_, err := l.client.SyncMetric(ctx, req)
+				if ctx.Err() != nil && err != nil {
+					return
+				}
+				l.record(l.syncCodes, status.Code(err), 0)
+			}
+		}
+	}
+}
+
+// record stores the outcome of a call, only envelope
+// calls that reached the receiver carry a latency
+func (l *LoadGen) record(counts map[codes.Code]int, code codes.Code, latency time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	counts[code]++
+	switch {
+	case latency <= 0:
+	case code == codes.OK:
+		l.latencies = append(l.latencies, latency)
+	default:
+		l.failedLatencies = append(l.failedLatencies, latency)
+	}
+}
+
+type Report struct {
+	Elapsed    time.Duration
+	Attempted  int
+	Succeeded  int
+	Skipped    int     // not sent, all workers were busy
+	Throughput float64 // successful envelopes per second
+	P50        time.Duration
+	P90        time.Duration
+	P99        time.Duration
+	Max        time.Duration
+	// latency of failed calls, apart from successful ones
+	FailedP50 time.Duration
+	FailedMax time.Duration
+	Codes     map[codes.Code]int
+	SyncCodes map[codes.Code]int
+}
+
+func (l *LoadGen) report(elapsed time.Duration) *Report {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	r := &Report{
+		Elapsed:   elapsed,
+		Skipped:   l.skipped,
+		Codes:     l.codes,
+		SyncCodes: l.syncCodes,
+	}
+	for _, count := range l.codes {
+		r.Attempted += count
+	}
+	r.Succeeded = l.codes[codes.OK]
+	if elapsed > 0 {
+		r.Throughput = float64(r.Succeeded) / elapsed.Seconds()
+	}
+
+	latencies := slices.Clone(l.latencies)
+	slices.Sort(latencies)
+	r.P50 = percentile(latencies, 50)
+	r.P90 = percentile(latencies, 90)
+	r.P99 = percentile(latencies, 99)
+	if len(latencies) > 0 {
+		r.Max = latencies[len(latencies)-1]
+	}
+
+	failed := slices.Clone(l.failedLatencies)
+	slices.Sort(failed)
+	r.FailedP50 = percentile(failed, 50)
+	if len(failed) > 0 {
+		r.FailedMax = failed[len(failed)-1]
+	}
+	return r
+}
+
+func percentile(sorted []time.Duration, p int) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+	return sorted[(len(sorted)-1)*p/100]
+}
+
+func (r *Report) Print(w io.Writer) {
+	_, _ = fmt.Fprintf(w, "elapsed:     %s\n", r.Elapsed.Round(time.Millisecond))
+	_, _ = fmt.Fprintf(w, "envelopes:   %d attempted, %d succeeded, %d skipped (workers busy)\n", r.Attempted, r.Succeeded, r.Skipped)
+	_, _ = fmt.Fprintf(w, "throughput:  %.1f envelopes/s\n", r.Throughput)
+	_, _ = fmt.Fprintf(w, "latency:     p50=%s p90=%s p99=%s max=%s\n", r.P50, r.P90, r.P99, r.Max)
+	if r.Attempted > r.Succeeded {
+		_, _ = fmt.Fprintf(w, "failed:      p50=%s max=%s\n", r.FailedP50, r.FailedMax)
+	}
+	printCodes(w, "codes:      ", r.Codes)
+	if len(r.SyncCodes) > 0 {
+		printCodes(w, "sync codes: ", r.SyncCodes)
+	}
+}
+
+func printCodes(w io.Writer, prefix string, counts map[codes.Code]int) {
+	keys := make([]codes.Code, 0, len(counts))
+	for code := range counts {
+		keys = append(keys, code)
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i] < keys[j] })
+
+	_, _ = fmt.Fprint(w, prefix)
+	for _, code := range keys {
+		_, _ = fmt.Fprintf(w, " %s=%d", code, counts[code])
+	}
+	_, _ = fmt.Fprintln(w)
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/destrex271/pgwatch3_rpc_server/sinks"
+	"github.com/destrex271/pgwatch3_rpc_server/sinks/pb"
+	testutils "github.com/destrex271/pgwatch3_rpc_server/sinks/test_utils"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const ServerPort = "5070"
+const ServerAddress = "localhost:5070"
+
+type Sink struct {
+	received atomic.Int64
+	sinks.SyncMetricHandler
+}
+
+func (s *Sink) UpdateMeasurements(ctx context.Context, msg *pb.MeasurementEnvelope) (*pb.Reply, error) {
+	if msg.GetMetricName() == "locks" {
+		return nil, status.Error(codes.Unavailable, "locks are not stored")
+	}
+	s.received.Add(1)
+	return &pb.Reply{}, nil
+}
+
+var sink *Sink
+
+func TestMain(m *testing.M) {
+	sink = &Sink{SyncMetricHandler: sinks.NewSyncMetricHandler(1024)}
+	go sink.HandleSyncMetric()
+
+	go func() {
+		if err := sinks.ListenAndServe(sink, ServerPort); err != nil {
+			panic(err)
+		}
+	}()
+	time.Sleep(time.Second)
+
+	os.Exit(m.Run())
+}
+
+func TestNewLoadGen(t *testing.T) {
+	_, err := NewLoadGen(Options{Address: ServerAddress})
+	assert.Error(t, err, "zero rate should be rejected")
+
+	_, err = NewLoadGen(Options{Address: ServerAddress, Rate: 2e9})
+	assert.Error(t, err, "rates that can't be ticked should be rejected")
+	_, err = NewLoadGen(Options{Address: ServerAddress, Rate: 1, SyncRate: -1})
+	assert.Error(t, err)
+
+	_, err = NewLoadGen(Options{Address: ServerAddress, Rate: 1, CAFile: "does-not-exist.crt"})
+	assert.Error(t, err)
+
+	loadgen, err := NewLoadGen(Options{Address: ServerAddress, Rate: 1})
+	assert.NoError(t, err)
+	assert.NoError(t, loadgen.Close())
+}
+
+func TestRun(t *testing.T) {
+	loadgen, err := NewLoadGen(Options{
+		Address:  ServerAddress,
+		Rate:     200,
+		SyncRate: 20,
+		Workers:  4,
+		Duration: time.Second,
+		GeneratorOptions: testutils.GeneratorOptions{
+			NumSources: 2,
+			Metrics:    []string{"db_stats", "locks"},
+		},
+	})
+	assert.NoError(t, err)
+	defer func() { _ = loadgen.Close() }()
+
+	report := loadgen.Run(context.Background())
+	assert.Greater(t, report.Attempted, 0)
+	assert.Greater(t, report.Succeeded, 0)
+	assert.Equal(t, int(sink.received.Load()), report.Succeeded)
+	assert.Greater(t, report.Codes[codes.Unavailable], 0)
+	// envelopes skipped locally aren't mistaken for receiver codes
+	assert.Zero(t, report.Codes[codes.ResourceExhausted])
+	assert.Greater(t, report.SyncCodes[codes.OK], 0)
+	assert.LessOrEqual(t, report.P50, report.P99)
+	assert.LessOrEqual(t, report.P99, report.Max)
+	// failed calls have their own latency
+	assert.Positive(t, report.FailedMax)
+	assert.LessOrEqual(t, report.FailedP50, report.FailedMax)
+
+	var out bytes.Buffer
+	report.Print(&out)
+	assert.Contains(t, out.String(), "Unavailable=")
+	assert.Contains(t, out.String(), "throughput:")
+	assert.Contains(t, out.String(), "skipped")
+	assert.Contains(t, out.String(), "failed:")
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"log"
+	"os"
+	"os/signal"
+	"strings"
+
+	testutils "github.com/destrex271/pgwatch3_rpc_server/sinks/test_utils"
+)
+
+func main() {
+	address := flag.String("addr", "localhost:9999", "Address (host:port) of the receiver to load.")
+	caFile := flag.String("ca-file", "", "Certificate Authority file path. Enables TLS if set.")
+	rate := flag.Float64("rate", 100, "Target number of envelopes sent per second.")
+	syncRate := flag.Float64("syncRate", 0, "Number of SyncMetric delete/add pairs sent per second.")
+	workers := flag.Int("workers", 8, "Number of concurrent in-flight requests.")
+	duration := flag.Duration("duration", 0, "How long to run, runs until interrupted if 0.")
+	sources := flag.Int("sources", 10, "Number of simulated sources.")
+	metrics := flag.String("metrics", strings.Join(testutils.StandardMetrics, ","), "Comma separated list of metrics to generate.")
+	cardinality := flag.Int("cardinality", 0, "Rows per envelope for multi row metrics, metric default if 0.")
+	churn := flag.Float64("churn", 0, "Fraction [0, 1] of row keys replaced on every sample.")
+	flag.Parse()
+
+	username := os.Getenv("PGWATCH_RPC_SERVER_USERNAME")
+	password := os.Getenv("PGWATCH_RPC_SERVER_PASSWORD")
+
+	loadgen, err := NewLoadGen(Options{
+		Address:  *address,
+		Username: username,
+		Password: password,
+		CAFile:   *caFile,
+		Rate:     *rate,
+		SyncRate: *syncRate,
+		Workers:  *workers,
+		Duration: *duration,
+		GeneratorOptions: testutils.GeneratorOptions{
+			NumSources:  *sources,
+			Metrics:     strings.Split(*metrics, ","),
+			Cardinality: *cardinality,
+			Churn:       *churn,
+		},
+	})
+	if err != nil {
+		log.Fatal("[ERROR]: Unable to create load generator: ", err)
+	}
+	defer func() { _ = loadgen.Close() }()
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	log.Printf("[INFO]: Sending %.1f envelopes/s to %s", *rate, *address)
+	report := loadgen.Run(ctx)
+	report.Print(os.Stdout)
+}
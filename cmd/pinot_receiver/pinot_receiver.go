@@ -206,9 +206,10 @@ func (r *PinotReceiver) createTable(tableConfigPath string) error {
 	return nil
 }
 
-func (r *PinotReceiver) insertData(dbName, metricName, data, customTags string) error {
+func (r *PinotReceiver) insertData(tenant, dbName, metricName, data, customTags string) error {
 	// Format data for Pinot ingestion
 	ingestionData := map[string]interface{}{
+		"tenant":      tenant,
 		"dbname":      dbName,
 		"metric_name": metricName,
 		"data":        data,
@@ -311,7 +312,7 @@ func (r *PinotReceiver) UpdateMeasurements(ctx context.Context, msg *pb.Measurem
 		if err != nil {
 			continue
 		}
-		err = r.insertData(msg.GetDBName(), msg.GetMetricName(), measurementJSON, customTagsJSON)
+		err = r.insertData(sinks.Tenant(ctx), msg.GetDBName(), msg.GetMetricName(), measurementJSON, customTagsJSON)
 		if err != nil {
 			logMsg := fmt.Sprintf("error inserting data: %v", err)
 			return nil, errors.New(logMsg)
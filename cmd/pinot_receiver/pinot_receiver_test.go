@@ -2,6 +2,7 @@ package main
 
 import (
 	"context"
+	"encoding/json"
 	"net/http"
 	"net/http/httptest"
 	"os"
@@ -195,4 +196,22 @@ func TestPinotAPIErrors(t *testing.T) {
 	err = receiver.createTable(filepath.Join(configDir, "table.json"))
 	assert.Error(t, err, "Should error when Pinot API returns error")
 	assert.Contains(t, err.Error(), "failed to create table", "Error should mention table creation failure")
-}
\ No newline at end of file
+}
+func TestUpdateMeasurements_Tenant(t *testing.T) {
+	var rows []map[string]any
+	handler := http.NewServeMux()
+	handler.HandleFunc("/ingestFromFile", func(w http.ResponseWriter, r *http.Request) {
+		file, _, err := r.FormFile("file")
+		assert.NoError(t, err)
+		assert.NoError(t, json.NewDecoder(file).Decode(&rows))
+		w.WriteHeader(http.StatusOK)
+	})
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	receiver := &PinotReceiver{ControllerURL: server.URL, TableName: "pgwatch_metrics", Client: server.Client()}
+	_, err := receiver.UpdateMeasurements(sinks.WithTenant(context.Background(), "acme"), testutils.GetTestMeasurementEnvelope())
+	assert.NoError(t, err)
+	assert.Len(t, rows, 1)
+	assert.Equal(t, "acme", rows[0]["tenant"])
+}
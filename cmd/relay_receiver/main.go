@@ -0,0 +1,67 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/destrex271/pgwatch3_rpc_server/sinks"
+	"github.com/destrex271/pgwatch3_rpc_server/sinks/client"
+	"go.opentelemetry.io/contrib/instrumentation/google.golang.org/grpc/otelgrpc"
+	"google.golang.org/grpc"
+)
+
+func main() {
+	port := flag.String("port", "-1", "Specify the port where you want your sink to receive the measurements on.")
+	upstream := flag.String("upstream", "", "Address (host:port) of the receiver measurements are forwarded to.")
+	upstreamCAFile := flag.String("upstreamCAFile", "", "Certificate Authority file path of the upstream receiver. Enables TLS if set.")
+	compression := flag.String("compression", "none", "Compression of upstream requests: none, gzip or zstd, the upstream receiver must support it.")
+	spoolFolder := flag.String("spoolFolder", ".", "Folder requests are buffered in while the upstream receiver is unavailable.")
+	spoolMaxBytes := flag.Int64("spoolMaxBytes", 1<<30, "Max size of the spool, requests are rejected once full. 0 means no limit.")
+	retryInterval := flag.Duration("retryInterval", 10*time.Second, "Interval between attempts to re-send spooled requests.")
+	tags := flag.String("tags", "", "Comma separated key=value tags added to every measurement, e.g. site=eu1.")
+	flag.Parse()
+
+	if *port == "-1" {
+		log.Println("[ERROR]: No Port Specified")
+		return
+	}
+	if *upstream == "" {
+		log.Println("[ERROR]: No Upstream Receiver Specified")
+		return
+	}
+
+	extraTags, err := ParseTags(*tags)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	dialOptions := []grpc.DialOption{grpc.WithStatsHandler(otelgrpc.NewClientHandler())}
+	if *compression != "none" {
+		dialOptions = append(dialOptions, grpc.WithDefaultCallOptions(grpc.UseCompressor(*compression)))
+	}
+	upstreamClient, err := client.New(*upstream,
+		client.WithCredentials(os.Getenv("PGWATCH_RPC_UPSTREAM_USERNAME"), os.Getenv("PGWATCH_RPC_UPSTREAM_PASSWORD")),
+		client.WithCAFile(*upstreamCAFile),
+		client.WithDialOptions(dialOptions...),
+	)
+	if err != nil {
+		log.Fatal("[ERROR]: Unable to connect to upstream receiver: ", err)
+	}
+	defer func() { _ = upstreamClient.Close() }()
+
+	if err := os.MkdirAll(*spoolFolder, os.ModePerm); err != nil {
+		log.Fatal(err)
+	}
+	spool := NewSpool(filepath.Join(*spoolFolder, "relay.spool"), *spoolMaxBytes)
+
+	server := NewRelayReceiver(upstreamClient, spool, extraTags)
+	go server.DrainEvery(context.Background(), *retryInterval)
+
+	if err := sinks.ListenAndServe(server, *port); err != nil {
+		log.Fatal(err)
+	}
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"maps"
+	"strings"
+	"time"
+
+	"github.com/destrex271/pgwatch3_rpc_server/sinks"
+	"github.com/destrex271/pgwatch3_rpc_server/sinks/client"
+	"github.com/destrex271/pgwatch3_rpc_server/sinks/pb"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+// RelayReceiver forwards everything it receives to an upstream
+// receiver, spooling requests to disk while it's unreachable
+type RelayReceiver struct {
+	pb.UnimplementedReceiverServer
+	upstream pb.ReceiverClient
+	spool    *Spool
+	// added to every envelope, overriding tags sent by pgwatch
+	tags map[string]string
+	// max time spent on a single upstream call
+	timeout time.Duration
+}
+
+func NewRelayReceiver(upstream pb.ReceiverClient, spool *Spool, tags map[string]string) *RelayReceiver {
+	return &RelayReceiver{
+		upstream: upstream,
+		spool:    spool,
+		tags:     tags,
+		timeout:  30 * time.Second,
+	}
+}
+
+// ParseTags parses a comma separated list of key=value pairs
+func ParseTags(s string) (map[string]string, error) {
+	tags := map[string]string{}
+	for _, pair := range strings.Split(s, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		key, value, ok := strings.Cut(pair, "=")
+		if !ok || strings.TrimSpace(key) == "" {
+			return nil, fmt.Errorf("invalid tag %q: expected key=value", pair)
+		}
+		tags[strings.TrimSpace(key)] = strings.TrimSpace(value)
+	}
+	return tags, nil
+}
+
+// unavailable reports whether err means the upstream
+// receiver couldn't be reached, rather than rejecting the request
+func unavailable(err error) bool {
+	return client.Retryable(err) || status.Code(err) == codes.DeadlineExceeded
+}
+
+func (r *RelayReceiver) forward(ctx context.Context, method string, req proto.Message) (*pb.Reply, error) {
+	// requests are spooled as long as older ones
+	// are waiting, so that upstream gets them in order
+	spooled, err := r.spool.AddIfPending(method, req)
+	if err != nil {
+		return nil, err
+	}
+	if !spooled {
+		reply, err := r.send(ctx, req)
+		if err == nil || !unavailable(err) {
+			return reply, err
+		}
+		log.Printf("[WARNING]: Upstream unavailable, spooling requests: %s", err)
+		if err := r.spool.Add(method, req); err != nil {
+			return nil, err
+		}
+	}
+	return &pb.Reply{Logmsg: "upstream unavailable, request spooled"}, nil
+}
+
+func (r *RelayReceiver) send(ctx context.Context, req proto.Message) (*pb.Reply, error) {
+	ctx, cancel := context.WithTimeout(ctx, r.timeout)
+	defer cancel()
+
+	switch req := req.(type) {
+	case *pb.MeasurementEnvelope:
+		return r.upstream.UpdateMeasurements(ctx, req)
+	case *pb.SyncReq:
+		return r.upstream.SyncMetric(ctx, req)
+	case *structpb.Struct:
+		return r.upstream.DefineMetrics(ctx, req)
+	}
+	return nil, status.Errorf(codes.Unimplemented, "unsupported request %T", req)
+}
+
+func (r *RelayReceiver) UpdateMeasurements(ctx context.Context, msg *pb.MeasurementEnvelope) (*pb.Reply, error) {
+	if len(r.tags) > 0 {
+		msg = proto.Clone(msg).(*pb.MeasurementEnvelope)
+		if msg.CustomTags == nil {
+			msg.CustomTags = map[string]string{}
+		}
+		maps.Copy(msg.CustomTags, r.tags)
+	}
+	return r.forward(ctx, pb.Receiver_UpdateMeasurements_FullMethodName, msg)
+}
+
+func (r *RelayReceiver) SyncMetric(ctx context.Context, req *pb.SyncReq) (*pb.Reply, error) {
+	return r.forward(ctx, pb.Receiver_SyncMetric_FullMethodName, req)
+}
+
+func (r *RelayReceiver) DefineMetrics(ctx context.Context, metrics *structpb.Struct) (*pb.Reply, error) {
+	return r.forward(ctx, pb.Receiver_DefineMetrics_FullMethodName, metrics)
+}
+
+// SelfStats adds the spool size to the receiver stats
+func (r *RelayReceiver) SelfStats() map[string]float64 {
+	return map[string]float64{"spool_bytes": float64(r.spool.Size())}
+}
+
+// Drain re-sends spooled requests, requests upstream
+// rejects are logged and dropped as pgwatch can't retry them
+func (r *RelayReceiver) Drain(ctx context.Context) (int, error) {
+	return r.spool.Drain(func(rec *sinks.Recording) error {
+		_, err := r.send(ctx, rec.Request)
+		if err != nil && !unavailable(err) {
+			log.Printf("[ERROR]: Upstream rejected spooled %s request, dropping it: %s", rec.Method, err)
+			return nil
+		}
+		return err
+	})
+}
+
+// Flush drains the spool, for the admin API
+func (r *RelayReceiver) Flush(ctx context.Context) error {
+	sent, err := r.Drain(ctx)
+	log.Printf("[INFO]: Re-sent %d spooled requests upstream", sent)
+	return err
+}
+
+// DrainEvery drains the spool every interval until ctx is cancelled
+func (r *RelayReceiver) DrainEvery(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if r.spool.Empty() {
+			continue
+		}
+		sent, err := r.Drain(ctx)
+		if sent > 0 {
+			log.Printf("[INFO]: Re-sent %d spooled requests upstream", sent)
+		}
+		if err != nil {
+			log.Printf("[WARNING]: Upstream still unavailable, %d bytes spooled: %s", r.spool.Size(), err)
+		}
+	}
+}
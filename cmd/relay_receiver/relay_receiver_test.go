@@ -0,0 +1,249 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/destrex271/pgwatch3_rpc_server/sinks"
+	"github.com/destrex271/pgwatch3_rpc_server/sinks/pb"
+	testutils "github.com/destrex271/pgwatch3_rpc_server/sinks/test_utils"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+// fakeUpstream records the requests it gets, failing while down
+type fakeUpstream struct {
+	mu       sync.Mutex
+	down     bool
+	reject   bool
+	requests []proto.Message
+}
+
+func (u *fakeUpstream) handle(req proto.Message) (*pb.Reply, error) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if u.down {
+		return nil, status.Error(codes.Unavailable, "connection refused")
+	}
+	if u.reject {
+		return nil, status.Error(codes.InvalidArgument, "invalid")
+	}
+	u.requests = append(u.requests, req)
+	return &pb.Reply{}, nil
+}
+
+func (u *fakeUpstream) UpdateMeasurements(ctx context.Context, in *pb.MeasurementEnvelope, opts ...grpc.CallOption) (*pb.Reply, error) {
+	return u.handle(in)
+}
+
+func (u *fakeUpstream) SyncMetric(ctx context.Context, in *pb.SyncReq, opts ...grpc.CallOption) (*pb.Reply, error) {
+	return u.handle(in)
+}
+
+func (u *fakeUpstream) DefineMetrics(ctx context.Context, in *structpb.Struct, opts ...grpc.CallOption) (*pb.Reply, error) {
+	return u.handle(in)
+}
+
+func newTestRelay(t *testing.T, maxBytes int64) (*RelayReceiver, *fakeUpstream) {
+	upstream := &fakeUpstream{}
+	spool := NewSpool(filepath.Join(t.TempDir(), "relay.spool"), maxBytes)
+	return NewRelayReceiver(upstream, spool, map[string]string{"site": "eu1"}), upstream
+}
+
+func TestParseTags(t *testing.T) {
+	tags, err := ParseTags("site=eu1, region = eu-central ,")
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{"site": "eu1", "region": "eu-central"}, tags)
+
+	_, err = ParseTags("site")
+	assert.Error(t, err)
+}
+
+func TestRelayReceiver(t *testing.T) {
+	relay, upstream := newTestRelay(t, 0)
+
+	msg := testutils.GetTestMeasurementEnvelope()
+	_, err := relay.UpdateMeasurements(context.Background(), msg)
+	assert.NoError(t, err)
+	_, err = relay.SyncMetric(context.Background(), testutils.GetTestRPCSyncRequest())
+	assert.NoError(t, err)
+
+	assert.Len(t, upstream.requests, 2)
+	forwarded := upstream.requests[0].(*pb.MeasurementEnvelope)
+	assert.Equal(t, map[string]string{"tagName": "tagValue", "site": "eu1"}, forwarded.GetCustomTags())
+	assert.NotContains(t, msg.GetCustomTags(), "site", "the received envelope must not be modified")
+
+	// rejections are passed on to pgwatch
+	upstream.reject = true
+	_, err = relay.UpdateMeasurements(context.Background(), msg)
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+	assert.True(t, relay.spool.Empty())
+}
+
+func TestRelayReceiver_Spool(t *testing.T) {
+	relay, upstream := newTestRelay(t, 0)
+	upstream.down = true
+
+	for _, db := range []string{"a", "b"} {
+		msg := testutils.GetTestMeasurementEnvelope()
+		msg.DBName = db
+		reply, err := relay.UpdateMeasurements(context.Background(), msg)
+		assert.NoError(t, err)
+		assert.Contains(t, reply.GetLogmsg(), "spooled")
+	}
+	assert.False(t, relay.spool.Empty())
+	assert.Positive(t, relay.SelfStats()["spool_bytes"])
+
+	sent, err := relay.Drain(context.Background())
+	assert.Equal(t, codes.Unavailable, status.Code(err))
+	assert.Equal(t, 0, sent)
+
+	// requests keep being spooled until older ones are delivered
+	upstream.down = false
+	msg := testutils.GetTestMeasurementEnvelope()
+	msg.DBName = "c"
+	_, err = relay.UpdateMeasurements(context.Background(), msg)
+	assert.NoError(t, err)
+	assert.Empty(t, upstream.requests)
+
+	sent, err = relay.Drain(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, 2, sent)
+	sent, err = relay.Drain(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, 1, sent)
+	assert.True(t, relay.spool.Empty())
+
+	dbs := []string{}
+	for _, req := range upstream.requests {
+		dbs = append(dbs, req.(*pb.MeasurementEnvelope).GetDBName())
+	}
+	assert.Equal(t, []string{"a", "b", "c"}, dbs)
+}
+
+func TestSpool_PartialDrain(t *testing.T) {
+	spool := NewSpool(filepath.Join(t.TempDir(), "relay.spool"), 0)
+	for _, db := range []string{"a", "b", "c"} {
+		assert.NoError(t, spool.Add(pb.Receiver_SyncMetric_FullMethodName, &pb.SyncReq{DBName: db}))
+	}
+
+	// the failed request and the following ones are kept, in order
+	received := []string{}
+	send := func(fail string) func(*sinks.Recording) error {
+		return func(rec *sinks.Recording) error {
+			db := rec.Request.(*pb.SyncReq).GetDBName()
+			if db == fail {
+				return status.Error(codes.Unavailable, "down")
+			}
+			received = append(received, db)
+			return nil
+		}
+	}
+	sent, err := spool.Drain(send("b"))
+	assert.Error(t, err)
+	assert.Equal(t, 1, sent)
+
+	assert.NoError(t, spool.Add(pb.Receiver_SyncMetric_FullMethodName, &pb.SyncReq{DBName: "d"}))
+	_, err = spool.Drain(send(""))
+	assert.NoError(t, err)
+	_, err = spool.Drain(send(""))
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"a", "b", "c", "d"}, received)
+	assert.True(t, spool.Empty())
+}
+
+func TestSpool_ConcurrentDrain(t *testing.T) {
+	spool := NewSpool(filepath.Join(t.TempDir(), "relay.spool"), 0)
+	added, err := spool.AddIfPending(pb.Receiver_SyncMetric_FullMethodName, &pb.SyncReq{DBName: "a"})
+	assert.NoError(t, err)
+	assert.False(t, added, "nothing is pending")
+	for _, db := range []string{"a", "b", "c"} {
+		assert.NoError(t, spool.Add(pb.Receiver_SyncMetric_FullMethodName, &pb.SyncReq{DBName: db}))
+	}
+	added, err = spool.AddIfPending(pb.Receiver_SyncMetric_FullMethodName, &pb.SyncReq{DBName: "d"})
+	assert.NoError(t, err)
+	assert.True(t, added)
+
+	// every spooled request is re-sent once, in order
+	var mu sync.Mutex
+	received := []string{}
+	send := func(rec *sinks.Recording) error {
+		mu.Lock()
+		defer mu.Unlock()
+		received = append(received, rec.Request.(*pb.SyncReq).GetDBName())
+		return nil
+	}
+	var wg sync.WaitGroup
+	for range 4 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := spool.Drain(send)
+			assert.NoError(t, err)
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, []string{"a", "b", "c", "d"}, received)
+	assert.True(t, spool.Empty())
+}
+
+func TestSpool_Full(t *testing.T) {
+	relay, upstream := newTestRelay(t, 10)
+	upstream.down = true
+
+	_, err := relay.UpdateMeasurements(context.Background(), testutils.GetTestMeasurementEnvelope())
+	assert.Equal(t, codes.ResourceExhausted, status.Code(err))
+}
+
+func TestSpool_Truncated(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "relay.spool")
+	spool := NewSpool(path, 0)
+	for _, db := range []string{"a", "b"} {
+		assert.NoError(t, spool.Add(pb.Receiver_SyncMetric_FullMethodName, &pb.SyncReq{DBName: db}))
+	}
+	// crash in the middle of appending b
+	data, err := os.ReadFile(path)
+	assert.NoError(t, err)
+	assert.NoError(t, os.WriteFile(path, data[:len(data)-2], 0644))
+
+	received := []string{}
+	send := func(rec *sinks.Recording) error {
+		received = append(received, rec.Request.(*pb.SyncReq).GetDBName())
+		return nil
+	}
+
+	// requests spooled after a restart follow the last valid one
+	spool = NewSpool(path, 0)
+	assert.NoError(t, spool.Add(pb.Receiver_SyncMetric_FullMethodName, &pb.SyncReq{DBName: "c"}))
+	sent, err := spool.Drain(send)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, sent)
+	assert.Equal(t, []string{"a", "c"}, received)
+	assert.True(t, spool.Empty())
+
+	// a corrupt spool being drained isn't re-sent again and again
+	received = received[:0]
+	for _, db := range []string{"d", "e"} {
+		assert.NoError(t, spool.Add(pb.Receiver_SyncMetric_FullMethodName, &pb.SyncReq{DBName: db}))
+	}
+	assert.NoError(t, spool.recorder.Close())
+	spool.recorder = nil
+	data, err = os.ReadFile(path)
+	assert.NoError(t, err)
+	assert.NoError(t, os.WriteFile(path, data[:len(data)-2], 0644))
+	sent, err = spool.Drain(send)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, sent)
+	sent, err = spool.Drain(send)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, sent)
+	assert.Equal(t, []string{"d"}, received)
+	assert.True(t, spool.Empty())
+}
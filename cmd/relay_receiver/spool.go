@@ -0,0 +1,169 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/destrex271/pgwatch3_rpc_server/sinks"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+)
+
+// Spool buffers requests on disk, in the recording format of
+// sinks.Recorder, while the upstream receiver can't be reached
+type Spool struct {
+	path     string
+	maxBytes int64
+
+	mu       sync.Mutex
+	recorder *sinks.Recorder
+	// serializes Drain, so that spooled requests are re-sent once
+	draining sync.Mutex
+}
+
+func NewSpool(path string, maxBytes int64) *Spool {
+	return &Spool{path: path, maxBytes: maxBytes}
+}
+
+// requests being re-sent, kept until all of them are delivered so
+// that they are always re-sent before those spooled in the meantime
+func (s *Spool) drainingPath() string {
+	return s.path + ".draining"
+}
+
+func fileSize(path string) int64 {
+	info, err := os.Stat(path)
+	if err != nil {
+		return 0
+	}
+	return info.Size()
+}
+
+// Size returns the number of bytes waiting to be re-sent
+func (s *Spool) Size() int64 {
+	return fileSize(s.path) + fileSize(s.drainingPath())
+}
+
+func (s *Spool) Empty() bool {
+	return s.Size() == 0
+}
+
+// Add appends req to the spool, failing with ResourceExhausted once full
+func (s *Spool) Add(method string, req proto.Message) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.add(method, req)
+}
+
+// AddIfPending appends req to the spool only if older requests are
+// waiting to be re-sent, checking and appending atomically so that
+// req can't overtake requests spooled concurrently
+func (s *Spool) AddIfPending(method string, req proto.Message) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.Empty() {
+		return false, nil
+	}
+	return true, s.add(method, req)
+}
+
+// add is Add, s.mu must be held
+func (s *Spool) add(method string, req proto.Message) error {
+	if s.maxBytes > 0 && s.Size()+int64(proto.Size(req)) > s.maxBytes {
+		return status.Error(codes.ResourceExhausted, "upstream unavailable and spool is full")
+	}
+	if s.recorder == nil {
+		// a record cut short by a crash would swallow the ones appended after it
+		if _, err := sinks.RepairRecording(s.path); err != nil {
+			return err
+		}
+		recorder, err := sinks.NewRecorder(s.path)
+		if err != nil {
+			return err
+		}
+		s.recorder = recorder
+	}
+	return s.recorder.Record(method, time.Now(), req)
+}
+
+// Drain re-sends spooled requests in order until send fails, the
+// failed request and the following ones are kept for the next Drain.
+// A corrupt record, e.g. cut short by a crash, and the rest are dropped
+func (s *Spool) Drain(send func(*sinks.Recording) error) (sent int, err error) {
+	s.draining.Lock()
+	defer s.draining.Unlock()
+
+	draining := s.drainingPath()
+	if fileSize(draining) == 0 {
+		s.mu.Lock()
+		if s.recorder != nil {
+			_ = s.recorder.Close()
+			s.recorder = nil
+		}
+		err = os.Rename(s.path, draining)
+		s.mu.Unlock()
+		if errors.Is(err, fs.ErrNotExist) {
+			return 0, nil
+		}
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	file, err := os.Open(draining)
+	if err != nil {
+		return 0, err
+	}
+	reader := sinks.NewRecordingReader(file)
+	for {
+		rec, err := reader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			log.Printf("[ERROR]: Dropping the spool after %d re-sent requests, it's corrupt: %s", sent, err)
+			break
+		}
+
+		if err := send(rec); err != nil {
+			err = s.keep(draining, rec, reader, err)
+			_ = file.Close()
+			return sent, err
+		}
+		sent++
+	}
+	_ = file.Close()
+	return sent, os.Remove(draining)
+}
+
+// keep rewrites the draining file with rec and the requests left in reader
+func (s *Spool) keep(draining string, rec *sinks.Recording, reader *sinks.RecordingReader, cause error) error {
+	tmp := draining + ".tmp"
+	_ = os.Remove(tmp)
+	recorder, err := sinks.NewRecorder(tmp)
+	if err != nil {
+		return errors.Join(cause, err)
+	}
+	for ; rec != nil; rec, err = reader.Next() {
+		if err := recorder.Record(rec.Method, rec.Time, rec.Request); err != nil {
+			_ = recorder.Close()
+			return errors.Join(cause, err)
+		}
+	}
+	if err != io.EOF {
+		log.Printf("[ERROR]: Dropping the rest of the spool, it's corrupt: %s", err)
+	}
+	if err := recorder.Close(); err != nil {
+		return errors.Join(cause, err)
+	}
+	if err := os.Rename(tmp, draining); err != nil {
+		return errors.Join(cause, err)
+	}
+	return cause
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"log"
+	"os"
+	"os/signal"
+)
+
+func main() {
+	file := flag.String("file", "", "Recording file written by a receiver with PGWATCH_RPC_SERVER_RECORD_FILE set. Required.")
+	address := flag.String("addr", "localhost:9999", "Address (host:port) of the receiver to replay to.")
+	caFile := flag.String("ca-file", "", "Certificate Authority file path. Enables TLS if set.")
+	tenantHeader := flag.String("tenant-header", os.Getenv("PGWATCH_RPC_SERVER_TENANT_HEADER"), "Metadata key the recorded tenant of requests is sent as, the target receiver's PGWATCH_RPC_SERVER_TENANT_HEADER.")
+	speed := flag.Float64("speed", 1, "Replay speed multiplier, 1 keeps the original timing and 0 sends as fast as possible.")
+	flag.Parse()
+
+	if *file == "" {
+		log.Println("[ERROR]: No Recording File Specified (--file)")
+		flag.Usage()
+		return
+	}
+
+	recording, err := os.Open(*file)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer func() { _ = recording.Close() }()
+
+	replayer, err := NewReplayer(Options{
+		Address:      *address,
+		Username:     os.Getenv("PGWATCH_RPC_SERVER_USERNAME"),
+		Password:     os.Getenv("PGWATCH_RPC_SERVER_PASSWORD"),
+		CAFile:       *caFile,
+		Speed:        *speed,
+		TenantHeader: *tenantHeader,
+	})
+	if err != nil {
+		log.Fatal("[ERROR]: Unable to create replayer: ", err)
+	}
+	defer func() { _ = replayer.Close() }()
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	result, err := replayer.Replay(ctx, recording)
+	log.Printf("[INFO]: Replayed %d requests, %d failed", result.Sent, result.Failed)
+	if err != nil {
+		log.Fatal(err)
+	}
+}
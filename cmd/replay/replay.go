@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"time"
+
+	"github.com/destrex271/pgwatch3_rpc_server/sinks"
+	"github.com/destrex271/pgwatch3_rpc_server/sinks/client"
+	"github.com/destrex271/pgwatch3_rpc_server/sinks/pb"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+type Options struct {
+	Address  string
+	Username string
+	Password string
+	// CAFile enables TLS, the receiver certificate is verified against it
+	CAFile string
+	// Speed scales the delays between recorded requests,
+	// 1 replays at original speed, 0 as fast as possible
+	Speed float64
+	// TenantHeader, if set, is the metadata key the recorded
+	// tenant of requests is sent as, see PGWATCH_RPC_SERVER_TENANT_HEADER
+	TenantHeader string
+}
+
+// Replayer re-sends a recording made by sinks.Recorder to a receiver
+type Replayer struct {
+	opts   Options
+	client *client.Client
+}
+
+type Result struct {
+	Sent   int
+	Failed int
+}
+
+func NewReplayer(opts Options) (*Replayer, error) {
+	if opts.Speed < 0 {
+		return nil, errors.New("speed can't be negative")
+	}
+
+	c, err := client.New(opts.Address,
+		client.WithCredentials(opts.Username, opts.Password),
+		client.WithCAFile(opts.CAFile),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Replayer{
+		opts:   opts,
+		client: c,
+	}, nil
+}
+
+func (r *Replayer) Close() error {
+	return r.client.Close()
+}
+
+// Replay sends all requests in the recording in their original
+// order, failed requests are logged and replay continues
+func (r *Replayer) Replay(ctx context.Context, recording io.Reader) (Result, error) {
+	var result Result
+	reader := sinks.NewRecordingReader(recording)
+
+	var first time.Time
+	start := time.Now()
+	for {
+		rec, err := reader.Next()
+		if errors.Is(err, io.EOF) {
+			return result, nil
+		}
+		if err != nil {
+			return result, err
+		}
+
+		if first.IsZero() {
+			first = rec.Time
+		}
+		if r.opts.Speed > 0 {
+			due := time.Duration(float64(rec.Time.Sub(first)) / r.opts.Speed)
+			select {
+			case <-ctx.Done():
+				return result, ctx.Err()
+			case <-time.After(time.Until(start.Add(due))):
+			}
+		}
+		if ctx.Err() != nil {
+			return result, ctx.Err()
+		}
+
+		if err := r.send(ctx, rec); err != nil {
+			log.Printf("[ERROR]: Replaying %s request recorded at %s failed: %s", rec.Method, rec.Time, err)
+			result.Failed++
+			continue
+		}
+		result.Sent++
+	}
+}
+
+func (r *Replayer) send(ctx context.Context, rec *sinks.Recording) error {
+	if rec.Tenant != "" && r.opts.TenantHeader != "" {
+		ctx = metadata.AppendToOutgoingContext(ctx, r.opts.TenantHeader, rec.Tenant)
+	}
+	var err error
+	switch req := rec.Request.(type) {
+	case *pb.MeasurementEnvelope:
+		_, err = r.client.UpdateMeasurements(ctx, req)
+	case *pb.SyncReq:
+		_, err = r.client.SyncMetric(ctx, req)
+	case *structpb.Struct:
+		_, err = r.client.DefineMetrics(ctx, req)
+	default:
+		err = fmt.Errorf("unsupported request type %T", req)
+	}
+	return err
+}
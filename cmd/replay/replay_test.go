@@ -0,0 +1,116 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/destrex271/pgwatch3_rpc_server/sinks"
+	"github.com/destrex271/pgwatch3_rpc_server/sinks/pb"
+	testutils "github.com/destrex271/pgwatch3_rpc_server/sinks/test_utils"
+	"github.com/stretchr/testify/assert"
+)
+
+const ServerPort = "5080"
+const ServerAddress = "localhost:5080"
+
+type Sink struct {
+	measurements atomic.Int64
+	syncs        atomic.Int64
+	// tenant of the last envelope
+	tenant atomic.Value
+	sinks.SyncMetricHandler
+}
+
+func (s *Sink) UpdateMeasurements(ctx context.Context, msg *pb.MeasurementEnvelope) (*pb.Reply, error) {
+	s.measurements.Add(1)
+	s.tenant.Store(sinks.Tenant(ctx))
+	return &pb.Reply{}, nil
+}
+
+func (s *Sink) SyncMetric(ctx context.Context, req *pb.SyncReq) (*pb.Reply, error) {
+	s.syncs.Add(1)
+	return &pb.Reply{}, nil
+}
+
+var sink *Sink
+
+func TestMain(m *testing.M) {
+	sink = &Sink{}
+	sinks.SERVER_TENANT_HEADER = "x-tenant"
+	go func() {
+		if err := sinks.ListenAndServe(sink, ServerPort); err != nil {
+			panic(err)
+		}
+	}()
+	time.Sleep(time.Second)
+
+	os.Exit(m.Run())
+}
+
+// writeRecording records n envelopes and one sync request of tenant acme spaced by interval
+func writeRecording(t *testing.T, n int, interval time.Duration) []byte {
+	path := filepath.Join(t.TempDir(), "traffic.rec")
+	recorder, err := sinks.NewRecorder(path)
+	assert.NoError(t, err)
+
+	ts := time.Now()
+	for range n {
+		err = recorder.RecordTenant("acme", pb.Receiver_UpdateMeasurements_FullMethodName, ts, testutils.GetTestMeasurementEnvelope())
+		assert.NoError(t, err)
+		ts = ts.Add(interval)
+	}
+	err = recorder.RecordTenant("acme", pb.Receiver_SyncMetric_FullMethodName, ts, testutils.GetTestRPCSyncRequest())
+	assert.NoError(t, err)
+	// rejected by the receiver's validation interceptor
+	err = recorder.RecordTenant("acme", pb.Receiver_UpdateMeasurements_FullMethodName, ts, &pb.MeasurementEnvelope{})
+	assert.NoError(t, err)
+	assert.NoError(t, recorder.Close())
+
+	data, err := os.ReadFile(path)
+	assert.NoError(t, err)
+	return data
+}
+
+func TestReplay(t *testing.T) {
+	recording := writeRecording(t, 5, 100*time.Millisecond)
+
+	_, err := NewReplayer(Options{Address: ServerAddress, Speed: -1})
+	assert.Error(t, err)
+
+	replayer, err := NewReplayer(Options{Address: ServerAddress, Speed: 0, TenantHeader: "x-tenant"})
+	assert.NoError(t, err)
+	defer func() { _ = replayer.Close() }()
+
+	measurements, syncs := sink.measurements.Load(), sink.syncs.Load()
+	result, err := replayer.Replay(context.Background(), bytes.NewReader(recording))
+	assert.NoError(t, err)
+	assert.Equal(t, Result{Sent: 6, Failed: 1}, result)
+	assert.Equal(t, measurements+5, sink.measurements.Load())
+	assert.Equal(t, syncs+1, sink.syncs.Load())
+	// replayed for the recorded tenant
+	assert.Equal(t, "acme", sink.tenant.Load())
+}
+
+func TestReplay_Speed(t *testing.T) {
+	recording := writeRecording(t, 5, 100*time.Millisecond)
+
+	replayer, err := NewReplayer(Options{Address: ServerAddress, Speed: 2, TenantHeader: "x-tenant"})
+	assert.NoError(t, err)
+	defer func() { _ = replayer.Close() }()
+
+	start := time.Now()
+	_, err = replayer.Replay(context.Background(), bytes.NewReader(recording))
+	assert.NoError(t, err)
+	// 400ms of recorded traffic at double speed
+	assert.GreaterOrEqual(t, time.Since(start), 200*time.Millisecond)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = replayer.Replay(ctx, bytes.NewReader(recording))
+	assert.ErrorIs(t, err, context.Canceled)
+}
@@ -25,6 +25,7 @@ func main() {
 	if err != nil {
 		log.Fatal("[ERROR]: Unable to create S3 receiver", err)
 	}
+	server.Dedup = os.Getenv("dedup") == "true"
 
 	if err := sinks.ListenAndServe(server, *port); err != nil {
 		log.Fatal(err)
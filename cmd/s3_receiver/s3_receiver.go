@@ -11,6 +11,7 @@ import (
 
 	"github.com/destrex271/pgwatch3_rpc_server/sinks"
 	"github.com/destrex271/pgwatch3_rpc_server/sinks/pb"
+	"go.opentelemetry.io/otel/attribute"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
 
@@ -27,6 +28,9 @@ type S3Receiver struct {
 	S3Client  *s3.Client
 	S3Manager *manager.Uploader
 	Ctx       context.Context
+	// Dedup names objects by sinks.RowID instead of the upload time,
+	// so that retried rows overwrite the same object
+	Dedup bool
 	sinks.SyncMetricHandler
 }
 
@@ -125,14 +129,23 @@ func (r *S3Receiver) UpdateMeasurements(ctx context.Context, msg *pb.Measurement
 			u.PartSize = partMiBs * 1024 * 1024
 		})
 
-		objectKey := msg.DBName + "_" + strconv.FormatInt(time.Now().UTC().Unix(), 10)
+		// prefixed by tenant since buckets are shared between tenants
+		objectKey := sinks.TenantPrefix(ctx, "/") + msg.DBName + "_" + strconv.FormatInt(time.Now().UTC().Unix(), 10)
+		if r.Dedup {
+			objectKey = sinks.TenantPrefix(ctx, "/") + msg.DBName + "_" + sinks.RowID(msg, data)
+		}
 
 		// Upload data
-		_, err = uploader.Upload(context.TODO(), &s3.PutObjectInput{
+		uploadCtx, span := sinks.StartSpan(ctx, "s3.upload",
+			attribute.String("s3.bucket", msg.GetDBName()),
+			attribute.String("s3.key", objectKey),
+		)
+		_, err = uploader.Upload(uploadCtx, &s3.PutObjectInput{
 			Bucket: aws.String(msg.GetDBName()),
 			Key:    aws.String(objectKey),
 			Body:   buffer,
 		})
+		sinks.EndSpan(span, err)
 
 		if err != nil {
 			return nil, err
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"log"
+	"os"
+	"time"
+
+	"github.com/destrex271/pgwatch3_rpc_server/sinks"
+	"github.com/destrex271/pgwatch3_rpc_server/sinks/client"
+	"go.opentelemetry.io/contrib/instrumentation/google.golang.org/grpc/otelgrpc"
+	"google.golang.org/grpc"
+)
+
+func main() {
+	port := flag.String("port", "-1", "Specify the port where you want your sink to receive the measurements on.")
+	downstreams := flag.String("downstreams", "", "Comma separated addresses (host:port) of the receivers measurements are sharded to.")
+	downstreamsFile := flag.String("downstreamsFile", "", "File listing downstream addresses, one per line. Re-read on every health check.")
+	downstreamCAFile := flag.String("downstreamCAFile", "", "Certificate Authority file path of the downstream receivers. Enables TLS if set.")
+	healthInterval := flag.Duration("healthInterval", 10*time.Second, "Interval between downstream health checks.")
+	flag.Parse()
+
+	if *port == "-1" {
+		log.Println("[ERROR]: No Port Specified")
+		return
+	}
+
+	members := ParseMembers(*downstreams)
+	if *downstreamsFile != "" {
+		var err error
+		if members, err = ReadMembers(*downstreamsFile); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if len(members) == 0 {
+		log.Println("[ERROR]: No Downstream Receivers Specified")
+		return
+	}
+
+	dial := func(address string) (Downstream, error) {
+		c, err := client.New(address,
+			client.WithCredentials(os.Getenv("PGWATCH_RPC_DOWNSTREAM_USERNAME"), os.Getenv("PGWATCH_RPC_DOWNSTREAM_PASSWORD")),
+			client.WithCAFile(*downstreamCAFile),
+			client.WithDialOptions(grpc.WithStatsHandler(otelgrpc.NewClientHandler())),
+		)
+		if err != nil {
+			return nil, err
+		}
+		return GRPCDownstream{c}, nil
+	}
+
+	server := NewShardingReceiver(dial)
+	if err := server.SetMembers(members); err != nil {
+		log.Fatal(err)
+	}
+	server.CheckHealth(context.Background(), *healthInterval)
+	go server.Run(context.Background(), *healthInterval, *downstreamsFile)
+
+	if err := sinks.ListenAndServe(server, *port); err != nil {
+		log.Fatal(err)
+	}
+}
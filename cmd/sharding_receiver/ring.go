@@ -0,0 +1,51 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"slices"
+	"strconv"
+)
+
+// Ring assigns keys to members using consistent hashing, adding
+// or removing a member only moves the keys it owns (or will own)
+type Ring struct {
+	// sorted hashes of the virtual nodes
+	hashes []uint64
+	owners map[uint64]string
+}
+
+func hashKey(key string) uint64 {
+	sum := sha256.Sum256([]byte(key))
+	return binary.BigEndian.Uint64(sum[:8])
+}
+
+// NewRing places replicas virtual nodes per member
+// on the ring, spreading keys evenly between members
+func NewRing(members []string, replicas int) *Ring {
+	r := &Ring{owners: map[uint64]string{}}
+	for _, member := range members {
+		for i := range replicas {
+			h := hashKey(member + "#" + strconv.Itoa(i))
+			if _, taken := r.owners[h]; taken {
+				continue
+			}
+			r.owners[h] = member
+			r.hashes = append(r.hashes, h)
+		}
+	}
+	slices.Sort(r.hashes)
+	return r
+}
+
+// Owner returns the member key belongs to, "" if the ring is empty
+func (r *Ring) Owner(key string) string {
+	if len(r.hashes) == 0 {
+		return ""
+	}
+	i, _ := slices.BinarySearch(r.hashes, hashKey(key))
+	if i == len(r.hashes) {
+		i = 0
+	}
+	return r.owners[r.hashes[i]]
+}
@@ -0,0 +1,291 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/destrex271/pgwatch3_rpc_server/sinks/client"
+	"github.com/destrex271/pgwatch3_rpc_server/sinks/pb"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/connectivity"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+// virtual nodes per downstream on the ring
+const ringReplicas = 128
+
+// how long forward waits for a downstream replying Unavailable to be probed
+const probeTimeout = 5 * time.Second
+
+// Downstream is a receiver envelopes are sharded to
+type Downstream interface {
+	pb.ReceiverClient
+	// Healthy reports whether the downstream can currently be reached
+	// and is serving, i.e. isn't in maintenance
+	Healthy(ctx context.Context) bool
+	Close() error
+}
+
+// GRPCDownstream probes the downstream through its gRPC health service,
+// or its connection state for receivers that don't register one
+type GRPCDownstream struct {
+	*client.Client
+}
+
+func (d GRPCDownstream) Healthy(ctx context.Context) bool {
+	resp, err := healthpb.NewHealthClient(d.Conn()).Check(ctx, &healthpb.HealthCheckRequest{Service: pb.Receiver_ServiceDesc.ServiceName})
+	switch status.Code(err) {
+	case codes.OK:
+		return resp.GetStatus() == healthpb.HealthCheckResponse_SERVING
+	case codes.Unimplemented, codes.NotFound:
+		return d.connected(ctx)
+	}
+	return false
+}
+
+func (d GRPCDownstream) connected(ctx context.Context) bool {
+	conn := d.Conn()
+	conn.Connect()
+	for {
+		state := conn.GetState()
+		switch state {
+		case connectivity.Ready:
+			return true
+		case connectivity.TransientFailure, connectivity.Shutdown:
+			return false
+		}
+		if !conn.WaitForStateChange(ctx, state) {
+			return false
+		}
+	}
+}
+
+type shard struct {
+	Downstream
+	healthy bool
+}
+
+// ShardingReceiver distributes envelopes between downstream receivers
+// by DBName, so that each source always lands on the same one
+type ShardingReceiver struct {
+	pb.UnimplementedReceiverServer
+	dial func(address string) (Downstream, error)
+
+	mu     sync.RWMutex
+	shards map[string]*shard
+	// only healthy shards are on the ring
+	ring *Ring
+}
+
+func NewShardingReceiver(dial func(address string) (Downstream, error)) *ShardingReceiver {
+	return &ShardingReceiver{
+		dial:   dial,
+		shards: map[string]*shard{},
+		ring:   NewRing(nil, ringReplicas),
+	}
+}
+
+// ReadMembers reads downstream addresses from a file, one per line
+func ReadMembers(path string) ([]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return ParseMembers(strings.ReplaceAll(string(data), "\n", ",")), nil
+}
+
+// ParseMembers parses a comma separated list of addresses
+func ParseMembers(s string) []string {
+	members := []string{}
+	for _, member := range strings.Split(s, ",") {
+		if member = strings.TrimSpace(member); member != "" && !slices.Contains(members, member) {
+			members = append(members, member)
+		}
+	}
+	return members
+}
+
+// SetMembers connects to new downstreams and disconnects from
+// removed ones, new downstreams are healthy until probed otherwise.
+// An empty list is rejected, keeping the current downstreams
+func (r *ShardingReceiver) SetMembers(addresses []string) error {
+	if len(addresses) == 0 {
+		return errors.New("no downstream receivers listed, keeping the current ones")
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var errs []error
+	for _, address := range addresses {
+		if _, ok := r.shards[address]; ok {
+			continue
+		}
+		downstream, err := r.dial(address)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		log.Println("[INFO]: Added downstream " + address)
+		r.shards[address] = &shard{Downstream: downstream, healthy: true}
+	}
+	for address, s := range r.shards {
+		if !slices.Contains(addresses, address) {
+			log.Println("[INFO]: Removed downstream " + address)
+			_ = s.Close()
+			delete(r.shards, address)
+		}
+	}
+	r.rebalance()
+	return errors.Join(errs...)
+}
+
+// rebalance rebuilds the ring from healthy shards, r.mu must be held
+func (r *ShardingReceiver) rebalance() {
+	healthy := []string{}
+	for address, s := range r.shards {
+		if s.healthy {
+			healthy = append(healthy, address)
+		}
+	}
+	r.ring = NewRing(healthy, ringReplicas)
+}
+
+func (r *ShardingReceiver) setHealthy(address string, healthy bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	s, ok := r.shards[address]
+	if !ok || s.healthy == healthy {
+		return
+	}
+	s.healthy = healthy
+	if healthy {
+		log.Println("[INFO]: Downstream " + address + " is healthy again")
+	} else {
+		log.Println("[WARNING]: Downstream " + address + " is unhealthy, moving its sources to other downstreams")
+	}
+	r.rebalance()
+}
+
+// CheckHealth probes all downstreams, rebalancing if any changed
+func (r *ShardingReceiver) CheckHealth(ctx context.Context, timeout time.Duration) {
+	r.mu.RLock()
+	shards := make(map[string]*shard, len(r.shards))
+	for address, s := range r.shards {
+		shards[address] = s
+	}
+	r.mu.RUnlock()
+
+	var wg sync.WaitGroup
+	for address, s := range shards {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ctx, cancel := context.WithTimeout(ctx, timeout)
+			defer cancel()
+			r.setHealthy(address, s.Healthy(ctx))
+		}()
+	}
+	wg.Wait()
+}
+
+// Owner returns the healthy downstream dbName is sharded to
+func (r *ShardingReceiver) Owner(dbName string) (string, Downstream, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	address := r.ring.Owner(dbName)
+	if address == "" {
+		return "", nil, status.Error(codes.Unavailable, "no healthy downstream receiver")
+	}
+	return address, r.shards[address], nil
+}
+
+// forward calls the owner of dbName, if it replies Unavailable and
+// fails a health probe it's marked unhealthy and the new owner is called.
+// Unavailable from a healthy downstream, e.g. an identical envelope being
+// written, is passed on to pgwatch to retry on the same downstream
+func (r *ShardingReceiver) forward(ctx context.Context, dbName string, call func(Downstream) (*pb.Reply, error)) (*pb.Reply, error) {
+	for {
+		address, downstream, err := r.Owner(dbName)
+		if err != nil {
+			return nil, err
+		}
+		reply, err := call(downstream)
+		if status.Code(err) != codes.Unavailable || r.probe(ctx, downstream) {
+			return reply, err
+		}
+		r.setHealthy(address, false)
+	}
+}
+
+func (r *ShardingReceiver) probe(ctx context.Context, downstream Downstream) bool {
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), probeTimeout)
+	defer cancel()
+	return downstream.Healthy(ctx)
+}
+
+func (r *ShardingReceiver) UpdateMeasurements(ctx context.Context, msg *pb.MeasurementEnvelope) (*pb.Reply, error) {
+	return r.forward(ctx, msg.GetDBName(), func(d Downstream) (*pb.Reply, error) {
+		return d.UpdateMeasurements(ctx, msg)
+	})
+}
+
+func (r *ShardingReceiver) SyncMetric(ctx context.Context, req *pb.SyncReq) (*pb.Reply, error) {
+	return r.forward(ctx, req.GetDBName(), func(d Downstream) (*pb.Reply, error) {
+		return d.SyncMetric(ctx, req)
+	})
+}
+
+// DefineMetrics is sent to every healthy downstream
+func (r *ShardingReceiver) DefineMetrics(ctx context.Context, metrics *structpb.Struct) (*pb.Reply, error) {
+	r.mu.RLock()
+	healthy := []Downstream{}
+	for _, s := range r.shards {
+		if s.healthy {
+			healthy = append(healthy, s.Downstream)
+		}
+	}
+	r.mu.RUnlock()
+
+	var errs []error
+	for _, d := range healthy {
+		if _, err := d.DefineMetrics(ctx, metrics); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if err := errors.Join(errs...); err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	return &pb.Reply{}, nil
+}
+
+// Run checks the health of downstreams every interval, re-reading
+// membersFile, if set, to pick up membership changes
+func (r *ShardingReceiver) Run(ctx context.Context, interval time.Duration, membersFile string) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		if membersFile != "" {
+			members, err := ReadMembers(membersFile)
+			if err != nil {
+				log.Printf("[ERROR]: Unable to read downstreams from %s: %s", membersFile, err)
+			} else if err := r.SetMembers(members); err != nil {
+				log.Printf("[ERROR]: Unable to connect to downstreams: %s", err)
+			}
+		}
+		r.CheckHealth(ctx, interval)
+	}
+}
@@ -0,0 +1,253 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/destrex271/pgwatch3_rpc_server/sinks/client"
+	"github.com/destrex271/pgwatch3_rpc_server/sinks/pb"
+	testutils "github.com/destrex271/pgwatch3_rpc_server/sinks/test_utils"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	healthsrv "google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+func TestRing(t *testing.T) {
+	assert.Equal(t, "", NewRing(nil, ringReplicas).Owner("db"))
+
+	members := []string{"a:1", "b:1", "c:1"}
+	ring := NewRing(members, ringReplicas)
+	owners := map[string]string{}
+	counts := map[string]int{}
+	for i := range 3000 {
+		key := fmt.Sprintf("db%d", i)
+		owners[key] = ring.Owner(key)
+		counts[owners[key]]++
+	}
+	// evenly spread
+	for _, member := range members {
+		assert.InDelta(t, 1000, counts[member], 300, member)
+	}
+
+	// only the keys of the removed member move
+	ring = NewRing([]string{"a:1", "c:1"}, ringReplicas)
+	for key, owner := range owners {
+		if owner != "b:1" {
+			assert.Equal(t, owner, ring.Owner(key))
+		}
+	}
+}
+
+func TestParseMembers(t *testing.T) {
+	assert.Equal(t, []string{"a:1", "b:1"}, ParseMembers(" a:1,b:1,,a:1"))
+
+	path := filepath.Join(t.TempDir(), "downstreams")
+	assert.NoError(t, os.WriteFile(path, []byte("a:1\nb:1\n"), 0644))
+	members, err := ReadMembers(path)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"a:1", "b:1"}, members)
+}
+
+type fakeDownstream struct {
+	address string
+
+	mu       sync.Mutex
+	down     bool
+	busy     bool
+	closed   bool
+	received []string
+}
+
+func (d *fakeDownstream) handle(name string) (*pb.Reply, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.down {
+		return nil, status.Error(codes.Unavailable, "connection refused")
+	}
+	if d.busy {
+		return nil, status.Error(codes.Unavailable, "identical envelope being written")
+	}
+	d.received = append(d.received, name)
+	return &pb.Reply{Logmsg: d.address}, nil
+}
+
+func (d *fakeDownstream) UpdateMeasurements(ctx context.Context, in *pb.MeasurementEnvelope, opts ...grpc.CallOption) (*pb.Reply, error) {
+	return d.handle(in.GetDBName())
+}
+
+func (d *fakeDownstream) SyncMetric(ctx context.Context, in *pb.SyncReq, opts ...grpc.CallOption) (*pb.Reply, error) {
+	return d.handle("sync:" + in.GetDBName())
+}
+
+func (d *fakeDownstream) DefineMetrics(ctx context.Context, in *structpb.Struct, opts ...grpc.CallOption) (*pb.Reply, error) {
+	return d.handle("metrics")
+}
+
+func (d *fakeDownstream) Healthy(ctx context.Context) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return !d.down
+}
+
+func (d *fakeDownstream) Close() error {
+	d.closed = true
+	return nil
+}
+
+func newTestShardingReceiver(t *testing.T, members ...string) (*ShardingReceiver, map[string]*fakeDownstream) {
+	downstreams := map[string]*fakeDownstream{}
+	r := NewShardingReceiver(func(address string) (Downstream, error) {
+		d := &fakeDownstream{address: address}
+		downstreams[address] = d
+		return d, nil
+	})
+	assert.NoError(t, r.SetMembers(members))
+	return r, downstreams
+}
+
+func send(t *testing.T, r *ShardingReceiver, dbName string) string {
+	msg := testutils.GetTestMeasurementEnvelope()
+	msg.DBName = dbName
+	reply, err := r.UpdateMeasurements(context.Background(), msg)
+	assert.NoError(t, err)
+	return reply.GetLogmsg()
+}
+
+func TestShardingReceiver(t *testing.T) {
+	r, downstreams := newTestShardingReceiver(t, "a:1", "b:1", "c:1")
+
+	// a source always lands on the same shard, with its sync requests
+	owners := map[string]string{}
+	for i := range 30 {
+		db := fmt.Sprintf("db%d", i)
+		owners[db] = send(t, r, db)
+		assert.Equal(t, owners[db], send(t, r, db))
+
+		_, err := r.SyncMetric(context.Background(), &pb.SyncReq{DBName: db})
+		assert.NoError(t, err)
+		assert.Contains(t, downstreams[owners[db]].received, "sync:"+db)
+	}
+	assert.Len(t, downstreams, 3)
+	for _, d := range downstreams {
+		assert.NotEmpty(t, d.received, "sources should be spread over all shards")
+	}
+
+	_, err := r.DefineMetrics(context.Background(), &structpb.Struct{})
+	assert.NoError(t, err)
+	for _, d := range downstreams {
+		assert.Contains(t, d.received, "metrics")
+	}
+}
+
+func TestShardingReceiver_Rebalance(t *testing.T) {
+	r, downstreams := newTestShardingReceiver(t, "a:1", "b:1")
+	owners := map[string]string{}
+	for i := range 30 {
+		db := fmt.Sprintf("db%d", i)
+		owners[db] = send(t, r, db)
+	}
+
+	// sources of an unreachable shard move to the others, right away
+	downstreams["a:1"].down = true
+	for db := range owners {
+		assert.Equal(t, "b:1", send(t, r, db))
+	}
+
+	// but not when a healthy shard asks for a retry
+	downstreams["a:1"].down = false
+	r.CheckHealth(context.Background(), time.Second)
+	downstreams["a:1"].busy = true
+	for db, owner := range owners {
+		if owner == "a:1" {
+			msg := testutils.GetTestMeasurementEnvelope()
+			msg.DBName = db
+			_, err := r.UpdateMeasurements(context.Background(), msg)
+			assert.Equal(t, codes.Unavailable, status.Code(err))
+		}
+	}
+	downstreams["a:1"].busy = false
+	for db, owner := range owners {
+		assert.Equal(t, owner, send(t, r, db))
+	}
+
+	// and move back once the health check passes again
+	downstreams["a:1"].down = true
+	r.CheckHealth(context.Background(), time.Second)
+	downstreams["a:1"].down = false
+	r.CheckHealth(context.Background(), time.Second)
+	for db, owner := range owners {
+		assert.Equal(t, owner, send(t, r, db))
+	}
+
+	// membership changes, an empty list keeps the current members
+	assert.Error(t, r.SetMembers(nil))
+	for db, owner := range owners {
+		assert.Equal(t, owner, send(t, r, db))
+	}
+	assert.NoError(t, r.SetMembers([]string{"b:1", "c:1"}))
+	assert.True(t, downstreams["a:1"].closed)
+	ring := NewRing([]string{"b:1", "c:1"}, ringReplicas)
+	for db := range owners {
+		assert.Equal(t, ring.Owner(db), send(t, r, db))
+	}
+
+	downstreams["b:1"].down = true
+	downstreams["c:1"].down = true
+	r.CheckHealth(context.Background(), time.Second)
+	_, err := r.UpdateMeasurements(context.Background(), testutils.GetTestMeasurementEnvelope())
+	assert.Equal(t, codes.Unavailable, status.Code(err))
+}
+
+func TestGRPCDownstream_Healthy(t *testing.T) {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	server := grpc.NewServer()
+	go func() { _ = server.Serve(lis) }()
+	defer server.Stop()
+
+	c, err := client.New(lis.Addr().String())
+	assert.NoError(t, err)
+	defer func() { _ = c.Close() }()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	assert.True(t, GRPCDownstream{c}.Healthy(ctx))
+
+	server.Stop()
+	assert.Eventually(t, func() bool {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		return !(GRPCDownstream{c}.Healthy(ctx))
+	}, 10*time.Second, 100*time.Millisecond)
+}
+
+func TestGRPCDownstream_HealthService(t *testing.T) {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	server := grpc.NewServer()
+	health := healthsrv.NewServer()
+	healthpb.RegisterHealthServer(server, health)
+	go func() { _ = server.Serve(lis) }()
+	defer server.Stop()
+
+	c, err := client.New(lis.Addr().String())
+	assert.NoError(t, err)
+	defer func() { _ = c.Close() }()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	// a receiver in maintenance is reachable but not serving
+	health.SetServingStatus(pb.Receiver_ServiceDesc.ServiceName, healthpb.HealthCheckResponse_NOT_SERVING)
+	assert.False(t, GRPCDownstream{c}.Healthy(ctx))
+	health.SetServingStatus(pb.Receiver_ServiceDesc.ServiceName, healthpb.HealthCheckResponse_SERVING)
+	assert.True(t, GRPCDownstream{c}.Healthy(ctx))
+}
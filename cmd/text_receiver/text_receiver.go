@@ -6,9 +6,12 @@ import (
 	"fmt"
 	"log"
 	"os"
+	"path/filepath"
 
 	"github.com/destrex271/pgwatch3_rpc_server/sinks"
 	"github.com/destrex271/pgwatch3_rpc_server/sinks/pb"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 )
 
 type TextReceiver struct {
@@ -27,9 +30,20 @@ func NewTextReceiver(fullPath string) (tr *TextReceiver) {
 }
 
 func (r TextReceiver) UpdateMeasurements(ctx context.Context, msg *pb.MeasurementEnvelope) (*pb.Reply, error) {
+	// DBName ends up in the file path, it must not escape FullPath
+	if err := sinks.ValidPathComponent(msg.GetDBName()); err != nil {
+		return nil, status.Error(codes.InvalidArgument, "invalid database name: "+err.Error())
+	}
+
+	// each tenant gets its own directory
+	dir := filepath.Join(r.FullPath, sinks.Tenant(ctx))
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		return nil, err
+	}
+
 	// Write Metrics in a text file
 	fileName := msg.GetDBName() + ".txt"
-	file, err := os.OpenFile(r.FullPath + "/" + fileName, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	file, err := os.OpenFile(filepath.Join(dir, fileName), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
 
 	if err != nil {
 		log.Println("Unable to open file. Error: " + err.Error())
@@ -44,6 +58,7 @@ func (r TextReceiver) UpdateMeasurements(ctx context.Context, msg *pb.Measuremen
 	for _, measurement := range msg.GetData() {
 		data, err := sinks.GetJson(measurement)
 		if err != nil {
+			sinks.AddDeadLetterRow("text_receiver", msg, measurement, err)
 			continue
 		}
 		output += data + "\n"
@@ -52,10 +67,14 @@ func (r TextReceiver) UpdateMeasurements(ctx context.Context, msg *pb.Measuremen
 	output += "\n===================================\n"
 
 	_, err = fmt.Fprintln(writer, output)
+	if err == nil {
+		err = writer.Flush()
+	}
 	if err != nil {
+		if sinks.AddDeadLetter("text_receiver", msg, err) {
+			return sinks.DeadLetteredReply(err), nil
+		}
 		return nil, err
 	}
-
-	err = writer.Flush()
-	return &pb.Reply{}, err
+	return &pb.Reply{}, nil
 }
\ No newline at end of file
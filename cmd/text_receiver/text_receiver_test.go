@@ -3,10 +3,14 @@ package main
 import (
 	"context"
 	"os"
+	"path/filepath"
 	"testing"
 
+	"github.com/destrex271/pgwatch3_rpc_server/sinks"
 	"github.com/destrex271/pgwatch3_rpc_server/sinks/pb"
 	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 	"google.golang.org/protobuf/types/known/structpb"
 )
 
@@ -37,4 +41,28 @@ func TestUpdateMeasurements(t *testing.T) {
 	assert.FileExists(t, path + "/" + msg.DBName + ".txt", "Database file does not exist")
 
 	_ = os.Remove(path + "/" + msg.DBName + ".txt")
-}
\ No newline at end of file
+}
+
+func TestUpdateMeasurements_PathTraversal(t *testing.T) {
+	root := t.TempDir()
+	path := filepath.Join(root, "measurements")
+	assert.NoError(t, os.Mkdir(path, 0755))
+	recv := NewTextReceiver(path)
+
+	msg := GetTestMeasurementEnvelope()
+	msg.DBName = "../escaped"
+	_, err := recv.UpdateMeasurements(context.Background(), msg)
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+	assert.NoFileExists(t, filepath.Join(root, "escaped.txt"))
+}
+
+func TestUpdateMeasurements_Tenant(t *testing.T) {
+	root := t.TempDir()
+	recv := NewTextReceiver(root)
+
+	msg := GetTestMeasurementEnvelope()
+	_, err := recv.UpdateMeasurements(sinks.WithTenant(context.Background(), "acme"), msg)
+	assert.NoError(t, err)
+	assert.FileExists(t, filepath.Join(root, "acme", msg.DBName+".txt"))
+	assert.NoFileExists(t, filepath.Join(root, msg.DBName+".txt"))
+}
@@ -0,0 +1,497 @@
+package sinks
+
+import (
+	"cmp"
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/destrex271/pgwatch3_rpc_server/sinks/pb"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// if set, the admin HTTP API is served on this port
+var SERVER_ADMIN_PORT = os.Getenv("PGWATCH_RPC_SERVER_ADMIN_PORT")
+
+// number of recent errors and sync requests the admin API keeps
+const adminHistorySize = 100
+
+// max number of sources the admin API tracks, or pauses
+const adminMaxSources = 10000
+
+// environment variables whose names contain one of these are masked
+var adminSecretNames = []string{"PASSWORD", "SECRET", "TOKEN", "CREDENTIAL", "TENANTS", "HEADERS", "URI"}
+
+// Flusher is implemented by receivers buffering measurements,
+// Flush writes what's buffered, e.g. re-sends spooled requests
+type Flusher interface {
+	Flush(ctx context.Context) error
+}
+
+type adminSourceKey struct {
+	tenant string
+	dbName string
+}
+
+// AdminMetric is what a source sent for a metric
+type AdminMetric struct {
+	LastSeen  time.Time `json:"last_seen"`
+	Envelopes int64     `json:"envelopes"`
+	Rows      int64     `json:"rows"`
+}
+
+// AdminSource is a source the receiver got measurements from, or a paused one
+type AdminSource struct {
+	Tenant   string    `json:"tenant,omitempty"`
+	DBName   string    `json:"dbname"`
+	LastSeen time.Time `json:"last_seen,omitzero"`
+	Paused   bool      `json:"paused"`
+	// measurements of paused sources are rejected, to be retried
+	// once resumed, unless paused with Drop set
+	Drop     bool                    `json:"drop"`
+	Rejected int64                   `json:"rejected_while_paused"`
+	Dropped  int64                   `json:"dropped_while_paused"`
+	Metrics  map[string]*AdminMetric `json:"metrics"`
+}
+
+// AdminError is a request that failed
+type AdminError struct {
+	Time       time.Time `json:"time"`
+	Method     string    `json:"method"`
+	DBName     string    `json:"dbname,omitempty"`
+	MetricName string    `json:"metric,omitempty"`
+	Code       string    `json:"code"`
+	Message    string    `json:"message"`
+}
+
+// AdminSyncRequest is a sync request sent by pgwatch
+type AdminSyncRequest struct {
+	Time       time.Time `json:"time"`
+	DBName     string    `json:"dbname"`
+	MetricName string    `json:"metric,omitempty"`
+	Operation  string    `json:"operation"`
+	Error      string    `json:"error,omitempty"`
+}
+
+// Admin tracks what a running receiver gets, through its interceptors,
+// and serves it with actions such as pausing a source over HTTP
+type Admin struct {
+	receiver pb.ReceiverServer
+	started  time.Time
+	// if set, maintenance can be entered and left through the API
+	maintenance *Maintenance
+
+	mu      sync.Mutex
+	sources map[adminSourceKey]*AdminSource
+	errors  []AdminError
+	syncs   []AdminSyncRequest
+}
+
+func NewAdmin(receiver pb.ReceiverServer) *Admin {
+	return &Admin{
+		receiver: receiver,
+		started:  time.Now(),
+		sources:  map[adminSourceKey]*AdminSource{},
+	}
+}
+
+// source returns the source of key, creating it if unknown,
+// nil if unknown and adminMaxSources are already tracked
+func (a *Admin) source(key adminSourceKey) *AdminSource {
+	source, ok := a.sources[key]
+	if !ok {
+		if len(a.sources) >= adminMaxSources {
+			return nil
+		}
+		source = &AdminSource{Tenant: key.tenant, DBName: key.dbName, Metrics: map[string]*AdminMetric{}}
+		a.sources[key] = source
+	}
+	return source
+}
+
+// appendHistory keeps the last adminHistorySize items
+func appendHistory[T any](history []T, item T) []T {
+	history = append(history, item)
+	if len(history) > adminHistorySize {
+		history = slices.Delete(history, 0, len(history)-adminHistorySize)
+	}
+	return history
+}
+
+// HistoryInterceptor records failed requests and sync requests, it
+// comes first so that requests rejected by other interceptors are seen
+func (a *Admin) HistoryInterceptor(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+	reply, err := handler(ctx, req)
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if syncReq, ok := req.(*pb.SyncReq); ok {
+		entry := AdminSyncRequest{
+			Time:       time.Now(),
+			DBName:     syncReq.GetDBName(),
+			MetricName: syncReq.GetMetricName(),
+			Operation:  syncReq.GetOperation().String(),
+		}
+		if err != nil {
+			entry.Error = err.Error()
+		}
+		a.syncs = appendHistory(a.syncs, entry)
+	}
+	if err != nil {
+		st := status.Convert(err)
+		entry := AdminError{
+			Time:    time.Now(),
+			Method:  filepath.Base(info.FullMethod),
+			Code:    st.Code().String(),
+			Message: st.Message(),
+		}
+		switch req := req.(type) {
+		case *pb.MeasurementEnvelope:
+			entry.DBName, entry.MetricName = req.GetDBName(), req.GetMetricName()
+		case *pb.SyncReq:
+			entry.DBName, entry.MetricName = req.GetDBName(), req.GetMetricName()
+		}
+		a.errors = appendHistory(a.errors, entry)
+	}
+	return reply, err
+}
+
+// UnaryInterceptor counts the envelopes of every source and metric and
+// rejects, or drops, the ones of paused sources. It comes after the
+// tenant is resolved
+func (a *Admin) UnaryInterceptor(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+	msg, ok := req.(*pb.MeasurementEnvelope)
+	if !ok {
+		return handler(ctx, req)
+	}
+
+	key := adminSourceKey{Tenant(ctx), msg.GetDBName()}
+	a.mu.Lock()
+	source := a.source(key)
+	switch {
+	case source == nil:
+		a.mu.Unlock()
+		return handler(ctx, req)
+	case source.Paused && source.Drop:
+		source.Dropped++
+		a.mu.Unlock()
+		return &pb.Reply{Logmsg: "dropped, ingestion is paused for DBName " + msg.GetDBName()}, nil
+	case source.Paused:
+		source.Rejected++
+		a.mu.Unlock()
+		return nil, status.Error(codes.Unavailable, "ingestion is paused for DBName "+msg.GetDBName())
+	}
+	now := time.Now()
+	source.LastSeen = now
+	m, ok := source.Metrics[msg.GetMetricName()]
+	if !ok {
+		m = &AdminMetric{}
+		source.Metrics[msg.GetMetricName()] = m
+	}
+	m.LastSeen = now
+	m.Envelopes++
+	m.Rows += int64(len(msg.GetData()))
+	a.mu.Unlock()
+
+	return handler(ctx, req)
+}
+
+// Pause pauses ingestion for the source dbName of tenant, its
+// measurements are dropped if drop is set, rejected otherwise
+func (a *Admin) Pause(tenant, dbName string, drop bool) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	source := a.source(adminSourceKey{tenant, dbName})
+	if source == nil {
+		return status.Errorf(codes.ResourceExhausted, "already tracking %d sources", adminMaxSources)
+	}
+	source.Paused, source.Drop = true, drop
+	return nil
+}
+
+// Resume resumes ingestion for the source dbName of tenant,
+// forgetting it if it never sent measurements
+func (a *Admin) Resume(tenant, dbName string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	key := adminSourceKey{tenant, dbName}
+	source, ok := a.sources[key]
+	if !ok {
+		return
+	}
+	source.Paused, source.Drop = false, false
+	if source.LastSeen.IsZero() {
+		delete(a.sources, key)
+	}
+}
+
+// Sources returns copies of the known sources, by tenant and DBName
+func (a *Admin) Sources() []AdminSource {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	sources := make([]AdminSource, 0, len(a.sources))
+	for _, source := range a.sources {
+		copied := *source
+		copied.Metrics = map[string]*AdminMetric{}
+		for name, m := range source.Metrics {
+			metricCopy := *m
+			copied.Metrics[name] = &metricCopy
+		}
+		sources = append(sources, copied)
+	}
+	slices.SortFunc(sources, func(a, b AdminSource) int {
+		return cmp.Or(cmp.Compare(a.Tenant, b.Tenant), cmp.Compare(a.DBName, b.DBName))
+	})
+	return sources
+}
+
+// Errors returns the recent failed requests, oldest first
+func (a *Admin) Errors() []AdminError {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return slices.Clone(a.errors)
+}
+
+// SyncRequests returns the recent sync requests, oldest first
+func (a *Admin) SyncRequests() []AdminSyncRequest {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return slices.Clone(a.syncs)
+}
+
+// Config returns the receiver's PGWATCH_RPC_* and OTEL_* environment
+// variables, masking the ones that may hold secrets
+func (a *Admin) Config() map[string]string {
+	config := map[string]string{}
+	for _, env := range os.Environ() {
+		name, value, _ := strings.Cut(env, "=")
+		if !strings.HasPrefix(name, "PGWATCH_RPC_") && !strings.HasPrefix(name, "OTEL_") {
+			continue
+		}
+		for _, secret := range adminSecretNames {
+			if value != "" && strings.Contains(strings.ToUpper(name), secret) {
+				value = "***"
+				break
+			}
+		}
+		config[name] = value
+	}
+	return config
+}
+
+// Status returns the receiver's queue and buffer stats
+func (a *Admin) Status() map[string]any {
+	result := map[string]any{
+		"receiver":   filepath.Base(os.Args[0]),
+		"started":    a.started,
+		"uptime_s":   time.Since(a.started).Seconds(),
+		"goroutines": runtime.NumGoroutine(),
+		"flushable":  false,
+	}
+	if queue, ok := a.receiver.(interface{ SyncQueueLength() int }); ok {
+		result["sync_queue_length"] = queue.SyncQueueLength()
+	}
+	if queue, ok := a.receiver.(interface{ SyncStats() SyncStats }); ok {
+		stats := queue.SyncStats()
+		result["sync_dropped_total"] = stats.Dropped
+		result["sync_coalesced_total"] = stats.Coalesced
+	}
+	if provider, ok := a.receiver.(StatsProvider); ok {
+		for name, value := range provider.SelfStats() {
+			result[name] = value
+		}
+	}
+	if _, ok := a.receiver.(Flusher); ok {
+		result["flushable"] = true
+	}
+	result["dead_letters_total"] = deadLetterCount.Load()
+	result["cardinality_limited_total"] = cardinalityLimited.Load()
+	result["shed_total"] = shedEnvelopes.Load()
+	if a.maintenance != nil {
+		result["maintenance"] = a.maintenance.Mode()
+		result["maintenance_buffered_bytes"] = a.maintenance.Buffered()
+	}
+	return result
+}
+
+// Flush flushes the receiver's buffers, if it has any
+func (a *Admin) Flush(ctx context.Context) error {
+	flusher, ok := a.receiver.(Flusher)
+	if !ok {
+		return status.Error(codes.Unimplemented, "receiver doesn't buffer measurements")
+	}
+	return flusher.Flush(ctx)
+}
+
+// Handler returns the admin API, authenticated like the receiver's
+// gRPC and HTTP/JSON endpoints:
+//
+//	GET  /admin/config
+//	GET  /admin/status
+//	GET  /admin/sources
+//	GET  /admin/errors
+//	GET  /admin/sync
+//	POST /admin/flush
+//	POST /admin/sources/{dbname}/pause?tenant=&drop=
+//	POST /admin/sources/{dbname}/resume?tenant=
+//	POST /admin/maintenance/enter?mode=
+//	POST /admin/maintenance/leave
+func (a *Admin) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /admin/config", func(w http.ResponseWriter, r *http.Request) {
+		writeAdminJSON(w, a.Config())
+	})
+	mux.HandleFunc("GET /admin/status", func(w http.ResponseWriter, r *http.Request) {
+		writeAdminJSON(w, a.Status())
+	})
+	mux.HandleFunc("GET /admin/sources", func(w http.ResponseWriter, r *http.Request) {
+		writeAdminJSON(w, a.Sources())
+	})
+	mux.HandleFunc("GET /admin/errors", func(w http.ResponseWriter, r *http.Request) {
+		writeAdminJSON(w, a.Errors())
+	})
+	mux.HandleFunc("GET /admin/sync", func(w http.ResponseWriter, r *http.Request) {
+		writeAdminJSON(w, a.SyncRequests())
+	})
+	mux.HandleFunc("POST /admin/flush", func(w http.ResponseWriter, r *http.Request) {
+		if err := a.Flush(r.Context()); err != nil {
+			writeHTTPError(w, err)
+			return
+		}
+		log.Println("[INFO]: Flushed receiver buffers through the admin API")
+		writeHTTPReply(w, &pb.Reply{Logmsg: "flushed"})
+	})
+	mux.HandleFunc("POST /admin/sources/{dbname}/{action}", func(w http.ResponseWriter, r *http.Request) {
+		dbName, tenant := r.PathValue("dbname"), r.URL.Query().Get("tenant")
+		switch r.PathValue("action") {
+		case "pause":
+			drop := r.URL.Query().Get("drop") == "true"
+			if err := a.Pause(tenant, dbName, drop); err != nil {
+				writeHTTPError(w, err)
+				return
+			}
+			log.Printf("[INFO]: Paused ingestion for DBName %s through the admin API", dbName)
+			writeHTTPReply(w, &pb.Reply{Logmsg: "paused ingestion for DBName " + dbName})
+		case "resume":
+			a.Resume(tenant, dbName)
+			log.Printf("[INFO]: Resumed ingestion for DBName %s through the admin API", dbName)
+			writeHTTPReply(w, &pb.Reply{Logmsg: "resumed ingestion for DBName " + dbName})
+		default:
+			http.NotFound(w, r)
+		}
+	})
+	mux.HandleFunc("POST /admin/maintenance/{action}", func(w http.ResponseWriter, r *http.Request) {
+		if a.maintenance == nil {
+			writeHTTPError(w, status.Error(codes.Unimplemented, "maintenance isn't available"))
+			return
+		}
+		switch r.PathValue("action") {
+		case "enter":
+			if err := a.maintenance.Enter(r.URL.Query().Get("mode")); err != nil {
+				writeHTTPError(w, err)
+				return
+			}
+			writeHTTPReply(w, &pb.Reply{Logmsg: "entered maintenance, mode " + a.maintenance.Mode()})
+		case "leave":
+			written, err := a.maintenance.Leave(r.Context())
+			if err != nil {
+				writeHTTPError(w, status.Errorf(codes.Unavailable, "still in maintenance, %d buffered requests written: %s", written, err))
+				return
+			}
+			writeHTTPReply(w, &pb.Reply{Logmsg: fmt.Sprintf("left maintenance, %d buffered requests written", written)})
+		default:
+			http.NotFound(w, r)
+		}
+	})
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := adminAuthenticate(httpMetadata(r)); err != nil {
+			writeHTTPError(w, err)
+			return
+		}
+		mux.ServeHTTP(w, r)
+	})
+}
+
+// adminCredentials tells if the receiver's username and password are both set
+func adminCredentials() bool {
+	return SERVER_USERNAME != "" && SERVER_PASSWORD != ""
+}
+
+// adminAuthenticate requires the receiver's username and password. Tenant
+// credentials don't give access, with multi-tenancy and no receiver
+// credentials set every request is rejected
+func adminAuthenticate(md metadata.MD) error {
+	if !adminCredentials() {
+		if SERVER_TENANTS != "" || SERVER_TENANT_HEADER != "" {
+			return status.Error(codes.Unauthenticated, "admin API requires PGWATCH_RPC_SERVER_USERNAME and PGWATCH_RPC_SERVER_PASSWORD")
+		}
+		return nil
+	}
+	username := subtle.ConstantTimeCompare([]byte(firstMetadataValue(md, "username")), []byte(SERVER_USERNAME))
+	password := subtle.ConstantTimeCompare([]byte(firstMetadataValue(md, "password")), []byte(SERVER_PASSWORD))
+	if username&password != 1 {
+		return status.Error(codes.Unauthenticated, "invalid username or password")
+	}
+	return nil
+}
+
+// adminBindAddress is the bind address if credentials are set, otherwise
+// the admin API is reachable from the local host only
+func adminBindAddress() (string, error) {
+	if adminCredentials() {
+		return bindAddress(), nil
+	}
+	if SERVER_TENANTS != "" || SERVER_TENANT_HEADER != "" {
+		return "", fmt.Errorf("admin API requires PGWATCH_RPC_SERVER_USERNAME and PGWATCH_RPC_SERVER_PASSWORD with multi-tenancy")
+	}
+	log.Println("[WARNING]: No credentials set, serving admin API on 127.0.0.1 only")
+	return "127.0.0.1", nil
+}
+
+func writeAdminJSON(w http.ResponseWriter, value any) {
+	body, err := json.Marshal(value)
+	if err != nil {
+		writeHTTPError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_, _ = w.Write(body)
+}
+
+// ListenAndServeAdmin serves the admin API on port of the bind address,
+// or loopback without credentials, using TLS if a valid cert/key pair is configured
+func ListenAndServeAdmin(admin *Admin, port string) error {
+	address, err := adminBindAddress()
+	if err != nil {
+		return err
+	}
+	lis, err := net.Listen("tcp", net.JoinHostPort(address, port))
+	if err != nil {
+		return err
+	}
+	server := &http.Server{
+		Handler:           admin.Handler(),
+		TLSConfig:         LoadTLSConfig(),
+		ReadHeaderTimeout: httpReadHeaderTimeout,
+	}
+	log.Println("[INFO]: Serving admin API on port " + port)
+	if server.TLSConfig != nil {
+		return server.ServeTLS(lis, "", "")
+	}
+	return server.Serve(lis)
+}
@@ -0,0 +1,216 @@
+package sinks
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/destrex271/pgwatch3_rpc_server/sinks/pb"
+	testutils "github.com/destrex271/pgwatch3_rpc_server/sinks/test_utils"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+type flushingReceiver struct {
+	statsReceiver
+	flushed int
+}
+
+func (r *flushingReceiver) Flush(ctx context.Context) error {
+	r.flushed++
+	return nil
+}
+
+func adminRequest(t *testing.T, server *httptest.Server, method, path string, value any) int {
+	req, err := http.NewRequest(method, server.URL+path, nil)
+	assert.NoError(t, err)
+	req.SetBasicAuth("admin", "secret")
+	resp, err := server.Client().Do(req)
+	assert.NoError(t, err)
+	defer func() { _ = resp.Body.Close() }()
+	body, err := io.ReadAll(resp.Body)
+	assert.NoError(t, err)
+	if value != nil {
+		assert.NoError(t, json.Unmarshal(body, value))
+	}
+	return resp.StatusCode
+}
+
+func TestAdmin_Interceptors(t *testing.T) {
+	a := NewAdmin(&statsReceiver{})
+	ok := func(ctx context.Context, req any) (any, error) { return &pb.Reply{Logmsg: "stored"}, nil }
+	failing := func(ctx context.Context, req any) (any, error) {
+		return nil, status.Error(codes.InvalidArgument, "empty metric name")
+	}
+	update := &grpc.UnaryServerInfo{FullMethod: pb.Receiver_UpdateMeasurements_FullMethodName}
+	syncInfo := &grpc.UnaryServerInfo{FullMethod: pb.Receiver_SyncMetric_FullMethodName}
+	chain := ChainUnaryInterceptors(a.HistoryInterceptor, a.UnaryInterceptor)
+
+	for range 2 {
+		_, err := chain(context.Background(), testutils.GetTestMeasurementEnvelope(), update, ok)
+		assert.NoError(t, err)
+	}
+	_, err := chain(WithTenant(context.Background(), "acme"), testutils.GetTestMeasurementEnvelope(), update, ok)
+	assert.NoError(t, err)
+	_, err = chain(context.Background(), testutils.GetTestMeasurementEnvelope(), update, failing)
+	assert.Error(t, err)
+	_, err = chain(context.Background(), testutils.GetTestRPCSyncRequest(), syncInfo, ok)
+	assert.NoError(t, err)
+
+	sources := a.Sources()
+	assert.Len(t, sources, 2)
+	assert.Equal(t, "", sources[0].Tenant)
+	assert.Equal(t, "acme", sources[1].Tenant)
+	metric := sources[0].Metrics[testutils.GetTestMeasurementEnvelope().GetMetricName()]
+	assert.Equal(t, int64(3), metric.Envelopes)
+	assert.Equal(t, int64(3), metric.Rows)
+	assert.False(t, metric.LastSeen.IsZero())
+
+	errs := a.Errors()
+	assert.Len(t, errs, 1)
+	assert.Equal(t, "UpdateMeasurements", errs[0].Method)
+	assert.Equal(t, "InvalidArgument", errs[0].Code)
+	assert.Equal(t, "empty metric name", errs[0].Message)
+	syncs := a.SyncRequests()
+	assert.Len(t, syncs, 1)
+	assert.Equal(t, testutils.GetTestRPCSyncRequest().GetOperation().String(), syncs[0].Operation)
+
+	// paused sources are rejected, of their tenant only
+	msg := testutils.GetTestMeasurementEnvelope()
+	assert.NoError(t, a.Pause("", msg.GetDBName(), false))
+	_, err = chain(context.Background(), msg, update, ok)
+	assert.Equal(t, codes.Unavailable, status.Code(err))
+	_, err = chain(WithTenant(context.Background(), "acme"), msg, update, ok)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1), a.Sources()[0].Rejected)
+
+	// or dropped if asked to
+	assert.NoError(t, a.Pause("", msg.GetDBName(), true))
+	reply, err := chain(context.Background(), msg, update, failing)
+	assert.NoError(t, err)
+	assert.Contains(t, reply.(*pb.Reply).GetLogmsg(), "paused")
+	assert.Equal(t, int64(1), a.Sources()[0].Dropped)
+	a.Resume("", msg.GetDBName())
+	reply, err = chain(context.Background(), msg, update, ok)
+	assert.NoError(t, err)
+	assert.Equal(t, "stored", reply.(*pb.Reply).GetLogmsg())
+
+	// sources are bounded
+	for i := len(a.sources); i < adminMaxSources; i++ {
+		assert.NoError(t, a.Pause("", fmt.Sprint("db", i), false))
+	}
+	assert.Equal(t, codes.ResourceExhausted, status.Code(a.Pause("", "one_too_many", false)))
+	_, err = chain(context.Background(), &pb.MeasurementEnvelope{DBName: "one_too_many", MetricName: "m"}, update, ok)
+	assert.NoError(t, err)
+	for i := range adminMaxSources {
+		a.Resume("", fmt.Sprint("db", i))
+	}
+	assert.Len(t, a.Sources(), 2)
+
+	// only the recent history is kept
+	for i := range adminHistorySize + 10 {
+		_, _ = chain(context.Background(), &pb.SyncReq{DBName: fmt.Sprint(i)}, syncInfo, failing)
+	}
+	assert.Len(t, a.SyncRequests(), adminHistorySize)
+	assert.Equal(t, "10", a.SyncRequests()[0].DBName)
+	assert.Len(t, a.Errors(), adminHistorySize)
+}
+
+func TestAdmin_Handler(t *testing.T) {
+	defer func(username, password string) { SERVER_USERNAME, SERVER_PASSWORD = username, password }(SERVER_USERNAME, SERVER_PASSWORD)
+	SERVER_USERNAME, SERVER_PASSWORD = "admin", "secret"
+	t.Setenv("PGWATCH_RPC_SERVER_PASSWORD", "secret")
+	t.Setenv("PGWATCH_RPC_SERVER_TENANTS", "acme=acme:pass")
+	t.Setenv("PGWATCH_RPC_SERVER_HTTP_PORT", "8080")
+
+	receiver := &flushingReceiver{statsReceiver: statsReceiver{SyncMetricHandler: NewSyncMetricHandler(10)}}
+	a := NewAdmin(receiver)
+	server := httptest.NewServer(a.Handler())
+	defer server.Close()
+
+	config := map[string]string{}
+	assert.Equal(t, http.StatusOK, adminRequest(t, server, http.MethodGet, "/admin/config", &config))
+	assert.Equal(t, "***", config["PGWATCH_RPC_SERVER_PASSWORD"])
+	assert.Equal(t, "***", config["PGWATCH_RPC_SERVER_TENANTS"])
+	assert.Equal(t, "8080", config["PGWATCH_RPC_SERVER_HTTP_PORT"])
+
+	stats := map[string]any{}
+	assert.Equal(t, http.StatusOK, adminRequest(t, server, http.MethodGet, "/admin/status", &stats))
+	assert.Equal(t, 42.0, stats["spool_bytes"])
+	assert.Equal(t, 0.0, stats["sync_queue_length"])
+	assert.Equal(t, true, stats["flushable"])
+
+	assert.Equal(t, http.StatusOK, adminRequest(t, server, http.MethodPost, "/admin/flush", nil))
+	assert.Equal(t, 1, receiver.flushed)
+
+	assert.Equal(t, http.StatusOK, adminRequest(t, server, http.MethodPost, "/admin/sources/db1/pause?drop=true", nil))
+	sources := []AdminSource{}
+	assert.Equal(t, http.StatusOK, adminRequest(t, server, http.MethodGet, "/admin/sources", &sources))
+	assert.Equal(t, []AdminSource{{DBName: "db1", Paused: true, Drop: true, Metrics: map[string]*AdminMetric{}}}, sources)
+	// sources that never sent measurements are forgotten once resumed
+	assert.Equal(t, http.StatusOK, adminRequest(t, server, http.MethodPost, "/admin/sources/db1/resume", nil))
+	assert.Empty(t, a.Sources())
+
+	assert.Equal(t, http.StatusNotFound, adminRequest(t, server, http.MethodPost, "/admin/sources/db1/stop", nil))
+	assert.Equal(t, http.StatusMethodNotAllowed, adminRequest(t, server, http.MethodGet, "/admin/flush", nil))
+	errs := []AdminError{}
+	assert.Equal(t, http.StatusOK, adminRequest(t, server, http.MethodGet, "/admin/errors", &errs))
+	assert.Empty(t, errs)
+
+	assert.Equal(t, http.StatusNotImplemented, adminRequest(t, server, http.MethodPost, "/admin/maintenance/enter", nil))
+	maintenance, err := NewMaintenance(receiver, "", "")
+	assert.NoError(t, err)
+	a.maintenance = maintenance
+	assert.Equal(t, http.StatusOK, adminRequest(t, server, http.MethodPost, "/admin/maintenance/enter", nil))
+	assert.Equal(t, http.StatusOK, adminRequest(t, server, http.MethodGet, "/admin/status", &stats))
+	assert.Equal(t, MaintenanceReject, stats["maintenance"])
+	assert.Equal(t, http.StatusBadRequest, adminRequest(t, server, http.MethodPost, "/admin/maintenance/enter?mode=buffer", nil))
+	assert.Equal(t, http.StatusOK, adminRequest(t, server, http.MethodPost, "/admin/maintenance/leave", nil))
+	assert.Equal(t, "", maintenance.Mode())
+
+	// same credentials as the receiver
+	SERVER_PASSWORD = "other"
+	assert.Equal(t, http.StatusUnauthorized, adminRequest(t, server, http.MethodGet, "/admin/config", nil))
+
+	// receivers without buffers can't be flushed
+	SERVER_PASSWORD = "secret"
+	server = httptest.NewServer(NewAdmin(&statsReceiver{}).Handler())
+	defer server.Close()
+	assert.Equal(t, http.StatusNotImplemented, adminRequest(t, server, http.MethodPost, "/admin/flush", nil))
+}
+
+func TestAdmin_Authentication(t *testing.T) {
+	defer func(username, password, tenants string) {
+		SERVER_USERNAME, SERVER_PASSWORD, SERVER_TENANTS = username, password, tenants
+	}(SERVER_USERNAME, SERVER_PASSWORD, SERVER_TENANTS)
+	SERVER_USERNAME, SERVER_PASSWORD, SERVER_TENANTS = "", "", ""
+
+	server := httptest.NewServer(NewAdmin(&statsReceiver{}).Handler())
+	defer server.Close()
+
+	// without credentials the admin API is served on loopback only
+	address, err := adminBindAddress()
+	assert.NoError(t, err)
+	assert.Equal(t, "127.0.0.1", address)
+	assert.Equal(t, http.StatusOK, adminRequest(t, server, http.MethodGet, "/admin/status", nil))
+
+	// tenant credentials don't give access
+	SERVER_TENANTS = "acme=admin:secret"
+	_, err = adminBindAddress()
+	assert.Error(t, err)
+	assert.Equal(t, http.StatusUnauthorized, adminRequest(t, server, http.MethodGet, "/admin/status", nil))
+
+	SERVER_USERNAME, SERVER_PASSWORD = "admin", "secret"
+	address, err = adminBindAddress()
+	assert.NoError(t, err)
+	assert.Equal(t, bindAddress(), address)
+	assert.Equal(t, http.StatusOK, adminRequest(t, server, http.MethodGet, "/admin/status", nil))
+	SERVER_PASSWORD = "other"
+	assert.Equal(t, http.StatusUnauthorized, adminRequest(t, server, http.MethodGet, "/admin/status", nil))
+}
@@ -0,0 +1,334 @@
+package sinks
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"fmt"
+	"maps"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/destrex271/pgwatch3_rpc_server/sinks/pb"
+	"google.golang.org/grpc"
+	"google.golang.org/protobuf/types/known/structpb"
+	"gopkg.in/yaml.v3"
+)
+
+// if set, YAML file configuring the downsampling of
+// measurements before they're stored (see AggregateConfig)
+var SERVER_AGGREGATE_FILE = os.Getenv("PGWATCH_RPC_SERVER_AGGREGATE_FILE")
+
+var aggregateFunctions = []string{"min", "max", "avg", "last", "sum"}
+
+// aggregates the receiver failed to store, dead-lettered as there's no
+// request left to fail and be retried by pgwatch
+var aggregateFailures atomic.Int64
+
+// rows dropped as their window was already emitted
+var aggregateLateRows atomic.Int64
+
+// AggregateRule aggregates the rows of Metric, grouped by Key columns
+type AggregateRule struct {
+	Metric string   `yaml:"metric"`
+	Key    []string `yaml:"key"`
+}
+
+type AggregateConfig struct {
+	// tumbling window length, e.g. 5m
+	Window time.Duration `yaml:"window"`
+	// how long a window stays open after its end for late rows, defaults to 10s
+	Grace time.Duration `yaml:"grace"`
+	// subset of min, max, avg, last and sum, defaults to all
+	Functions []string `yaml:"functions"`
+	// metrics not listed are passed on as they are
+	Metrics []AggregateRule `yaml:"metrics"`
+}
+
+// LoadAggregateConfig reads the aggregation config from a YAML file
+func LoadAggregateConfig(path string) (AggregateConfig, error) {
+	config := AggregateConfig{}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return config, err
+	}
+	if err := yaml.Unmarshal(data, &config); err != nil {
+		return config, fmt.Errorf("invalid aggregate file %s: %w", path, err)
+	}
+	return config, nil
+}
+
+type aggregateStats struct {
+	count         int
+	min, max, sum float64
+	last          float64
+	lastTime      int64
+}
+
+type aggregateRow struct {
+	key     map[string]any
+	columns map[string]*aggregateStats
+}
+
+// aggregateWindow holds the rows of one source and metric in one window
+type aggregateWindow struct {
+	series string
+	tenant string
+	dbName string
+	metric string
+	tags   map[string]string
+	start  int64
+	rows   map[string]*aggregateRow
+	// keys in order of appearance, to keep output stable
+	order []string
+}
+
+// Aggregator downsamples measurements over tumbling windows, emitting
+// one envelope per source, metric and window with the min, max, avg,
+// last and sum of every numeric column, per distinct key
+type Aggregator struct {
+	window    time.Duration
+	grace     time.Duration
+	functions []string
+	rules     map[string]AggregateRule
+	emit      func(context.Context, *pb.MeasurementEnvelope) error
+
+	mu      sync.Mutex
+	windows map[string]*aggregateWindow
+	// start of the last emitted window of every series
+	emitted map[string]int64
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+// NewAggregator flushes closed windows to emit every interval until Close is called
+func NewAggregator(config AggregateConfig, interval time.Duration, emit func(context.Context, *pb.MeasurementEnvelope) error) (*Aggregator, error) {
+	if config.Window <= 0 {
+		return nil, fmt.Errorf("invalid aggregate window %s", config.Window)
+	}
+	if config.Grace == 0 {
+		config.Grace = 10 * time.Second
+	}
+	if len(config.Functions) == 0 {
+		config.Functions = aggregateFunctions
+	}
+	for _, function := range config.Functions {
+		if !slices.Contains(aggregateFunctions, function) {
+			return nil, fmt.Errorf("invalid aggregate function %q, expected one of %s", function, strings.Join(aggregateFunctions, ", "))
+		}
+	}
+
+	a := &Aggregator{
+		window:    config.Window,
+		grace:     config.Grace,
+		functions: config.Functions,
+		rules:     map[string]AggregateRule{},
+		emit:      emit,
+		windows:   map[string]*aggregateWindow{},
+		emitted:   map[string]int64{},
+		stop:      make(chan struct{}),
+		done:      make(chan struct{}),
+	}
+	for i, rule := range config.Metrics {
+		if rule.Metric == "" {
+			return nil, fmt.Errorf("aggregate rule %d: missing metric", i+1)
+		}
+		a.rules[rule.Metric] = rule
+	}
+	go a.run(interval)
+	return a, nil
+}
+
+// NewAggregatorFromEnv returns nil if PGWATCH_RPC_SERVER_AGGREGATE_FILE
+// isn't set, aggregates are passed to receiver once their window closes
+func NewAggregatorFromEnv(receiver pb.ReceiverServer) (*Aggregator, error) {
+	if SERVER_AGGREGATE_FILE == "" {
+		return nil, nil
+	}
+	config, err := LoadAggregateConfig(SERVER_AGGREGATE_FILE)
+	if err != nil {
+		return nil, err
+	}
+	return NewAggregator(config, time.Second, func(ctx context.Context, msg *pb.MeasurementEnvelope) error {
+		_, err := receiver.UpdateMeasurements(ctx, msg)
+		return err
+	})
+}
+
+func (a *Aggregator) run(interval time.Duration) {
+	defer close(a.done)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-a.stop:
+			return
+		case <-ticker.C:
+		}
+		a.Flush(time.Now())
+	}
+}
+
+// Aggregates reports whether rows of metric are aggregated
+func (a *Aggregator) Aggregates(metric string) bool {
+	_, ok := a.rules[metric]
+	return ok
+}
+
+// Add folds the rows of msg, sent by tenant, into their windows.
+// Rows of windows already emitted are dropped
+func (a *Aggregator) Add(tenant string, msg *pb.MeasurementEnvelope) {
+	rule := a.rules[msg.GetMetricName()]
+	tags, _ := json.Marshal(msg.GetCustomTags())
+	series := strings.Join([]string{tenant, msg.GetDBName(), msg.GetMetricName(), string(tags)}, "\x00")
+	window := int64(a.window)
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for _, row := range msg.GetData() {
+		ts := rowTime(row)
+		start := ts - ts%window
+		if last, ok := a.emitted[series]; ok && start <= last {
+			aggregateLateRows.Add(1)
+			continue
+		}
+		id := series + "\x00" + fmt.Sprint(start)
+		w, ok := a.windows[id]
+		if !ok {
+			w = &aggregateWindow{
+				series: series,
+				tenant: tenant,
+				dbName: msg.GetDBName(),
+				metric: msg.GetMetricName(),
+				tags:   maps.Clone(msg.GetCustomTags()),
+				start:  start,
+				rows:   map[string]*aggregateRow{},
+			}
+			a.windows[id] = w
+		}
+
+		key := map[string]any{}
+		for _, column := range rule.Key {
+			key[column] = row.GetFields()[column].AsInterface()
+		}
+		keyID, _ := json.Marshal(key)
+		r, ok := w.rows[string(keyID)]
+		if !ok {
+			r = &aggregateRow{key: key, columns: map[string]*aggregateStats{}}
+			w.rows[string(keyID)] = r
+			w.order = append(w.order, string(keyID))
+		}
+
+		for column, value := range row.GetFields() {
+			number, ok := value.GetKind().(*structpb.Value_NumberValue)
+			if !ok || column == "epoch_ns" || slices.Contains(rule.Key, column) {
+				continue
+			}
+			v := number.NumberValue
+			stats, ok := r.columns[column]
+			if !ok {
+				stats = &aggregateStats{min: v, max: v}
+				r.columns[column] = stats
+			}
+			stats.count++
+			stats.sum += v
+			stats.min = min(stats.min, v)
+			stats.max = max(stats.max, v)
+			if ts >= stats.lastTime {
+				stats.last, stats.lastTime = v, ts
+			}
+		}
+	}
+}
+
+func (a *Aggregator) envelope(w *aggregateWindow) *pb.MeasurementEnvelope {
+	msg := &pb.MeasurementEnvelope{DBName: w.dbName, MetricName: w.metric, CustomTags: w.tags}
+	for _, keyID := range w.order {
+		r := w.rows[keyID]
+		fields := map[string]*structpb.Value{"epoch_ns": structpb.NewNumberValue(float64(w.start))}
+		for column, value := range r.key {
+			v, err := structpb.NewValue(value)
+			if err != nil {
+				v = structpb.NewNullValue()
+			}
+			fields[column] = v
+		}
+		for column, stats := range r.columns {
+			for _, function := range a.functions {
+				var v float64
+				switch function {
+				case "min":
+					v = stats.min
+				case "max":
+					v = stats.max
+				case "avg":
+					v = stats.sum / float64(stats.count)
+				case "last":
+					v = stats.last
+				case "sum":
+					v = stats.sum
+				}
+				fields[column+"_"+function] = structpb.NewNumberValue(v)
+			}
+		}
+		msg.Data = append(msg.Data, &structpb.Struct{Fields: fields})
+	}
+	return msg
+}
+
+// Flush emits the windows closed at now, their end and grace period passed
+func (a *Aggregator) Flush(now time.Time) {
+	a.flush(func(w *aggregateWindow) bool {
+		return now.UnixNano() >= w.start+int64(a.window+a.grace)
+	})
+}
+
+func (a *Aggregator) flush(closed func(*aggregateWindow) bool) {
+	a.mu.Lock()
+	ready := []*aggregateWindow{}
+	for id, w := range a.windows {
+		if closed(w) {
+			ready = append(ready, w)
+			delete(a.windows, id)
+			if last, ok := a.emitted[w.series]; !ok || w.start > last {
+				a.emitted[w.series] = w.start
+			}
+		}
+	}
+	a.mu.Unlock()
+
+	slices.SortFunc(ready, func(x, y *aggregateWindow) int {
+		return cmp.Or(cmp.Compare(x.start, y.start), strings.Compare(x.dbName, y.dbName), strings.Compare(x.metric, y.metric))
+	})
+	for _, w := range ready {
+		msg := a.envelope(w)
+		if err := a.emit(WithTenant(context.Background(), w.tenant), msg); err != nil {
+			aggregateFailures.Add(1)
+			AddDeadLetter("aggregator", msg, err)
+		}
+	}
+}
+
+// Close stops the background flushing and emits all open windows
+func (a *Aggregator) Close() error {
+	close(a.stop)
+	<-a.done
+	a.flush(func(*aggregateWindow) bool { return true })
+	return nil
+}
+
+// UnaryInterceptor holds back measurements of aggregated metrics,
+// the aggregates are emitted once their window closes
+func (a *Aggregator) UnaryInterceptor(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+	msg, ok := req.(*pb.MeasurementEnvelope)
+	if !ok || !a.Aggregates(msg.GetMetricName()) {
+		return handler(ctx, req)
+	}
+	a.Add(Tenant(ctx), msg)
+	return &pb.Reply{Logmsg: fmt.Sprintf("aggregated into %s windows", a.window)}, nil
+}
@@ -0,0 +1,157 @@
+package sinks
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/destrex271/pgwatch3_rpc_server/sinks/pb"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc"
+)
+
+func TestLoadAggregateConfig(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "aggregate.yaml")
+	assert.NoError(t, os.WriteFile(path, []byte("window: 5m\nfunctions: [avg]\nmetrics:\n  - metric: table_stats\n    key: [table_name]\n"), 0644))
+	config, err := LoadAggregateConfig(path)
+	assert.NoError(t, err)
+	assert.Equal(t, AggregateConfig{
+		Window:    5 * time.Minute,
+		Functions: []string{"avg"},
+		Metrics:   []AggregateRule{{Metric: "table_stats", Key: []string{"table_name"}}},
+	}, config)
+
+	for _, config := range []AggregateConfig{
+		{},
+		{Window: time.Minute, Functions: []string{"median"}},
+		{Window: time.Minute, Metrics: []AggregateRule{{Key: []string{"a"}}}},
+	} {
+		_, err := NewAggregator(config, time.Hour, nil)
+		assert.Error(t, err)
+	}
+}
+
+type emitted struct {
+	mu   sync.Mutex
+	msgs []*pb.MeasurementEnvelope
+}
+
+func (e *emitted) emit(ctx context.Context, msg *pb.MeasurementEnvelope) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.msgs = append(e.msgs, msg)
+	return nil
+}
+
+func TestAggregator(t *testing.T) {
+	out := &emitted{}
+	a, err := NewAggregator(AggregateConfig{
+		Window:  time.Minute,
+		Metrics: []AggregateRule{{Metric: "table_stats", Key: []string{"table_name"}}},
+	}, time.Hour, out.emit)
+	assert.NoError(t, err)
+	assert.True(t, a.Aggregates("table_stats"))
+	assert.False(t, a.Aggregates("db_stats"))
+
+	sec := float64(time.Second)
+	a.Add("", rateEnvelope(t, "table_stats",
+		map[string]any{"epoch_ns": 60 * sec, "table_name": "a", "size": 10, "kind": "r"},
+		map[string]any{"epoch_ns": 60 * sec, "table_name": "b", "size": 1},
+	))
+	a.Add("", rateEnvelope(t, "table_stats",
+		map[string]any{"epoch_ns": 90 * sec, "table_name": "a", "size": 30},
+		// next window
+		map[string]any{"epoch_ns": 125 * sec, "table_name": "a", "size": 50},
+	))
+
+	// windows stay open during the grace period
+	a.Flush(time.Unix(125, 0))
+	assert.Empty(t, out.msgs)
+
+	a.Flush(time.Unix(130, 0))
+	assert.Len(t, out.msgs, 1)
+	msg := out.msgs[0]
+	assert.Equal(t, "test", msg.GetDBName())
+	assert.Equal(t, "table_stats", msg.GetMetricName())
+	assert.Len(t, msg.Data, 2)
+	assert.Equal(t, map[string]any{
+		"epoch_ns":   60 * sec,
+		"table_name": "a",
+		"size_min":   10.0,
+		"size_max":   30.0,
+		"size_avg":   20.0,
+		"size_last":  30.0,
+		"size_sum":   40.0,
+	}, msg.Data[0].AsMap())
+	assert.Equal(t, "b", msg.Data[1].AsMap()["table_name"])
+
+	// late rows of an emitted window are dropped, not emitted as a second aggregate
+	late := aggregateLateRows.Load()
+	a.Add("", rateEnvelope(t, "table_stats", map[string]any{"epoch_ns": 70 * sec, "table_name": "a", "size": 20}))
+	assert.Equal(t, late+1, aggregateLateRows.Load())
+
+	// open windows are emitted on close
+	assert.NoError(t, a.Close())
+	assert.Len(t, out.msgs, 2)
+	assert.Equal(t, 120*sec, out.msgs[1].Data[0].AsMap()["epoch_ns"])
+}
+
+func TestAggregator_UnaryInterceptor(t *testing.T) {
+	out := &emitted{}
+	a, err := NewAggregator(AggregateConfig{
+		Window:    time.Minute,
+		Functions: []string{"max"},
+		Metrics:   []AggregateRule{{Metric: "db_stats"}},
+	}, time.Hour, func(ctx context.Context, msg *pb.MeasurementEnvelope) error {
+		assert.Equal(t, "acme", Tenant(ctx))
+		return out.emit(ctx, msg)
+	})
+	assert.NoError(t, err)
+
+	handler := func(ctx context.Context, req any) (any, error) {
+		return &pb.Reply{}, out.emit(ctx, req.(*pb.MeasurementEnvelope))
+	}
+	info := &grpc.UnaryServerInfo{FullMethod: pb.Receiver_UpdateMeasurements_FullMethodName}
+	ctx, cancel := context.WithCancel(WithTenant(context.Background(), "acme"))
+
+	for _, size := range []int{3, 7} {
+		reply, err := a.UnaryInterceptor(ctx, rateEnvelope(t, "db_stats", map[string]any{"epoch_ns": float64(time.Second), "size": size}), info, handler)
+		assert.NoError(t, err)
+		assert.Contains(t, reply.(*pb.Reply).GetLogmsg(), "aggregated")
+	}
+	// other metrics pass through
+	_, err = a.UnaryInterceptor(ctx, rateEnvelope(t, "other", map[string]any{"size": 1}), info, handler)
+	assert.NoError(t, err)
+	assert.Len(t, out.msgs, 1)
+
+	// the request being over doesn't prevent storing its aggregates
+	cancel()
+	assert.NoError(t, a.Close())
+	assert.Len(t, out.msgs, 2)
+	assert.Equal(t, 7.0, out.msgs[1].Data[0].AsMap()["size_max"])
+}
+
+func TestAggregator_DeadLetters(t *testing.T) {
+	defer func(path string) { SERVER_DEADLETTER_FILE = path }(SERVER_DEADLETTER_FILE)
+	SERVER_DEADLETTER_FILE = filepath.Join(t.TempDir(), "deadletters.jsonl")
+
+	a, err := NewAggregator(AggregateConfig{Window: time.Minute, Metrics: []AggregateRule{{Metric: "db_stats"}}}, time.Hour,
+		func(ctx context.Context, msg *pb.MeasurementEnvelope) error { return errors.New("backend down") })
+	assert.NoError(t, err)
+	failures := aggregateFailures.Load()
+	a.Add("", rateEnvelope(t, "db_stats", map[string]any{"epoch_ns": float64(time.Second), "size": 3}))
+	assert.NoError(t, a.Close())
+
+	// failed aggregates aren't lost
+	assert.Equal(t, failures+1, aggregateFailures.Load())
+	letters, err := ReadDeadLetters(SERVER_DEADLETTER_FILE)
+	assert.NoError(t, err)
+	assert.Len(t, letters, 1)
+	assert.Equal(t, "aggregator", letters[0].Receiver)
+	assert.Equal(t, "backend down", letters[0].Error)
+	assert.Equal(t, 3.0, letters[0].Envelope.Data[0].AsMap()["size_max"])
+}
@@ -0,0 +1,343 @@
+package sinks
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"maps"
+	"os"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/destrex271/pgwatch3_rpc_server/sinks/pb"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/structpb"
+	"gopkg.in/yaml.v3"
+)
+
+// if set, YAML file limiting the distinct values of tags
+// and key columns per metric (see CardinalityConfig)
+var SERVER_CARDINALITY_FILE = os.Getenv("PGWATCH_RPC_SERVER_CARDINALITY_FILE")
+
+// value over limit tags and key columns are collapsed to
+const CardinalityOther = "__other__"
+
+// CardinalityRule also limits the distinct values of the Key columns of Metric
+type CardinalityRule struct {
+	Metric string   `yaml:"metric"`
+	Key    []string `yaml:"key"`
+	// overrides the default limit for this metric
+	Limit int `yaml:"limit"`
+}
+
+type CardinalityConfig struct {
+	// distinct values allowed per metric and tag or key column, defaults to 1000
+	Limit int `yaml:"limit"`
+	// what happens to values over the limit: "collapse" (default) to
+	// __other__, "drop" the envelope or row, or "reject" the request
+	Action string `yaml:"action"`
+	// how often top offenders are logged, defaults to 5m
+	ReportInterval time.Duration `yaml:"report_interval"`
+	// how often distinct values are forgotten, defaults to 24h
+	ResetInterval time.Duration     `yaml:"reset_interval"`
+	Metrics       []CardinalityRule `yaml:"metrics"`
+}
+
+// LoadCardinalityConfig reads the cardinality limits from a YAML file
+func LoadCardinalityConfig(path string) (CardinalityConfig, error) {
+	config := CardinalityConfig{}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return config, err
+	}
+	if err := yaml.Unmarshal(data, &config); err != nil {
+		return config, fmt.Errorf("invalid cardinality file %s: %w", path, err)
+	}
+	return config, nil
+}
+
+// CardinalityOffender is a metric tag, "tag:<name>", or key
+// column, "column:<name>", with its count of distinct values
+// and of values limited since distinct values were last reset
+type CardinalityOffender struct {
+	Metric    string
+	Dimension string
+	Distinct  int
+	Limited   int
+}
+
+type cardinalityDimension struct {
+	values  map[string]struct{}
+	limited int
+}
+
+// CardinalityGuard tracks the distinct values of tags and key columns
+// per metric, enforcing limits so that a misbehaving metric can't
+// explode the number of series stored
+// number of tag and key column values over the limit, reported by SelfMonitor
+var cardinalityLimited atomic.Int64
+
+type CardinalityGuard struct {
+	config CardinalityConfig
+	rules  map[string]CardinalityRule
+
+	mu         sync.Mutex
+	dimensions map[[2]string]*cardinalityDimension
+
+	limitedCounter metric.Int64Counter
+	registration   metric.Registration
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+func NewCardinalityGuard(config CardinalityConfig) (*CardinalityGuard, error) {
+	if config.Limit == 0 {
+		config.Limit = 1000
+	}
+	if config.Action == "" {
+		config.Action = "collapse"
+	}
+	if config.ReportInterval == 0 {
+		config.ReportInterval = 5 * time.Minute
+	}
+	if config.ResetInterval == 0 {
+		config.ResetInterval = 24 * time.Hour
+	}
+	switch {
+	case config.Limit < 0:
+		return nil, fmt.Errorf("invalid cardinality limit %d", config.Limit)
+	case !slices.Contains([]string{"collapse", "drop", "reject"}, config.Action):
+		return nil, fmt.Errorf("invalid cardinality action %q, expected collapse, drop or reject", config.Action)
+	case config.ReportInterval < 0 || config.ResetInterval < 0:
+		return nil, fmt.Errorf("invalid cardinality intervals")
+	}
+
+	g := &CardinalityGuard{
+		config:     config,
+		rules:      map[string]CardinalityRule{},
+		dimensions: map[[2]string]*cardinalityDimension{},
+		stop:       make(chan struct{}),
+		done:       make(chan struct{}),
+	}
+	for i, rule := range config.Metrics {
+		if rule.Metric == "" {
+			return nil, fmt.Errorf("cardinality rule %d: missing metric", i+1)
+		}
+		g.rules[rule.Metric] = rule
+	}
+
+	meter := otel.Meter(tracerName)
+	var err error
+	g.limitedCounter, err = meter.Int64Counter("pgwatch_rpc.cardinality.limited",
+		metric.WithDescription("Tag and key column values over the cardinality limit"))
+	if err != nil {
+		return nil, err
+	}
+	distinct, err := meter.Int64ObservableGauge("pgwatch_rpc.cardinality.distinct",
+		metric.WithDescription("Distinct values of tags and key columns per metric"))
+	if err != nil {
+		return nil, err
+	}
+	g.registration, err = meter.RegisterCallback(func(ctx context.Context, o metric.Observer) error {
+		for _, offender := range g.Top(0) {
+			o.ObserveInt64(distinct, int64(offender.Distinct), metric.WithAttributes(
+				attribute.String("metric", offender.Metric), attribute.String("dimension", offender.Dimension)))
+		}
+		return nil
+	}, distinct)
+	if err != nil {
+		return nil, err
+	}
+
+	go g.run()
+	return g, nil
+}
+
+// NewCardinalityGuardFromEnv returns nil if PGWATCH_RPC_SERVER_CARDINALITY_FILE isn't set
+func NewCardinalityGuardFromEnv() (*CardinalityGuard, error) {
+	if SERVER_CARDINALITY_FILE == "" {
+		return nil, nil
+	}
+	config, err := LoadCardinalityConfig(SERVER_CARDINALITY_FILE)
+	if err != nil {
+		return nil, err
+	}
+	return NewCardinalityGuard(config)
+}
+
+func (g *CardinalityGuard) run() {
+	defer close(g.done)
+	report := time.NewTicker(g.config.ReportInterval)
+	defer report.Stop()
+	reset := time.NewTicker(g.config.ResetInterval)
+	defer reset.Stop()
+	for {
+		select {
+		case <-g.stop:
+			return
+		case <-report.C:
+			g.Report()
+		case <-reset.C:
+			g.Reset()
+		}
+	}
+}
+
+// Report logs the top offenders that had values limited
+func (g *CardinalityGuard) Report() {
+	for _, offender := range g.Top(10) {
+		if offender.Limited == 0 {
+			break
+		}
+		log.Printf("[WARNING]: Metric %s exceeds the cardinality limit on %s: %d distinct values, %d limited",
+			offender.Metric, offender.Dimension, offender.Distinct, offender.Limited)
+	}
+}
+
+// Reset forgets the distinct values seen so far
+func (g *CardinalityGuard) Reset() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	clear(g.dimensions)
+}
+
+func (g *CardinalityGuard) Close() error {
+	close(g.stop)
+	<-g.done
+	return g.registration.Unregister()
+}
+
+// Top returns the n, or all if n is 0, dimensions with the most
+// limited values, then with the most distinct values
+func (g *CardinalityGuard) Top(n int) []CardinalityOffender {
+	g.mu.Lock()
+	offenders := make([]CardinalityOffender, 0, len(g.dimensions))
+	for id, dimension := range g.dimensions {
+		offenders = append(offenders, CardinalityOffender{
+			Metric:    id[0],
+			Dimension: id[1],
+			Distinct:  len(dimension.values),
+			Limited:   dimension.limited,
+		})
+	}
+	g.mu.Unlock()
+
+	slices.SortFunc(offenders, func(a, b CardinalityOffender) int {
+		return cmp.Or(cmp.Compare(b.Limited, a.Limited), cmp.Compare(b.Distinct, a.Distinct),
+			cmp.Compare(a.Metric, b.Metric), cmp.Compare(a.Dimension, b.Dimension))
+	})
+	if n > 0 && len(offenders) > n {
+		offenders = offenders[:n]
+	}
+	return offenders
+}
+
+// admit reports whether value is within the limit of the dimension,
+// counting it as distinct if it wasn't seen yet
+func (g *CardinalityGuard) admit(ctx context.Context, metricName, dimensionName, value string, limit int) bool {
+	g.mu.Lock()
+	id := [2]string{metricName, dimensionName}
+	dimension, ok := g.dimensions[id]
+	if !ok {
+		dimension = &cardinalityDimension{values: map[string]struct{}{}}
+		g.dimensions[id] = dimension
+	}
+	_, seen := dimension.values[value]
+	admitted := seen || len(dimension.values) < limit
+	if !seen && admitted {
+		dimension.values[value] = struct{}{}
+	}
+	if !admitted {
+		dimension.limited++
+	}
+	g.mu.Unlock()
+
+	if !admitted {
+		cardinalityLimited.Add(1)
+		g.limitedCounter.Add(ctx, 1, metric.WithAttributes(attribute.String("metric", metricName),
+			attribute.String("dimension", dimensionName), attribute.String("action", g.config.Action)))
+	}
+	return admitted
+}
+
+func columnValue(value *structpb.Value) string {
+	if s, ok := value.GetKind().(*structpb.Value_StringValue); ok {
+		return s.StringValue
+	}
+	data, _ := json.Marshal(value.AsInterface())
+	return string(data)
+}
+
+// Guard enforces the cardinality limits on msg, in place. Dropped
+// envelopes are left without rows, rejected ones return an error
+func (g *CardinalityGuard) Guard(ctx context.Context, msg *pb.MeasurementEnvelope) error {
+	rule := g.rules[msg.GetMetricName()]
+	limit := cmp.Or(rule.Limit, g.config.Limit)
+	metricName := TenantPrefix(ctx, "/") + msg.GetMetricName()
+
+	for _, name := range slices.Sorted(maps.Keys(msg.GetCustomTags())) {
+		dimension := "tag:" + name
+		if g.admit(ctx, metricName, dimension, msg.CustomTags[name], limit) {
+			continue
+		}
+		switch g.config.Action {
+		case "reject":
+			return status.Errorf(codes.FailedPrecondition, "too many distinct values of %s for metric %s, limit is %d", dimension, msg.GetMetricName(), limit)
+		case "drop":
+			msg.Data = nil
+			return nil
+		default:
+			msg.CustomTags[name] = CardinalityOther
+		}
+	}
+
+	rows := msg.Data[:0]
+rows:
+	for _, row := range msg.GetData() {
+		for _, column := range rule.Key {
+			value, ok := row.GetFields()[column]
+			if !ok {
+				continue
+			}
+			dimension := "column:" + column
+			if g.admit(ctx, metricName, dimension, columnValue(value), limit) {
+				continue
+			}
+			switch g.config.Action {
+			case "reject":
+				return status.Errorf(codes.FailedPrecondition, "too many distinct values of %s for metric %s, limit is %d", dimension, msg.GetMetricName(), limit)
+			case "drop":
+				continue rows
+			default:
+				row.Fields[column] = structpb.NewStringValue(CardinalityOther)
+			}
+		}
+		rows = append(rows, row)
+	}
+	msg.Data = rows
+	return nil
+}
+
+func (g *CardinalityGuard) UnaryInterceptor(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+	msg, ok := req.(*pb.MeasurementEnvelope)
+	if !ok {
+		return handler(ctx, req)
+	}
+	if err := g.Guard(ctx, msg); err != nil {
+		return nil, err
+	}
+	if len(msg.GetData()) == 0 {
+		return &pb.Reply{Logmsg: "dropped, over the cardinality limit"}, nil
+	}
+	return handler(ctx, req)
+}
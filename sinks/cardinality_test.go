@@ -0,0 +1,123 @@
+package sinks
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/destrex271/pgwatch3_rpc_server/sinks/pb"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func newTestCardinalityGuard(t *testing.T, action string) *CardinalityGuard {
+	g, err := NewCardinalityGuard(CardinalityConfig{
+		Limit:   2,
+		Action:  action,
+		Metrics: []CardinalityRule{{Metric: "table_stats", Key: []string{"table_name"}, Limit: 3}},
+	})
+	assert.NoError(t, err)
+	t.Cleanup(func() { _ = g.Close() })
+	return g
+}
+
+func taggedEnvelope(t *testing.T, metric, tag string, rows ...map[string]any) *pb.MeasurementEnvelope {
+	msg := rateEnvelope(t, metric, rows...)
+	msg.CustomTags = map[string]string{"env": "prod", "host": tag}
+	return msg
+}
+
+func TestLoadCardinalityConfig(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cardinality.yaml")
+	assert.NoError(t, os.WriteFile(path, []byte("limit: 10\naction: drop\nreset_interval: 1h\n"), 0644))
+	config, err := LoadCardinalityConfig(path)
+	assert.NoError(t, err)
+	assert.Equal(t, CardinalityConfig{Limit: 10, Action: "drop", ResetInterval: time.Hour}, config)
+
+	for _, config := range []CardinalityConfig{
+		{Limit: -1},
+		{Action: "ignore"},
+		{Metrics: []CardinalityRule{{Limit: 1}}},
+	} {
+		_, err := NewCardinalityGuard(config)
+		assert.Error(t, err)
+	}
+}
+
+func TestCardinalityGuard_Collapse(t *testing.T) {
+	g := newTestCardinalityGuard(t, "")
+	ctx := context.Background()
+
+	for i := range 4 {
+		msg := taggedEnvelope(t, "db_stats", fmt.Sprintf("host%d", i), map[string]any{"size": 1})
+		assert.NoError(t, g.Guard(ctx, msg))
+		if i < 2 {
+			assert.Equal(t, fmt.Sprintf("host%d", i), msg.CustomTags["host"])
+		} else {
+			assert.Equal(t, CardinalityOther, msg.CustomTags["host"])
+		}
+		assert.Equal(t, "prod", msg.CustomTags["env"])
+	}
+	// already seen values stay admitted
+	msg := taggedEnvelope(t, "db_stats", "host0")
+	assert.NoError(t, g.Guard(ctx, msg))
+	assert.Equal(t, "host0", msg.CustomTags["host"])
+
+	msg = taggedEnvelope(t, "table_stats", "host0",
+		map[string]any{"table_name": "a"}, map[string]any{"table_name": "b"},
+		map[string]any{"table_name": "c"}, map[string]any{"table_name": "d"}, map[string]any{"size": 1})
+	assert.NoError(t, g.Guard(ctx, msg))
+	assert.Len(t, msg.Data, 5)
+	assert.Equal(t, "c", msg.Data[2].AsMap()["table_name"])
+	assert.Equal(t, CardinalityOther, msg.Data[3].AsMap()["table_name"])
+
+	// tenants have their own limits
+	msg = taggedEnvelope(t, "db_stats", "host9")
+	assert.NoError(t, g.Guard(WithTenant(ctx, "acme"), msg))
+	assert.Equal(t, "host9", msg.CustomTags["host"])
+
+	assert.Equal(t, []CardinalityOffender{
+		{Metric: "db_stats", Dimension: "tag:host", Distinct: 2, Limited: 2},
+		{Metric: "table_stats", Dimension: "column:table_name", Distinct: 3, Limited: 1},
+	}, g.Top(2))
+	assert.Len(t, g.Top(0), 7)
+	g.Report()
+
+	g.Reset()
+	assert.Empty(t, g.Top(0))
+}
+
+func TestCardinalityGuard_Drop(t *testing.T) {
+	g := newTestCardinalityGuard(t, "drop")
+	handler := func(ctx context.Context, req any) (any, error) {
+		return &pb.Reply{Logmsg: "stored"}, nil
+	}
+	info := &grpc.UnaryServerInfo{FullMethod: pb.Receiver_UpdateMeasurements_FullMethodName}
+
+	for i, expected := range []string{"stored", "stored", "dropped, over the cardinality limit"} {
+		reply, err := g.UnaryInterceptor(context.Background(), taggedEnvelope(t, "db_stats", fmt.Sprint(i), map[string]any{"size": 1}), info, handler)
+		assert.NoError(t, err)
+		assert.Equal(t, expected, reply.(*pb.Reply).GetLogmsg())
+	}
+
+	msg := taggedEnvelope(t, "table_stats", "0",
+		map[string]any{"table_name": "a"}, map[string]any{"table_name": "b"},
+		map[string]any{"table_name": "c"}, map[string]any{"table_name": "d"})
+	assert.NoError(t, g.Guard(context.Background(), msg))
+	assert.Len(t, msg.Data, 3)
+}
+
+func TestCardinalityGuard_Reject(t *testing.T) {
+	g := newTestCardinalityGuard(t, "reject")
+	for i := range 2 {
+		assert.NoError(t, g.Guard(context.Background(), taggedEnvelope(t, "db_stats", fmt.Sprint(i))))
+	}
+	err := g.Guard(context.Background(), taggedEnvelope(t, "db_stats", "2"))
+	assert.Equal(t, codes.FailedPrecondition, status.Code(err), "not retried by pgwatch")
+	assert.ErrorContains(t, err, "tag:host")
+}
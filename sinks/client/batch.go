@@ -0,0 +1,145 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"log"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/destrex271/pgwatch3_rpc_server/sinks/pb"
+)
+
+type BatchOptions struct {
+	// pending rows are sent once there are MaxRows of them, defaults to 1000
+	MaxRows int
+	// and at least every Interval, defaults to 1s
+	Interval time.Duration
+	// called for envelopes background flushes failed to send, defaults to logging
+	OnError func(msg *pb.MeasurementEnvelope, err error)
+}
+
+// Batcher merges the rows of envelopes sharing database, metric
+// and tags, sending fewer and bigger envelopes to the receiver
+type Batcher struct {
+	client *Client
+	opts   BatchOptions
+
+	mu sync.Mutex
+	// by batchKey, in order of arrival
+	pending map[string]*pb.MeasurementEnvelope
+	order   []string
+	rows    int
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+func NewBatcher(client *Client, opts BatchOptions) *Batcher {
+	if opts.MaxRows <= 0 {
+		opts.MaxRows = 1000
+	}
+	if opts.Interval <= 0 {
+		opts.Interval = time.Second
+	}
+	if opts.OnError == nil {
+		opts.OnError = func(msg *pb.MeasurementEnvelope, err error) {
+			log.Printf("[ERROR]: Unable to send %d rows of %s/%s: %s", len(msg.GetData()), msg.GetDBName(), msg.GetMetricName(), err)
+		}
+	}
+
+	b := &Batcher{
+		client:  client,
+		opts:    opts,
+		pending: map[string]*pb.MeasurementEnvelope{},
+		stop:    make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+	go b.run()
+	return b
+}
+
+func (b *Batcher) run() {
+	defer close(b.done)
+	ticker := time.NewTicker(b.opts.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-b.stop:
+			return
+		case <-ticker.C:
+			_ = b.flush(context.Background(), b.opts.OnError)
+		}
+	}
+}
+
+func batchKey(msg *pb.MeasurementEnvelope) string {
+	parts := []string{msg.GetDBName(), msg.GetMetricName()}
+	for key, value := range msg.GetCustomTags() {
+		parts = append(parts, key+"="+value)
+	}
+	slices.Sort(parts[2:])
+	return strings.Join(parts, "\x00")
+}
+
+// Add queues the rows of msg, sending pending rows
+// right away if MaxRows is reached
+func (b *Batcher) Add(ctx context.Context, msg *pb.MeasurementEnvelope) error {
+	b.mu.Lock()
+	key := batchKey(msg)
+	if batch, ok := b.pending[key]; ok {
+		batch.Data = append(batch.Data, msg.GetData()...)
+	} else {
+		b.pending[key] = &pb.MeasurementEnvelope{
+			DBName:     msg.GetDBName(),
+			MetricName: msg.GetMetricName(),
+			CustomTags: msg.GetCustomTags(),
+			Data:       slices.Clone(msg.GetData()),
+		}
+		b.order = append(b.order, key)
+	}
+	b.rows += len(msg.GetData())
+	full := b.rows >= b.opts.MaxRows
+	b.mu.Unlock()
+
+	if full {
+		return b.Flush(ctx)
+	}
+	return nil
+}
+
+// Flush sends all pending rows, rows failing to send are dropped
+func (b *Batcher) Flush(ctx context.Context) error {
+	var errs []error
+	err := b.flush(ctx, func(_ *pb.MeasurementEnvelope, err error) {
+		errs = append(errs, err)
+	})
+	if err != nil {
+		return err
+	}
+	return errors.Join(errs...)
+}
+
+func (b *Batcher) flush(ctx context.Context, onError func(*pb.MeasurementEnvelope, error)) error {
+	b.mu.Lock()
+	pending, order := b.pending, b.order
+	b.pending, b.order, b.rows = map[string]*pb.MeasurementEnvelope{}, nil, 0
+	b.mu.Unlock()
+
+	for _, key := range order {
+		msg := pending[key]
+		if err := b.client.Write(ctx, msg); err != nil {
+			onError(msg, err)
+		}
+	}
+	return ctx.Err()
+}
+
+// Close stops background flushes and sends pending rows
+func (b *Batcher) Close(ctx context.Context) error {
+	close(b.stop)
+	<-b.done
+	return b.Flush(ctx)
+}
@@ -0,0 +1,212 @@
+// Package client writes measurements to receivers over gRPC
+// the same way pgwatch's gRPC sink does, e.g. to push custom
+// metrics from Go services into the receivers pgwatch uses
+package client
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/destrex271/pgwatch3_rpc_server/sinks/pb"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+type config struct {
+	username string
+	password string
+	caFile   string
+	tls      *tls.Config
+	metadata []string
+
+	attempts int
+	backoff  time.Duration
+
+	dialOptions []grpc.DialOption
+}
+
+// Option configures a Client
+type Option func(*config)
+
+// WithCredentials sends username and password with every
+// call, as expected by the receivers' auth interceptor
+func WithCredentials(username, password string) Option {
+	return func(c *config) {
+		c.username, c.password = username, password
+	}
+}
+
+// WithCAFile enables TLS, the receiver certificate is
+// verified against caFile. Ignored if caFile is empty
+func WithCAFile(caFile string) Option {
+	return func(c *config) {
+		c.caFile = caFile
+	}
+}
+
+// WithTLSConfig enables TLS using tlsConfig, e.g. to verify the
+// receiver certificate against the system roots with &tls.Config{}
+func WithTLSConfig(tlsConfig *tls.Config) Option {
+	return func(c *config) {
+		c.tls = tlsConfig
+	}
+}
+
+// WithMetadata sends key with every call, e.g. the tenant header
+func WithMetadata(key, value string) Option {
+	return func(c *config) {
+		c.metadata = append(c.metadata, key, value)
+	}
+}
+
+// WithRetry makes up to attempts calls, waiting backoff, doubled
+// after every attempt, when the receiver is unavailable or overloaded
+func WithRetry(attempts int, backoff time.Duration) Option {
+	return func(c *config) {
+		c.attempts, c.backoff = attempts, backoff
+	}
+}
+
+// WithDialOptions are passed to grpc.NewClient
+func WithDialOptions(opts ...grpc.DialOption) Option {
+	return func(c *config) {
+		c.dialOptions = append(c.dialOptions, opts...)
+	}
+}
+
+// Client is a pb.ReceiverClient adding credentials,
+// metadata and retries to every call
+type Client struct {
+	config
+	conn *grpc.ClientConn
+	rpc  pb.ReceiverClient
+}
+
+var _ pb.ReceiverClient = (*Client)(nil)
+
+// New connects lazily to the receiver at address (host:port)
+func New(address string, opts ...Option) (*Client, error) {
+	c := &Client{config: config{attempts: 1}}
+	for _, opt := range opts {
+		opt(&c.config)
+	}
+	if c.attempts < 1 {
+		c.attempts = 1
+	}
+
+	creds, err := c.transportCredentials()
+	if err != nil {
+		return nil, err
+	}
+	dialOptions := append([]grpc.DialOption{grpc.WithTransportCredentials(creds)}, c.dialOptions...)
+	c.conn, err = grpc.NewClient(address, dialOptions...)
+	if err != nil {
+		return nil, err
+	}
+	c.rpc = pb.NewReceiverClient(c.conn)
+	return c, nil
+}
+
+func (c *Client) transportCredentials() (credentials.TransportCredentials, error) {
+	tlsConfig := c.tls
+	if c.caFile != "" {
+		ca, err := os.ReadFile(c.caFile)
+		if err != nil {
+			return nil, err
+		}
+		certPool := x509.NewCertPool()
+		if !certPool.AppendCertsFromPEM(ca) {
+			return nil, fmt.Errorf("no valid certificates found in %s", c.caFile)
+		}
+		if tlsConfig == nil {
+			tlsConfig = &tls.Config{}
+		}
+		tlsConfig = tlsConfig.Clone()
+		tlsConfig.RootCAs = certPool
+	}
+
+	if tlsConfig == nil {
+		return insecure.NewCredentials(), nil
+	}
+	return credentials.NewTLS(tlsConfig), nil
+}
+
+func (c *Client) Conn() *grpc.ClientConn {
+	return c.conn
+}
+
+func (c *Client) Close() error {
+	return c.conn.Close()
+}
+
+// OutgoingContext attaches the credentials and metadata sent with every call
+func (c *Client) OutgoingContext(ctx context.Context) context.Context {
+	pairs := c.metadata
+	if c.username != "" || c.password != "" {
+		pairs = append([]string{"username", c.username, "password", c.password}, pairs...)
+	}
+	if len(pairs) == 0 {
+		return ctx
+	}
+	return metadata.AppendToOutgoingContext(ctx, pairs...)
+}
+
+func (c *Client) UpdateMeasurements(ctx context.Context, msg *pb.MeasurementEnvelope, opts ...grpc.CallOption) (*pb.Reply, error) {
+	return c.call(ctx, func(ctx context.Context) (*pb.Reply, error) {
+		return c.rpc.UpdateMeasurements(ctx, msg, opts...)
+	})
+}
+
+func (c *Client) SyncMetric(ctx context.Context, req *pb.SyncReq, opts ...grpc.CallOption) (*pb.Reply, error) {
+	return c.call(ctx, func(ctx context.Context) (*pb.Reply, error) {
+		return c.rpc.SyncMetric(ctx, req, opts...)
+	})
+}
+
+func (c *Client) DefineMetrics(ctx context.Context, metrics *structpb.Struct, opts ...grpc.CallOption) (*pb.Reply, error) {
+	return c.call(ctx, func(ctx context.Context) (*pb.Reply, error) {
+		return c.rpc.DefineMetrics(ctx, metrics, opts...)
+	})
+}
+
+// Write sends msg, see NewEnvelope
+func (c *Client) Write(ctx context.Context, msg *pb.MeasurementEnvelope) error {
+	_, err := c.UpdateMeasurements(ctx, msg)
+	return err
+}
+
+func (c *Client) call(ctx context.Context, rpc func(context.Context) (*pb.Reply, error)) (*pb.Reply, error) {
+	ctx = c.OutgoingContext(ctx)
+	backoff := c.backoff
+	for attempt := 1; ; attempt++ {
+		reply, err := rpc(ctx)
+		if err == nil || attempt >= c.attempts || !Retryable(err) {
+			return reply, err
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, err
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+}
+
+// Retryable reports whether a call failing with err may succeed later
+func Retryable(err error) bool {
+	switch status.Code(err) {
+	case codes.Unavailable, codes.ResourceExhausted, codes.Aborted:
+		return true
+	}
+	return false
+}
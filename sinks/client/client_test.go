@@ -0,0 +1,199 @@
+package client
+
+import (
+	"context"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/destrex271/pgwatch3_rpc_server/sinks/pb"
+	testutils "github.com/destrex271/pgwatch3_rpc_server/sinks/test_utils"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+type fakeReceiver struct {
+	pb.UnimplementedReceiverServer
+
+	mu        sync.Mutex
+	envelopes []*pb.MeasurementEnvelope
+	metadata  []metadata.MD
+	// returned by the next calls
+	errs []error
+}
+
+func (r *fakeReceiver) UpdateMeasurements(ctx context.Context, msg *pb.MeasurementEnvelope) (*pb.Reply, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	md, _ := metadata.FromIncomingContext(ctx)
+	r.metadata = append(r.metadata, md)
+	if len(r.errs) > 0 {
+		err := r.errs[0]
+		r.errs = r.errs[1:]
+		return nil, err
+	}
+	r.envelopes = append(r.envelopes, msg)
+	return &pb.Reply{}, nil
+}
+
+func (r *fakeReceiver) SyncMetric(ctx context.Context, req *pb.SyncReq) (*pb.Reply, error) {
+	return &pb.Reply{Logmsg: req.GetDBName()}, nil
+}
+
+func (r *fakeReceiver) received() []*pb.MeasurementEnvelope {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.envelopes
+}
+
+func serve(t *testing.T) (*fakeReceiver, string) {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	receiver := &fakeReceiver{}
+	server := grpc.NewServer()
+	pb.RegisterReceiverServer(server, receiver)
+	go func() { _ = server.Serve(lis) }()
+	t.Cleanup(server.Stop)
+	return receiver, lis.Addr().String()
+}
+
+func TestClient(t *testing.T) {
+	receiver, address := serve(t)
+	c, err := New(address, WithCredentials("user", "pass"), WithMetadata("x-tenant", "acme"))
+	assert.NoError(t, err)
+	defer func() { _ = c.Close() }()
+
+	assert.NoError(t, c.Write(context.Background(), testutils.GetTestMeasurementEnvelope()))
+	assert.Len(t, receiver.received(), 1)
+	md := receiver.metadata[0]
+	assert.Equal(t, []string{"user"}, md.Get("username"))
+	assert.Equal(t, []string{"pass"}, md.Get("password"))
+	assert.Equal(t, []string{"acme"}, md.Get("x-tenant"))
+
+	reply, err := c.SyncMetric(context.Background(), testutils.GetTestRPCSyncRequest())
+	assert.NoError(t, err)
+	assert.Equal(t, "test_database", reply.GetLogmsg())
+
+	// no credentials, no metadata
+	c, err = New(address)
+	assert.NoError(t, err)
+	defer func() { _ = c.Close() }()
+	assert.NoError(t, c.Write(context.Background(), testutils.GetTestMeasurementEnvelope()))
+	assert.Empty(t, receiver.metadata[1].Get("username"))
+}
+
+func TestClient_Retry(t *testing.T) {
+	receiver, address := serve(t)
+	c, err := New(address, WithRetry(3, time.Millisecond))
+	assert.NoError(t, err)
+	defer func() { _ = c.Close() }()
+
+	unavailable := status.Error(codes.Unavailable, "overloaded")
+	receiver.errs = []error{unavailable, unavailable}
+	assert.NoError(t, c.Write(context.Background(), testutils.GetTestMeasurementEnvelope()))
+	assert.Len(t, receiver.metadata, 3)
+
+	receiver.errs = []error{unavailable, unavailable, unavailable}
+	assert.Equal(t, codes.Unavailable, status.Code(c.Write(context.Background(), testutils.GetTestMeasurementEnvelope())))
+	assert.Len(t, receiver.metadata, 6)
+
+	// invalid requests won't succeed later
+	receiver.errs = []error{status.Error(codes.InvalidArgument, "invalid")}
+	assert.Equal(t, codes.InvalidArgument, status.Code(c.Write(context.Background(), testutils.GetTestMeasurementEnvelope())))
+	assert.Len(t, receiver.metadata, 7)
+}
+
+func TestClient_CAFile(t *testing.T) {
+	_, err := New("localhost:1", WithCAFile(filepath.Join(t.TempDir(), "missing.crt")))
+	assert.Error(t, err)
+
+	caFile := filepath.Join(t.TempDir(), "ca.crt")
+	assert.NoError(t, os.WriteFile(caFile, []byte("not a certificate"), 0600))
+	_, err = New("localhost:1", WithCAFile(caFile))
+	assert.ErrorContains(t, err, "no valid certificates")
+}
+
+func TestNewEnvelope(t *testing.T) {
+	msg, err := NewEnvelope("db", "metric", map[string]string{"env": "prod"}, []map[string]any{
+		{"value": 1},
+		{"value": 2, "epoch_ns": 42},
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, "db", msg.GetDBName())
+	assert.Equal(t, "metric", msg.GetMetricName())
+	assert.Equal(t, "prod", msg.GetCustomTags()["env"])
+	assert.Len(t, msg.GetData(), 2)
+	assert.Greater(t, msg.GetData()[0].Fields["epoch_ns"].GetNumberValue(), float64(0))
+	assert.Equal(t, float64(42), msg.GetData()[1].Fields["epoch_ns"].GetNumberValue())
+
+	// rows don't share their timestamp value
+	msg, err = NewEnvelope("db", "metric", nil, []map[string]any{{"value": 1}, {"value": 2}})
+	assert.NoError(t, err)
+	assert.NotSame(t, msg.GetData()[0].Fields["epoch_ns"], msg.GetData()[1].Fields["epoch_ns"])
+
+	_, err = NewEnvelope("db", "metric", nil, []map[string]any{{"value": struct{}{}}})
+	assert.ErrorContains(t, err, "row 0")
+}
+
+func TestBatcher(t *testing.T) {
+	receiver, address := serve(t)
+	c, err := New(address)
+	assert.NoError(t, err)
+	defer func() { _ = c.Close() }()
+
+	b := NewBatcher(c, BatchOptions{MaxRows: 3, Interval: time.Hour})
+	row, _ := structpb.NewStruct(map[string]any{"value": 1})
+	add := func(db string) {
+		assert.NoError(t, b.Add(context.Background(), &pb.MeasurementEnvelope{DBName: db, MetricName: "metric", Data: []*structpb.Struct{row}}))
+	}
+
+	// rows of the same source and metric are merged
+	add("a")
+	add("b")
+	assert.Empty(t, receiver.received())
+	add("a")
+	received := receiver.received()
+	assert.Len(t, received, 2)
+	assert.Equal(t, "a", received[0].GetDBName())
+	assert.Len(t, received[0].GetData(), 2)
+	assert.Len(t, received[1].GetData(), 1)
+
+	// pending rows are sent on close
+	add("c")
+	assert.NoError(t, b.Close(context.Background()))
+	assert.Len(t, receiver.received(), 3)
+}
+
+func TestBatcher_Interval(t *testing.T) {
+	receiver, address := serve(t)
+	c, err := New(address)
+	assert.NoError(t, err)
+	defer func() { _ = c.Close() }()
+
+	failed := make(chan *pb.MeasurementEnvelope, 1)
+	b := NewBatcher(c, BatchOptions{Interval: 10 * time.Millisecond, OnError: func(msg *pb.MeasurementEnvelope, err error) {
+		failed <- msg
+	}})
+	defer func() { _ = b.Close(context.Background()) }()
+
+	receiver.mu.Lock()
+	receiver.errs = []error{status.Error(codes.Internal, "backend down")}
+	receiver.mu.Unlock()
+	assert.NoError(t, b.Add(context.Background(), testutils.GetTestMeasurementEnvelope()))
+	select {
+	case msg := <-failed:
+		assert.Equal(t, "test", msg.GetDBName())
+	case <-time.After(5 * time.Second):
+		t.Fatal("pending rows were not flushed")
+	}
+
+	assert.NoError(t, b.Add(context.Background(), testutils.GetTestMeasurementEnvelope()))
+	assert.Eventually(t, func() bool { return len(receiver.received()) == 1 }, 5*time.Second, 10*time.Millisecond)
+}
@@ -0,0 +1,34 @@
+package client
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/destrex271/pgwatch3_rpc_server/sinks/pb"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+// NewEnvelope converts rows to a measurement envelope. Like pgwatch,
+// rows are stamped with the current time in epoch_ns unless already set.
+// Values must be convertible by structpb.NewValue
+func NewEnvelope(dbName, metricName string, tags map[string]string, rows []map[string]any) (*pb.MeasurementEnvelope, error) {
+	msg := &pb.MeasurementEnvelope{
+		DBName:     dbName,
+		MetricName: metricName,
+		CustomTags: tags,
+		Data:       make([]*structpb.Struct, 0, len(rows)),
+	}
+
+	now := float64(time.Now().UnixNano())
+	for i, row := range rows {
+		st, err := structpb.NewStruct(row)
+		if err != nil {
+			return nil, fmt.Errorf("row %d: %w", i, err)
+		}
+		if _, ok := st.Fields["epoch_ns"]; !ok {
+			st.Fields["epoch_ns"] = structpb.NewNumberValue(now)
+		}
+		msg.Data = append(msg.Data, st)
+	}
+	return msg, nil
+}
@@ -16,7 +16,16 @@ func GetJson(value any) (string, error) {
 	return string(jsonString), nil
 }
 
+// IsValidMeasurement rejects empty envelopes and names
+// that can't be used as a file name, without any limits
 func IsValidMeasurement(msg *pb.MeasurementEnvelope) error {
+	if err := checkMeasurement(msg); err != nil {
+		return err
+	}
+	return (&ValidationLimits{}).Validate(msg)
+}
+
+func checkMeasurement(msg *pb.MeasurementEnvelope) error {
 	if msg.GetDBName() == "" {
 		return status.Error(codes.InvalidArgument, "empty database name")
 	}
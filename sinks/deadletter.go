@@ -0,0 +1,189 @@
+package sinks
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/destrex271/pgwatch3_rpc_server/sinks/pb"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+// if set, measurements receivers fail to persist are stored in this file
+var SERVER_DEADLETTER_FILE = os.Getenv("PGWATCH_RPC_SERVER_DEADLETTER_FILE")
+
+// DeadLetter is a measurement envelope, or a single row
+// of it, that a receiver failed to persist
+type DeadLetter struct {
+	Time     time.Time
+	Receiver string
+	Error    string
+	Envelope *pb.MeasurementEnvelope
+}
+
+// the envelope is stored protobuf encoded as rows that failed
+// JSON serialization in receivers (e.g. NaN values) would
+// fail again if the envelope was stored as JSON
+type deadLetterJSON struct {
+	Time     time.Time `json:"time"`
+	Receiver string    `json:"receiver"`
+	Error    string    `json:"error"`
+	Envelope []byte    `json:"envelope"`
+}
+
+func (dl *DeadLetter) MarshalJSON() ([]byte, error) {
+	envelope, err := proto.Marshal(dl.Envelope)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(deadLetterJSON{
+		Time:     dl.Time,
+		Receiver: dl.Receiver,
+		Error:    dl.Error,
+		Envelope: envelope,
+	})
+}
+
+func (dl *DeadLetter) UnmarshalJSON(data []byte) error {
+	var v deadLetterJSON
+	if err := json.Unmarshal(data, &v); err != nil {
+		return err
+	}
+	envelope := &pb.MeasurementEnvelope{}
+	if err := proto.Unmarshal(v.Envelope, envelope); err != nil {
+		return err
+	}
+	*dl = DeadLetter{
+		Time:     v.Time,
+		Receiver: v.Receiver,
+		Error:    v.Error,
+		Envelope: envelope,
+	}
+	return nil
+}
+
+// DeadLetterStore appends dead letters as JSON lines to a local file.
+//
+// The file is opened on every write, under LockDeadLetters, so it can
+// be renamed (e.g. by the deadletter command while re-driving it)
+// without restarting the receivers writing to it.
+type DeadLetterStore struct {
+	Path string
+}
+
+// serializes writes of all stores, receivers may
+// create several stores pointing to the same file
+var deadLetterMu sync.Mutex
+
+func NewDeadLetterStore(path string) *DeadLetterStore {
+	return &DeadLetterStore{Path: path}
+}
+
+func (s *DeadLetterStore) Append(dl *DeadLetter) error {
+	line, err := json.Marshal(dl)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	deadLetterMu.Lock()
+	defer deadLetterMu.Unlock()
+	unlock, err := LockDeadLetters(s.Path)
+	if err != nil {
+		return err
+	}
+	file, err := os.OpenFile(s.Path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return errors.Join(err, unlock())
+	}
+	_, err = file.Write(line)
+	return errors.Join(err, file.Close(), unlock())
+}
+
+// Add stores msg as failed to persist by receiver because of cause
+func (s *DeadLetterStore) Add(receiver string, msg *pb.MeasurementEnvelope, cause error) error {
+	return s.Append(&DeadLetter{
+		Time:     time.Now(),
+		Receiver: receiver,
+		Error:    cause.Error(),
+		Envelope: msg,
+	})
+}
+
+// ReadDeadLetters returns all dead letters stored in the file at path
+func ReadDeadLetters(path string) ([]*DeadLetter, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = file.Close() }()
+
+	var deadLetters []*DeadLetter
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 0, 64*1024), 64*1024*1024)
+	for scanner.Scan() {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		dl := &DeadLetter{}
+		if err := json.Unmarshal(scanner.Bytes(), dl); err != nil {
+			return deadLetters, err
+		}
+		deadLetters = append(deadLetters, dl)
+	}
+	return deadLetters, scanner.Err()
+}
+
+// AddDeadLetter logs that receiver failed to persist msg and stores
+// it in the store configured by PGWATCH_RPC_SERVER_DEADLETTER_FILE.
+// It reports whether msg was stored, receivers then acknowledge msg
+// as pgwatch retrying it would store it twice once re-driven
+func AddDeadLetter(receiver string, msg *pb.MeasurementEnvelope, cause error) bool {
+	deadLetterCount.Add(1)
+	log.Printf("[ERROR]: %s failed to persist %d measurement(s) for DBName %s MetricName %s: %s",
+		receiver, len(msg.GetData()), msg.GetDBName(), msg.GetMetricName(), cause)
+	if SERVER_DEADLETTER_FILE == "" {
+		return false
+	}
+
+	if err := NewDeadLetterStore(SERVER_DEADLETTER_FILE).Add(receiver, msg, cause); err != nil {
+		log.Printf("[ERROR]: Unable to store dead letter in %s: %s", SERVER_DEADLETTER_FILE, err)
+		return false
+	}
+	return true
+}
+
+// AddDeadLetterRow is AddDeadLetter for a single row of msg
+func AddDeadLetterRow(receiver string, msg *pb.MeasurementEnvelope, row *structpb.Struct, cause error) bool {
+	return AddDeadLetterRows(receiver, msg, []*structpb.Struct{row}, cause)
+}
+
+// AddDeadLetterRows is AddDeadLetter for some rows of msg,
+// e.g. those not written once a write failed
+func AddDeadLetterRows(receiver string, msg *pb.MeasurementEnvelope, rows []*structpb.Struct, cause error) bool {
+	return AddDeadLetter(receiver, &pb.MeasurementEnvelope{
+		DBName:     msg.GetDBName(),
+		MetricName: msg.GetMetricName(),
+		CustomTags: msg.GetCustomTags(),
+		Data:       rows,
+	}, cause)
+}
+
+const deadLetteredPrefix = "dead-lettered: "
+
+// DeadLetteredReply acknowledges an envelope stored as dead letter
+func DeadLetteredReply(cause error) *pb.Reply {
+	return &pb.Reply{Logmsg: deadLetteredPrefix + cause.Error()}
+}
+
+// IsDeadLettered reports whether reply acknowledged an envelope stored as
+// dead letter rather than written, see DeadLetteredReply
+func IsDeadLettered(reply *pb.Reply) bool {
+	return strings.HasPrefix(reply.GetLogmsg(), deadLetteredPrefix)
+}
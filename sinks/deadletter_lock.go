@@ -0,0 +1,25 @@
+//go:build unix
+
+package sinks
+
+import (
+	"errors"
+	"os"
+	"syscall"
+)
+
+// LockDeadLetters takes an exclusive lock on the dead-letter file at
+// path, shared by all processes through path.lock, so that the file
+// isn't moved while a dead letter is being appended to it
+func LockDeadLetters(path string) (unlock func() error, err error) {
+	file, err := os.OpenFile(path+".lock", os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, err
+	}
+	if err := syscall.Flock(int(file.Fd()), syscall.LOCK_EX); err != nil {
+		return nil, errors.Join(err, file.Close())
+	}
+	return func() error {
+		return errors.Join(syscall.Flock(int(file.Fd()), syscall.LOCK_UN), file.Close())
+	}, nil
+}
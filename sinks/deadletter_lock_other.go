@@ -0,0 +1,9 @@
+//go:build !unix
+
+package sinks
+
+// LockDeadLetters does nothing, dead-letter files must not
+// be re-driven while receivers are appending to them
+func LockDeadLetters(path string) (unlock func() error, err error) {
+	return func() error { return nil }, nil
+}
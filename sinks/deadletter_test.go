@@ -0,0 +1,70 @@
+package sinks
+
+import (
+	"errors"
+	"math"
+	"path/filepath"
+	"testing"
+
+	"github.com/destrex271/pgwatch3_rpc_server/sinks/pb"
+	testutils "github.com/destrex271/pgwatch3_rpc_server/sinks/test_utils"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+func TestDeadLetterStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "deadletters.jsonl")
+	store := NewDeadLetterStore(path)
+
+	msg := testutils.GetTestMeasurementEnvelope()
+	assert.NoError(t, store.Add("csv_receiver", msg, errors.New("disk full")))
+
+	// rows that can't be serialized to JSON must survive the round trip
+	msg2 := testutils.GetTestMeasurementEnvelope()
+	msg2.Data = []*structpb.Struct{{Fields: map[string]*structpb.Value{"value": structpb.NewNumberValue(math.NaN())}}}
+	assert.NoError(t, store.Add("clickhouse_receiver", msg2, errors.New("json: unsupported value: NaN")))
+
+	deadLetters, err := ReadDeadLetters(path)
+	assert.NoError(t, err)
+	assert.Len(t, deadLetters, 2)
+
+	assert.Equal(t, "csv_receiver", deadLetters[0].Receiver)
+	assert.Equal(t, "disk full", deadLetters[0].Error)
+	assert.True(t, proto.Equal(msg, deadLetters[0].Envelope))
+	assert.False(t, deadLetters[0].Time.IsZero())
+
+	assert.Equal(t, "clickhouse_receiver", deadLetters[1].Receiver)
+	assert.True(t, math.IsNaN(deadLetters[1].Envelope.GetData()[0].GetFields()["value"].GetNumberValue()))
+}
+
+func TestAddDeadLetterRow(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "deadletters.jsonl")
+	SERVER_DEADLETTER_FILE = path
+	defer func() { SERVER_DEADLETTER_FILE = "" }()
+
+	row1, _ := structpb.NewStruct(map[string]any{"row": 1})
+	row2, _ := structpb.NewStruct(map[string]any{"row": 2})
+	msg := &pb.MeasurementEnvelope{
+		DBName:     "test",
+		MetricName: "testMetric",
+		CustomTags: map[string]string{"tagName": "tagValue"},
+		Data:       []*structpb.Struct{row1, row2},
+	}
+	assert.True(t, AddDeadLetterRow("duckdb_receiver", msg, row2, errors.New("insert failed")))
+
+	deadLetters, err := ReadDeadLetters(path)
+	assert.NoError(t, err)
+	assert.Len(t, deadLetters, 1)
+	assert.Equal(t, "test", deadLetters[0].Envelope.GetDBName())
+	assert.Equal(t, msg.GetCustomTags(), deadLetters[0].Envelope.GetCustomTags())
+	assert.Len(t, deadLetters[0].Envelope.GetData(), 1)
+	assert.True(t, proto.Equal(row2, deadLetters[0].Envelope.GetData()[0]))
+
+	// no file configured, only logged
+	SERVER_DEADLETTER_FILE = ""
+	assert.False(t, AddDeadLetter("duckdb_receiver", msg, errors.New("insert failed")))
+	deadLetters, err = ReadDeadLetters(path)
+	assert.NoError(t, err)
+	assert.Len(t, deadLetters, 1)
+}
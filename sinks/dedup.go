@@ -0,0 +1,231 @@
+package sinks
+
+import (
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"os"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/destrex271/pgwatch3_rpc_server/sinks/pb"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+// if set, envelopes already written within this window, e.g. "10m",
+// are acknowledged without reaching the receiver again
+var SERVER_DEDUP_WINDOW = os.Getenv("PGWATCH_RPC_SERVER_DEDUP_WINDOW")
+
+// max number of envelope hashes remembered, defaults to 100000
+var SERVER_DEDUP_MAX_ENTRIES = os.Getenv("PGWATCH_RPC_SERVER_DEDUP_MAX_ENTRIES")
+
+const defaultDedupMaxEntries = 100000
+
+// hex encoded length of hashes, 128 bits are plenty to avoid collisions
+// while staying usable as ES document IDs, S3 object keys or Kafka keys
+const hashLength = 32
+
+var deterministic = proto.MarshalOptions{Deterministic: true}
+
+// EnvelopeHash returns a stable content hash of msg: source,
+// metric, custom tags and every row, timestamps included
+func EnvelopeHash(msg *pb.MeasurementEnvelope) string {
+	h := sha256.New()
+	writeEnvelopeHeader(h, msg)
+	for _, row := range msg.GetData() {
+		writeRow(h, row)
+	}
+	return hex.EncodeToString(h.Sum(nil))[:hashLength]
+}
+
+// RowID returns a deterministic ID for row of msg, the same row
+// sent again, e.g. on retries, always gets the same ID
+func RowID(msg *pb.MeasurementEnvelope, row *structpb.Struct) string {
+	h := sha256.New()
+	writeEnvelopeHeader(h, msg)
+	writeRow(h, row)
+	return hex.EncodeToString(h.Sum(nil))[:hashLength]
+}
+
+// RowIDs returns the RowID of every row of msg
+func RowIDs(msg *pb.MeasurementEnvelope) []string {
+	ids := make([]string, 0, len(msg.GetData()))
+	for _, row := range msg.GetData() {
+		ids = append(ids, RowID(msg, row))
+	}
+	return ids
+}
+
+// values are length prefixed so that
+// e.g. ("ab", "c") and ("a", "bc") differ
+func writeField(h hash.Hash, value []byte) {
+	_, _ = fmt.Fprintf(h, "%d:", len(value))
+	_, _ = h.Write(value)
+}
+
+func writeEnvelopeHeader(h hash.Hash, msg *pb.MeasurementEnvelope) {
+	writeField(h, []byte(msg.GetDBName()))
+	writeField(h, []byte(msg.GetMetricName()))
+
+	keys := make([]string, 0, len(msg.GetCustomTags()))
+	for key := range msg.GetCustomTags() {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+	writeField(h, []byte(strconv.Itoa(len(keys))))
+	for _, key := range keys {
+		writeField(h, []byte(key))
+		writeField(h, []byte(msg.GetCustomTags()[key]))
+	}
+}
+
+func writeRow(h hash.Hash, row *structpb.Struct) {
+	// map entries are sorted by key when marshalling deterministically
+	data, _ := deterministic.Marshal(row)
+	writeField(h, data)
+}
+
+// Deduplicator remembers keys for a time window,
+// evicting the oldest ones past maxEntries
+type Deduplicator struct {
+	window     time.Duration
+	maxEntries int
+
+	mu      sync.Mutex
+	entries map[string]*list.Element
+	// oldest first
+	order *list.List
+	// keys reserved while their envelope is being written
+	reserved map[string]struct{}
+}
+
+type dedupEntry struct {
+	key  string
+	seen time.Time
+}
+
+func NewDeduplicator(window time.Duration, maxEntries int) *Deduplicator {
+	return &Deduplicator{
+		window:     window,
+		maxEntries: maxEntries,
+		entries:    map[string]*list.Element{},
+		order:      list.New(),
+		reserved:   map[string]struct{}{},
+	}
+}
+
+// Seen reports whether key was added within the window
+func (d *Deduplicator) Seen(key string) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.evict(time.Now())
+	_, ok := d.entries[key]
+	return ok
+}
+
+// Reserve atomically checks that key was neither added within the
+// window nor is already reserved, and reserves it until Release
+func (d *Deduplicator) Reserve(key string) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.evict(time.Now())
+	if _, ok := d.entries[key]; ok {
+		return false
+	}
+	if _, ok := d.reserved[key]; ok {
+		return false
+	}
+	d.reserved[key] = struct{}{}
+	return true
+}
+
+// Release releases a reserved key, adding it if its envelope was written
+func (d *Deduplicator) Release(key string, written bool) {
+	d.mu.Lock()
+	delete(d.reserved, key)
+	d.mu.Unlock()
+	if written {
+		d.Add(key)
+	}
+}
+
+// Add remembers key for the window
+func (d *Deduplicator) Add(key string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	now := time.Now()
+	if elem, ok := d.entries[key]; ok {
+		d.order.Remove(elem)
+	}
+	d.entries[key] = d.order.PushBack(&dedupEntry{key: key, seen: now})
+	d.evict(now)
+}
+
+func (d *Deduplicator) Len() int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.order.Len()
+}
+
+func (d *Deduplicator) evict(now time.Time) {
+	for front := d.order.Front(); front != nil; front = d.order.Front() {
+		entry := front.Value.(*dedupEntry)
+		if now.Sub(entry.seen) < d.window && d.order.Len() <= d.maxEntries {
+			return
+		}
+		d.order.Remove(front)
+		delete(d.entries, entry.key)
+	}
+}
+
+// UnaryInterceptor acknowledges envelopes already written within the
+// window without calling the receiver. Envelopes are only remembered
+// once written successfully, so retries of failed writes go through.
+// Identical envelopes arriving while one is being written are answered
+// with Unavailable, to be retried once the outcome of the write is known
+func (d *Deduplicator) UnaryInterceptor(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+	msg, ok := req.(*pb.MeasurementEnvelope)
+	if !ok {
+		return handler(ctx, req)
+	}
+
+	// tenants sending the same envelope aren't duplicates
+	key := TenantPrefix(ctx, "/") + EnvelopeHash(msg)
+	if !d.Reserve(key) {
+		if d.Seen(key) {
+			return &pb.Reply{Logmsg: "duplicate envelope ignored"}, nil
+		}
+		return nil, status.Error(codes.Unavailable, "identical envelope being written, retry later")
+	}
+
+	reply, err := handler(ctx, req)
+	d.Release(key, err == nil)
+	return reply, err
+}
+
+// NewDeduplicatorFromEnv returns nil if PGWATCH_RPC_SERVER_DEDUP_WINDOW isn't set
+func NewDeduplicatorFromEnv() (*Deduplicator, error) {
+	window, err := parseDurationEnv("PGWATCH_RPC_SERVER_DEDUP_WINDOW", SERVER_DEDUP_WINDOW)
+	if err != nil || window == 0 {
+		return nil, err
+	}
+
+	maxEntries := defaultDedupMaxEntries
+	if SERVER_DEDUP_MAX_ENTRIES != "" {
+		maxEntries, err = strconv.Atoi(SERVER_DEDUP_MAX_ENTRIES)
+		if err != nil || maxEntries <= 0 {
+			return nil, fmt.Errorf("invalid PGWATCH_RPC_SERVER_DEDUP_MAX_ENTRIES: %q", SERVER_DEDUP_MAX_ENTRIES)
+		}
+	}
+	return NewDeduplicator(window, maxEntries), nil
+}
@@ -0,0 +1,134 @@
+package sinks
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/destrex271/pgwatch3_rpc_server/sinks/pb"
+	testutils "github.com/destrex271/pgwatch3_rpc_server/sinks/test_utils"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+func TestEnvelopeHash(t *testing.T) {
+	generator, err := testutils.NewGenerator(testutils.GeneratorOptions{Seed: 1})
+	assert.NoError(t, err)
+	msg := generator.Next()
+
+	// same content, same hash, whatever the map ordering
+	clone := proto.Clone(msg).(*pb.MeasurementEnvelope)
+	assert.Equal(t, EnvelopeHash(msg), EnvelopeHash(clone))
+	assert.Equal(t, RowIDs(msg), RowIDs(clone))
+	assert.Len(t, EnvelopeHash(msg), 32)
+
+	clone.CustomTags = map[string]string{"tag": "other"}
+	assert.NotEqual(t, EnvelopeHash(msg), EnvelopeHash(clone))
+	assert.NotEqual(t, RowIDs(msg), RowIDs(clone))
+
+	clone = proto.Clone(msg).(*pb.MeasurementEnvelope)
+	clone.Data[0].Fields["epoch_ns"] = structpb.NewNumberValue(0)
+	assert.NotEqual(t, EnvelopeHash(msg), EnvelopeHash(clone))
+	assert.NotEqual(t, RowIDs(msg)[0], RowIDs(clone)[0])
+	assert.Equal(t, RowIDs(msg)[1:], RowIDs(clone)[1:])
+
+	// fields don't run into each other
+	a := &pb.MeasurementEnvelope{DBName: "ab", MetricName: "c"}
+	b := &pb.MeasurementEnvelope{DBName: "a", MetricName: "bc"}
+	assert.NotEqual(t, EnvelopeHash(a), EnvelopeHash(b))
+}
+
+func TestDeduplicator(t *testing.T) {
+	d := NewDeduplicator(50*time.Millisecond, 2)
+	assert.False(t, d.Seen("a"))
+
+	d.Add("a")
+	assert.True(t, d.Seen("a"))
+
+	// oldest entries are evicted past maxEntries
+	d.Add("b")
+	d.Add("c")
+	assert.False(t, d.Seen("a"))
+	assert.True(t, d.Seen("b"))
+	assert.Equal(t, 2, d.Len())
+
+	// and once outside of the window
+	time.Sleep(60 * time.Millisecond)
+	assert.False(t, d.Seen("c"))
+	assert.Equal(t, 0, d.Len())
+}
+
+func TestDeduplicator_UnaryInterceptor(t *testing.T) {
+	d := NewDeduplicator(time.Minute, 100)
+	calls := 0
+	var handlerErr error
+	handler := func(ctx context.Context, req any) (any, error) {
+		calls++
+		return &pb.Reply{}, handlerErr
+	}
+	call := func(req any) (any, error) {
+		return d.UnaryInterceptor(context.Background(), req, &grpc.UnaryServerInfo{}, handler)
+	}
+
+	// failed writes are not remembered, so retries go through
+	handlerErr = errors.New("backend down")
+	_, err := call(testutils.GetTestMeasurementEnvelope())
+	assert.Error(t, err)
+	handlerErr = nil
+
+	_, err = call(testutils.GetTestMeasurementEnvelope())
+	assert.NoError(t, err)
+	reply, err := call(testutils.GetTestMeasurementEnvelope())
+	assert.NoError(t, err)
+	assert.Equal(t, "duplicate envelope ignored", reply.(*pb.Reply).GetLogmsg())
+	assert.Equal(t, 2, calls)
+
+	// other requests are never suppressed
+	_, _ = call(testutils.GetTestRPCSyncRequest())
+	_, _ = call(testutils.GetTestRPCSyncRequest())
+	assert.Equal(t, 4, calls)
+
+	// identical envelopes aren't written concurrently
+	msg := testutils.GetTestMeasurementEnvelope()
+	msg.DBName = "concurrent"
+	writing, release := make(chan struct{}), make(chan struct{})
+	done := make(chan error, 1)
+	go func() {
+		_, err := d.UnaryInterceptor(context.Background(), msg, &grpc.UnaryServerInfo{}, func(ctx context.Context, req any) (any, error) {
+			close(writing)
+			<-release
+			return nil, errors.New("backend down")
+		})
+		done <- err
+	}()
+	<-writing
+	_, err = call(proto.Clone(msg))
+	assert.Equal(t, codes.Unavailable, status.Code(err))
+	close(release)
+	assert.Error(t, <-done)
+	// the key is released once the write failed
+	_, err = call(proto.Clone(msg))
+	assert.NoError(t, err)
+	assert.Equal(t, 5, calls)
+}
+
+func TestNewDeduplicatorFromEnv(t *testing.T) {
+	d, err := NewDeduplicatorFromEnv()
+	assert.NoError(t, err)
+	assert.Nil(t, d)
+
+	SERVER_DEDUP_WINDOW = "10m"
+	defer func() { SERVER_DEDUP_WINDOW, SERVER_DEDUP_MAX_ENTRIES = "", "" }()
+	d, err = NewDeduplicatorFromEnv()
+	assert.NoError(t, err)
+	assert.Equal(t, defaultDedupMaxEntries, d.maxEntries)
+
+	SERVER_DEDUP_MAX_ENTRIES = "0"
+	_, err = NewDeduplicatorFromEnv()
+	assert.Error(t, err)
+}
@@ -0,0 +1,279 @@
+package sinks
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/destrex271/pgwatch3_rpc_server/sinks/pb"
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+// if set, an HTTP/JSON endpoint is served on this port next to gRPC
+var SERVER_HTTP_PORT = os.Getenv("PGWATCH_RPC_SERVER_HTTP_PORT")
+
+// HTTP paths served by HTTPHandler, each accepts a POST of a
+// JSON encoded request or of NDJSON with one request per line
+const (
+	HTTPMeasurementsPath = "/v1/measurements"
+	HTTPSyncPath         = "/v1/sync"
+	HTTPMetricsPath      = "/v1/metrics"
+)
+
+// how long clients have to send the request headers, so
+// that idle connections can't hold on to the server
+const httpReadHeaderTimeout = 10 * time.Second
+
+type httpMethod struct {
+	fullMethod string
+	newRequest func() proto.Message
+	call       func(ctx context.Context, receiver pb.ReceiverServer, req any) (*pb.Reply, error)
+}
+
+var httpMethods = map[string]httpMethod{
+	HTTPMeasurementsPath: {
+		fullMethod: pb.Receiver_UpdateMeasurements_FullMethodName,
+		newRequest: func() proto.Message { return &pb.MeasurementEnvelope{} },
+		call: func(ctx context.Context, receiver pb.ReceiverServer, req any) (*pb.Reply, error) {
+			return receiver.UpdateMeasurements(ctx, req.(*pb.MeasurementEnvelope))
+		},
+	},
+	HTTPSyncPath: {
+		fullMethod: pb.Receiver_SyncMetric_FullMethodName,
+		newRequest: func() proto.Message { return &pb.SyncReq{} },
+		call: func(ctx context.Context, receiver pb.ReceiverServer, req any) (*pb.Reply, error) {
+			return receiver.SyncMetric(ctx, req.(*pb.SyncReq))
+		},
+	},
+	HTTPMetricsPath: {
+		fullMethod: pb.Receiver_DefineMetrics_FullMethodName,
+		newRequest: func() proto.Message { return &structpb.Struct{} },
+		call: func(ctx context.Context, receiver pb.ReceiverServer, req any) (*pb.Reply, error) {
+			return receiver.DefineMetrics(ctx, req.(*structpb.Struct))
+		},
+	},
+}
+
+// HTTPHandler accepts JSON encoded gRPC requests and dispatches them
+// to the receiver through the same interceptors as the gRPC server.
+//
+// Auth credentials are read from the `username` and `password`
+// headers, the same metadata keys pgwatch uses, or from HTTP basic auth.
+type HTTPHandler struct {
+	receiver    pb.ReceiverServer
+	interceptor grpc.UnaryServerInterceptor
+	// applies to the whole body of JSON requests
+	// and to every line of NDJSON requests
+	MaxMessageSize int
+}
+
+func NewHTTPHandler(receiver pb.ReceiverServer, interceptors ...grpc.UnaryServerInterceptor) *HTTPHandler {
+	return &HTTPHandler{
+		receiver:       receiver,
+		interceptor:    ChainUnaryInterceptors(interceptors...),
+		MaxMessageSize: defaultMaxRecvSize,
+	}
+}
+
+func (h *HTTPHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	method, ok := httpMethods[r.URL.Path]
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		writeHTTPStatus(w, http.StatusMethodNotAllowed, status.Error(codes.Unimplemented, "only POST is supported"))
+		return
+	}
+
+	ctx := metadata.NewIncomingContext(r.Context(), httpMetadata(r))
+	info := &grpc.UnaryServerInfo{Server: h.receiver, FullMethod: method.fullMethod}
+	handler := func(ctx context.Context, req any) (any, error) {
+		return method.call(ctx, h.receiver, req)
+	}
+
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if mediaType == "application/x-ndjson" {
+		h.serveNDJSON(ctx, w, r.Body, method, info, handler)
+		return
+	}
+
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, int64(h.MaxMessageSize)))
+	if err != nil {
+		writeHTTPError(w, status.Error(codes.ResourceExhausted, err.Error()))
+		return
+	}
+
+	req := method.newRequest()
+	if err := protojson.Unmarshal(body, req); err != nil {
+		writeHTTPError(w, status.Error(codes.InvalidArgument, err.Error()))
+		return
+	}
+
+	reply, err := h.interceptor(ctx, req, info, handler)
+	if err != nil {
+		writeHTTPError(w, err)
+		return
+	}
+	writeHTTPReply(w, reply)
+}
+
+// serveNDJSON dispatches one request per line and stops at the first
+// failing one, the error reports how many requests were accepted
+func (h *HTTPHandler) serveNDJSON(ctx context.Context, w http.ResponseWriter, body io.Reader, method httpMethod, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) {
+	scanner := bufio.NewScanner(body)
+	scanner.Buffer(make([]byte, 0, 64*1024), h.MaxMessageSize)
+
+	accepted, line := 0, 0
+	for scanner.Scan() {
+		line++
+		if len(strings.TrimSpace(scanner.Text())) == 0 {
+			continue
+		}
+
+		req := method.newRequest()
+		err := protojson.Unmarshal(scanner.Bytes(), req)
+		if err != nil {
+			err = status.Error(codes.InvalidArgument, err.Error())
+		} else {
+			_, err = h.interceptor(ctx, req, info, handler)
+		}
+		if err != nil {
+			st := status.Convert(err)
+			writeHTTPError(w, status.Errorf(st.Code(), "line %d (%d accepted): %s", line, accepted, st.Message()))
+			return
+		}
+		accepted++
+	}
+	if err := scanner.Err(); err != nil {
+		writeHTTPError(w, status.Errorf(codes.InvalidArgument, "line %d (%d accepted): %s", line+1, accepted, err))
+		return
+	}
+	writeHTTPReply(w, &pb.Reply{Logmsg: fmt.Sprintf("%d requests accepted", accepted)})
+}
+
+func httpMetadata(r *http.Request) metadata.MD {
+	md := metadata.MD{}
+	for key, values := range r.Header {
+		md.Append(strings.ToLower(key), values...)
+	}
+	if username, password, ok := r.BasicAuth(); ok {
+		md.Set("username", username)
+		md.Set("password", password)
+	}
+	return md
+}
+
+func writeHTTPReply(w http.ResponseWriter, reply any) {
+	msg, ok := reply.(*pb.Reply)
+	if !ok || msg == nil {
+		msg = &pb.Reply{}
+	}
+	body, err := protojson.Marshal(msg)
+	if err != nil {
+		writeHTTPError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_, _ = w.Write(body)
+}
+
+func writeHTTPError(w http.ResponseWriter, err error) {
+	writeHTTPStatus(w, httpStatusFromCode(status.Code(err)), err)
+}
+
+// writeHTTPStatus writes the status of err with an explicit HTTP status code
+func writeHTTPStatus(w http.ResponseWriter, code int, err error) {
+	body, _ := protojson.Marshal(status.Convert(err).Proto())
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	_, _ = w.Write(body)
+}
+
+func httpStatusFromCode(code codes.Code) int {
+	switch code {
+	case codes.OK:
+		return http.StatusOK
+	case codes.InvalidArgument, codes.OutOfRange, codes.FailedPrecondition:
+		return http.StatusBadRequest
+	case codes.Unauthenticated:
+		return http.StatusUnauthorized
+	case codes.PermissionDenied:
+		return http.StatusForbidden
+	case codes.NotFound:
+		return http.StatusNotFound
+	case codes.AlreadyExists, codes.Aborted:
+		return http.StatusConflict
+	case codes.ResourceExhausted:
+		return http.StatusTooManyRequests
+	case codes.Canceled:
+		return 499 // client closed request
+	case codes.Unimplemented:
+		return http.StatusNotImplemented
+	case codes.Unavailable:
+		return http.StatusServiceUnavailable
+	case codes.DeadlineExceeded:
+		return http.StatusGatewayTimeout
+	}
+	return http.StatusInternalServerError
+}
+
+// ListenAndServeHTTP serves the HTTP/JSON endpoint on port of the bind
+// address, using TLS if a valid cert/key pair is configured
+func ListenAndServeHTTP(receiver pb.ReceiverServer, port string, interceptors ...grpc.UnaryServerInterceptor) error {
+	lis, err := net.Listen("tcp", net.JoinHostPort(bindAddress(), port))
+	if err != nil {
+		return err
+	}
+
+	maxMessageSize, err := serverMaxRecvSize()
+	if err != nil {
+		return err
+	}
+	handler := NewHTTPHandler(receiver, interceptors...)
+	handler.MaxMessageSize = maxMessageSize
+
+	server := &http.Server{
+		Handler: otelhttp.NewHandler(handler, "HTTPHandler", otelhttp.WithSpanNameFormatter(
+			func(_ string, r *http.Request) string { return r.Method + " " + r.URL.Path },
+		)),
+		TLSConfig:         LoadTLSConfig(),
+		ReadHeaderTimeout: httpReadHeaderTimeout,
+	}
+	log.Println("[INFO]: Serving HTTP/JSON endpoint on port " + port)
+	if server.TLSConfig != nil {
+		return server.ServeTLS(lis, "", "")
+	}
+	return server.Serve(lis)
+}
+
+// ChainUnaryInterceptors creates a single interceptor out of
+// interceptors, the first one being the outermost
+func ChainUnaryInterceptors(interceptors ...grpc.UnaryServerInterceptor) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+		next := handler
+		for i := len(interceptors) - 1; i >= 0; i-- {
+			interceptor, inner := interceptors[i], next
+			next = func(ctx context.Context, req any) (any, error) {
+				return interceptor(ctx, req, info, inner)
+			}
+		}
+		return next(ctx, req)
+	}
+}
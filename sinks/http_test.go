@@ -0,0 +1,166 @@
+package sinks
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/destrex271/pgwatch3_rpc_server/sinks/pb"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+type httpTestSink struct {
+	received []*pb.MeasurementEnvelope
+	synced   []*pb.SyncReq
+	pb.UnimplementedReceiverServer
+}
+
+func (s *httpTestSink) UpdateMeasurements(ctx context.Context, msg *pb.MeasurementEnvelope) (*pb.Reply, error) {
+	s.received = append(s.received, msg)
+	return &pb.Reply{Logmsg: "Measurements Updated"}, nil
+}
+
+func (s *httpTestSink) SyncMetric(ctx context.Context, req *pb.SyncReq) (*pb.Reply, error) {
+	s.synced = append(s.synced, req)
+	return &pb.Reply{Logmsg: "Synced"}, nil
+}
+
+const testEnvelopeJSON = `{"DBName": "test", "MetricName": "testMetric", "CustomTags": {"tagName": "tagValue"}, "Data": [{"key": "val"}]}`
+
+func postHTTP(t *testing.T, server *httptest.Server, path, contentType, body string, header http.Header) (int, map[string]any) {
+	req, err := http.NewRequest(http.MethodPost, server.URL+path, strings.NewReader(body))
+	assert.NoError(t, err)
+	req.Header.Set("Content-Type", contentType)
+	for k, v := range header {
+		req.Header[k] = v
+	}
+
+	resp, err := server.Client().Do(req)
+	assert.NoError(t, err)
+	defer func() { _ = resp.Body.Close() }()
+
+	data, err := io.ReadAll(resp.Body)
+	assert.NoError(t, err)
+	reply := map[string]any{}
+	assert.NoError(t, json.Unmarshal(data, &reply))
+	return resp.StatusCode, reply
+}
+
+func TestHTTPHandler(t *testing.T) {
+	sink := &httpTestSink{}
+	server := httptest.NewServer(NewHTTPHandler(sink, MsgValidationInterceptor))
+	defer server.Close()
+
+	code, reply := postHTTP(t, server, HTTPMeasurementsPath, "application/json", testEnvelopeJSON, nil)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, "Measurements Updated", reply["logmsg"])
+	assert.Len(t, sink.received, 1)
+	assert.Equal(t, "test", sink.received[0].GetDBName())
+	assert.Equal(t, "tagValue", sink.received[0].GetCustomTags()["tagName"])
+	assert.Equal(t, "val", sink.received[0].GetData()[0].AsMap()["key"])
+
+	code, _ = postHTTP(t, server, HTTPSyncPath, "application/json", `{"DBName": "test", "Operation": "AddOp"}`, nil)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, pb.SyncOp_AddOp, sink.synced[0].GetOperation())
+
+	// goes through the validation interceptor
+	code, reply = postHTTP(t, server, HTTPMeasurementsPath, "application/json", `{"MetricName": "testMetric"}`, nil)
+	assert.Equal(t, http.StatusBadRequest, code)
+	assert.Equal(t, "empty database name", reply["message"])
+
+	code, _ = postHTTP(t, server, HTTPMeasurementsPath, "application/json", `not json`, nil)
+	assert.Equal(t, http.StatusBadRequest, code)
+
+	// not implemented by the receiver
+	code, _ = postHTTP(t, server, HTTPMetricsPath, "application/json", `{}`, nil)
+	assert.Equal(t, http.StatusNotImplemented, code)
+
+	resp, err := server.Client().Get(server.URL + HTTPMeasurementsPath)
+	assert.NoError(t, err)
+	_ = resp.Body.Close()
+	assert.Equal(t, http.StatusMethodNotAllowed, resp.StatusCode)
+	assert.Equal(t, http.MethodPost, resp.Header.Get("Allow"))
+
+	resp, err = server.Client().Post(server.URL+"/unknown", "application/json", strings.NewReader(testEnvelopeJSON))
+	assert.NoError(t, err)
+	_ = resp.Body.Close()
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+}
+
+func TestHTTPHandler_NDJSON(t *testing.T) {
+	sink := &httpTestSink{}
+	server := httptest.NewServer(NewHTTPHandler(sink, MsgValidationInterceptor))
+	defer server.Close()
+
+	body := testEnvelopeJSON + "\n\n" + testEnvelopeJSON + "\n"
+	code, reply := postHTTP(t, server, HTTPMeasurementsPath, "application/x-ndjson", body, nil)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, "2 requests accepted", reply["logmsg"])
+	assert.Len(t, sink.received, 2)
+
+	body = testEnvelopeJSON + "\n" + `{"DBName": "test"}` + "\n" + testEnvelopeJSON
+	code, reply = postHTTP(t, server, HTTPMeasurementsPath, "application/x-ndjson", body, nil)
+	assert.Equal(t, http.StatusBadRequest, code)
+	assert.Equal(t, "line 2 (1 accepted): empty metric name", reply["message"])
+	assert.Len(t, sink.received, 3)
+}
+
+func TestHTTPHandler_Auth(t *testing.T) {
+	SERVER_USERNAME, SERVER_PASSWORD = "username", "password"
+	defer func() { SERVER_USERNAME, SERVER_PASSWORD = "", "" }()
+
+	sink := &httpTestSink{}
+	server := httptest.NewServer(NewHTTPHandler(sink, AuthInterceptor, MsgValidationInterceptor))
+	defer server.Close()
+
+	code, _ := postHTTP(t, server, HTTPMeasurementsPath, "application/json", testEnvelopeJSON, nil)
+	assert.Equal(t, http.StatusUnauthorized, code)
+
+	header := http.Header{"Username": {"username"}, "Password": {"password"}}
+	code, _ = postHTTP(t, server, HTTPMeasurementsPath, "application/json", testEnvelopeJSON, header)
+	assert.Equal(t, http.StatusOK, code)
+
+	basic := httptest.NewRequest(http.MethodPost, "/", nil)
+	basic.SetBasicAuth("username", "wrong")
+	code, _ = postHTTP(t, server, HTTPMeasurementsPath, "application/json", testEnvelopeJSON, basic.Header)
+	assert.Equal(t, http.StatusUnauthorized, code)
+
+	basic.SetBasicAuth("username", "password")
+	code, _ = postHTTP(t, server, HTTPMeasurementsPath, "application/json", testEnvelopeJSON, basic.Header)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Len(t, sink.received, 2)
+}
+
+func TestChainUnaryInterceptors(t *testing.T) {
+	var calls []string
+	interceptor := func(name string) grpc.UnaryServerInterceptor {
+		return func(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+			calls = append(calls, name)
+			return handler(ctx, req)
+		}
+	}
+	reject := func(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+		return nil, status.Error(codes.PermissionDenied, "rejected")
+	}
+	handler := func(ctx context.Context, req any) (any, error) {
+		calls = append(calls, "handler")
+		return req, nil
+	}
+
+	resp, err := ChainUnaryInterceptors(interceptor("first"), interceptor("second"))(context.Background(), "req", &grpc.UnaryServerInfo{}, handler)
+	assert.NoError(t, err)
+	assert.Equal(t, "req", resp)
+	assert.Equal(t, []string{"first", "second", "handler"}, calls)
+
+	calls = nil
+	_, err = ChainUnaryInterceptors(interceptor("first"), reject, interceptor("second"))(context.Background(), "req", &grpc.UnaryServerInfo{}, handler)
+	assert.Equal(t, codes.PermissionDenied, status.Code(err))
+	assert.Equal(t, []string{"first"}, calls)
+}
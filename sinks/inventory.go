@@ -0,0 +1,217 @@
+package sinks
+
+import (
+	"context"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/destrex271/pgwatch3_rpc_server/sinks/pb"
+	"google.golang.org/grpc"
+	"gopkg.in/yaml.v3"
+)
+
+// if set, measurements are enriched with the tags this
+// YAML or CSV inventory file maps their DBName to
+var SERVER_INVENTORY_FILE = os.Getenv("PGWATCH_RPC_SERVER_INVENTORY_FILE")
+
+// which tags win when both pgwatch and the inventory set
+// one: "pgwatch" (default) or "inventory"
+var SERVER_INVENTORY_PRECEDENCE = os.Getenv("PGWATCH_RPC_SERVER_INVENTORY_PRECEDENCE")
+
+// how often the inventory file is checked for changes
+const inventoryReloadInterval = 10 * time.Second
+
+// InventoryEntry maps databases whose name matches
+// Match, a path.Match pattern, to tags
+type InventoryEntry struct {
+	Match string            `yaml:"match"`
+	Tags  map[string]string `yaml:"tags"`
+}
+
+// Inventory enriches measurements with tags from an inventory file,
+// reloaded when it changes. Entries are applied in file order, later
+// matching entries overriding earlier ones
+type Inventory struct {
+	path string
+	// inventory tags override the ones sent by pgwatch
+	override bool
+
+	mu      sync.RWMutex
+	entries []InventoryEntry
+	modTime time.Time
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+// ParseInventory reads entries in YAML, a list of entries, or in CSV,
+// with a header row naming the tags after the first, pattern, column
+func ParseInventory(r io.Reader, format string) ([]InventoryEntry, error) {
+	entries := []InventoryEntry{}
+	switch format {
+	case ".yaml", ".yml":
+		if err := yaml.NewDecoder(r).Decode(&entries); err != nil && err != io.EOF {
+			return nil, err
+		}
+	case ".csv":
+		reader := csv.NewReader(r)
+		reader.TrimLeadingSpace = true
+		records, err := reader.ReadAll()
+		if err != nil {
+			return nil, err
+		}
+		if len(records) == 0 {
+			return entries, nil
+		}
+		header := records[0]
+		for _, record := range records[1:] {
+			entry := InventoryEntry{Match: record[0], Tags: map[string]string{}}
+			for i, value := range record[1:] {
+				if value != "" {
+					entry.Tags[header[i+1]] = value
+				}
+			}
+			entries = append(entries, entry)
+		}
+	default:
+		return nil, fmt.Errorf("unsupported inventory format %q, expected .yaml, .yml or .csv", format)
+	}
+
+	for i, entry := range entries {
+		if entry.Match == "" {
+			return nil, fmt.Errorf("inventory entry %d: missing match", i+1)
+		}
+		if _, err := path.Match(entry.Match, ""); err != nil {
+			return nil, fmt.Errorf("inventory entry %d: invalid match %q: %w", i+1, entry.Match, err)
+		}
+	}
+	return entries, nil
+}
+
+// NewInventory loads the inventory at path, reloading it
+// every interval if it changed until Close is called
+func NewInventory(path string, override bool, interval time.Duration) (*Inventory, error) {
+	inv := &Inventory{path: path, override: override, stop: make(chan struct{}), done: make(chan struct{})}
+	if _, err := inv.Reload(); err != nil {
+		return nil, err
+	}
+	go inv.watch(interval)
+	return inv, nil
+}
+
+// NewInventoryFromEnv returns nil if PGWATCH_RPC_SERVER_INVENTORY_FILE isn't set
+func NewInventoryFromEnv() (*Inventory, error) {
+	if SERVER_INVENTORY_FILE == "" {
+		return nil, nil
+	}
+	var override bool
+	switch SERVER_INVENTORY_PRECEDENCE {
+	case "", "pgwatch":
+	case "inventory":
+		override = true
+	default:
+		return nil, fmt.Errorf("invalid PGWATCH_RPC_SERVER_INVENTORY_PRECEDENCE: %q, expected pgwatch or inventory", SERVER_INVENTORY_PRECEDENCE)
+	}
+	return NewInventory(SERVER_INVENTORY_FILE, override, inventoryReloadInterval)
+}
+
+// Reload reads the inventory file if it changed since last
+// loaded, an invalid file keeps the previous entries in use
+func (inv *Inventory) Reload() (bool, error) {
+	info, err := os.Stat(inv.path)
+	if err != nil {
+		return false, err
+	}
+	inv.mu.RLock()
+	unchanged := info.ModTime().Equal(inv.modTime)
+	inv.mu.RUnlock()
+	if unchanged {
+		return false, nil
+	}
+
+	file, err := os.Open(inv.path)
+	if err != nil {
+		return false, err
+	}
+	defer func() { _ = file.Close() }()
+	entries, err := ParseInventory(file, strings.ToLower(filepath.Ext(inv.path)))
+	if err != nil {
+		return false, fmt.Errorf("invalid inventory %s: %w", inv.path, err)
+	}
+
+	inv.mu.Lock()
+	inv.entries, inv.modTime = entries, info.ModTime()
+	inv.mu.Unlock()
+	return true, nil
+}
+
+func (inv *Inventory) watch(interval time.Duration) {
+	defer close(inv.done)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-inv.stop:
+			return
+		case <-ticker.C:
+		}
+		reloaded, err := inv.Reload()
+		if err != nil {
+			log.Printf("[ERROR]: Unable to reload inventory, keeping the previous one: %s", err)
+		} else if reloaded {
+			log.Println("[INFO]: Reloaded inventory " + inv.path)
+		}
+	}
+}
+
+func (inv *Inventory) Close() error {
+	close(inv.stop)
+	<-inv.done
+	return nil
+}
+
+// Tags returns the inventory tags of dbName
+func (inv *Inventory) Tags(dbName string) map[string]string {
+	inv.mu.RLock()
+	defer inv.mu.RUnlock()
+	tags := map[string]string{}
+	for _, entry := range inv.entries {
+		if matched, _ := path.Match(entry.Match, dbName); matched {
+			for key, value := range entry.Tags {
+				tags[key] = value
+			}
+		}
+	}
+	return tags
+}
+
+// Enrich merges the inventory tags of msg into its CustomTags
+func (inv *Inventory) Enrich(msg *pb.MeasurementEnvelope) {
+	tags := inv.Tags(msg.GetDBName())
+	if len(tags) == 0 {
+		return
+	}
+	if msg.CustomTags == nil {
+		msg.CustomTags = map[string]string{}
+	}
+	for key, value := range tags {
+		if _, exists := msg.CustomTags[key]; !exists || inv.override {
+			msg.CustomTags[key] = value
+		}
+	}
+}
+
+func (inv *Inventory) UnaryInterceptor(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+	if msg, ok := req.(*pb.MeasurementEnvelope); ok {
+		inv.Enrich(msg)
+	}
+	return handler(ctx, req)
+}
@@ -0,0 +1,121 @@
+package sinks
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	testutils "github.com/destrex271/pgwatch3_rpc_server/sinks/test_utils"
+	"github.com/stretchr/testify/assert"
+)
+
+const testInventoryYAML = `
+- match: "*"
+  tags: {env: dev}
+- match: "prod_*"
+  tags: {env: prod, team: payments}
+- match: prod_orders
+  tags: {team: orders, region: eu-central-1}
+`
+
+func writeInventory(t *testing.T, name, content string, modTime time.Time) string {
+	path := filepath.Join(t.TempDir(), name)
+	assert.NoError(t, os.WriteFile(path, []byte(content), 0644))
+	assert.NoError(t, os.Chtimes(path, modTime, modTime))
+	return path
+}
+
+func TestParseInventory(t *testing.T) {
+	entries, err := ParseInventory(strings.NewReader(testInventoryYAML), ".yaml")
+	assert.NoError(t, err)
+	assert.Len(t, entries, 3)
+	assert.Equal(t, InventoryEntry{Match: "prod_*", Tags: map[string]string{"env": "prod", "team": "payments"}}, entries[1])
+
+	entries, err = ParseInventory(strings.NewReader("dbname,env,team\nprod_*,prod,payments\ntest,,qa\n"), ".csv")
+	assert.NoError(t, err)
+	assert.Equal(t, []InventoryEntry{
+		{Match: "prod_*", Tags: map[string]string{"env": "prod", "team": "payments"}},
+		{Match: "test", Tags: map[string]string{"team": "qa"}},
+	}, entries)
+
+	entries, err = ParseInventory(strings.NewReader(""), ".yml")
+	assert.NoError(t, err)
+	assert.Empty(t, entries)
+
+	_, err = ParseInventory(strings.NewReader("- match: '[prod'\n"), ".yaml")
+	assert.ErrorContains(t, err, "invalid match")
+	_, err = ParseInventory(strings.NewReader("- tags: {env: prod}\n"), ".yaml")
+	assert.ErrorContains(t, err, "missing match")
+	_, err = ParseInventory(strings.NewReader(""), ".json")
+	assert.Error(t, err)
+}
+
+func TestInventory(t *testing.T) {
+	path := writeInventory(t, "inventory.yaml", testInventoryYAML, time.Now().Add(-time.Minute))
+	inv, err := NewInventory(path, false, time.Hour)
+	assert.NoError(t, err)
+	defer func() { _ = inv.Close() }()
+
+	// later matching entries override earlier ones
+	assert.Equal(t, map[string]string{"env": "dev"}, inv.Tags("test"))
+	assert.Equal(t, map[string]string{"env": "prod", "team": "orders", "region": "eu-central-1"}, inv.Tags("prod_orders"))
+
+	// tags sent by pgwatch win by default
+	msg := testutils.GetTestMeasurementEnvelope()
+	msg.DBName = "prod_orders"
+	msg.CustomTags["team"] = "dba"
+	inv.Enrich(msg)
+	assert.Equal(t, map[string]string{"tagName": "tagValue", "env": "prod", "team": "dba", "region": "eu-central-1"}, msg.GetCustomTags())
+
+	inv.override = true
+	inv.Enrich(msg)
+	assert.Equal(t, "orders", msg.GetCustomTags()["team"])
+
+	msg.CustomTags = nil
+	inv.Enrich(msg)
+	assert.Equal(t, "prod", msg.GetCustomTags()["env"])
+}
+
+func TestInventory_Reload(t *testing.T) {
+	path := writeInventory(t, "inventory.csv", "dbname,env\n*,dev\n", time.Now().Add(-time.Minute))
+	inv, err := NewInventory(path, false, time.Hour)
+	assert.NoError(t, err)
+	defer func() { _ = inv.Close() }()
+
+	reloaded, err := inv.Reload()
+	assert.NoError(t, err)
+	assert.False(t, reloaded)
+
+	assert.NoError(t, os.WriteFile(path, []byte("dbname,env\n*,prod\n"), 0644))
+	reloaded, err = inv.Reload()
+	assert.NoError(t, err)
+	assert.True(t, reloaded)
+	assert.Equal(t, "prod", inv.Tags("test")["env"])
+
+	// invalid changes keep the previous inventory
+	assert.NoError(t, os.WriteFile(path, []byte("dbname,env\n[prod,dev\n"), 0644))
+	assert.NoError(t, os.Chtimes(path, time.Now().Add(time.Minute), time.Now().Add(time.Minute)))
+	_, err = inv.Reload()
+	assert.Error(t, err)
+	assert.Equal(t, "prod", inv.Tags("test")["env"])
+}
+
+func TestNewInventoryFromEnv(t *testing.T) {
+	inv, err := NewInventoryFromEnv()
+	assert.NoError(t, err)
+	assert.Nil(t, inv)
+
+	SERVER_INVENTORY_FILE = writeInventory(t, "inventory.yaml", testInventoryYAML, time.Now())
+	SERVER_INVENTORY_PRECEDENCE = "inventory"
+	defer func() { SERVER_INVENTORY_FILE, SERVER_INVENTORY_PRECEDENCE = "", "" }()
+	inv, err = NewInventoryFromEnv()
+	assert.NoError(t, err)
+	assert.True(t, inv.override)
+	_ = inv.Close()
+
+	SERVER_INVENTORY_PRECEDENCE = "other"
+	_, err = NewInventoryFromEnv()
+	assert.Error(t, err)
+}
@@ -0,0 +1,161 @@
+package sinks
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// address the --port listener binds to, e.g. "127.0.0.1" or "::1",
+// defaults to all IPv4 interfaces
+var SERVER_BIND_ADDRESS = os.Getenv("PGWATCH_RPC_SERVER_BIND_ADDRESS")
+
+// comma separated list of additional listener specs (see ParseListener)
+var SERVER_LISTEN = os.Getenv("PGWATCH_RPC_SERVER_LISTEN")
+
+// Listener is an address the server accepts connections on
+// along with the auth/TLS policy applied to them
+type Listener struct {
+	Network string // "tcp" or "unix"
+	Address string
+	// nil means plaintext
+	TLS *tls.Config
+	// whether AuthInterceptor checks requests from this listener
+	Auth bool
+}
+
+// ParseListener parses a listener spec of the form
+//
+//	[tcp://]host:port[?options]
+//	unix:///path/to/socket[?options]
+//
+// supported options are `tls=true|false`, `cert` and `key` to use
+// another cert/key pair than the server one, and `auth=true|false`.
+// Listeners use defaultTLS and authentication unless told otherwise.
+func ParseListener(spec string, defaultTLS *tls.Config) (*Listener, error) {
+	spec = strings.TrimSpace(spec)
+	if !strings.Contains(spec, "://") {
+		spec = "tcp://" + spec
+	}
+	u, err := url.Parse(spec)
+	if err != nil {
+		return nil, fmt.Errorf("invalid listener %q: %w", spec, err)
+	}
+
+	l := &Listener{Network: u.Scheme, TLS: defaultTLS, Auth: true}
+	switch u.Scheme {
+	case "tcp":
+		if u.Port() == "" {
+			return nil, fmt.Errorf("invalid listener %q: missing port", spec)
+		}
+		l.Address = u.Host
+	case "unix":
+		l.Address = u.Host + u.Path
+		if l.Address == "" {
+			return nil, fmt.Errorf("invalid listener %q: missing socket path", spec)
+		}
+	default:
+		return nil, fmt.Errorf("invalid listener %q: unsupported network %q", spec, u.Scheme)
+	}
+
+	query := u.Query()
+	if value := query.Get("auth"); value != "" {
+		if l.Auth, err = strconv.ParseBool(value); err != nil {
+			return nil, fmt.Errorf("invalid listener %q: auth: %w", spec, err)
+		}
+	}
+
+	certFile, keyFile := query.Get("cert"), query.Get("key")
+	if certFile != "" || keyFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("invalid listener %q: %w", spec, err)
+		}
+		l.TLS = &tls.Config{Certificates: []tls.Certificate{cert}}
+	}
+	if value := query.Get("tls"); value != "" {
+		enabled, err := strconv.ParseBool(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid listener %q: tls: %w", spec, err)
+		}
+		if !enabled {
+			l.TLS = nil
+		} else if l.TLS == nil {
+			return nil, fmt.Errorf("invalid listener %q: tls requested but no valid cert/key pair configured", spec)
+		}
+	}
+
+	return l, nil
+}
+
+// ServerListeners returns the listeners to serve on, the one given
+// by port followed by the ones from PGWATCH_RPC_SERVER_LISTEN.
+// port is either a port number bound to PGWATCH_RPC_SERVER_BIND_ADDRESS
+// or a listener spec itself.
+func ServerListeners(port string) ([]*Listener, error) {
+	defaultTLS := LoadTLSConfig()
+
+	specs := []string{}
+	if port != "" {
+		if _, err := strconv.Atoi(port); err == nil {
+			port = net.JoinHostPort(bindAddress(), port)
+		}
+		specs = append(specs, port)
+	}
+	for _, spec := range strings.Split(SERVER_LISTEN, ",") {
+		if strings.TrimSpace(spec) != "" {
+			specs = append(specs, spec)
+		}
+	}
+	if len(specs) == 0 {
+		return nil, errors.New("no listener configured")
+	}
+
+	listeners := make([]*Listener, 0, len(specs))
+	for _, spec := range specs {
+		l, err := ParseListener(spec, defaultTLS)
+		if err != nil {
+			return nil, err
+		}
+		listeners = append(listeners, l)
+	}
+	return listeners, nil
+}
+
+func bindAddress() string {
+	if SERVER_BIND_ADDRESS == "" {
+		return "0.0.0.0"
+	}
+	return SERVER_BIND_ADDRESS
+}
+
+// Listen starts listening, for unix sockets a stale
+// socket file left behind by a previous run is removed
+func (l *Listener) Listen() (net.Listener, error) {
+	if l.Network == "unix" {
+		if info, err := os.Stat(l.Address); err == nil && info.Mode().Type() == fs.ModeSocket {
+			if err := os.Remove(l.Address); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return net.Listen(l.Network, l.Address)
+}
+
+func (l *Listener) String() string {
+	security := "plaintext"
+	if l.TLS != nil {
+		security = "TLS"
+	}
+	auth := "auth"
+	if !l.Auth {
+		auth = "no auth"
+	}
+	return fmt.Sprintf("%s://%s (%s, %s)", l.Network, l.Address, security, auth)
+}
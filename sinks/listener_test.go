@@ -0,0 +1,106 @@
+package sinks
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/destrex271/pgwatch3_rpc_server/sinks/pb"
+	testutils "github.com/destrex271/pgwatch3_rpc_server/sinks/test_utils"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+)
+
+func TestParseListener(t *testing.T) {
+	defaultTLS := &tls.Config{}
+
+	l, err := ParseListener("0.0.0.0:5000", defaultTLS)
+	assert.NoError(t, err)
+	assert.Equal(t, &Listener{Network: "tcp", Address: "0.0.0.0:5000", TLS: defaultTLS, Auth: true}, l)
+
+	l, err = ParseListener("tcp://[::1]:5000?tls=false&auth=false", defaultTLS)
+	assert.NoError(t, err)
+	assert.Equal(t, &Listener{Network: "tcp", Address: "[::1]:5000"}, l)
+
+	l, err = ParseListener("unix:///run/pgwatch/receiver.sock?auth=false", nil)
+	assert.NoError(t, err)
+	assert.Equal(t, &Listener{Network: "unix", Address: "/run/pgwatch/receiver.sock"}, l)
+
+	l, err = ParseListener("tcp://localhost:5000?cert="+TestCertFile+"&key="+TestPrivateKeyFile, nil)
+	assert.NoError(t, err)
+	assert.NotNil(t, l.TLS)
+
+	invalid := []string{
+		"localhost",
+		"unix://",
+		"udp://localhost:5000",
+		"localhost:5000?auth=maybe",
+		"localhost:5000?tls=true",
+		"localhost:5000?cert=does-not-exist.crt&key=does-not-exist.key",
+	}
+	for _, spec := range invalid {
+		_, err := ParseListener(spec, nil)
+		assert.Error(t, err, spec)
+	}
+}
+
+func TestServerListeners(t *testing.T) {
+	SERVER_LISTEN = "127.0.0.1:5001?auth=false, unix:///tmp/receiver.sock"
+	SERVER_BIND_ADDRESS = "::1"
+	defer func() { SERVER_LISTEN, SERVER_BIND_ADDRESS = "", "" }()
+
+	listeners, err := ServerListeners("5000")
+	assert.NoError(t, err)
+	assert.Len(t, listeners, 3)
+	assert.Equal(t, "[::1]:5000", listeners[0].Address)
+	assert.Equal(t, "127.0.0.1:5001", listeners[1].Address)
+	assert.False(t, listeners[1].Auth)
+	assert.Equal(t, "unix", listeners[2].Network)
+
+	// port can be a listener spec
+	listeners, err = ServerListeners("unix:///tmp/receiver.sock")
+	assert.NoError(t, err)
+	assert.Equal(t, "/tmp/receiver.sock", listeners[0].Address)
+
+	SERVER_LISTEN = ""
+	_, err = ServerListeners("")
+	assert.Error(t, err)
+}
+
+func TestListenAndServe_MultipleListeners(t *testing.T) {
+	socket := filepath.Join(t.TempDir(), "receiver.sock")
+	// stale socket left behind by a previous run
+	stale, err := net.Listen("unix", socket)
+	assert.NoError(t, err)
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	_ = stale.Close()
+
+	SERVER_USERNAME, SERVER_PASSWORD = "username", "password"
+	SERVER_LISTEN = "unix://" + socket + "?auth=false&tls=false"
+	defer func() { SERVER_USERNAME, SERVER_PASSWORD, SERVER_LISTEN = "", "", "" }()
+
+	go func() {
+		if err := ListenAndServe(NewSink(), "127.0.0.1:5055?tls=false"); err != nil {
+			panic(err)
+		}
+	}()
+	time.Sleep(time.Second)
+
+	msg := testutils.GetTestMeasurementEnvelope()
+	for target, code := range map[string]codes.Code{
+		"localhost:5055":   codes.Unauthenticated,
+		"unix://" + socket: codes.OK,
+	} {
+		conn, err := grpc.NewClient(target, grpc.WithTransportCredentials(insecure.NewCredentials()))
+		assert.NoError(t, err)
+		_, err = pb.NewReceiverClient(conn).UpdateMeasurements(context.Background(), msg)
+		assert.Equal(t, code, status.Code(err), target)
+		_ = conn.Close()
+	}
+}
@@ -0,0 +1,328 @@
+package sinks
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/destrex271/pgwatch3_rpc_server/sinks/pb"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+// maintenance mode entered on SIGUSR1 or through the admin
+// API if none is given: "reject" (default) or "buffer"
+var SERVER_MAINTENANCE_MODE = os.Getenv("PGWATCH_RPC_SERVER_MAINTENANCE_MODE")
+
+// file requests are buffered to in buffer mode, required to use it
+var SERVER_MAINTENANCE_BUFFER_FILE = os.Getenv("PGWATCH_RPC_SERVER_MAINTENANCE_BUFFER_FILE")
+
+const (
+	// requests are answered with Unavailable, so that pgwatch retries them
+	MaintenanceReject = "reject"
+	// requests are buffered locally and passed to the receiver on Leave
+	MaintenanceBuffer = "buffer"
+)
+
+// Maintenance lets a receiver stop writing to its backend without
+// restarting, e.g. during a backend upgrade. While in maintenance the
+// gRPC health status of the receiver is NOT_SERVING
+type Maintenance struct {
+	receiver    pb.ReceiverServer
+	defaultMode string
+	bufferPath  string
+	health      *health.Server
+
+	mu       sync.Mutex
+	mode     string
+	recorder *Recorder
+
+	// only one Leave drains the buffer at a time
+	leaving sync.Mutex
+}
+
+func NewMaintenance(receiver pb.ReceiverServer, defaultMode, bufferPath string) (*Maintenance, error) {
+	m := &Maintenance{
+		receiver:    receiver,
+		defaultMode: defaultMode,
+		bufferPath:  bufferPath,
+		health:      health.NewServer(),
+	}
+	if m.defaultMode == "" {
+		m.defaultMode = MaintenanceReject
+	}
+	if err := m.validMode(m.defaultMode); err != nil {
+		return nil, err
+	}
+	m.setServing(true)
+	return m, nil
+}
+
+// NewMaintenanceFromEnv configures maintenance from PGWATCH_RPC_SERVER_MAINTENANCE_*
+func NewMaintenanceFromEnv(receiver pb.ReceiverServer) (*Maintenance, error) {
+	return NewMaintenance(receiver, SERVER_MAINTENANCE_MODE, SERVER_MAINTENANCE_BUFFER_FILE)
+}
+
+func (m *Maintenance) validMode(mode string) error {
+	switch mode {
+	case MaintenanceReject:
+		return nil
+	case MaintenanceBuffer:
+		if m.bufferPath == "" {
+			return fmt.Errorf("maintenance mode %q requires PGWATCH_RPC_SERVER_MAINTENANCE_BUFFER_FILE", mode)
+		}
+		return nil
+	}
+	return fmt.Errorf("invalid maintenance mode %q: expected %s or %s", mode, MaintenanceReject, MaintenanceBuffer)
+}
+
+func (m *Maintenance) setServing(serving bool) {
+	st := healthpb.HealthCheckResponse_SERVING
+	if !serving {
+		st = healthpb.HealthCheckResponse_NOT_SERVING
+	}
+	m.health.SetServingStatus("", st)
+	m.health.SetServingStatus(pb.Receiver_ServiceDesc.ServiceName, st)
+}
+
+// Health returns the gRPC health service reflecting the maintenance mode
+func (m *Maintenance) Health() healthpb.HealthServer {
+	return m.health
+}
+
+// Mode returns the current maintenance mode, "" if not in maintenance
+func (m *Maintenance) Mode() string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.mode
+}
+
+// Enter puts the receiver in maintenance, in the default mode if mode is ""
+func (m *Maintenance) Enter(mode string) error {
+	if mode == "" {
+		mode = m.defaultMode
+	}
+	if err := m.validMode(mode); err != nil {
+		return status.Error(codes.InvalidArgument, err.Error())
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.mode == MaintenanceBuffer && mode != MaintenanceBuffer {
+		return status.Error(codes.FailedPrecondition, "leave buffer mode first, so that buffered requests are written")
+	}
+	m.mode = mode
+	m.setServing(false)
+	log.Printf("[INFO]: Entered maintenance, mode %s", mode)
+	return nil
+}
+
+// Buffered returns the size in bytes of the requests waiting to be written
+func (m *Maintenance) Buffered() int64 {
+	if m.bufferPath == "" {
+		return 0
+	}
+	return fileSize(m.bufferPath) + fileSize(m.drainingPath())
+}
+
+func fileSize(path string) int64 {
+	info, err := os.Stat(path)
+	if err != nil {
+		return 0
+	}
+	return info.Size()
+}
+
+func (m *Maintenance) drainingPath() string {
+	return m.bufferPath + ".draining"
+}
+
+// Leave writes the buffered requests, in order and along with those
+// arriving meanwhile, then takes the receiver out of maintenance.
+// If the receiver is still Unavailable it stays in maintenance
+func (m *Maintenance) Leave(ctx context.Context) (int, error) {
+	m.leaving.Lock()
+	defer m.leaving.Unlock()
+
+	written := 0
+	for {
+		n, err := m.drain(ctx)
+		written += n
+		if err != nil {
+			return written, err
+		}
+
+		m.mu.Lock()
+		if m.bufferPath == "" || fileSize(m.bufferPath) == 0 {
+			if m.recorder != nil {
+				_ = m.recorder.Close()
+				m.recorder = nil
+			}
+			if m.bufferPath != "" {
+				_ = os.Remove(m.bufferPath)
+			}
+			if m.mode != "" {
+				log.Printf("[INFO]: Left maintenance, %d buffered requests written", written)
+			}
+			m.mode = ""
+			m.setServing(true)
+			m.mu.Unlock()
+			return written, nil
+		}
+		// requests buffered meanwhile are drained next
+		if m.recorder != nil {
+			_ = m.recorder.Close()
+			m.recorder = nil
+		}
+		err = os.Rename(m.bufferPath, m.drainingPath())
+		m.mu.Unlock()
+		if err != nil {
+			return written, err
+		}
+	}
+}
+
+// drain passes the requests of the draining file to the receiver, the
+// ones rejected as Unavailable and after are kept for the next Leave.
+// A corrupt record, e.g. cut short by a crash, and the rest are dropped
+func (m *Maintenance) drain(ctx context.Context) (int, error) {
+	draining := m.drainingPath()
+	file, err := os.Open(draining)
+	if errors.Is(err, fs.ErrNotExist) || m.bufferPath == "" {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	defer func() { _ = file.Close() }()
+
+	written := 0
+	reader := NewRecordingReader(file)
+	for {
+		rec, err := reader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			log.Printf("[ERROR]: Dropping buffered requests after %d written, the buffer is corrupt: %s", written, err)
+			break
+		}
+
+		_, err = invokeReceiver(WithTenant(ctx, rec.Tenant), m.receiver, rec.Method, rec.Request)
+		if status.Code(err) == codes.Unavailable {
+			return written, errors.Join(err, keepRecordings(draining, rec, reader))
+		}
+		if err != nil {
+			log.Printf("[ERROR]: Unable to write buffered %s request: %s", rec.Method, err)
+			if msg, ok := rec.Request.(*pb.MeasurementEnvelope); ok {
+				AddDeadLetter("maintenance", msg, err)
+			}
+		}
+		written++
+	}
+	_ = file.Close()
+	return written, os.Remove(draining)
+}
+
+// keepRecordings rewrites path with rec and the requests left in reader
+func keepRecordings(path string, rec *Recording, reader *RecordingReader) error {
+	tmp := path + ".tmp"
+	_ = os.Remove(tmp)
+	recorder, err := NewRecorder(tmp)
+	if err != nil {
+		return err
+	}
+	for ; rec != nil; rec, err = reader.Next() {
+		if err := recorder.RecordTenant(rec.Tenant, rec.Method, rec.Time, rec.Request); err != nil {
+			_ = recorder.Close()
+			return err
+		}
+	}
+	if err != io.EOF {
+		log.Printf("[ERROR]: Dropping the rest of the buffered requests, the buffer is corrupt: %s", err)
+	}
+	if err := recorder.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// invokeReceiver calls the receiver method named by a full gRPC method name
+func invokeReceiver(ctx context.Context, receiver pb.ReceiverServer, method string, req proto.Message) (*pb.Reply, error) {
+	switch method {
+	case pb.Receiver_UpdateMeasurements_FullMethodName:
+		return receiver.UpdateMeasurements(ctx, req.(*pb.MeasurementEnvelope))
+	case pb.Receiver_SyncMetric_FullMethodName:
+		return receiver.SyncMetric(ctx, req.(*pb.SyncReq))
+	case pb.Receiver_DefineMetrics_FullMethodName:
+		return receiver.DefineMetrics(ctx, req.(*structpb.Struct))
+	}
+	return nil, status.Errorf(codes.Unimplemented, "unknown method %s", method)
+}
+
+func receiverMethod(fullMethod string) bool {
+	return strings.HasPrefix(fullMethod, "/"+pb.Receiver_ServiceDesc.ServiceName+"/")
+}
+
+// UnaryInterceptor rejects requests in reject mode, it comes first so
+// that rejected requests leave no state behind, e.g. in deduplication
+func (m *Maintenance) UnaryInterceptor(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+	if m.Mode() == MaintenanceReject && receiverMethod(info.FullMethod) {
+		return nil, status.Error(codes.Unavailable, "receiver is in maintenance, retry later")
+	}
+	return handler(ctx, req)
+}
+
+// BufferInterceptor buffers requests in buffer mode, it comes
+// last so that buffered requests are passed to the receiver as is
+func (m *Maintenance) BufferInterceptor(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+	msg, ok := req.(proto.Message)
+	if !ok || !receiverMethod(info.FullMethod) {
+		return handler(ctx, req)
+	}
+
+	m.mu.Lock()
+	if m.mode != MaintenanceBuffer {
+		m.mu.Unlock()
+		return handler(ctx, req)
+	}
+	defer m.mu.Unlock()
+	if m.recorder == nil {
+		// a record cut short by a crash would swallow the ones appended after it
+		if _, err := RepairRecording(m.bufferPath); err != nil {
+			return nil, status.Errorf(codes.Unavailable, "receiver is in maintenance and can't buffer: %s", err)
+		}
+		recorder, err := NewRecorder(m.bufferPath)
+		if err != nil {
+			return nil, status.Errorf(codes.Unavailable, "receiver is in maintenance and can't buffer: %s", err)
+		}
+		m.recorder = recorder
+	}
+	if err := m.recorder.RecordTenant(Tenant(ctx), info.FullMethod, time.Now(), msg); err != nil {
+		return nil, status.Errorf(codes.Unavailable, "receiver is in maintenance and can't buffer: %s", err)
+	}
+	return &pb.Reply{Logmsg: "buffered during maintenance"}, nil
+}
+
+// Close closes the buffer, buffered requests are written by the next Leave
+func (m *Maintenance) Close() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.recorder == nil {
+		return nil
+	}
+	err := m.recorder.Close()
+	m.recorder = nil
+	return err
+}
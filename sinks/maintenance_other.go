@@ -0,0 +1,8 @@
+//go:build !unix
+
+package sinks
+
+import "context"
+
+// HandleSignals does nothing, maintenance is toggled through the admin API only
+func (m *Maintenance) HandleSignals(ctx context.Context) {}
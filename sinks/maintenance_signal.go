@@ -0,0 +1,34 @@
+//go:build unix
+
+package sinks
+
+import (
+	"context"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// HandleSignals enters maintenance on SIGUSR1 and leaves it on SIGUSR2, until ctx is done
+func (m *Maintenance) HandleSignals(ctx context.Context) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGUSR1, syscall.SIGUSR2)
+	defer signal.Stop(signals)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case sig := <-signals:
+			if sig == syscall.SIGUSR1 {
+				if err := m.Enter(""); err != nil {
+					log.Printf("[ERROR]: Unable to enter maintenance: %s", err)
+				}
+				continue
+			}
+			if _, err := m.Leave(ctx); err != nil {
+				log.Printf("[ERROR]: Unable to leave maintenance: %s", err)
+			}
+		}
+	}
+}
@@ -0,0 +1,173 @@
+package sinks
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/destrex271/pgwatch3_rpc_server/sinks/pb"
+	testutils "github.com/destrex271/pgwatch3_rpc_server/sinks/test_utils"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/status"
+)
+
+type maintenanceReceiver struct {
+	pb.UnimplementedReceiverServer
+
+	mu          sync.Mutex
+	unavailable bool
+	received    []*pb.MeasurementEnvelope
+	tenants     []string
+}
+
+func (r *maintenanceReceiver) UpdateMeasurements(ctx context.Context, msg *pb.MeasurementEnvelope) (*pb.Reply, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.unavailable {
+		return nil, status.Error(codes.Unavailable, "backend down")
+	}
+	r.received = append(r.received, msg)
+	r.tenants = append(r.tenants, Tenant(ctx))
+	return &pb.Reply{Logmsg: "stored"}, nil
+}
+
+func healthStatus(t *testing.T, m *Maintenance) healthpb.HealthCheckResponse_ServingStatus {
+	resp, err := m.Health().Check(context.Background(), &healthpb.HealthCheckRequest{Service: "Receiver"})
+	assert.NoError(t, err)
+	return resp.GetStatus()
+}
+
+func TestMaintenance_Reject(t *testing.T) {
+	receiver := &maintenanceReceiver{}
+	m, err := NewMaintenance(receiver, "", "")
+	assert.NoError(t, err)
+	update := &grpc.UnaryServerInfo{FullMethod: pb.Receiver_UpdateMeasurements_FullMethodName}
+	handler := func(ctx context.Context, req any) (any, error) {
+		return receiver.UpdateMeasurements(ctx, req.(*pb.MeasurementEnvelope))
+	}
+	assert.Equal(t, healthpb.HealthCheckResponse_SERVING, healthStatus(t, m))
+
+	assert.NoError(t, m.Enter(""))
+	assert.Equal(t, MaintenanceReject, m.Mode())
+	assert.Equal(t, healthpb.HealthCheckResponse_NOT_SERVING, healthStatus(t, m))
+	_, err = m.UnaryInterceptor(context.Background(), testutils.GetTestMeasurementEnvelope(), update, handler)
+	assert.Equal(t, codes.Unavailable, status.Code(err))
+	// other services, e.g. health checks, aren't rejected
+	_, err = m.UnaryInterceptor(context.Background(), nil, &grpc.UnaryServerInfo{FullMethod: "/grpc.health.v1.Health/Check"},
+		func(ctx context.Context, req any) (any, error) { return nil, nil })
+	assert.NoError(t, err)
+
+	// buffer mode needs a buffer file
+	assert.Equal(t, codes.InvalidArgument, status.Code(m.Enter(MaintenanceBuffer)))
+	written, err := m.Leave(context.Background())
+	assert.NoError(t, err)
+	assert.Zero(t, written)
+	assert.Equal(t, "", m.Mode())
+	assert.Equal(t, healthpb.HealthCheckResponse_SERVING, healthStatus(t, m))
+	_, err = m.UnaryInterceptor(context.Background(), testutils.GetTestMeasurementEnvelope(), update, handler)
+	assert.NoError(t, err)
+	assert.Len(t, receiver.received, 1)
+
+	_, err = NewMaintenance(receiver, MaintenanceBuffer, "")
+	assert.Error(t, err)
+	_, err = NewMaintenance(receiver, "drain", "")
+	assert.Error(t, err)
+}
+
+func TestMaintenance_Buffer(t *testing.T) {
+	receiver := &maintenanceReceiver{}
+	path := filepath.Join(t.TempDir(), "maintenance.rec")
+	m, err := NewMaintenance(receiver, MaintenanceBuffer, path)
+	assert.NoError(t, err)
+	update := &grpc.UnaryServerInfo{FullMethod: pb.Receiver_UpdateMeasurements_FullMethodName}
+	handler := func(ctx context.Context, req any) (any, error) {
+		return receiver.UpdateMeasurements(ctx, req.(*pb.MeasurementEnvelope))
+	}
+	send := func(ctx context.Context, metric string) {
+		msg := testutils.GetTestMeasurementEnvelope()
+		msg.MetricName = metric
+		_, err := m.BufferInterceptor(ctx, msg, update, handler)
+		assert.NoError(t, err)
+	}
+
+	assert.NoError(t, m.Enter(""))
+	send(context.Background(), "m1")
+	send(WithTenant(context.Background(), "acme"), "m2")
+	send(context.Background(), "m3")
+	assert.Empty(t, receiver.received)
+	assert.Positive(t, m.Buffered())
+	// buffered requests aren't lost by switching to reject mode
+	assert.Equal(t, codes.FailedPrecondition, status.Code(m.Enter(MaintenanceReject)))
+
+	// still unavailable, stays in maintenance and keeps the requests
+	receiver.unavailable = true
+	_, err = m.Leave(context.Background())
+	assert.Equal(t, codes.Unavailable, status.Code(err))
+	assert.Equal(t, MaintenanceBuffer, m.Mode())
+	send(context.Background(), "m4")
+	assert.NoError(t, m.Close())
+
+	receiver.unavailable = false
+	written, err := m.Leave(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, 4, written)
+	assert.Equal(t, "", m.Mode())
+	assert.Zero(t, m.Buffered())
+	metrics := []string{}
+	for _, msg := range receiver.received {
+		metrics = append(metrics, msg.GetMetricName())
+	}
+	assert.Equal(t, []string{"m1", "m2", "m3", "m4"}, metrics)
+	assert.Equal(t, []string{"", "acme", "", ""}, receiver.tenants)
+
+	send(context.Background(), "m5")
+	assert.Len(t, receiver.received, 5)
+}
+
+func TestMaintenance_Truncated(t *testing.T) {
+	receiver := &maintenanceReceiver{}
+	path := filepath.Join(t.TempDir(), "maintenance.rec")
+	m, err := NewMaintenance(receiver, MaintenanceBuffer, path)
+	assert.NoError(t, err)
+	update := &grpc.UnaryServerInfo{FullMethod: pb.Receiver_UpdateMeasurements_FullMethodName}
+	send := func(metric string) {
+		msg := testutils.GetTestMeasurementEnvelope()
+		msg.MetricName = metric
+		_, err := m.BufferInterceptor(context.Background(), msg, update, func(ctx context.Context, req any) (any, error) {
+			return receiver.UpdateMeasurements(ctx, req.(*pb.MeasurementEnvelope))
+		})
+		assert.NoError(t, err)
+	}
+	truncate := func() {
+		assert.NoError(t, m.Close())
+		data, err := os.ReadFile(path)
+		assert.NoError(t, err)
+		assert.NoError(t, os.WriteFile(path, data[:len(data)-2], 0644))
+	}
+
+	// crash in the middle of buffering m2, m3 is buffered after a restart
+	assert.NoError(t, m.Enter(""))
+	send("m1")
+	send("m2")
+	truncate()
+	send("m3")
+
+	// a corrupt buffer doesn't keep the receiver in maintenance
+	send("m4")
+	truncate()
+	written, err := m.Leave(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, 2, written)
+	assert.Equal(t, "", m.Mode())
+	assert.Zero(t, m.Buffered())
+	metrics := []string{}
+	for _, msg := range receiver.received {
+		metrics = append(metrics, msg.GetMetricName())
+	}
+	assert.Equal(t, []string{"m1", "m3"}, metrics)
+}
@@ -0,0 +1,139 @@
+package sinks
+
+import (
+	"fmt"
+	"math"
+	"os"
+	"strconv"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/keepalive"
+)
+
+// max size in bytes of a single request, gRPC's default of 4MB is too
+// small for large stat_statements envelopes. Also applies to HTTP/JSON
+var SERVER_MAX_RECV_SIZE = os.Getenv("PGWATCH_RPC_SERVER_MAX_RECV_SIZE")
+
+// max number of concurrent streams per client connection
+var SERVER_MAX_CONCURRENT_STREAMS = os.Getenv("PGWATCH_RPC_SERVER_MAX_CONCURRENT_STREAMS")
+
+// keepalive enforcement, durations are given as e.g. "30s" or "5m"
+var SERVER_KEEPALIVE_MIN_TIME = os.Getenv("PGWATCH_RPC_SERVER_KEEPALIVE_MIN_TIME")
+var SERVER_KEEPALIVE_PERMIT_WITHOUT_STREAM = os.Getenv("PGWATCH_RPC_SERVER_KEEPALIVE_PERMIT_WITHOUT_STREAM")
+var SERVER_KEEPALIVE_TIME = os.Getenv("PGWATCH_RPC_SERVER_KEEPALIVE_TIME")
+var SERVER_KEEPALIVE_TIMEOUT = os.Getenv("PGWATCH_RPC_SERVER_KEEPALIVE_TIMEOUT")
+
+// connection age limits, forcing clients to reconnect
+// e.g. to spread them over newly started replicas
+var SERVER_MAX_CONNECTION_IDLE = os.Getenv("PGWATCH_RPC_SERVER_MAX_CONNECTION_IDLE")
+var SERVER_MAX_CONNECTION_AGE = os.Getenv("PGWATCH_RPC_SERVER_MAX_CONNECTION_AGE")
+var SERVER_MAX_CONNECTION_AGE_GRACE = os.Getenv("PGWATCH_RPC_SERVER_MAX_CONNECTION_AGE_GRACE")
+
+// same as gRPC's default
+const defaultMaxRecvSize = 4 * 1024 * 1024
+
+// Option customizes the server started by ListenAndServe
+type Option func(*serverConfig)
+
+type serverConfig struct {
+	grpcOptions  []grpc.ServerOption
+	interceptors []grpc.UnaryServerInterceptor
+}
+
+// WithGRPCOptions passes extra options to the gRPC servers,
+// they take precedence over the ones set through env variables.
+// Interceptors must be added with WithInterceptors instead, the server
+// panics on a second grpc.UnaryInterceptor, and grpc.ChainUnaryInterceptor
+// ones aren't applied to HTTP/JSON requests
+func WithGRPCOptions(opts ...grpc.ServerOption) Option {
+	return func(c *serverConfig) {
+		c.grpcOptions = append(c.grpcOptions, opts...)
+	}
+}
+
+// WithInterceptors adds interceptors that run after the built-in
+// ones, right before the receiver, for both gRPC and HTTP/JSON requests
+func WithInterceptors(interceptors ...grpc.UnaryServerInterceptor) Option {
+	return func(c *serverConfig) {
+		c.interceptors = append(c.interceptors, interceptors...)
+	}
+}
+
+// ServerTuningOptions returns the gRPC server options
+// configured through PGWATCH_RPC_SERVER_* env variables
+func ServerTuningOptions() ([]grpc.ServerOption, error) {
+	opts := []grpc.ServerOption{}
+
+	maxRecvSize, err := serverMaxRecvSize()
+	if err != nil {
+		return nil, err
+	}
+	opts = append(opts, grpc.MaxRecvMsgSize(maxRecvSize))
+
+	if SERVER_MAX_CONCURRENT_STREAMS != "" {
+		streams, err := strconv.ParseUint(SERVER_MAX_CONCURRENT_STREAMS, 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid PGWATCH_RPC_SERVER_MAX_CONCURRENT_STREAMS: %w", err)
+		}
+		opts = append(opts, grpc.MaxConcurrentStreams(uint32(streams)))
+	}
+
+	policy := keepalive.EnforcementPolicy{}
+	if policy.MinTime, err = parseDurationEnv("PGWATCH_RPC_SERVER_KEEPALIVE_MIN_TIME", SERVER_KEEPALIVE_MIN_TIME); err != nil {
+		return nil, err
+	}
+	if SERVER_KEEPALIVE_PERMIT_WITHOUT_STREAM != "" {
+		if policy.PermitWithoutStream, err = strconv.ParseBool(SERVER_KEEPALIVE_PERMIT_WITHOUT_STREAM); err != nil {
+			return nil, fmt.Errorf("invalid PGWATCH_RPC_SERVER_KEEPALIVE_PERMIT_WITHOUT_STREAM: %w", err)
+		}
+	}
+	if policy != (keepalive.EnforcementPolicy{}) {
+		opts = append(opts, grpc.KeepaliveEnforcementPolicy(policy))
+	}
+
+	params := keepalive.ServerParameters{}
+	durations := []struct {
+		name  string
+		value string
+		field *time.Duration
+	}{
+		{"PGWATCH_RPC_SERVER_KEEPALIVE_TIME", SERVER_KEEPALIVE_TIME, &params.Time},
+		{"PGWATCH_RPC_SERVER_KEEPALIVE_TIMEOUT", SERVER_KEEPALIVE_TIMEOUT, &params.Timeout},
+		{"PGWATCH_RPC_SERVER_MAX_CONNECTION_IDLE", SERVER_MAX_CONNECTION_IDLE, &params.MaxConnectionIdle},
+		{"PGWATCH_RPC_SERVER_MAX_CONNECTION_AGE", SERVER_MAX_CONNECTION_AGE, &params.MaxConnectionAge},
+		{"PGWATCH_RPC_SERVER_MAX_CONNECTION_AGE_GRACE", SERVER_MAX_CONNECTION_AGE_GRACE, &params.MaxConnectionAgeGrace},
+	}
+	for _, d := range durations {
+		if *d.field, err = parseDurationEnv(d.name, d.value); err != nil {
+			return nil, err
+		}
+	}
+	if params != (keepalive.ServerParameters{}) {
+		opts = append(opts, grpc.KeepaliveParams(params))
+	}
+
+	return opts, nil
+}
+
+func serverMaxRecvSize() (int, error) {
+	if SERVER_MAX_RECV_SIZE == "" {
+		return defaultMaxRecvSize, nil
+	}
+	size, err := strconv.Atoi(SERVER_MAX_RECV_SIZE)
+	if err != nil || size <= 0 || size > math.MaxInt32 {
+		return 0, fmt.Errorf("invalid PGWATCH_RPC_SERVER_MAX_RECV_SIZE: %q", SERVER_MAX_RECV_SIZE)
+	}
+	return size, nil
+}
+
+func parseDurationEnv(name, value string) (time.Duration, error) {
+	if value == "" {
+		return 0, nil
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil || d < 0 {
+		return 0, fmt.Errorf("invalid %s: %q", name, value)
+	}
+	return d, nil
+}
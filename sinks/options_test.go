@@ -0,0 +1,108 @@
+package sinks
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/destrex271/pgwatch3_rpc_server/sinks/pb"
+	testutils "github.com/destrex271/pgwatch3_rpc_server/sinks/test_utils"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+func TestServerTuningOptions(t *testing.T) {
+	opts, err := ServerTuningOptions()
+	assert.NoError(t, err)
+	assert.Len(t, opts, 1, "only the max receive size is set by default")
+
+	SERVER_MAX_RECV_SIZE = "16777216"
+	SERVER_MAX_CONCURRENT_STREAMS = "100"
+	SERVER_KEEPALIVE_MIN_TIME = "10s"
+	SERVER_KEEPALIVE_PERMIT_WITHOUT_STREAM = "true"
+	SERVER_MAX_CONNECTION_AGE = "30m"
+	defer func() {
+		SERVER_MAX_RECV_SIZE, SERVER_MAX_CONCURRENT_STREAMS = "", ""
+		SERVER_KEEPALIVE_MIN_TIME, SERVER_KEEPALIVE_PERMIT_WITHOUT_STREAM = "", ""
+		SERVER_MAX_CONNECTION_AGE = ""
+	}()
+
+	opts, err = ServerTuningOptions()
+	assert.NoError(t, err)
+	assert.Len(t, opts, 4)
+
+	invalid := []*string{
+		&SERVER_MAX_RECV_SIZE,
+		&SERVER_MAX_CONCURRENT_STREAMS,
+		&SERVER_KEEPALIVE_MIN_TIME,
+		&SERVER_KEEPALIVE_PERMIT_WITHOUT_STREAM,
+		&SERVER_MAX_CONNECTION_AGE,
+	}
+	for _, env := range invalid {
+		valid := *env
+		*env = "-1x"
+		_, err := ServerTuningOptions()
+		assert.Error(t, err)
+		*env = valid
+	}
+}
+
+func TestCompression(t *testing.T) {
+	msg := testutils.GetTestMeasurementEnvelope()
+	conn, err := grpc.NewClient(PlainServerAddress, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	assert.NoError(t, err)
+	defer func() { _ = conn.Close() }()
+	client := pb.NewReceiverClient(conn)
+
+	for _, compressor := range []string{"gzip", "zstd"} {
+		// twice to go through pooled encoders/decoders
+		for range 2 {
+			reply, err := client.UpdateMeasurements(context.Background(), msg, grpc.UseCompressor(compressor))
+			assert.NoError(t, err, compressor)
+			assert.Equal(t, "Measurements Updated", reply.GetLogmsg())
+		}
+	}
+}
+
+func TestListenAndServe_Options(t *testing.T) {
+	SERVER_MAX_RECV_SIZE = "1024"
+	defer func() { SERVER_MAX_RECV_SIZE = "" }()
+
+	intercepted := 0
+	interceptor := func(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+		intercepted++
+		return handler(ctx, req)
+	}
+	go func() {
+		err := ListenAndServe(NewSink(), "127.0.0.1:5056?tls=false",
+			WithInterceptors(interceptor),
+			WithGRPCOptions(grpc.MaxConcurrentStreams(10)),
+		)
+		if err != nil {
+			panic(err)
+		}
+	}()
+	time.Sleep(time.Second)
+
+	conn, err := grpc.NewClient("localhost:5056", grpc.WithTransportCredentials(insecure.NewCredentials()))
+	assert.NoError(t, err)
+	defer func() { _ = conn.Close() }()
+	client := pb.NewReceiverClient(conn)
+
+	msg := testutils.GetTestMeasurementEnvelope()
+	_, err = client.UpdateMeasurements(context.Background(), msg)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, intercepted)
+
+	msg.Data = append(msg.Data, &structpb.Struct{Fields: map[string]*structpb.Value{
+		"query": structpb.NewStringValue(strings.Repeat("x", 2048)),
+	}})
+	_, err = client.UpdateMeasurements(context.Background(), msg)
+	assert.Equal(t, codes.ResourceExhausted, status.Code(err))
+	assert.Equal(t, 1, intercepted)
+}
@@ -0,0 +1,309 @@
+package sinks
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/destrex271/pgwatch3_rpc_server/sinks/pb"
+	"google.golang.org/grpc"
+	"google.golang.org/protobuf/types/known/structpb"
+	"gopkg.in/yaml.v3"
+)
+
+// if set, YAML file listing the cumulative counters converted to rates (see RateRule)
+var SERVER_RATES_FILE = os.Getenv("PGWATCH_RPC_SERVER_RATES_FILE")
+
+// if set, previous samples are persisted to this file so
+// that restarts don't lose them, producing gaps
+var SERVER_RATES_STATE_FILE = os.Getenv("PGWATCH_RPC_SERVER_RATES_STATE_FILE")
+
+const (
+	// samples older than this are forgotten, e.g. removed sources
+	rateSampleMaxAge = time.Hour
+	// how often old samples are evicted and the state persisted
+	rateStateInterval = time.Minute
+)
+
+// RateRule converts the counters Columns of Metric to per second
+// rates or deltas, rows being identified by DBName and Key columns
+type RateRule struct {
+	Metric  string   `yaml:"metric"`
+	Key     []string `yaml:"key"`
+	Columns []string `yaml:"columns"`
+	// "rate" (default) or "delta"
+	Mode string `yaml:"mode"`
+	// optional column, e.g. stats_reset, whose change means counters were reset
+	ResetColumn string `yaml:"reset_column"`
+	// write results in place of the counters instead of adding
+	// <column>_<mode> fields, rows without a previous sample are dropped
+	Replace bool `yaml:"replace"`
+}
+
+// LoadRateRules reads rules from a YAML file, a list of RateRule
+func LoadRateRules(path string) ([]RateRule, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	rules := []RateRule{}
+	if err := yaml.Unmarshal(data, &rules); err != nil {
+		return nil, fmt.Errorf("invalid rates file %s: %w", path, err)
+	}
+	return rules, nil
+}
+
+type counterSample struct {
+	// unix nanoseconds
+	Time   int64              `json:"time"`
+	Values map[string]float64 `json:"values"`
+	Reset  string             `json:"reset,omitempty"`
+}
+
+// RateConverter keeps the previous sample of every row
+// to convert cumulative counters to rates or deltas
+type RateConverter struct {
+	rules     map[string]RateRule
+	statePath string
+
+	mu      sync.Mutex
+	samples map[string]counterSample
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+// NewRateConverter loads the previous samples from statePath, if set,
+// and evicts old samples, persisting the state, every interval
+func NewRateConverter(rules []RateRule, statePath string, interval time.Duration) (*RateConverter, error) {
+	c := &RateConverter{
+		rules:     map[string]RateRule{},
+		statePath: statePath,
+		samples:   map[string]counterSample{},
+		stop:      make(chan struct{}),
+		done:      make(chan struct{}),
+	}
+	for i, rule := range rules {
+		switch {
+		case rule.Metric == "":
+			return nil, fmt.Errorf("rate rule %d: missing metric", i+1)
+		case len(rule.Columns) == 0:
+			return nil, fmt.Errorf("rate rule %d: missing columns", i+1)
+		case rule.Mode == "":
+			rule.Mode = "rate"
+		case rule.Mode != "rate" && rule.Mode != "delta":
+			return nil, fmt.Errorf("rate rule %d: invalid mode %q, expected rate or delta", i+1, rule.Mode)
+		}
+		if _, exists := c.rules[rule.Metric]; exists {
+			return nil, fmt.Errorf("rate rule %d: duplicate metric %q", i+1, rule.Metric)
+		}
+		c.rules[rule.Metric] = rule
+	}
+
+	if statePath != "" {
+		data, err := os.ReadFile(statePath)
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return nil, err
+		}
+		if err == nil {
+			if err := json.Unmarshal(data, &c.samples); err != nil {
+				return nil, fmt.Errorf("invalid rates state file %s: %w", statePath, err)
+			}
+		}
+	}
+
+	go c.run(interval)
+	return c, nil
+}
+
+// NewRateConverterFromEnv returns nil if PGWATCH_RPC_SERVER_RATES_FILE isn't set
+func NewRateConverterFromEnv() (*RateConverter, error) {
+	if SERVER_RATES_FILE == "" {
+		return nil, nil
+	}
+	rules, err := LoadRateRules(SERVER_RATES_FILE)
+	if err != nil {
+		return nil, err
+	}
+	return NewRateConverter(rules, SERVER_RATES_STATE_FILE, rateStateInterval)
+}
+
+func (c *RateConverter) run(interval time.Duration) {
+	defer close(c.done)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.stop:
+			return
+		case <-ticker.C:
+		}
+		c.evict(time.Now())
+		if err := c.SaveState(); err != nil {
+			log.Printf("[ERROR]: Unable to persist rates state: %s", err)
+		}
+	}
+}
+
+func (c *RateConverter) evict(now time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for key, sample := range c.samples {
+		if now.Sub(time.Unix(0, sample.Time)) > rateSampleMaxAge {
+			delete(c.samples, key)
+		}
+	}
+}
+
+// SaveState atomically writes the previous samples to the state file, if any
+func (c *RateConverter) SaveState() error {
+	if c.statePath == "" {
+		return nil
+	}
+	c.mu.Lock()
+	data, err := json.Marshal(c.samples)
+	c.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	tmp := c.statePath + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, c.statePath)
+}
+
+// Close stops the background eviction and persists the state
+func (c *RateConverter) Close() error {
+	close(c.stop)
+	<-c.done
+	return c.SaveState()
+}
+
+func rowTime(row *structpb.Struct) int64 {
+	if v, ok := row.GetFields()["epoch_ns"].GetKind().(*structpb.Value_NumberValue); ok {
+		return int64(v.NumberValue)
+	}
+	return time.Now().UnixNano()
+}
+
+func rowKey(tenant string, msg *pb.MeasurementEnvelope, row *structpb.Struct, columns []string) string {
+	parts := []string{tenant, msg.GetDBName(), msg.GetMetricName()}
+	for _, column := range columns {
+		value, _ := json.Marshal(row.GetFields()[column].AsInterface())
+		parts = append(parts, string(value))
+	}
+	return strings.Join(parts, "\x00")
+}
+
+// Convert replaces, or complements, the counters of msg with the rates
+// or deltas since the previous sample of the same row. Counters going
+// backwards, or a changed reset column, mean the counter was reset
+func (c *RateConverter) Convert(tenant string, msg *pb.MeasurementEnvelope) {
+	c.commit(c.convert(tenant, msg))
+}
+
+// convert is Convert without keeping the samples of msg, which are
+// returned to be committed once stored, so that retries of an envelope
+// the backend failed to store are converted the same way
+func (c *RateConverter) convert(tenant string, msg *pb.MeasurementEnvelope) map[string]counterSample {
+	rule, ok := c.rules[msg.GetMetricName()]
+	if !ok {
+		return nil
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	samples := map[string]counterSample{}
+	rows := msg.Data[:0]
+	for _, row := range msg.GetData() {
+		key := rowKey(tenant, msg, row, rule.Key)
+		cur := counterSample{Time: rowTime(row), Values: map[string]float64{}}
+		if rule.ResetColumn != "" {
+			reset, _ := json.Marshal(row.GetFields()[rule.ResetColumn].AsInterface())
+			cur.Reset = string(reset)
+		}
+		for _, column := range rule.Columns {
+			if v, ok := row.GetFields()[column].GetKind().(*structpb.Value_NumberValue); ok {
+				cur.Values[column] = v.NumberValue
+			}
+		}
+
+		prev, seen := c.samples[key]
+		// duplicates and out of order samples can't be compared
+		usable := seen && cur.Time > prev.Time
+		samples[key] = cur
+		if !usable && rule.Replace {
+			continue
+		}
+
+		seconds := float64(cur.Time-prev.Time) / float64(time.Second)
+		for column, value := range cur.Values {
+			previous, ok := prev.Values[column]
+			if !usable || !ok {
+				if rule.Replace {
+					delete(row.Fields, column)
+				}
+				continue
+			}
+			delta := value - previous
+			if delta < 0 || cur.Reset != prev.Reset {
+				// counted since the reset
+				delta = value
+			}
+			result := delta
+			if rule.Mode == "rate" {
+				result = delta / seconds
+			}
+
+			field := column + "_" + rule.Mode
+			if rule.Replace {
+				field = column
+			}
+			row.Fields[field] = structpb.NewNumberValue(result)
+		}
+		rows = append(rows, row)
+	}
+	msg.Data = rows
+	return samples
+}
+
+// commit keeps the samples returned by convert, unless newer ones are kept
+func (c *RateConverter) commit(samples map[string]counterSample) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for key, cur := range samples {
+		if prev, seen := c.samples[key]; !seen || cur.Time >= prev.Time {
+			c.samples[key] = cur
+		}
+	}
+}
+
+// UnaryInterceptor converts counters before they reach the receiver,
+// envelopes left without rows, e.g. first samples, aren't passed on.
+// Samples are only kept once the receiver stored the envelope
+func (c *RateConverter) UnaryInterceptor(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+	msg, ok := req.(*pb.MeasurementEnvelope)
+	if !ok {
+		return handler(ctx, req)
+	}
+	samples := c.convert(Tenant(ctx), msg)
+	if len(msg.GetData()) == 0 {
+		c.commit(samples)
+		return &pb.Reply{Logmsg: "no rates yet, waiting for the next sample"}, nil
+	}
+	reply, err := handler(ctx, req)
+	if err == nil {
+		c.commit(samples)
+	}
+	return reply, err
+}
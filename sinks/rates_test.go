@@ -0,0 +1,160 @@
+package sinks
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/destrex271/pgwatch3_rpc_server/sinks/pb"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+func rateEnvelope(t *testing.T, metric string, rows ...map[string]any) *pb.MeasurementEnvelope {
+	msg := &pb.MeasurementEnvelope{DBName: "test", MetricName: metric}
+	for _, row := range rows {
+		st, err := structpb.NewStruct(row)
+		assert.NoError(t, err)
+		msg.Data = append(msg.Data, st)
+	}
+	return msg
+}
+
+func TestLoadRateRules(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "rates.yaml")
+	assert.NoError(t, os.WriteFile(path, []byte("- metric: db_stats\n  columns: [xact_commit]\n  mode: delta\n"), 0644))
+	rules, err := LoadRateRules(path)
+	assert.NoError(t, err)
+	assert.Equal(t, []RateRule{{Metric: "db_stats", Columns: []string{"xact_commit"}, Mode: "delta"}}, rules)
+
+	for _, rules := range [][]RateRule{
+		{{Columns: []string{"a"}}},
+		{{Metric: "m"}},
+		{{Metric: "m", Columns: []string{"a"}, Mode: "avg"}},
+		{{Metric: "m", Columns: []string{"a"}}, {Metric: "m", Columns: []string{"b"}}},
+	} {
+		_, err := NewRateConverter(rules, "", time.Hour)
+		assert.Error(t, err)
+	}
+}
+
+func TestRateConverter(t *testing.T) {
+	c, err := NewRateConverter([]RateRule{
+		{Metric: "db_stats", Columns: []string{"xact_commit", "blks_read"}, ResetColumn: "stats_reset"},
+		{Metric: "table_stats", Key: []string{"table_name"}, Columns: []string{"seq_scan"}, Mode: "delta", Replace: true},
+	}, "", time.Hour)
+	assert.NoError(t, err)
+	defer func() { _ = c.Close() }()
+
+	sec := float64(time.Second)
+	msg := rateEnvelope(t, "db_stats", map[string]any{"epoch_ns": 10 * sec, "xact_commit": 100, "blks_read": 50, "stats_reset": "a"})
+	c.Convert("", msg)
+	assert.Len(t, msg.Data, 1)
+	assert.NotContains(t, msg.Data[0].Fields, "xact_commit_rate", "first samples have no rate")
+
+	msg = rateEnvelope(t, "db_stats", map[string]any{"epoch_ns": 20 * sec, "xact_commit": 300, "blks_read": 40, "stats_reset": "a"})
+	c.Convert("", msg)
+	fields := msg.Data[0].AsMap()
+	assert.Equal(t, 20.0, fields["xact_commit_rate"])
+	assert.Equal(t, 300.0, fields["xact_commit"])
+	// counters going backwards were reset
+	assert.Equal(t, 4.0, fields["blks_read_rate"])
+
+	msg = rateEnvelope(t, "db_stats", map[string]any{"epoch_ns": 30 * sec, "xact_commit": 310, "blks_read": 50, "stats_reset": "b"})
+	c.Convert("", msg)
+	assert.Equal(t, 31.0, msg.Data[0].AsMap()["xact_commit_rate"])
+
+	// other tenants keep their own samples
+	msg = rateEnvelope(t, "db_stats", map[string]any{"epoch_ns": 40 * sec, "xact_commit": 400, "stats_reset": "b"})
+	c.Convert("acme", msg)
+	assert.NotContains(t, msg.Data[0].Fields, "xact_commit_rate")
+
+	// with replace, rows without a previous sample are dropped
+	msg = rateEnvelope(t, "table_stats",
+		map[string]any{"epoch_ns": 10 * sec, "table_name": "a", "seq_scan": 1},
+		map[string]any{"epoch_ns": 10 * sec, "table_name": "b", "seq_scan": 5})
+	c.Convert("", msg)
+	assert.Empty(t, msg.Data)
+	msg = rateEnvelope(t, "table_stats",
+		map[string]any{"epoch_ns": 20 * sec, "table_name": "a", "seq_scan": 3},
+		map[string]any{"epoch_ns": 20 * sec, "table_name": "c", "seq_scan": 7})
+	c.Convert("", msg)
+	assert.Len(t, msg.Data, 1)
+	assert.Equal(t, map[string]any{"epoch_ns": 20 * sec, "table_name": "a", "seq_scan": 2.0}, msg.Data[0].AsMap())
+
+	// duplicates can't be compared
+	msg = rateEnvelope(t, "table_stats", map[string]any{"epoch_ns": 20 * sec, "table_name": "a", "seq_scan": 3})
+	c.Convert("", msg)
+	assert.Empty(t, msg.Data)
+
+	// other metrics pass through
+	msg = rateEnvelope(t, "other", map[string]any{"xact_commit": 1})
+	c.Convert("", msg)
+	assert.Equal(t, map[string]any{"xact_commit": 1.0}, msg.Data[0].AsMap())
+}
+
+func TestRateConverter_State(t *testing.T) {
+	state := filepath.Join(t.TempDir(), "rates.json")
+	rules := []RateRule{{Metric: "db_stats", Columns: []string{"xact_commit"}, Mode: "delta"}}
+	now := float64(time.Now().UnixNano())
+
+	c, err := NewRateConverter(rules, state, time.Hour)
+	assert.NoError(t, err)
+	c.Convert("", rateEnvelope(t, "db_stats", map[string]any{"epoch_ns": now, "xact_commit": 100}))
+	assert.NoError(t, c.Close())
+
+	// restarts continue from the persisted samples
+	c, err = NewRateConverter(rules, state, time.Hour)
+	assert.NoError(t, err)
+	msg := rateEnvelope(t, "db_stats", map[string]any{"epoch_ns": now + float64(time.Minute), "xact_commit": 150})
+	c.Convert("", msg)
+	assert.Equal(t, 50.0, msg.Data[0].AsMap()["xact_commit_delta"])
+
+	// old samples are evicted
+	c.evict(time.Now().Add(2 * rateSampleMaxAge))
+	assert.Empty(t, c.samples)
+	assert.NoError(t, c.Close())
+
+	assert.NoError(t, os.WriteFile(state, []byte("{"), 0644))
+	_, err = NewRateConverter(rules, state, time.Hour)
+	assert.Error(t, err)
+}
+
+func TestRateConverter_UnaryInterceptor(t *testing.T) {
+	c, err := NewRateConverter([]RateRule{{Metric: "db_stats", Columns: []string{"xact_commit"}, Replace: true}}, "", time.Hour)
+	assert.NoError(t, err)
+	defer func() { _ = c.Close() }()
+
+	calls := 0
+	handler := func(ctx context.Context, req any) (any, error) {
+		calls++
+		return &pb.Reply{}, nil
+	}
+	info := &grpc.UnaryServerInfo{FullMethod: pb.Receiver_UpdateMeasurements_FullMethodName}
+	sec := float64(time.Second)
+
+	reply, err := c.UnaryInterceptor(context.Background(), rateEnvelope(t, "db_stats", map[string]any{"epoch_ns": sec, "xact_commit": 1}), info, handler)
+	assert.NoError(t, err)
+	assert.Contains(t, reply.(*pb.Reply).GetLogmsg(), "no rates yet")
+	assert.Equal(t, 0, calls)
+
+	// envelopes the backend failed to store are converted the same way on retry
+	failing := func(ctx context.Context, req any) (any, error) { return nil, errors.New("backend down") }
+	_, err = c.UnaryInterceptor(context.Background(), rateEnvelope(t, "db_stats", map[string]any{"epoch_ns": 2 * sec, "xact_commit": 3}), info, failing)
+	assert.Error(t, err)
+
+	var stored *pb.MeasurementEnvelope
+	handler = func(ctx context.Context, req any) (any, error) {
+		calls++
+		stored = req.(*pb.MeasurementEnvelope)
+		return &pb.Reply{}, nil
+	}
+	_, err = c.UnaryInterceptor(context.Background(), rateEnvelope(t, "db_stats", map[string]any{"epoch_ns": 2 * sec, "xact_commit": 3}), info, handler)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, calls)
+	assert.Equal(t, 2.0, stored.Data[0].AsMap()["xact_commit"])
+}
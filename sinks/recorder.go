@@ -0,0 +1,236 @@
+package sinks
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/destrex271/pgwatch3_rpc_server/sinks/pb"
+	"google.golang.org/grpc"
+	"google.golang.org/protobuf/encoding/protowire"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+// Recording file format: a sequence of varint length prefixed
+// records, each record is protobuf encoded with the fields
+//
+//	1: string full gRPC method name
+//	2: int64 unix timestamp in nanoseconds
+//	3: bytes protobuf encoded request
+//	4: string tenant, if any
+const (
+	recordMethodField  protowire.Number = 1
+	recordTimeField    protowire.Number = 2
+	recordRequestField protowire.Number = 3
+	recordTenantField  protowire.Number = 4
+)
+
+// Recording is a single request read from a recording file
+type Recording struct {
+	Method  string
+	Time    time.Time
+	Request proto.Message
+	Tenant  string
+}
+
+// Recorder writes every received request with its arrival
+// time to a file, to be re-sent later using the replay command
+type Recorder struct {
+	mu   sync.Mutex
+	file *os.File
+}
+
+func NewRecorder(path string) (*Recorder, error) {
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &Recorder{file: file}, nil
+}
+
+func (r *Recorder) Record(method string, ts time.Time, req proto.Message) error {
+	return r.RecordTenant("", method, ts, req)
+}
+
+// RecordTenant records req along with the tenant it was sent by
+func (r *Recorder) RecordTenant(tenant, method string, ts time.Time, req proto.Message) error {
+	reqBytes, err := proto.Marshal(req)
+	if err != nil {
+		return err
+	}
+
+	var record []byte
+	record = protowire.AppendTag(record, recordMethodField, protowire.BytesType)
+	record = protowire.AppendString(record, method)
+	record = protowire.AppendTag(record, recordTimeField, protowire.VarintType)
+	record = protowire.AppendVarint(record, uint64(ts.UnixNano()))
+	record = protowire.AppendTag(record, recordRequestField, protowire.BytesType)
+	record = protowire.AppendBytes(record, reqBytes)
+	if tenant != "" {
+		record = protowire.AppendTag(record, recordTenantField, protowire.BytesType)
+		record = protowire.AppendString(record, tenant)
+	}
+
+	buf := protowire.AppendVarint(nil, uint64(len(record)))
+	buf = append(buf, record...)
+
+	// single write per record so concurrent
+	// requests never interleave in the file
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	_, err = r.file.Write(buf)
+	return err
+}
+
+func (r *Recorder) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.file.Close()
+}
+
+func (r *Recorder) UnaryInterceptor(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+	if msg, ok := req.(proto.Message); ok {
+		if err := r.RecordTenant(Tenant(ctx), info.FullMethod, time.Now(), msg); err != nil {
+			log.Printf("[ERROR]: Unable to record %s request: %s", info.FullMethod, err)
+		}
+	}
+	return handler(ctx, req)
+}
+
+// room for the method, time and tenant of a record next to its request
+const recordOverhead = 1024
+
+// RecordingReader reads the requests written by a Recorder
+type RecordingReader struct {
+	r *bufio.Reader
+	// records larger than this are corrupt
+	maxSize uint64
+	// end of the last record read
+	offset int64
+}
+
+// NewRecordingReader rejects records with requests larger
+// than PGWATCH_RPC_SERVER_MAX_RECV_SIZE, as they can't be received
+func NewRecordingReader(r io.Reader) *RecordingReader {
+	maxSize, err := serverMaxRecvSize()
+	if err != nil {
+		maxSize = defaultMaxRecvSize
+	}
+	return &RecordingReader{r: bufio.NewReader(r), maxSize: uint64(maxSize) + recordOverhead}
+}
+
+// Next returns the next recorded request or io.EOF
+// once the end of the recording is reached
+func (rr *RecordingReader) Next() (*Recording, error) {
+	size, err := binary.ReadUvarint(rr.r)
+	if err != nil {
+		return nil, err
+	}
+	// checked before allocating, the size of a corrupt record is arbitrary
+	if size > rr.maxSize {
+		return nil, fmt.Errorf("corrupt recording: record of %d bytes exceeds the max message size", size)
+	}
+
+	record := make([]byte, size)
+	if _, err := io.ReadFull(rr.r, record); err != nil {
+		return nil, fmt.Errorf("truncated recording: %w", err)
+	}
+	end := rr.offset + int64(protowire.SizeVarint(size)) + int64(size)
+
+	rec := &Recording{}
+	var reqBytes []byte
+	for len(record) > 0 {
+		num, typ, n := protowire.ConsumeTag(record)
+		if n < 0 {
+			return nil, protowire.ParseError(n)
+		}
+		record = record[n:]
+
+		switch {
+		case num == recordMethodField && typ == protowire.BytesType:
+			rec.Method, n = protowire.ConsumeString(record)
+		case num == recordTimeField && typ == protowire.VarintType:
+			var v uint64
+			v, n = protowire.ConsumeVarint(record)
+			rec.Time = time.Unix(0, int64(v))
+		case num == recordRequestField && typ == protowire.BytesType:
+			reqBytes, n = protowire.ConsumeBytes(record)
+		case num == recordTenantField && typ == protowire.BytesType:
+			rec.Tenant, n = protowire.ConsumeString(record)
+		default:
+			n = protowire.ConsumeFieldValue(num, typ, record)
+		}
+		if n < 0 {
+			return nil, protowire.ParseError(n)
+		}
+		record = record[n:]
+	}
+
+	rec.Request, err = newRequest(rec.Method)
+	if err != nil {
+		return nil, err
+	}
+	if err := proto.Unmarshal(reqBytes, rec.Request); err != nil {
+		return nil, err
+	}
+	rr.offset = end
+	return rec, nil
+}
+
+// Offset returns the number of bytes of the records read so far
+func (rr *RecordingReader) Offset() int64 {
+	return rr.offset
+}
+
+// RepairRecording truncates a recording left corrupt, e.g. by a crash
+// in the middle of a write, after its last valid record so that
+// records appended later can be read. It returns the bytes dropped
+func RepairRecording(path string) (int64, error) {
+	file, err := os.OpenFile(path, os.O_RDWR, 0)
+	if errors.Is(err, fs.ErrNotExist) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	defer func() { _ = file.Close() }()
+
+	reader := NewRecordingReader(file)
+	for {
+		_, err = reader.Next()
+		if err == io.EOF {
+			return 0, nil
+		}
+		if err != nil {
+			break
+		}
+	}
+	info, statErr := file.Stat()
+	if statErr != nil {
+		return 0, statErr
+	}
+	dropped := info.Size() - reader.Offset()
+	log.Printf("[WARNING]: Dropping the last %d bytes of %s: %s", dropped, path, err)
+	return dropped, file.Truncate(reader.Offset())
+}
+
+func newRequest(method string) (proto.Message, error) {
+	switch method {
+	case pb.Receiver_UpdateMeasurements_FullMethodName:
+		return &pb.MeasurementEnvelope{}, nil
+	case pb.Receiver_SyncMetric_FullMethodName:
+		return &pb.SyncReq{}, nil
+	case pb.Receiver_DefineMetrics_FullMethodName:
+		return &structpb.Struct{}, nil
+	}
+	return nil, fmt.Errorf("unknown method %q in recording", method)
+}
@@ -0,0 +1,92 @@
+package sinks
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/destrex271/pgwatch3_rpc_server/sinks/pb"
+	testutils "github.com/destrex271/pgwatch3_rpc_server/sinks/test_utils"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc"
+	"google.golang.org/protobuf/encoding/protowire"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+func TestRecorder(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "traffic.rec")
+	recorder, err := NewRecorder(path)
+	assert.NoError(t, err)
+
+	metrics, err := structpb.NewStruct(map[string]any{"db_stats": "SELECT 1"})
+	assert.NoError(t, err)
+
+	requests := []struct {
+		method string
+		req    proto.Message
+		tenant string
+	}{
+		{pb.Receiver_UpdateMeasurements_FullMethodName, testutils.GetTestMeasurementEnvelope(), ""},
+		{pb.Receiver_SyncMetric_FullMethodName, testutils.GetTestRPCSyncRequest(), "acme"},
+		{pb.Receiver_DefineMetrics_FullMethodName, metrics, ""},
+	}
+
+	handler := func(ctx context.Context, req any) (any, error) {
+		return &pb.Reply{}, nil
+	}
+	start := time.Now()
+	for _, r := range requests {
+		_, err := recorder.UnaryInterceptor(WithTenant(context.Background(), r.tenant), r.req, &grpc.UnaryServerInfo{FullMethod: r.method}, handler)
+		assert.NoError(t, err)
+	}
+	assert.NoError(t, recorder.Close())
+
+	file, err := os.Open(path)
+	assert.NoError(t, err)
+	defer func() { _ = file.Close() }()
+
+	reader := NewRecordingReader(file)
+	for _, r := range requests {
+		rec, err := reader.Next()
+		assert.NoError(t, err)
+		assert.Equal(t, r.method, rec.Method)
+		assert.Equal(t, r.tenant, rec.Tenant)
+		assert.True(t, proto.Equal(r.req, rec.Request))
+		assert.False(t, rec.Time.Before(start))
+	}
+	_, err = reader.Next()
+	assert.ErrorIs(t, err, io.EOF)
+}
+
+func TestRecordingReader_Truncated(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "traffic.rec")
+	recorder, err := NewRecorder(path)
+	assert.NoError(t, err)
+	assert.NoError(t, recorder.Record(pb.Receiver_SyncMetric_FullMethodName, time.Now(), testutils.GetTestRPCSyncRequest()))
+	assert.NoError(t, recorder.Close())
+
+	data, err := os.ReadFile(path)
+	assert.NoError(t, err)
+	assert.NoError(t, os.WriteFile(path, data[:len(data)-1], 0644))
+
+	file, err := os.Open(path)
+	assert.NoError(t, err)
+	defer func() { _ = file.Close() }()
+
+	_, err = NewRecordingReader(file).Next()
+	assert.ErrorIs(t, err, io.ErrUnexpectedEOF)
+}
+
+func TestRecordingReader_Oversized(t *testing.T) {
+	// a corrupt size prefix of almost 1 TiB
+	data := protowire.AppendVarint(nil, 1<<40)
+	data = append(data, "garbage"...)
+
+	_, err := NewRecordingReader(bytes.NewReader(data)).Next()
+	assert.ErrorContains(t, err, "exceeds the max message size")
+}
@@ -0,0 +1,254 @@
+package sinks
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.com/destrex271/pgwatch3_rpc_server/sinks/pb"
+	"google.golang.org/grpc"
+	"google.golang.org/protobuf/types/known/structpb"
+	"gopkg.in/yaml.v3"
+)
+
+// if set, YAML file with the redaction policy of this receiver (see RedactionPolicy)
+var SERVER_REDACT_FILE = os.Getenv("PGWATCH_RPC_SERVER_REDACT_FILE")
+
+type RedactionMask struct {
+	Pattern string `yaml:"pattern"`
+	// defaults to ***
+	Replacement string `yaml:"replacement"`
+}
+
+// RedactionPolicy lists what's removed from measurements
+// before they reach the receiver
+type RedactionPolicy struct {
+	// metrics the policy applies to, defaults to all
+	Metrics []string `yaml:"metrics"`
+	// columns holding SQL whose literals are replaced with ?
+	NormalizeSQL []string `yaml:"normalize_sql"`
+	// columns replaced with a hash of their value, still allowing to group by them
+	Hash []string `yaml:"hash"`
+	// prepended to values before hashing, so they can't be guessed
+	HashSalt string   `yaml:"hash_salt"`
+	Drop     []string `yaml:"drop"`
+	// patterns masked in every string column, e.g. emails or tokens
+	Mask []RedactionMask `yaml:"mask"`
+}
+
+// LoadRedactionPolicy reads the policy from a YAML file
+func LoadRedactionPolicy(path string) (RedactionPolicy, error) {
+	policy := RedactionPolicy{}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return policy, err
+	}
+	if err := yaml.Unmarshal(data, &policy); err != nil {
+		return policy, fmt.Errorf("invalid redaction file %s: %w", path, err)
+	}
+	return policy, nil
+}
+
+type compiledMask struct {
+	re          *regexp.Regexp
+	replacement string
+}
+
+// Redactor applies a RedactionPolicy to measurements
+type Redactor struct {
+	policy RedactionPolicy
+	masks  []compiledMask
+}
+
+func NewRedactor(policy RedactionPolicy) (*Redactor, error) {
+	r := &Redactor{policy: policy}
+	for i, mask := range policy.Mask {
+		re, err := regexp.Compile(mask.Pattern)
+		if err != nil {
+			return nil, fmt.Errorf("redaction mask %d: %w", i+1, err)
+		}
+		if mask.Replacement == "" {
+			mask.Replacement = "***"
+		}
+		r.masks = append(r.masks, compiledMask{re: re, replacement: mask.Replacement})
+	}
+	return r, nil
+}
+
+// NewRedactorFromEnv returns nil if PGWATCH_RPC_SERVER_REDACT_FILE isn't set
+func NewRedactorFromEnv() (*Redactor, error) {
+	if SERVER_REDACT_FILE == "" {
+		return nil, nil
+	}
+	policy, err := LoadRedactionPolicy(SERVER_REDACT_FILE)
+	if err != nil {
+		return nil, err
+	}
+	return NewRedactor(policy)
+}
+
+func (r *Redactor) hash(value *structpb.Value) *structpb.Value {
+	var text string
+	if s, ok := value.GetKind().(*structpb.Value_StringValue); ok {
+		text = s.StringValue
+	} else {
+		data, _ := value.MarshalJSON()
+		text = string(data)
+	}
+	sum := sha256.Sum256([]byte(r.policy.HashSalt + text))
+	return structpb.NewStringValue(hex.EncodeToString(sum[:8]))
+}
+
+// Redact removes the sensitive data of msg, in place
+func (r *Redactor) Redact(msg *pb.MeasurementEnvelope) {
+	if len(r.policy.Metrics) > 0 && !slices.Contains(r.policy.Metrics, msg.GetMetricName()) {
+		return
+	}
+	for _, row := range msg.GetData() {
+		for _, column := range r.policy.Drop {
+			delete(row.Fields, column)
+		}
+		for _, column := range r.policy.Hash {
+			value, ok := row.GetFields()[column]
+			if _, null := value.GetKind().(*structpb.Value_NullValue); ok && !null {
+				row.Fields[column] = r.hash(value)
+			}
+		}
+		for column, value := range row.GetFields() {
+			s, ok := value.GetKind().(*structpb.Value_StringValue)
+			if !ok || slices.Contains(r.policy.Hash, column) {
+				continue
+			}
+			text := s.StringValue
+			if slices.Contains(r.policy.NormalizeSQL, column) {
+				text = NormalizeSQL(text)
+			}
+			for _, mask := range r.masks {
+				text = mask.re.ReplaceAllString(text, mask.replacement)
+			}
+			if text != s.StringValue {
+				row.Fields[column] = structpb.NewStringValue(text)
+			}
+		}
+	}
+}
+
+func (r *Redactor) UnaryInterceptor(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+	if msg, ok := req.(*pb.MeasurementEnvelope); ok {
+		r.Redact(msg)
+	}
+	return handler(ctx, req)
+}
+
+func isIdentChar(c byte) bool {
+	return c == '_' || c == '$' || c >= '0' && c <= '9' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= 0x80
+}
+
+// skipString returns the index following the string literal starting at i
+func skipString(query string, i int, escapes bool) int {
+	for j := i + 1; j < len(query); j++ {
+		switch {
+		case escapes && query[j] == '\\':
+			j++
+		case query[j] == '\'' && j+1 < len(query) && query[j+1] == '\'':
+			j++
+		case query[j] == '\'':
+			return j + 1
+		}
+	}
+	return len(query)
+}
+
+// NormalizeSQL replaces the string, dollar quoted and numeric literals
+// of query with ?, keeping identifiers, parameters and comments
+func NormalizeSQL(query string) string {
+	var b strings.Builder
+	n := len(query)
+	for i := 0; i < n; {
+		c := query[i]
+		switch {
+		case c == '-' && i+1 < n && query[i+1] == '-':
+			end := strings.IndexByte(query[i:], '\n')
+			if end < 0 {
+				end = n - i
+			}
+			b.WriteString(query[i : i+end])
+			i += end
+		case c == '/' && i+1 < n && query[i+1] == '*':
+			end := strings.Index(query[i+2:], "*/")
+			if end < 0 {
+				end = n - i - 2
+			} else {
+				end += 2
+			}
+			b.WriteString(query[i : i+2+end])
+			i += 2 + end
+		case c == '"':
+			// quoted identifier, "" escaping a quote
+			j := i + 1
+			for j < n {
+				if query[j] == '"' {
+					if j+1 < n && query[j+1] == '"' {
+						j += 2
+						continue
+					}
+					j++
+					break
+				}
+				j++
+			}
+			b.WriteString(query[i:j])
+			i = j
+		case (c == 'E' || c == 'e') && i+1 < n && query[i+1] == '\'' && (i == 0 || !isIdentChar(query[i-1])):
+			// E'...' strings allow backslash escapes
+			b.WriteByte('?')
+			i = skipString(query, i+1, true)
+		case c == '\'':
+			b.WriteByte('?')
+			i = skipString(query, i, false)
+		case c == '$' && (i == 0 || !isIdentChar(query[i-1])) && i+1 < n && !(query[i+1] >= '0' && query[i+1] <= '9'):
+			// $tag$...$tag$
+			end := strings.IndexByte(query[i+1:], '$')
+			tag := ""
+			if end >= 0 {
+				tag = query[i : i+end+2]
+			}
+			if end < 0 || strings.IndexFunc(tag[1:len(tag)-1], func(r rune) bool { return r == '$' || !isIdentChar(byte(r)) }) >= 0 {
+				b.WriteByte(c)
+				i++
+				continue
+			}
+			end = strings.Index(query[i+len(tag):], tag)
+			if end < 0 {
+				i = n
+			} else {
+				i += len(tag) + end + len(tag)
+			}
+			b.WriteByte('?')
+		case c >= '0' && c <= '9' && (i == 0 || !isIdentChar(query[i-1])),
+			c == '.' && i+1 < n && query[i+1] >= '0' && query[i+1] <= '9' && (i == 0 || !isIdentChar(query[i-1])):
+			j := i
+			for j < n {
+				d := query[j]
+				if d >= '0' && d <= '9' || d == '.' {
+					j++
+				} else if exp := strings.TrimLeft(query[j+1:min(j+3, n)], "+-"); (d == 'e' || d == 'E') && exp != "" && exp[0] >= '0' && exp[0] <= '9' {
+					j += 3 - len(exp)
+				} else {
+					break
+				}
+			}
+			b.WriteByte('?')
+			i = j
+		default:
+			b.WriteByte(c)
+			i++
+		}
+	}
+	return b.String()
+}
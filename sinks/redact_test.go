@@ -0,0 +1,81 @@
+package sinks
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/destrex271/pgwatch3_rpc_server/sinks/pb"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc"
+)
+
+func TestNormalizeSQL(t *testing.T) {
+	for query, expected := range map[string]string{
+		"select * from users where email = 'a@b.c' and id = 42":   "select * from users where email = ? and id = ?",
+		"select 'it''s', E'a\\'b', 1.5e-3, .5, $1 from t1":        "select ?, ?, ?, ?, $1 from t1",
+		`select "col 1", "a""b" from "t'x"`:                       `select "col 1", "a""b" from "t'x"`,
+		"select $$secret$$, $tag$a $$ b$tag$ from x2y":            "select ?, ? from x2y",
+		"select 1 -- comment 'kept'\n/* 2 */ from table_3":        "select ? -- comment 'kept'\n/* 2 */ from table_3",
+		"insert into t values (1e5, 'unterminated":                "insert into t values (?, ?",
+		"select price$1 from t where e = e'x' and name like 'E%'": "select price$1 from t where e = ? and name like ?",
+	} {
+		assert.Equal(t, expected, NormalizeSQL(query), query)
+	}
+}
+
+func TestRedactor(t *testing.T) {
+	_, err := NewRedactor(RedactionPolicy{Mask: []RedactionMask{{Pattern: "("}}})
+	assert.Error(t, err)
+
+	path := filepath.Join(t.TempDir(), "redact.yaml")
+	assert.NoError(t, os.WriteFile(path, []byte(`
+metrics: [stat_statements]
+normalize_sql: [query]
+hash: [usename, userid]
+hash_salt: salt
+drop: [application_name]
+mask:
+  - pattern: '[\w.+-]+@[\w-]+\.[\w.]+'
+    replacement: "<email>"
+  - pattern: 'token=\S+'
+`), 0644))
+	policy, err := LoadRedactionPolicy(path)
+	assert.NoError(t, err)
+	r, err := NewRedactor(policy)
+	assert.NoError(t, err)
+
+	msg := rateEnvelope(t, "stat_statements", map[string]any{
+		"query":            "select * from users where id = 7 -- by ops@example.com",
+		"usename":          "alice",
+		"userid":           10,
+		"application_name": "app",
+		"comment":          "token=abc123 sent",
+		"calls":            3,
+		"dbid":             nil,
+	})
+	r.Redact(msg)
+	fields := msg.Data[0].AsMap()
+	assert.Equal(t, "select * from users where id = ? -- by <email>", fields["query"])
+	assert.Len(t, fields["usename"], 16)
+	assert.NotEqual(t, "alice", fields["usename"])
+	assert.Len(t, fields["userid"], 16)
+	assert.NotContains(t, fields, "application_name")
+	assert.Equal(t, "*** sent", fields["comment"])
+	assert.Equal(t, 3.0, fields["calls"])
+
+	// hashes are stable, allowing to group by them
+	again := rateEnvelope(t, "stat_statements", map[string]any{"usename": "alice"})
+	reply, err := r.UnaryInterceptor(context.Background(), again, &grpc.UnaryServerInfo{}, func(ctx context.Context, req any) (any, error) {
+		return &pb.Reply{}, nil
+	})
+	assert.NoError(t, err)
+	assert.NotNil(t, reply)
+	assert.Equal(t, fields["usename"], again.Data[0].AsMap()["usename"])
+
+	// other metrics are left alone
+	other := rateEnvelope(t, "db_stats", map[string]any{"usename": "alice"})
+	r.Redact(other)
+	assert.Equal(t, "alice", other.Data[0].AsMap()["usename"])
+}
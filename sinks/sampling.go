@@ -0,0 +1,234 @@
+package sinks
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"math/rand/v2"
+	"os"
+	"path"
+	"slices"
+	"strconv"
+	"sync"
+
+	"github.com/destrex271/pgwatch3_rpc_server/sinks/pb"
+	"google.golang.org/grpc"
+	"google.golang.org/protobuf/types/known/structpb"
+	"gopkg.in/yaml.v3"
+)
+
+// if set, YAML file configuring the sampling
+// of measurements per metric (see SamplingConfig)
+var SERVER_SAMPLING_FILE = os.Getenv("PGWATCH_RPC_SERVER_SAMPLING_FILE")
+
+// SamplingRule samples the envelopes of the metrics matching
+// Metric, a path.Match pattern, in one of the following ways
+type SamplingRule struct {
+	Metric string `yaml:"metric"`
+	// keep every Nth envelope of each source
+	Every int `yaml:"every"`
+	// keep this random percentage of rows
+	Percent float64 `yaml:"percent"`
+	// keep the TopK rows with the highest numeric By column
+	TopK int    `yaml:"top_k"`
+	By   string `yaml:"by"`
+}
+
+type SamplingConfig struct {
+	// tag the fraction of rows kept is recorded as, defaults to sample_rate
+	Tag string `yaml:"tag"`
+	// the first matching rule applies
+	Metrics []SamplingRule `yaml:"metrics"`
+}
+
+// LoadSamplingConfig reads the sampling rules from a YAML file
+func LoadSamplingConfig(path string) (SamplingConfig, error) {
+	config := SamplingConfig{}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return config, err
+	}
+	if err := yaml.Unmarshal(data, &config); err != nil {
+		return config, fmt.Errorf("invalid sampling file %s: %w", path, err)
+	}
+	return config, nil
+}
+
+// Sampler keeps a fraction of the measurements of high volume metrics,
+// tagging what's kept with the sampling rate so that analyses can rescale
+type Sampler struct {
+	config SamplingConfig
+	// returns a number in [0, 1)
+	random func() float64
+
+	mu sync.Mutex
+	// envelopes seen per tenant, source and metric
+	seen map[[3]string]int
+	// kept envelopes not stored yet, see sample
+	pending map[[3]string]bool
+}
+
+func NewSampler(config SamplingConfig) (*Sampler, error) {
+	if config.Tag == "" {
+		config.Tag = "sample_rate"
+	}
+	for i, rule := range config.Metrics {
+		if _, err := path.Match(rule.Metric, ""); err != nil || rule.Metric == "" {
+			return nil, fmt.Errorf("sampling rule %d: invalid metric pattern %q", i+1, rule.Metric)
+		}
+		ways := 0
+		for _, set := range []bool{rule.Every != 0, rule.Percent != 0, rule.TopK != 0} {
+			if set {
+				ways++
+			}
+		}
+		switch {
+		case ways != 1:
+			return nil, fmt.Errorf("sampling rule %d: expected one of every, percent or top_k", i+1)
+		case rule.Every < 0 || rule.TopK < 0:
+			return nil, fmt.Errorf("sampling rule %d: every and top_k must be positive", i+1)
+		case rule.Percent < 0 || rule.Percent > 100:
+			return nil, fmt.Errorf("sampling rule %d: percent must be between 0 and 100", i+1)
+		case rule.TopK > 0 && rule.By == "":
+			return nil, fmt.Errorf("sampling rule %d: top_k requires a by column", i+1)
+		}
+	}
+	return &Sampler{config: config, random: rand.Float64, seen: map[[3]string]int{}, pending: map[[3]string]bool{}}, nil
+}
+
+// NewSamplerFromEnv returns nil if PGWATCH_RPC_SERVER_SAMPLING_FILE isn't set
+func NewSamplerFromEnv() (*Sampler, error) {
+	if SERVER_SAMPLING_FILE == "" {
+		return nil, nil
+	}
+	config, err := LoadSamplingConfig(SERVER_SAMPLING_FILE)
+	if err != nil {
+		return nil, err
+	}
+	return NewSampler(config)
+}
+
+func (s *Sampler) rule(metricName string) (SamplingRule, bool) {
+	for _, rule := range s.config.Metrics {
+		if matched, _ := path.Match(rule.Metric, metricName); matched {
+			return rule, true
+		}
+	}
+	return SamplingRule{}, false
+}
+
+// Sample removes the rows of msg its rule doesn't keep and tags it with
+// the fraction kept, false means the whole envelope isn't kept
+func (s *Sampler) Sample(ctx context.Context, msg *pb.MeasurementEnvelope) bool {
+	keep, commit := s.sample(ctx, msg)
+	commit(true)
+	return keep
+}
+
+// sample is Sample, except that the kept envelopes only count as seen
+// once commit is called with stored, so that a retry of one is kept again.
+// Envelopes arriving while a kept one isn't committed yet are dropped
+func (s *Sampler) sample(ctx context.Context, msg *pb.MeasurementEnvelope) (bool, func(stored bool)) {
+	commit := func(bool) {}
+	rule, ok := s.rule(msg.GetMetricName())
+	if !ok || len(msg.GetData()) == 0 {
+		return true, commit
+	}
+
+	var rate float64
+	switch {
+	case rule.Every > 0:
+		key := [3]string{Tenant(ctx), msg.GetDBName(), msg.GetMetricName()}
+		s.mu.Lock()
+		if s.pending[key] {
+			s.mu.Unlock()
+			return false, commit
+		}
+		if s.seen[key] != 0 {
+			s.seen[key] = (s.seen[key] + 1) % rule.Every
+			s.mu.Unlock()
+			return false, commit
+		}
+		s.pending[key] = true
+		s.mu.Unlock()
+		commit = func(stored bool) {
+			s.mu.Lock()
+			defer s.mu.Unlock()
+			delete(s.pending, key)
+			if stored {
+				s.seen[key] = (s.seen[key] + 1) % rule.Every
+			}
+		}
+		rate = 1 / float64(rule.Every)
+	case rule.Percent > 0:
+		total := len(msg.Data)
+		msg.Data = slices.DeleteFunc(msg.Data, func(*structpb.Struct) bool {
+			return s.random()*100 >= rule.Percent
+		})
+		if len(msg.Data) == 0 {
+			return false, commit
+		}
+		rate = float64(len(msg.Data)) / float64(total)
+	case rule.TopK > 0:
+		total := len(msg.Data)
+		msg.Data = topRows(msg.Data, rule.TopK, rule.By)
+		rate = float64(len(msg.Data)) / float64(total)
+	}
+
+	if msg.CustomTags == nil {
+		msg.CustomTags = map[string]string{}
+	}
+	msg.CustomTags[s.config.Tag] = strconv.FormatFloat(rate, 'g', -1, 64)
+	return true, commit
+}
+
+// topRows returns the k rows with the highest numeric column, in
+// their original order. Rows without a numeric column come last
+func topRows(rows []*structpb.Struct, k int, column string) []*structpb.Struct {
+	if len(rows) <= k {
+		return rows
+	}
+	value := func(row *structpb.Struct) (float64, bool) {
+		v, ok := row.GetFields()[column].GetKind().(*structpb.Value_NumberValue)
+		if !ok {
+			return 0, false
+		}
+		return v.NumberValue, true
+	}
+	order := make([]int, len(rows))
+	for i := range order {
+		order[i] = i
+	}
+	slices.SortStableFunc(order, func(a, b int) int {
+		va, okA := value(rows[a])
+		vb, okB := value(rows[b])
+		if okA != okB {
+			if okA {
+				return -1
+			}
+			return 1
+		}
+		return cmp.Compare(vb, va)
+	})
+	kept := order[:k]
+	slices.Sort(kept)
+	top := make([]*structpb.Struct, 0, k)
+	for _, i := range kept {
+		top = append(top, rows[i])
+	}
+	return top
+}
+
+func (s *Sampler) UnaryInterceptor(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+	msg, ok := req.(*pb.MeasurementEnvelope)
+	if !ok {
+		return handler(ctx, req)
+	}
+	keep, commit := s.sample(ctx, msg)
+	if !keep {
+		return &pb.Reply{Logmsg: "dropped by sampling"}, nil
+	}
+	reply, err := handler(ctx, req)
+	commit(err == nil)
+	return reply, err
+}
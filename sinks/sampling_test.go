@@ -0,0 +1,154 @@
+package sinks
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/destrex271/pgwatch3_rpc_server/sinks/pb"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc"
+)
+
+func newTestSampler(t *testing.T) *Sampler {
+	s, err := NewSampler(SamplingConfig{Metrics: []SamplingRule{
+		{Metric: "locks*", Every: 3},
+		{Metric: "table_stats", Percent: 50},
+		{Metric: "stat_statements", TopK: 2, By: "total_time"},
+	}})
+	assert.NoError(t, err)
+	return s
+}
+
+func TestLoadSamplingConfig(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "sampling.yaml")
+	assert.NoError(t, os.WriteFile(path, []byte("tag: rate\nmetrics:\n  - metric: stat_statements\n    top_k: 100\n    by: total_time\n"), 0644))
+	config, err := LoadSamplingConfig(path)
+	assert.NoError(t, err)
+	assert.Equal(t, SamplingConfig{Tag: "rate", Metrics: []SamplingRule{{Metric: "stat_statements", TopK: 100, By: "total_time"}}}, config)
+
+	for _, rule := range []SamplingRule{
+		{Every: 2},
+		{Metric: "[", Every: 2},
+		{Metric: "m"},
+		{Metric: "m", Every: 2, Percent: 10},
+		{Metric: "m", Every: -1},
+		{Metric: "m", Percent: 150},
+		{Metric: "m", TopK: 10},
+	} {
+		_, err := NewSampler(SamplingConfig{Metrics: []SamplingRule{rule}})
+		assert.Error(t, err, rule)
+	}
+}
+
+func TestSampler_Every(t *testing.T) {
+	s := newTestSampler(t)
+	ctx := context.Background()
+	kept := []bool{}
+	for range 6 {
+		msg := rateEnvelope(t, "locks_mode", map[string]any{"count": 1})
+		kept = append(kept, s.Sample(ctx, msg))
+		if kept[len(kept)-1] {
+			assert.Equal(t, "0.3333333333333333", msg.CustomTags["sample_rate"])
+		}
+	}
+	assert.Equal(t, []bool{true, false, false, true, false, false}, kept)
+
+	// counted per source
+	msg := rateEnvelope(t, "locks_mode", map[string]any{"count": 1})
+	msg.DBName = "other"
+	assert.True(t, s.Sample(ctx, msg))
+	assert.True(t, s.Sample(WithTenant(ctx, "acme"), rateEnvelope(t, "locks_mode", map[string]any{"count": 1})))
+
+	// other metrics aren't sampled nor tagged
+	msg = rateEnvelope(t, "db_stats", map[string]any{"size": 1})
+	assert.True(t, s.Sample(ctx, msg))
+	assert.NotContains(t, msg.CustomTags, "sample_rate")
+}
+
+func TestSampler_EveryConcurrent(t *testing.T) {
+	s := newTestSampler(t)
+	ctx := context.Background()
+
+	// only one of concurrent envelopes is kept
+	keep, commit := s.sample(ctx, rateEnvelope(t, "locks_mode", map[string]any{"count": 1}))
+	assert.True(t, keep)
+	keepOther, _ := s.sample(ctx, rateEnvelope(t, "locks_mode", map[string]any{"count": 1}))
+	assert.False(t, keepOther)
+
+	// and kept again if it couldn't be stored
+	commit(false)
+	keep, commit = s.sample(ctx, rateEnvelope(t, "locks_mode", map[string]any{"count": 1}))
+	assert.True(t, keep)
+	commit(true)
+	assert.False(t, s.Sample(ctx, rateEnvelope(t, "locks_mode", map[string]any{"count": 1})))
+}
+
+func TestSampler_Percent(t *testing.T) {
+	s := newTestSampler(t)
+	draws := []float64{0.1, 0.9, 0.4, 0.6}
+	s.random = func() float64 {
+		draw := draws[0]
+		draws = append(draws[1:], draw)
+		return draw
+	}
+	rows := []map[string]any{}
+	for i := range 4 {
+		rows = append(rows, map[string]any{"relname": fmt.Sprint(i)})
+	}
+	msg := rateEnvelope(t, "table_stats", rows...)
+	assert.True(t, s.Sample(context.Background(), msg))
+	assert.Len(t, msg.Data, 2)
+	assert.Equal(t, "0", msg.Data[0].AsMap()["relname"])
+	assert.Equal(t, "2", msg.Data[1].AsMap()["relname"])
+	assert.Equal(t, "0.5", msg.CustomTags["sample_rate"])
+
+	// envelopes left without rows aren't kept
+	s.random = func() float64 { return 0.99 }
+	assert.False(t, s.Sample(context.Background(), rateEnvelope(t, "table_stats", rows...)))
+}
+
+func TestSampler_TopK(t *testing.T) {
+	s := newTestSampler(t)
+	handler := func(ctx context.Context, req any) (any, error) {
+		return &pb.Reply{Logmsg: "stored"}, nil
+	}
+	info := &grpc.UnaryServerInfo{FullMethod: pb.Receiver_UpdateMeasurements_FullMethodName}
+
+	msg := rateEnvelope(t, "stat_statements",
+		map[string]any{"queryid": 1, "total_time": 5},
+		map[string]any{"queryid": 2},
+		map[string]any{"queryid": 3, "total_time": 50},
+		map[string]any{"queryid": 4, "total_time": 20},
+	)
+	reply, err := s.UnaryInterceptor(context.Background(), msg, info, handler)
+	assert.NoError(t, err)
+	assert.Equal(t, "stored", reply.(*pb.Reply).GetLogmsg())
+	assert.Len(t, msg.Data, 2)
+	assert.Equal(t, 3.0, msg.Data[0].AsMap()["queryid"])
+	assert.Equal(t, 4.0, msg.Data[1].AsMap()["queryid"])
+	assert.Equal(t, "0.5", msg.CustomTags["sample_rate"])
+
+	// rows without the column come last
+	msg = rateEnvelope(t, "stat_statements", map[string]any{"queryid": 2}, map[string]any{"queryid": 1, "total_time": 5}, map[string]any{"queryid": 3})
+	assert.True(t, s.Sample(context.Background(), msg))
+	assert.Equal(t, 2.0, msg.Data[0].AsMap()["queryid"])
+	assert.Equal(t, 1.0, msg.Data[1].AsMap()["queryid"])
+
+	s, err = NewSampler(SamplingConfig{Metrics: []SamplingRule{{Metric: "locks", Every: 2}}})
+	assert.NoError(t, err)
+	_, _ = s.UnaryInterceptor(context.Background(), rateEnvelope(t, "locks", map[string]any{"count": 1}), info, handler)
+	reply, err = s.UnaryInterceptor(context.Background(), rateEnvelope(t, "locks", map[string]any{"count": 1}), info, handler)
+	assert.NoError(t, err)
+	assert.Equal(t, "dropped by sampling", reply.(*pb.Reply).GetLogmsg())
+
+	// kept envelopes the backend failed to store are kept again on retry
+	failing := func(ctx context.Context, req any) (any, error) { return nil, fmt.Errorf("backend down") }
+	_, err = s.UnaryInterceptor(context.Background(), rateEnvelope(t, "locks", map[string]any{"count": 1}), info, failing)
+	assert.Error(t, err)
+	reply, err = s.UnaryInterceptor(context.Background(), rateEnvelope(t, "locks", map[string]any{"count": 1}), info, handler)
+	assert.NoError(t, err)
+	assert.Equal(t, "stored", reply.(*pb.Reply).GetLogmsg())
+}
@@ -0,0 +1,208 @@
+package sinks
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"maps"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/destrex271/pgwatch3_rpc_server/sinks/pb"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+// if set, e.g. to "1m", receivers periodically store their own
+// operational stats, through their UpdateMeasurements
+var SERVER_SELF_MONITORING_INTERVAL = os.Getenv("PGWATCH_RPC_SERVER_SELF_MONITORING_INTERVAL")
+
+// DBName the stats are stored under, defaults to _receiver
+var SERVER_SELF_MONITORING_DBNAME = os.Getenv("PGWATCH_RPC_SERVER_SELF_MONITORING_DBNAME")
+
+// MetricName the stats are stored under
+const SelfMonitoringMetric = "receiver_stats"
+
+// counted by AddDeadLetter, for self monitoring
+var deadLetterCount atomic.Int64
+
+// StatsProvider is implemented by receivers adding their
+// own stats to self monitoring, e.g. their spool size
+type StatsProvider interface {
+	SelfStats() map[string]float64
+}
+
+// SelfMonitor counts the requests reaching a receiver, periodically
+// storing them with runtime stats as a receiver_stats measurement
+// of the reserved DBName, so that dashboards can show the health of
+// the pipeline alongside the database metrics
+type SelfMonitor struct {
+	receiver pb.ReceiverServer
+	dbName   string
+	interval time.Duration
+	tags     map[string]string
+	started  time.Time
+	// if set, stats aren't stored while in maintenance
+	maintenance *Maintenance
+
+	mu           sync.Mutex
+	since        time.Time
+	envelopes    int64
+	rows         int64
+	errors       int64
+	syncRequests int64
+	latencySum   time.Duration
+	latencyMax   time.Duration
+	deadLetters  int64
+}
+
+func NewSelfMonitor(receiver pb.ReceiverServer, dbName string, interval time.Duration) *SelfMonitor {
+	tags := map[string]string{"receiver": filepath.Base(os.Args[0])}
+	if hostname, err := os.Hostname(); err == nil {
+		tags["host"] = hostname
+	}
+	now := time.Now()
+	return &SelfMonitor{
+		receiver:    receiver,
+		dbName:      dbName,
+		interval:    interval,
+		tags:        tags,
+		started:     now,
+		since:       now,
+		deadLetters: deadLetterCount.Load(),
+	}
+}
+
+// NewSelfMonitorFromEnv returns nil if PGWATCH_RPC_SERVER_SELF_MONITORING_INTERVAL isn't set
+func NewSelfMonitorFromEnv(receiver pb.ReceiverServer) (*SelfMonitor, error) {
+	if SERVER_SELF_MONITORING_INTERVAL == "" {
+		return nil, nil
+	}
+	interval, err := parseDurationEnv("PGWATCH_RPC_SERVER_SELF_MONITORING_INTERVAL", SERVER_SELF_MONITORING_INTERVAL)
+	if err != nil {
+		return nil, err
+	}
+	if interval == 0 {
+		return nil, fmt.Errorf("invalid PGWATCH_RPC_SERVER_SELF_MONITORING_INTERVAL: %q", SERVER_SELF_MONITORING_INTERVAL)
+	}
+	dbName := SERVER_SELF_MONITORING_DBNAME
+	if dbName == "" {
+		dbName = "_receiver"
+	}
+	return NewSelfMonitor(receiver, dbName, interval), nil
+}
+
+// UnaryInterceptor counts requests reaching the receiver and the time
+// it takes to handle them. Envelopes of the reserved DBName are rejected
+func (m *SelfMonitor) UnaryInterceptor(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+	msg, isEnvelope := req.(*pb.MeasurementEnvelope)
+	if isEnvelope && msg.GetDBName() == m.dbName {
+		return nil, status.Errorf(codes.InvalidArgument, "DBName %s is reserved for the receiver's own stats", m.dbName)
+	}
+
+	start := time.Now()
+	reply, err := handler(ctx, req)
+	elapsed := time.Since(start)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err != nil {
+		m.errors++
+	}
+	switch {
+	case isEnvelope:
+		m.envelopes++
+		m.rows += int64(len(msg.GetData()))
+		m.latencySum += elapsed
+		m.latencyMax = max(m.latencyMax, elapsed)
+	case info.FullMethod == pb.Receiver_SyncMetric_FullMethodName:
+		m.syncRequests++
+	}
+	return reply, err
+}
+
+// Envelope returns the stats since the previous call
+func (m *SelfMonitor) Envelope(now time.Time) *pb.MeasurementEnvelope {
+	m.mu.Lock()
+	seconds := now.Sub(m.since).Seconds()
+	deadLetters := deadLetterCount.Load()
+	fields := map[string]float64{
+		"epoch_ns":             float64(now.UnixNano()),
+		"interval_s":           seconds,
+		"envelopes":            float64(m.envelopes),
+		"rows":                 float64(m.rows),
+		"errors":               float64(m.errors),
+		"sync_requests":        float64(m.syncRequests),
+		"dead_letters":         float64(deadLetters - m.deadLetters),
+		"write_latency_max_ms": float64(m.latencyMax) / float64(time.Millisecond),
+	}
+	if seconds > 0 {
+		fields["envelopes_per_sec"] = float64(m.envelopes) / seconds
+		fields["rows_per_sec"] = float64(m.rows) / seconds
+	}
+	if m.envelopes > 0 {
+		fields["write_latency_avg_ms"] = float64(m.latencySum) / float64(m.envelopes) / float64(time.Millisecond)
+	}
+	m.since, m.deadLetters = now, deadLetters
+	m.envelopes, m.rows, m.errors, m.syncRequests = 0, 0, 0, 0
+	m.latencySum, m.latencyMax = 0, 0
+	m.mu.Unlock()
+
+	var memStats runtime.MemStats
+	runtime.ReadMemStats(&memStats)
+	fields["uptime_s"] = now.Sub(m.started).Seconds()
+	fields["goroutines"] = float64(runtime.NumGoroutine())
+	fields["heap_alloc_bytes"] = float64(memStats.HeapAlloc)
+	fields["aggregates_failed_total"] = float64(aggregateFailures.Load())
+	fields["aggregate_late_rows_total"] = float64(aggregateLateRows.Load())
+	fields["cardinality_limited_total"] = float64(cardinalityLimited.Load())
+	fields["shed_total"] = float64(shedEnvelopes.Load())
+	if queue, ok := m.receiver.(interface{ SyncQueueLength() int }); ok {
+		fields["sync_queue_length"] = float64(queue.SyncQueueLength())
+	}
+	if queue, ok := m.receiver.(interface{ SyncStats() SyncStats }); ok {
+		stats := queue.SyncStats()
+		fields["sync_dropped_total"] = float64(stats.Dropped)
+		fields["sync_coalesced_total"] = float64(stats.Coalesced)
+	}
+	if provider, ok := m.receiver.(StatsProvider); ok {
+		maps.Copy(fields, provider.SelfStats())
+	}
+
+	row := &structpb.Struct{Fields: map[string]*structpb.Value{}}
+	for name, value := range fields {
+		row.Fields[name] = structpb.NewNumberValue(value)
+	}
+	return &pb.MeasurementEnvelope{
+		DBName:     m.dbName,
+		MetricName: SelfMonitoringMetric,
+		CustomTags: maps.Clone(m.tags),
+		Data:       []*structpb.Struct{row},
+	}
+}
+
+// Run stores the stats through the receiver every interval until ctx
+// is done. While in maintenance stats keep adding up until it's left
+func (m *SelfMonitor) Run(ctx context.Context) {
+	ticker := time.NewTicker(m.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			if m.maintenance != nil && m.maintenance.Mode() != "" {
+				continue
+			}
+			if _, err := m.receiver.UpdateMeasurements(ctx, m.Envelope(now)); err != nil {
+				log.Printf("[ERROR]: Unable to store receiver stats: %s", err)
+			}
+		}
+	}
+}
@@ -0,0 +1,139 @@
+package sinks
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/destrex271/pgwatch3_rpc_server/sinks/pb"
+	testutils "github.com/destrex271/pgwatch3_rpc_server/sinks/test_utils"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+type statsReceiver struct {
+	SyncMetricHandler
+
+	mu       sync.Mutex
+	received []*pb.MeasurementEnvelope
+}
+
+func (r *statsReceiver) UpdateMeasurements(ctx context.Context, msg *pb.MeasurementEnvelope) (*pb.Reply, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.received = append(r.received, msg)
+	return &pb.Reply{}, nil
+}
+
+func (r *statsReceiver) SelfStats() map[string]float64 {
+	return map[string]float64{"spool_bytes": 42}
+}
+
+func TestSelfMonitor(t *testing.T) {
+	receiver := &statsReceiver{SyncMetricHandler: NewSyncMetricHandler(10)}
+	m := NewSelfMonitor(receiver, "_receiver", time.Hour)
+	start := m.since
+
+	ok := func(ctx context.Context, req any) (any, error) { return &pb.Reply{}, nil }
+	failing := func(ctx context.Context, req any) (any, error) { return nil, errors.New("disk full") }
+	update := &grpc.UnaryServerInfo{FullMethod: pb.Receiver_UpdateMeasurements_FullMethodName}
+	syncInfo := &grpc.UnaryServerInfo{FullMethod: pb.Receiver_SyncMetric_FullMethodName}
+
+	_, err := m.UnaryInterceptor(context.Background(), testutils.GetTestMeasurementEnvelope(), update, ok)
+	assert.NoError(t, err)
+	_, err = m.UnaryInterceptor(context.Background(), testutils.GetTestMeasurementEnvelope(), update, failing)
+	assert.Error(t, err)
+	_, err = m.UnaryInterceptor(context.Background(), testutils.GetTestRPCSyncRequest(), syncInfo, ok)
+	assert.NoError(t, err)
+	_, err = receiver.SyncMetric(context.Background(), testutils.GetTestRPCSyncRequest())
+	assert.NoError(t, err)
+	AddDeadLetter("test_receiver", testutils.GetTestMeasurementEnvelope(), errors.New("disk full"))
+
+	// the reserved DBName can't be written by clients
+	msg := testutils.GetTestMeasurementEnvelope()
+	msg.DBName = "_receiver"
+	_, err = m.UnaryInterceptor(context.Background(), msg, update, ok)
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+
+	stats := m.Envelope(start.Add(2 * time.Second))
+	assert.Equal(t, "_receiver", stats.GetDBName())
+	assert.Equal(t, SelfMonitoringMetric, stats.GetMetricName())
+	assert.Contains(t, stats.GetCustomTags(), "receiver")
+	fields := stats.Data[0].AsMap()
+	assert.Equal(t, 2.0, fields["envelopes"])
+	assert.Equal(t, 1.0, fields["envelopes_per_sec"])
+	assert.Equal(t, 2.0, fields["rows"])
+	assert.Equal(t, 1.0, fields["errors"])
+	assert.Equal(t, 1.0, fields["sync_requests"])
+	assert.Equal(t, 1.0, fields["sync_queue_length"])
+	assert.Equal(t, 1.0, fields["dead_letters"])
+	assert.Equal(t, 0.0, fields["sync_dropped_total"])
+	assert.Equal(t, float64(cardinalityLimited.Load()), fields["cardinality_limited_total"])
+	assert.Equal(t, float64(shedEnvelopes.Load()), fields["shed_total"])
+	assert.Equal(t, 42.0, fields["spool_bytes"])
+	assert.Contains(t, fields, "write_latency_avg_ms")
+	assert.Positive(t, fields["goroutines"])
+	assert.NoError(t, IsValidMeasurement(stats))
+
+	// counters restart with every interval
+	fields = m.Envelope(start.Add(4 * time.Second)).Data[0].AsMap()
+	assert.Equal(t, 0.0, fields["envelopes"])
+	assert.Equal(t, 0.0, fields["dead_letters"])
+	assert.NotContains(t, fields, "write_latency_avg_ms")
+}
+
+func TestSelfMonitor_Run(t *testing.T) {
+	receiver := &statsReceiver{}
+	m := NewSelfMonitor(receiver, "_pipeline", 10*time.Millisecond)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		m.Run(ctx)
+		close(done)
+	}()
+
+	assert.Eventually(t, func() bool {
+		receiver.mu.Lock()
+		defer receiver.mu.Unlock()
+		return len(receiver.received) >= 2
+	}, 5*time.Second, 10*time.Millisecond)
+	cancel()
+	<-done
+	assert.Equal(t, "_pipeline", receiver.received[0].GetDBName())
+
+	// nothing is stored while in maintenance
+	maintenance, err := NewMaintenance(receiver, "", "")
+	assert.NoError(t, err)
+	assert.NoError(t, maintenance.Enter(""))
+	m.maintenance = maintenance
+	receiver.mu.Lock()
+	received := len(receiver.received)
+	receiver.mu.Unlock()
+	ctx, cancel = context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	m.Run(ctx)
+	assert.Len(t, receiver.received, received)
+}
+
+func TestNewSelfMonitorFromEnv(t *testing.T) {
+	m, err := NewSelfMonitorFromEnv(&statsReceiver{})
+	assert.NoError(t, err)
+	assert.Nil(t, m)
+
+	defer func() { SERVER_SELF_MONITORING_INTERVAL = "" }()
+	SERVER_SELF_MONITORING_INTERVAL = "1m"
+	m, err = NewSelfMonitorFromEnv(&statsReceiver{})
+	assert.NoError(t, err)
+	assert.Equal(t, "_receiver", m.dbName)
+	assert.Equal(t, time.Minute, m.interval)
+
+	for _, interval := range []string{"0s", "soon"} {
+		SERVER_SELF_MONITORING_INTERVAL = interval
+		_, err = NewSelfMonitorFromEnv(&statsReceiver{})
+		assert.Error(t, err)
+	}
+}
@@ -3,40 +3,298 @@ package sinks
 import (
 	"context"
 	"crypto/tls"
-	"fmt"
 	"log"
 	"net"
 	"os"
 
 	"github.com/destrex271/pgwatch3_rpc_server/sinks/pb"
+	"go.opentelemetry.io/contrib/instrumentation/google.golang.org/grpc/otelgrpc"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/credentials"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
 	"google.golang.org/grpc/metadata"
 	"google.golang.org/grpc/status"
 )
 
-func ListenAndServe(receiver pb.ReceiverServer, port string) error {
-	lis, err := net.Listen("tcp", fmt.Sprintf("0.0.0.0:%s", port))
+func ListenAndServe(receiver pb.ReceiverServer, port string, opts ...Option) error {
+	config := &serverConfig{}
+	for _, opt := range opts {
+		opt(config)
+	}
+
+	listeners, err := ServerListeners(port)
 	if err != nil {
 		return err
 	}
 
-	creds := LoadTLSCredentials()
-	server := grpc.NewServer(
-		grpc.Creds(creds),
-		grpc.ChainUnaryInterceptor(
-			AuthInterceptor,
-			MsgValidationInterceptor,
-		),
-	)
+	shutdownTracing, err := SetupTracing(context.Background())
+	if err != nil {
+		return err
+	}
+	defer func() { _ = shutdownTracing(context.Background()) }()
 
-	pb.RegisterReceiverServer(server, receiver)
+	shutdownMetrics, err := SetupMetrics(context.Background())
+	if err != nil {
+		return err
+	}
+	defer func() { _ = shutdownMetrics(context.Background()) }()
+
+	grpcOptions, err := ServerTuningOptions()
+	if err != nil {
+		return err
+	}
+	grpcOptions = append(grpcOptions, grpc.StatsHandler(otelgrpc.NewServerHandler()))
+	grpcOptions = append(grpcOptions, config.grpcOptions...)
+
+	interceptors, closeInterceptors, err := ServerInterceptors(receiver)
+	if err != nil {
+		return err
+	}
+	defer closeInterceptors()
+
+	maintenance, err := NewMaintenanceFromEnv(receiver)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = maintenance.Close() }()
+	// first, so that rejected requests leave no state behind
+	interceptors = append([]grpc.UnaryServerInterceptor{maintenance.UnaryInterceptor}, interceptors...)
+
+	var admin *Admin
+	if SERVER_ADMIN_PORT != "" {
+		admin = NewAdmin(receiver)
+		admin.maintenance = maintenance
+		// first to see every failed request, and
+		// once the tenant is known to track sources
+		interceptors = append([]grpc.UnaryServerInterceptor{admin.HistoryInterceptor}, interceptors...)
+		interceptors = append(interceptors, admin.UnaryInterceptor)
+	}
+
+	monitor, err := NewSelfMonitorFromEnv(receiver)
+	if err != nil {
+		return err
+	}
+	if monitor != nil {
+		monitor.maintenance = maintenance
+		// last, to count what reaches the receiver
+		interceptors = append(interceptors, monitor.UnaryInterceptor)
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		go monitor.Run(ctx)
+		log.Println("[INFO]: Storing receiver stats every " + SERVER_SELF_MONITORING_INTERVAL + " as DBName " + monitor.dbName)
+	}
+	interceptors = append(interceptors, config.interceptors...)
+	// last, so that buffered requests are written as the receiver would get them
+	interceptors = append(interceptors, maintenance.BufferInterceptor)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go maintenance.HandleSignals(ctx)
+	if buffered := maintenance.Buffered(); buffered > 0 {
+		log.Printf("[INFO]: Writing %d bytes buffered during a previous maintenance", buffered)
+		go func() {
+			if _, err := maintenance.Leave(ctx); err != nil {
+				log.Printf("[ERROR]: Unable to write requests buffered during maintenance: %s", err)
+			}
+		}()
+	}
+
+	netListeners := make([]net.Listener, 0, len(listeners))
+	for _, l := range listeners {
+		lis, err := l.Listen()
+		if err != nil {
+			for _, opened := range netListeners {
+				_ = opened.Close()
+			}
+			return err
+		}
+		netListeners = append(netListeners, lis)
+	}
+
+	servers := make([]*grpc.Server, 0, len(listeners))
+	errs := make(chan error, len(listeners)+2)
+	for i, l := range listeners {
+		server := NewServer(receiver, l, interceptors, grpcOptions...)
+		healthpb.RegisterHealthServer(server, maintenance.Health())
+		servers = append(servers, server)
+		log.Println("[INFO]: Listening on " + l.String())
+		go func(lis net.Listener) { errs <- server.Serve(lis) }(netListeners[i])
+	}
 	log.Println("[INFO]: Registered Receiver")
+
+	if SERVER_HTTP_PORT != "" {
+		httpInterceptors := append([]grpc.UnaryServerInterceptor{AuthInterceptor}, interceptors...)
+		go func() { errs <- ListenAndServeHTTP(receiver, SERVER_HTTP_PORT, httpInterceptors...) }()
+	}
+	if admin != nil {
+		go func() { errs <- ListenAndServeAdmin(admin, SERVER_ADMIN_PORT) }()
+	}
+
 	// if no error it should never return
-	return server.Serve(lis)
+	err = <-errs
+	for _, server := range servers {
+		server.Stop()
+	}
+	return err
+}
+
+// NewServer creates a gRPC server for the receiver applying
+// the auth/TLS policy of listener on top of interceptors and opts
+func NewServer(receiver pb.ReceiverServer, listener *Listener, interceptors []grpc.UnaryServerInterceptor, opts ...grpc.ServerOption) *grpc.Server {
+	chain := []grpc.UnaryServerInterceptor{}
+	if listener.Auth {
+		chain = append(chain, AuthInterceptor)
+	}
+	chain = append(chain, interceptors...)
+	// other services, e.g. health checks, skip auth and interceptors
+	receiverOnly := func(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+		if !receiverMethod(info.FullMethod) {
+			return handler(ctx, req)
+		}
+		return ChainUnaryInterceptors(chain...)(ctx, req, info, handler)
+	}
+
+	opts = append([]grpc.ServerOption{grpc.UnaryInterceptor(receiverOnly)}, opts...)
+	if listener.TLS != nil {
+		opts = append(opts, grpc.Creds(credentials.NewTLS(listener.TLS)))
+	}
+	server := grpc.NewServer(opts...)
+	pb.RegisterReceiverServer(server, receiver)
+	return server
+}
+
+// ServerInterceptors returns the interceptors every request goes
+// through before reaching the receiver, after authentication.
+// The returned function releases the resources they hold
+func ServerInterceptors(receiver pb.ReceiverServer) ([]grpc.UnaryServerInterceptor, func(), error) {
+	interceptors := []grpc.UnaryServerInterceptor{}
+	closers := []func() error{}
+	closeAll := func() {
+		for _, c := range closers {
+			_ = c()
+		}
+	}
+
+	tenants, err := NewTenantResolverFromEnv()
+	if err != nil {
+		return nil, nil, err
+	}
+	if tenants != nil {
+		log.Println("[INFO]: Multi-tenancy enabled")
+		interceptors = append(interceptors, tenants.UnaryInterceptor)
+	}
+
+	// early, so that shed envelopes cost as little as possible
+	shedder, err := NewLoadShedderFromEnv()
+	if err != nil {
+		return nil, nil, err
+	}
+	if shedder != nil {
+		closers = append(closers, shedder.Close)
+		log.Println("[INFO]: Shedding low priority envelopes as configured in " + SERVER_PRIORITY_FILE)
+		interceptors = append(interceptors, shedder.UnaryInterceptor)
+	}
+
+	// before recording, so that nothing sensitive is written to disk
+	redactor, err := NewRedactorFromEnv()
+	if err != nil {
+		closeAll()
+		return nil, nil, err
+	}
+	if redactor != nil {
+		log.Println("[INFO]: Redacting measurements as configured in " + SERVER_REDACT_FILE)
+		interceptors = append(interceptors, redactor.UnaryInterceptor)
+	}
+
+	if SERVER_RECORD_FILE != "" {
+		recorder, err := NewRecorder(SERVER_RECORD_FILE)
+		if err != nil {
+			closeAll()
+			return nil, nil, err
+		}
+		closers = append(closers, recorder.Close)
+		log.Println("[INFO]: Recording incoming requests to " + SERVER_RECORD_FILE)
+		interceptors = append(interceptors, recorder.UnaryInterceptor)
+	}
+	limits, err := LoadValidationLimits()
+	if err != nil {
+		closeAll()
+		return nil, nil, err
+	}
+	interceptors = append(interceptors, limits.UnaryInterceptor)
+
+	inventory, err := NewInventoryFromEnv()
+	if err != nil {
+		closeAll()
+		return nil, nil, err
+	}
+	if inventory != nil {
+		closers = append(closers, inventory.Close)
+		log.Println("[INFO]: Enriching measurements with tags from " + SERVER_INVENTORY_FILE)
+		interceptors = append(interceptors, inventory.UnaryInterceptor)
+	}
+
+	cardinality, err := NewCardinalityGuardFromEnv()
+	if err != nil {
+		closeAll()
+		return nil, nil, err
+	}
+	if cardinality != nil {
+		closers = append(closers, cardinality.Close)
+		log.Println("[INFO]: Enforcing cardinality limits configured in " + SERVER_CARDINALITY_FILE)
+		interceptors = append(interceptors, cardinality.UnaryInterceptor)
+	}
+
+	deduplicator, err := NewDeduplicatorFromEnv()
+	if err != nil {
+		closeAll()
+		return nil, nil, err
+	}
+	if deduplicator != nil {
+		log.Println("[INFO]: Suppressing duplicate envelopes within " + SERVER_DEDUP_WINDOW)
+		interceptors = append(interceptors, deduplicator.UnaryInterceptor)
+	}
+
+	rates, err := NewRateConverterFromEnv()
+	if err != nil {
+		closeAll()
+		return nil, nil, err
+	}
+	if rates != nil {
+		closers = append(closers, rates.Close)
+		log.Println("[INFO]: Converting counters to rates as configured in " + SERVER_RATES_FILE)
+		interceptors = append(interceptors, rates.UnaryInterceptor)
+	}
+
+	aggregator, err := NewAggregatorFromEnv(receiver)
+	if err != nil {
+		closeAll()
+		return nil, nil, err
+	}
+	if aggregator != nil {
+		closers = append(closers, aggregator.Close)
+		log.Println("[INFO]: Aggregating measurements as configured in " + SERVER_AGGREGATE_FILE)
+		interceptors = append(interceptors, aggregator.UnaryInterceptor)
+	}
+
+	// last, so that rates and aggregates are computed on every row
+	sampler, err := NewSamplerFromEnv()
+	if err != nil {
+		closeAll()
+		return nil, nil, err
+	}
+	if sampler != nil {
+		log.Println("[INFO]: Sampling measurements as configured in " + SERVER_SAMPLING_FILE)
+		interceptors = append(interceptors, sampler.UnaryInterceptor)
+	}
+
+	return interceptors, closeAll, nil
 }
 
+// if set, every request is recorded to this file (see Recorder)
+var SERVER_RECORD_FILE = os.Getenv("PGWATCH_RPC_SERVER_RECORD_FILE")
+
 var SERVER_USERNAME = os.Getenv("PGWATCH_RPC_SERVER_USERNAME")
 var SERVER_PASSWORD = os.Getenv("PGWATCH_RPC_SERVER_PASSWORD")
 
@@ -45,12 +303,12 @@ func AuthInterceptor(ctx context.Context, req any, info *grpc.UnaryServerInfo, h
 	authenticated := true
 
 	if ok && SERVER_USERNAME != "" {
-		clientUsername := md.Get("username")[0]
+		clientUsername := firstMetadataValue(md, "username")
 		authenticated = (clientUsername == SERVER_USERNAME)
 	}
 
 	if ok && SERVER_PASSWORD != "" {
-		clientPassword := md.Get("password")[0]
+		clientPassword := firstMetadataValue(md, "password")
 		authenticated = (clientPassword == SERVER_PASSWORD) && authenticated
 	}
 
@@ -61,29 +319,43 @@ func AuthInterceptor(ctx context.Context, req any, info *grpc.UnaryServerInfo, h
 	return handler(ctx, req)
 }
 
+// firstMetadataValue returns "" for missing keys, e.g.
+// HTTP/JSON requests sent without credentials
+func firstMetadataValue(md metadata.MD, key string) string {
+	values := md.Get(key)
+	if len(values) == 0 {
+		return ""
+	}
+	return values[0]
+}
+
 var SERVER_CERT = os.Getenv("PGWATCH_RPC_SERVER_CERT")
 var SERVER_KEY  = os.Getenv("PGWATCH_RPC_SERVER_KEY")
 
 func LoadTLSCredentials() credentials.TransportCredentials {
+	tlsConfig := LoadTLSConfig()
+	if tlsConfig == nil {
+		// results in grpc.Creds(nil) => ignoring encryption
+		return nil
+	}
+	return credentials.NewTLS(tlsConfig)
+}
+
+// LoadTLSConfig returns nil if no valid cert/key pair is configured
+func LoadTLSConfig() *tls.Config {
 	cert, err := tls.LoadX509KeyPair(SERVER_CERT, SERVER_KEY)
 	if err != nil {
-		// results in grpc.Creds(nil) => ignoring encryption
 		return nil
 	}
 
 	log.Println("Valid cert/key pair detected - enabling TLS")
-	tlsConfig := &tls.Config{
+	return &tls.Config{
 		Certificates: []tls.Certificate{cert},
 	}
-	return credentials.NewTLS(tlsConfig)
 }
 
-func MsgValidationInterceptor(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {  
-	msg, ok := req.(*pb.MeasurementEnvelope)
-	if ok {
-		if err := IsValidMeasurement(msg); err != nil {
-			return nil, err
-		}
-	}
-    return handler(ctx, req)  
+// MsgValidationInterceptor rejects invalid measurements, without any
+// limits, ServerInterceptors applies the ones set in env variables
+func MsgValidationInterceptor(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+	return (&ValidationLimits{}).UnaryInterceptor(ctx, req, info, handler)
 }
\ No newline at end of file
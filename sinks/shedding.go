@@ -0,0 +1,355 @@
+package sinks
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"path"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/destrex271/pgwatch3_rpc_server/sinks/pb"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+	"gopkg.in/yaml.v3"
+)
+
+// if set, YAML file configuring envelope priorities and
+// the limits over which envelopes are shed (see PriorityConfig)
+var SERVER_PRIORITY_FILE = os.Getenv("PGWATCH_RPC_SERVER_PRIORITY_FILE")
+
+// reasons envelopes are shed for
+const (
+	ShedQueueFull = "queue_full"
+	ShedTimeout   = "timeout"
+	ShedPreempted = "preempted"
+)
+
+// PriorityRule assigns Priority to the envelopes whose MetricName and
+// DBName match the Metric and DBName path.Match patterns, empty ones match all
+type PriorityRule struct {
+	Metric   string `yaml:"metric"`
+	DBName   string `yaml:"dbname"`
+	Priority int    `yaml:"priority"`
+}
+
+type PriorityConfig struct {
+	// envelopes handled concurrently, defaults to 64
+	MaxInFlight int `yaml:"max_in_flight"`
+	// envelopes waiting for their turn, defaults to 1000
+	MaxQueued int `yaml:"max_queued"`
+	// total size of the waiting envelopes, unlimited if 0
+	MaxQueuedBytes int `yaml:"max_queued_bytes"`
+	// how long envelopes wait for their turn, defaults to 5s
+	MaxWait time.Duration `yaml:"max_wait"`
+	// how often shed envelopes are logged, defaults to 1m
+	ReportInterval time.Duration `yaml:"report_interval"`
+	// priority of envelopes no rule matches
+	DefaultPriority int `yaml:"default_priority"`
+	// the first matching rule applies
+	Priorities []PriorityRule `yaml:"priorities"`
+}
+
+// LoadPriorityConfig reads the priorities and limits from a YAML file
+func LoadPriorityConfig(path string) (PriorityConfig, error) {
+	config := PriorityConfig{}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return config, err
+	}
+	if err := yaml.Unmarshal(data, &config); err != nil {
+		return config, fmt.Errorf("invalid priority file %s: %w", path, err)
+	}
+	return config, nil
+}
+
+// ShedCount is the number of envelopes of a metric shed for a reason
+type ShedCount struct {
+	Metric   string
+	Priority int
+	Reason   string
+	Count    int64
+}
+
+type shedWaiter struct {
+	priority int
+	seq      uint64
+	size     int
+	// receives nil once the envelope got its turn, or why it's shed
+	ready  chan error
+	queued bool
+}
+
+// number of envelopes shed, reported by SelfMonitor and the admin API
+var shedEnvelopes atomic.Int64
+
+// LoadShedder limits the envelopes handled concurrently, the others wait
+// for their turn by priority. When too many wait, or for too long, the
+// lowest priority envelopes are shed, answered with ResourceExhausted
+type LoadShedder struct {
+	config PriorityConfig
+
+	mu          sync.Mutex
+	inFlight    int
+	queue       []*shedWaiter
+	queuedBytes int
+	seq         uint64
+	// since the last report
+	shed map[ShedCount]int64
+
+	shedCounter metric.Int64Counter
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+func NewLoadShedder(config PriorityConfig) (*LoadShedder, error) {
+	if config.MaxInFlight == 0 {
+		config.MaxInFlight = 64
+	}
+	if config.MaxQueued == 0 {
+		config.MaxQueued = 1000
+	}
+	if config.MaxWait == 0 {
+		config.MaxWait = 5 * time.Second
+	}
+	if config.ReportInterval == 0 {
+		config.ReportInterval = time.Minute
+	}
+	switch {
+	case config.MaxInFlight < 0 || config.MaxQueued < 0 || config.MaxQueuedBytes < 0:
+		return nil, fmt.Errorf("invalid load shedding limits")
+	case config.MaxWait < 0 || config.ReportInterval < 0:
+		return nil, fmt.Errorf("invalid load shedding intervals")
+	}
+	for i, rule := range config.Priorities {
+		for _, pattern := range []string{rule.Metric, rule.DBName} {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return nil, fmt.Errorf("priority rule %d: invalid pattern %q", i+1, pattern)
+			}
+		}
+	}
+
+	s := &LoadShedder{
+		config: config,
+		shed:   map[ShedCount]int64{},
+		stop:   make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+	var err error
+	s.shedCounter, err = otel.Meter(tracerName).Int64Counter("pgwatch_rpc.shed",
+		metric.WithDescription("Envelopes shed because the receiver was overloaded"))
+	if err != nil {
+		return nil, err
+	}
+	go s.run()
+	return s, nil
+}
+
+// NewLoadShedderFromEnv returns nil if PGWATCH_RPC_SERVER_PRIORITY_FILE isn't set
+func NewLoadShedderFromEnv() (*LoadShedder, error) {
+	if SERVER_PRIORITY_FILE == "" {
+		return nil, nil
+	}
+	config, err := LoadPriorityConfig(SERVER_PRIORITY_FILE)
+	if err != nil {
+		return nil, err
+	}
+	return NewLoadShedder(config)
+}
+
+func (s *LoadShedder) run() {
+	defer close(s.done)
+	ticker := time.NewTicker(s.config.ReportInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.stop:
+			return
+		case <-ticker.C:
+			s.Report()
+		}
+	}
+}
+
+func (s *LoadShedder) Close() error {
+	close(s.stop)
+	<-s.done
+	return nil
+}
+
+// Priority returns the priority of the envelopes of metricName and dbName
+func (s *LoadShedder) Priority(metricName, dbName string) int {
+	for _, rule := range s.config.Priorities {
+		if matched, _ := path.Match(rule.Metric, metricName); rule.Metric != "" && !matched {
+			continue
+		}
+		if matched, _ := path.Match(rule.DBName, dbName); rule.DBName != "" && !matched {
+			continue
+		}
+		return rule.Priority
+	}
+	return s.config.DefaultPriority
+}
+
+// Acquire waits for the turn of an envelope of priority and size, the
+// returned error tells why it was shed. Release must follow a nil error
+func (s *LoadShedder) Acquire(ctx context.Context, priority, size int) error {
+	s.mu.Lock()
+	if s.inFlight < s.config.MaxInFlight && len(s.queue) == 0 {
+		s.inFlight++
+		s.mu.Unlock()
+		return nil
+	}
+
+	// make room by shedding lower priority envelopes, latest first
+	for len(s.queue) >= s.config.MaxQueued || (s.config.MaxQueuedBytes > 0 && s.queuedBytes+size > s.config.MaxQueuedBytes) {
+		if len(s.queue) == 0 {
+			s.mu.Unlock()
+			return shedError(ShedQueueFull)
+		}
+		victim := slices.MinFunc(s.queue, func(a, b *shedWaiter) int {
+			return cmp.Or(cmp.Compare(a.priority, b.priority), cmp.Compare(b.seq, a.seq))
+		})
+		if victim.priority >= priority {
+			s.mu.Unlock()
+			return shedError(ShedQueueFull)
+		}
+		s.dequeue(victim)
+		victim.ready <- shedError(ShedPreempted)
+	}
+
+	s.seq++
+	w := &shedWaiter{priority: priority, seq: s.seq, size: size, ready: make(chan error, 1), queued: true}
+	s.queue = append(s.queue, w)
+	s.queuedBytes += size
+	s.mu.Unlock()
+
+	timer := time.NewTimer(s.config.MaxWait)
+	defer timer.Stop()
+	var err error
+	select {
+	case err = <-w.ready:
+		return err
+	case <-timer.C:
+		err = shedError(ShedTimeout)
+	case <-ctx.Done():
+		err = status.FromContextError(ctx.Err()).Err()
+	}
+
+	s.mu.Lock()
+	if w.queued {
+		s.dequeue(w)
+		s.mu.Unlock()
+		return err
+	}
+	s.mu.Unlock()
+	// got its turn or was preempted meanwhile
+	if readyErr := <-w.ready; readyErr == nil {
+		s.Release()
+	}
+	return err
+}
+
+// Release passes the turn of a handled envelope to the
+// highest priority waiting one, the oldest first
+func (s *LoadShedder) Release() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.queue) == 0 {
+		s.inFlight--
+		return
+	}
+	next := slices.MaxFunc(s.queue, func(a, b *shedWaiter) int {
+		return cmp.Or(cmp.Compare(a.priority, b.priority), cmp.Compare(b.seq, a.seq))
+	})
+	s.dequeue(next)
+	next.ready <- nil
+}
+
+// dequeue removes w from the queue, s.mu must be held
+func (s *LoadShedder) dequeue(w *shedWaiter) {
+	s.queue = slices.DeleteFunc(s.queue, func(queued *shedWaiter) bool { return queued == w })
+	s.queuedBytes -= w.size
+	w.queued = false
+}
+
+// ShedError is returned for shed envelopes, as ResourceExhausted
+type ShedError struct {
+	Reason string
+}
+
+func shedError(reason string) error {
+	return &ShedError{Reason: reason}
+}
+
+func (e *ShedError) Error() string {
+	return e.GRPCStatus().Err().Error()
+}
+
+func (e *ShedError) GRPCStatus() *status.Status {
+	return status.Newf(codes.ResourceExhausted, "shed, receiver overloaded (%s)", e.Reason)
+}
+
+func (s *LoadShedder) count(ctx context.Context, metricName string, priority int, reason string) {
+	key := ShedCount{Metric: metricName, Priority: priority, Reason: reason}
+	s.mu.Lock()
+	s.shed[key]++
+	s.mu.Unlock()
+	shedEnvelopes.Add(1)
+	s.shedCounter.Add(ctx, 1, metric.WithAttributes(
+		attribute.String("metric", metricName),
+		attribute.Int("priority", priority),
+		attribute.String("reason", reason),
+	))
+}
+
+func sortedShedCounts(counts map[ShedCount]int64) []ShedCount {
+	result := make([]ShedCount, 0, len(counts))
+	for key, count := range counts {
+		key.Count = count
+		result = append(result, key)
+	}
+	slices.SortFunc(result, func(a, b ShedCount) int {
+		return cmp.Or(cmp.Compare(a.Priority, b.Priority), cmp.Compare(a.Metric, b.Metric), cmp.Compare(a.Reason, b.Reason))
+	})
+	return result
+}
+
+// Report logs the envelopes shed since the previous report
+func (s *LoadShedder) Report() {
+	s.mu.Lock()
+	counts := sortedShedCounts(s.shed)
+	clear(s.shed)
+	s.mu.Unlock()
+	for _, count := range counts {
+		log.Printf("[WARNING]: Shed %d envelopes of metric %s, priority %d, %s", count.Count, count.Metric, count.Priority, count.Reason)
+	}
+}
+
+// UnaryInterceptor makes envelopes wait for their turn,
+// other requests are never shed nor count as in flight
+func (s *LoadShedder) UnaryInterceptor(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+	msg, ok := req.(*pb.MeasurementEnvelope)
+	if !ok {
+		return handler(ctx, req)
+	}
+	priority := s.Priority(msg.GetMetricName(), msg.GetDBName())
+	if err := s.Acquire(ctx, priority, proto.Size(msg)); err != nil {
+		if shed, ok := err.(*ShedError); ok {
+			s.count(ctx, msg.GetMetricName(), priority, shed.Reason)
+		}
+		return nil, err
+	}
+	defer s.Release()
+	return handler(ctx, req)
+}
@@ -0,0 +1,159 @@
+package sinks
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/destrex271/pgwatch3_rpc_server/sinks/pb"
+	testutils "github.com/destrex271/pgwatch3_rpc_server/sinks/test_utils"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func newTestLoadShedder(t *testing.T, config PriorityConfig) *LoadShedder {
+	config.Priorities = []PriorityRule{
+		{Metric: "replication*", Priority: 10},
+		{Metric: "wal", DBName: "prod*", Priority: 10},
+		{Metric: "stat_statements", Priority: -10},
+	}
+	s, err := NewLoadShedder(config)
+	assert.NoError(t, err)
+	t.Cleanup(func() { _ = s.Close() })
+	return s
+}
+
+// acquireAsync returns the result of Acquire once it's waiting in the queue
+func acquireAsync(t *testing.T, s *LoadShedder, priority int) chan error {
+	result := make(chan error, 1)
+	s.mu.Lock()
+	queued := len(s.queue)
+	s.mu.Unlock()
+	go func() { result <- s.Acquire(context.Background(), priority, 1) }()
+	assert.Eventually(t, func() bool {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		return len(s.queue) > queued
+	}, time.Second, time.Millisecond)
+	return result
+}
+
+func TestLoadPriorityConfig(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "priority.yaml")
+	assert.NoError(t, os.WriteFile(path, []byte("max_in_flight: 8\nmax_wait: 1s\npriorities:\n  - metric: wal\n    priority: 5\n"), 0644))
+	config, err := LoadPriorityConfig(path)
+	assert.NoError(t, err)
+	assert.Equal(t, PriorityConfig{MaxInFlight: 8, MaxWait: time.Second, Priorities: []PriorityRule{{Metric: "wal", Priority: 5}}}, config)
+
+	for _, config := range []PriorityConfig{
+		{MaxInFlight: -1},
+		{MaxWait: -time.Second},
+		{Priorities: []PriorityRule{{Metric: "["}}},
+	} {
+		_, err := NewLoadShedder(config)
+		assert.Error(t, err)
+	}
+}
+
+func TestLoadShedder_Priority(t *testing.T) {
+	s := newTestLoadShedder(t, PriorityConfig{DefaultPriority: 1})
+	assert.Equal(t, 10, s.Priority("replication_slots", "db1"))
+	assert.Equal(t, 10, s.Priority("wal", "prod1"))
+	assert.Equal(t, 1, s.Priority("wal", "test1"))
+	assert.Equal(t, -10, s.Priority("stat_statements", "prod1"))
+	assert.Equal(t, 1, s.Priority("db_stats", "prod1"))
+}
+
+func TestLoadShedder_Queue(t *testing.T) {
+	s := newTestLoadShedder(t, PriorityConfig{MaxInFlight: 1, MaxQueued: 2, MaxWait: time.Minute})
+	ctx := context.Background()
+	assert.NoError(t, s.Acquire(ctx, 0, 1))
+
+	low := acquireAsync(t, s, -10)
+	normal := acquireAsync(t, s, 0)
+	// the queue is full, lower priority envelopes make room
+	high := make(chan error, 1)
+	go func() { high <- s.Acquire(ctx, 10, 1) }()
+	assert.Equal(t, &ShedError{Reason: ShedPreempted}, <-low)
+	err := s.Acquire(ctx, -10, 1)
+	assert.Equal(t, codes.ResourceExhausted, status.Code(err))
+	assert.Equal(t, &ShedError{Reason: ShedQueueFull}, err)
+
+	// highest priority first
+	s.Release()
+	assert.NoError(t, <-high)
+	select {
+	case <-normal:
+		t.Fatal("lower priority envelope got its turn first")
+	default:
+	}
+	s.Release()
+	assert.NoError(t, <-normal)
+	s.Release()
+	assert.Zero(t, s.inFlight)
+}
+
+func TestLoadShedder_Timeout(t *testing.T) {
+	s := newTestLoadShedder(t, PriorityConfig{MaxInFlight: 1, MaxWait: 20 * time.Millisecond})
+	update := &grpc.UnaryServerInfo{FullMethod: pb.Receiver_UpdateMeasurements_FullMethodName}
+	release := make(chan struct{})
+	blocking := func(ctx context.Context, req any) (any, error) {
+		<-release
+		return &pb.Reply{}, nil
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := s.UnaryInterceptor(context.Background(), testutils.GetTestMeasurementEnvelope(), update, blocking)
+		done <- err
+	}()
+	assert.Eventually(t, func() bool {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		return s.inFlight == 1
+	}, time.Second, time.Millisecond)
+
+	shed := shedEnvelopes.Load()
+	msg := testutils.GetTestMeasurementEnvelope()
+	msg.MetricName = "stat_statements"
+	_, err := s.UnaryInterceptor(context.Background(), msg, update, blocking)
+	assert.Equal(t, &ShedError{Reason: ShedTimeout}, err)
+	// other requests aren't limited
+	_, err = s.UnaryInterceptor(context.Background(), testutils.GetTestRPCSyncRequest(),
+		&grpc.UnaryServerInfo{FullMethod: pb.Receiver_SyncMetric_FullMethodName},
+		func(ctx context.Context, req any) (any, error) { return &pb.Reply{}, nil })
+	assert.NoError(t, err)
+
+	close(release)
+	assert.NoError(t, <-done)
+	assert.Zero(t, s.inFlight)
+	assert.Equal(t, map[ShedCount]int64{{Metric: "stat_statements", Priority: -10, Reason: ShedTimeout}: 1}, s.shed)
+	assert.Equal(t, shed+1, shedEnvelopes.Load())
+	s.Report()
+	assert.Empty(t, s.shed)
+}
+
+func TestLoadShedder_QueuedBytes(t *testing.T) {
+	s := newTestLoadShedder(t, PriorityConfig{MaxInFlight: 1, MaxQueuedBytes: 10, MaxWait: time.Minute})
+	assert.NoError(t, s.Acquire(context.Background(), 0, 1))
+	err := s.Acquire(context.Background(), 10, 11)
+	assert.Equal(t, &ShedError{Reason: ShedQueueFull}, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	result := make(chan error, 1)
+	go func() { result <- s.Acquire(ctx, 0, 5) }()
+	assert.Eventually(t, func() bool {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		return s.queuedBytes == 5
+	}, time.Second, time.Millisecond)
+	cancel()
+	assert.Equal(t, codes.Canceled, status.Code(<-result))
+	assert.Zero(t, s.queuedBytes)
+	s.Release()
+	assert.Zero(t, s.inFlight)
+}
@@ -86,6 +86,97 @@ func TestDefaultHandleSyncMetric(t *testing.T) {
 	}
 }
 
+func TestSyncMetricHandler_Coalesce(t *testing.T) {
+	handler := NewSyncMetricHandler(10)
+	ctx := context.Background()
+	send := func(db, metric string, op pb.SyncOp) {
+		_, err := handler.SyncMetric(ctx, &pb.SyncReq{DBName: db, MetricName: metric, Operation: op})
+		assert.NoError(t, err)
+	}
+
+	send("db1", "m1", pb.SyncOp_AddOp)
+	send("db1", "m1", pb.SyncOp_AddOp)
+	send("db1", "m1", pb.SyncOp_DeleteOp)
+	send("db2", "m1", pb.SyncOp_AddOp)
+	// a database wide delete isn't overtaken by a later add
+	send("db2", "", pb.SyncOp_DeleteOp)
+	send("db2", "m1", pb.SyncOp_AddOp)
+	assert.Equal(t, 4, handler.SyncQueueLength())
+	assert.Equal(t, SyncStats{Coalesced: 2}, handler.SyncStats())
+
+	handled := []string{}
+	done := make(chan struct{})
+	go func() {
+		handler.HandleSyncMetricFunc(func(req *pb.SyncReq) error {
+			handled = append(handled, fmt.Sprintf("%s/%s/%s", req.GetDBName(), req.GetMetricName(), req.GetOperation()))
+			return fmt.Errorf("logged")
+		})
+		close(done)
+	}()
+	assert.Eventually(t, func() bool { return handler.SyncQueueLength() == 0 }, time.Second, 10*time.Millisecond)
+	handler.CloseSync()
+	<-done
+	assert.Equal(t, []string{"db1/m1/DeleteOp", "db2/m1/AddOp", "db2//DeleteOp", "db2/m1/AddOp"}, handled)
+
+	// handled requests aren't coalesced into
+	handler = NewSyncMetricHandler(10)
+	send("db1", "m1", pb.SyncOp_AddOp)
+	req, ok := handler.GetSyncChannelContent()
+	assert.True(t, ok)
+	send("db1", "m1", pb.SyncOp_DeleteOp)
+	assert.Equal(t, pb.SyncOp_AddOp, req.GetOperation())
+	assert.Equal(t, 1, handler.SyncQueueLength())
+}
+
+func TestSyncMetricHandler_Backpressure(t *testing.T) {
+	handler := NewSyncMetricHandler(1, WithSyncTimeout(0))
+	_, err := handler.SyncMetric(context.Background(), &pb.SyncReq{DBName: "db1", Operation: pb.SyncOp_AddOp})
+	assert.NoError(t, err)
+	_, err = handler.SyncMetric(context.Background(), &pb.SyncReq{DBName: "db2", Operation: pb.SyncOp_AddOp})
+	assert.Equal(t, codes.ResourceExhausted, status.Code(err))
+
+	handler = NewSyncMetricHandler(1, WithSyncTimeout(50*time.Millisecond))
+	_, err = handler.SyncMetric(context.Background(), &pb.SyncReq{DBName: "db1", Operation: pb.SyncOp_AddOp})
+	assert.NoError(t, err)
+	start := time.Now()
+	_, err = handler.SyncMetric(context.Background(), &pb.SyncReq{DBName: "db2", Operation: pb.SyncOp_AddOp})
+	assert.Equal(t, codes.ResourceExhausted, status.Code(err))
+	assert.GreaterOrEqual(t, time.Since(start), 50*time.Millisecond)
+	assert.Equal(t, SyncStats{Dropped: 1}, handler.SyncStats())
+
+	// waiting requests get in once there's room
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		_, _ = handler.GetSyncChannelContent()
+	}()
+	_, err = handler.SyncMetric(context.Background(), &pb.SyncReq{DBName: "db3", Operation: pb.SyncOp_AddOp})
+	assert.NoError(t, err)
+}
+
+func TestSyncMetricHandler_Close(t *testing.T) {
+	handler := NewSyncMetricHandler(10)
+	done := make(chan struct{})
+	go func() {
+		handler.HandleSyncMetric()
+		close(done)
+	}()
+	handler.CloseSync()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("HandleSyncMetric didn't return once closed")
+	}
+
+	_, err := handler.SyncMetric(context.Background(), testutils.GetTestRPCSyncRequest())
+	assert.Equal(t, codes.Unavailable, status.Code(err))
+	_, ok := handler.GetSyncChannelContent()
+	assert.False(t, ok)
+
+	// receivers without a handler don't hang
+	_, err = SyncMetricHandler{}.SyncMetric(context.Background(), testutils.GetTestRPCSyncRequest())
+	assert.Equal(t, codes.Unimplemented, status.Code(err))
+}
+
 func TestIsValidMeasurement(t *testing.T) {
 	msg := &pb.MeasurementEnvelope{}
 	err := IsValidMeasurement(msg)
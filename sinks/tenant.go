@@ -0,0 +1,129 @@
+package sinks
+
+import (
+	"context"
+	"crypto/subtle"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// comma separated list of `tenant=username:password`, callers
+// authenticating with these credentials belong to the tenant
+var SERVER_TENANTS = os.Getenv("PGWATCH_RPC_SERVER_TENANTS")
+
+// metadata key (HTTP header) holding the tenant of callers,
+// e.g. set by a trusted proxy. Ignored if PGWATCH_RPC_SERVER_TENANTS is set
+var SERVER_TENANT_HEADER = os.Getenv("PGWATCH_RPC_SERVER_TENANT_HEADER")
+
+// tenants end up in paths, topics, index names... keep them simple
+var validTenant = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9_-]{0,63}$`)
+
+type tenantKey struct{}
+
+// WithTenant returns a copy of ctx carrying tenant
+func WithTenant(ctx context.Context, tenant string) context.Context {
+	return context.WithValue(ctx, tenantKey{}, tenant)
+}
+
+// Tenant returns the tenant the request belongs to,
+// "" if multi-tenancy isn't enabled
+func Tenant(ctx context.Context) string {
+	tenant, _ := ctx.Value(tenantKey{}).(string)
+	return tenant
+}
+
+// TenantPrefix returns the tenant followed by sep, "" if there's
+// no tenant, to namespace e.g. topics or index names
+func TenantPrefix(ctx context.Context, sep string) string {
+	if tenant := Tenant(ctx); tenant != "" {
+		return tenant + sep
+	}
+	return ""
+}
+
+type tenantCredentials struct {
+	password string
+	tenant   string
+}
+
+// TenantResolver derives the tenant of requests from the caller's
+// credentials or from a metadata header and attaches it to their context
+type TenantResolver struct {
+	// by username
+	credentials map[string]tenantCredentials
+	header      string
+}
+
+// NewTenantResolver parses tenants, as in PGWATCH_RPC_SERVER_TENANTS,
+// if empty the tenant is read from the header metadata key
+func NewTenantResolver(tenants, header string) (*TenantResolver, error) {
+	r := &TenantResolver{credentials: map[string]tenantCredentials{}, header: strings.ToLower(header)}
+	for _, entry := range strings.Split(tenants, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		tenant, creds, _ := strings.Cut(entry, "=")
+		username, password, ok := strings.Cut(creds, ":")
+		if !ok || username == "" {
+			return nil, fmt.Errorf("invalid tenant %q: expected tenant=username:password", tenant)
+		}
+		if !validTenant.MatchString(tenant) {
+			return nil, fmt.Errorf("invalid tenant %q: must match %s", tenant, validTenant)
+		}
+		if _, exists := r.credentials[username]; exists {
+			return nil, fmt.Errorf("invalid tenant %q: username %q already used", tenant, username)
+		}
+		r.credentials[username] = tenantCredentials{password: password, tenant: tenant}
+	}
+
+	if len(r.credentials) == 0 && r.header == "" {
+		return nil, fmt.Errorf("no tenant credentials nor header configured")
+	}
+	return r, nil
+}
+
+// NewTenantResolverFromEnv returns nil if multi-tenancy isn't configured
+func NewTenantResolverFromEnv() (*TenantResolver, error) {
+	if SERVER_TENANTS == "" && SERVER_TENANT_HEADER == "" {
+		return nil, nil
+	}
+	return NewTenantResolver(SERVER_TENANTS, SERVER_TENANT_HEADER)
+}
+
+// Resolve returns the tenant of a caller given its metadata
+func (r *TenantResolver) Resolve(md metadata.MD) (string, error) {
+	if len(r.credentials) > 0 {
+		creds, ok := r.credentials[firstMetadataValue(md, "username")]
+		password := firstMetadataValue(md, "password")
+		if !ok || subtle.ConstantTimeCompare([]byte(creds.password), []byte(password)) != 1 {
+			return "", status.Error(codes.Unauthenticated, "invalid username or password")
+		}
+		return creds.tenant, nil
+	}
+
+	tenant := firstMetadataValue(md, r.header)
+	if tenant == "" {
+		return "", status.Errorf(codes.Unauthenticated, "missing %s header", r.header)
+	}
+	if !validTenant.MatchString(tenant) {
+		return "", status.Errorf(codes.InvalidArgument, "invalid tenant %q: must match %s", tenant, validTenant)
+	}
+	return tenant, nil
+}
+
+func (r *TenantResolver) UnaryInterceptor(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+	md, _ := metadata.FromIncomingContext(ctx)
+	tenant, err := r.Resolve(md)
+	if err != nil {
+		return nil, err
+	}
+	return handler(WithTenant(ctx, tenant), req)
+}
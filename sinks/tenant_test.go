@@ -0,0 +1,101 @@
+package sinks
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/destrex271/pgwatch3_rpc_server/sinks/pb"
+	testutils "github.com/destrex271/pgwatch3_rpc_server/sinks/test_utils"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+func TestTenant(t *testing.T) {
+	ctx := context.Background()
+	assert.Equal(t, "", Tenant(ctx))
+	assert.Equal(t, "", TenantPrefix(ctx, "."))
+
+	ctx = WithTenant(ctx, "acme")
+	assert.Equal(t, "acme", Tenant(ctx))
+	assert.Equal(t, "acme.", TenantPrefix(ctx, "."))
+}
+
+func TestNewTenantResolver(t *testing.T) {
+	_, err := NewTenantResolver("", "")
+	assert.Error(t, err)
+
+	for _, tenants := range []string{"acme", "acme=user", "../acme=user:pass", "a=user:pass,b=user:pass"} {
+		_, err = NewTenantResolver(tenants, "")
+		assert.Error(t, err, tenants)
+	}
+
+	r, err := NewTenantResolver("acme=alice:secret, globex=bob:pass:word", "")
+	assert.NoError(t, err)
+	assert.Equal(t, tenantCredentials{password: "pass:word", tenant: "globex"}, r.credentials["bob"])
+}
+
+func TestTenantResolver_Resolve(t *testing.T) {
+	r, err := NewTenantResolver("acme=alice:secret,globex=bob:password", "X-Tenant")
+	assert.NoError(t, err)
+
+	tenant, err := r.Resolve(metadata.Pairs("username", "bob", "password", "password"))
+	assert.NoError(t, err)
+	assert.Equal(t, "globex", tenant)
+
+	// credentials take precedence over the header
+	for _, md := range []metadata.MD{
+		metadata.Pairs("username", "bob", "password", "secret"),
+		metadata.Pairs("username", "eve", "password", "secret"),
+		metadata.Pairs("x-tenant", "acme"),
+	} {
+		_, err = r.Resolve(md)
+		assert.Equal(t, codes.Unauthenticated, status.Code(err), md)
+	}
+
+	r, err = NewTenantResolver("", "X-Tenant")
+	assert.NoError(t, err)
+	tenant, err = r.Resolve(metadata.Pairs("x-tenant", "acme"))
+	assert.NoError(t, err)
+	assert.Equal(t, "acme", tenant)
+
+	_, err = r.Resolve(metadata.MD{})
+	assert.Equal(t, codes.Unauthenticated, status.Code(err))
+	_, err = r.Resolve(metadata.Pairs("x-tenant", "../acme"))
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+}
+
+func TestTenantResolver_UnaryInterceptor(t *testing.T) {
+	r, err := NewTenantResolver("", "x-tenant")
+	assert.NoError(t, err)
+
+	var tenant string
+	handler := func(ctx context.Context, req any) (any, error) {
+		tenant = Tenant(ctx)
+		return &pb.Reply{}, nil
+	}
+	ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs("x-tenant", "acme"))
+	_, err = r.UnaryInterceptor(ctx, testutils.GetTestMeasurementEnvelope(), &grpc.UnaryServerInfo{}, handler)
+	assert.NoError(t, err)
+	assert.Equal(t, "acme", tenant)
+}
+
+func TestDeduplicator_Tenants(t *testing.T) {
+	d := NewDeduplicator(time.Minute, 100)
+	calls := 0
+	handler := func(ctx context.Context, req any) (any, error) {
+		calls++
+		return &pb.Reply{}, nil
+	}
+
+	// the same envelope sent by different tenants isn't a duplicate
+	for _, tenant := range []string{"acme", "globex", "acme"} {
+		ctx := WithTenant(context.Background(), tenant)
+		_, err := d.UnaryInterceptor(ctx, testutils.GetTestMeasurementEnvelope(), &grpc.UnaryServerInfo{}, handler)
+		assert.NoError(t, err)
+	}
+	assert.Equal(t, 2, calls)
+}
@@ -0,0 +1,121 @@
+package testutils
+
+import (
+	"context"
+	"net"
+	"sync"
+
+	collectormetrics "go.opentelemetry.io/proto/otlp/collector/metrics/v1"
+	collectortrace "go.opentelemetry.io/proto/otlp/collector/trace/v1"
+	tracepb "go.opentelemetry.io/proto/otlp/trace/v1"
+	"google.golang.org/grpc"
+)
+
+// TraceCollector is an in-process stand-in for an OTLP collector,
+// it keeps the spans it receives in memory.
+// Point exporters to it with OTEL_EXPORTER_OTLP_ENDPOINT=Endpoint
+type TraceCollector struct {
+	collectortrace.UnimplementedTraceServiceServer
+	Endpoint string
+
+	mu     sync.Mutex
+	spans  []*tracepb.Span
+	server *grpc.Server
+}
+
+func NewTraceCollector() (*TraceCollector, error) {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+
+	c := &TraceCollector{
+		Endpoint: "http://" + lis.Addr().String(),
+		server:   grpc.NewServer(),
+	}
+	collectortrace.RegisterTraceServiceServer(c.server, c)
+	go func() { _ = c.server.Serve(lis) }()
+	return c, nil
+}
+
+func (c *TraceCollector) Export(ctx context.Context, req *collectortrace.ExportTraceServiceRequest) (*collectortrace.ExportTraceServiceResponse, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, resourceSpans := range req.GetResourceSpans() {
+		for _, scopeSpans := range resourceSpans.GetScopeSpans() {
+			c.spans = append(c.spans, scopeSpans.GetSpans()...)
+		}
+	}
+	return &collectortrace.ExportTraceServiceResponse{}, nil
+}
+
+// Spans returns all the spans received so far
+func (c *TraceCollector) Spans() []*tracepb.Span {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]*tracepb.Span{}, c.spans...)
+}
+
+// Span returns the first received span with name, nil if none
+func (c *TraceCollector) Span(name string) *tracepb.Span {
+	for _, span := range c.Spans() {
+		if span.GetName() == name {
+			return span
+		}
+	}
+	return nil
+}
+
+func (c *TraceCollector) Close() {
+	c.server.Stop()
+}
+
+// MetricsCollector is TraceCollector for metrics, it
+// keeps the names of the metrics it receives
+type MetricsCollector struct {
+	collectormetrics.UnimplementedMetricsServiceServer
+	Endpoint string
+
+	mu     sync.Mutex
+	names  []string
+	server *grpc.Server
+}
+
+func NewMetricsCollector() (*MetricsCollector, error) {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+
+	c := &MetricsCollector{
+		Endpoint: "http://" + lis.Addr().String(),
+		server:   grpc.NewServer(),
+	}
+	collectormetrics.RegisterMetricsServiceServer(c.server, c)
+	go func() { _ = c.server.Serve(lis) }()
+	return c, nil
+}
+
+func (c *MetricsCollector) Export(ctx context.Context, req *collectormetrics.ExportMetricsServiceRequest) (*collectormetrics.ExportMetricsServiceResponse, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, resourceMetrics := range req.GetResourceMetrics() {
+		for _, scopeMetrics := range resourceMetrics.GetScopeMetrics() {
+			for _, metric := range scopeMetrics.GetMetrics() {
+				c.names = append(c.names, metric.GetName())
+			}
+		}
+	}
+	return &collectormetrics.ExportMetricsServiceResponse{}, nil
+}
+
+// Names returns the names of all the metrics received so far
+func (c *MetricsCollector) Names() []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]string{}, c.names...)
+}
+
+func (c *MetricsCollector) Close() {
+	c.server.Stop()
+}
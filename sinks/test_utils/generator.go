@@ -0,0 +1,361 @@
+package testutils
+
+import (
+	"fmt"
+	"maps"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/destrex271/pgwatch3_rpc_server/sinks/pb"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+type columnKind int
+
+const (
+	counterColumn columnKind = iota // monotonically growing integer, e.g. xact_commit
+	gaugeColumn                     // integer that moves freely within a range, e.g. numbackends
+	floatColumn                     // float gauge, e.g. mean_time
+	timeColumn                      // cumulative float counter in ms, e.g. total_time
+	boolColumn
+)
+
+type column struct {
+	name string
+	kind columnKind
+	// for counters max is the largest increment between two samples,
+	// for gauges and floats min/max bound the generated value
+	min, max float64
+}
+
+type metricDef struct {
+	columns []column
+	// rows is the number of rows per envelope when Cardinality is not set,
+	// single row metrics (db_stats, wal) ignore Cardinality
+	rows      int
+	singleRow bool
+	// tags returns the row identifying `tag_` columns for the key with index i
+	tags func(i int) map[string]any
+}
+
+var locktypes = []string{"relation", "transactionid", "virtualxid", "tuple", "advisory", "object"}
+var lockmodes = []string{"AccessShareLock", "RowShareLock", "RowExclusiveLock", "ShareUpdateExclusiveLock", "ShareLock", "ExclusiveLock", "AccessExclusiveLock"}
+
+var metricDefs = map[string]metricDef{
+	"db_stats": {
+		singleRow: true,
+		columns: []column{
+			{name: "numbackends", kind: gaugeColumn, min: 1, max: 200},
+			{name: "xact_commit", kind: counterColumn, max: 5000},
+			{name: "xact_rollback", kind: counterColumn, max: 20},
+			{name: "blks_read", kind: counterColumn, max: 2000},
+			{name: "blks_hit", kind: counterColumn, max: 200000},
+			{name: "tup_returned", kind: counterColumn, max: 500000},
+			{name: "tup_fetched", kind: counterColumn, max: 100000},
+			{name: "tup_inserted", kind: counterColumn, max: 5000},
+			{name: "tup_updated", kind: counterColumn, max: 3000},
+			{name: "tup_deleted", kind: counterColumn, max: 500},
+			{name: "conflicts", kind: counterColumn, max: 1},
+			{name: "temp_files", kind: counterColumn, max: 3},
+			{name: "temp_bytes", kind: counterColumn, max: 50 << 20},
+			{name: "deadlocks", kind: counterColumn, max: 1},
+			{name: "blk_read_time", kind: timeColumn, max: 500},
+			{name: "blk_write_time", kind: timeColumn, max: 100},
+			{name: "postmaster_uptime_s", kind: counterColumn, max: 60},
+			{name: "checksum_failures", kind: counterColumn},
+			{name: "in_recovery", kind: boolColumn},
+		},
+	},
+	"table_stats": {
+		rows: 50,
+		columns: []column{
+			{name: "table_size_b", kind: gaugeColumn, min: 8192, max: 10 << 30},
+			{name: "total_relation_size_b", kind: gaugeColumn, min: 16384, max: 20 << 30},
+			{name: "seq_scan", kind: counterColumn, max: 50},
+			{name: "seq_tup_read", kind: counterColumn, max: 100000},
+			{name: "idx_scan", kind: counterColumn, max: 5000},
+			{name: "idx_tup_fetch", kind: counterColumn, max: 20000},
+			{name: "n_tup_ins", kind: counterColumn, max: 1000},
+			{name: "n_tup_upd", kind: counterColumn, max: 800},
+			{name: "n_tup_del", kind: counterColumn, max: 100},
+			{name: "n_tup_hot_upd", kind: counterColumn, max: 600},
+			{name: "n_live_tup", kind: gaugeColumn, min: 0, max: 50000000},
+			{name: "n_dead_tup", kind: gaugeColumn, min: 0, max: 500000},
+			{name: "vacuum_count", kind: counterColumn, max: 1},
+			{name: "autovacuum_count", kind: counterColumn, max: 1},
+			{name: "analyze_count", kind: counterColumn, max: 1},
+			{name: "autoanalyze_count", kind: counterColumn, max: 1},
+			{name: "seconds_since_last_vacuum", kind: gaugeColumn, min: 0, max: 86400},
+			{name: "is_part_root", kind: boolColumn},
+		},
+		tags: func(i int) map[string]any {
+			table := fmt.Sprintf("table_%d", i)
+			return map[string]any{
+				"tag_schema":          "public",
+				"tag_table_name":      table,
+				"tag_table_full_name": "public." + table,
+			}
+		},
+	},
+	"stat_statements": {
+		rows: 100,
+		columns: []column{
+			{name: "calls", kind: counterColumn, max: 2000},
+			{name: "total_time", kind: timeColumn, max: 20000},
+			{name: "mean_time", kind: floatColumn, min: 0.01, max: 250},
+			{name: "rows", kind: counterColumn, max: 10000},
+			{name: "shared_blks_hit", kind: counterColumn, max: 100000},
+			{name: "shared_blks_read", kind: counterColumn, max: 2000},
+			{name: "shared_blks_written", kind: counterColumn, max: 200},
+			{name: "temp_blks_read", kind: counterColumn, max: 50},
+			{name: "temp_blks_written", kind: counterColumn, max: 50},
+			{name: "blk_read_time", kind: timeColumn, max: 300},
+			{name: "blk_write_time", kind: timeColumn, max: 50},
+		},
+		tags: func(i int) map[string]any {
+			return map[string]any{
+				"tag_queryid": fmt.Sprintf("%d", int64(i)*7919+1000003),
+				"tag_query":   fmt.Sprintf("SELECT * FROM public.table_%d WHERE id = $1", i),
+				"users":       "app_user",
+			}
+		},
+	},
+	"wal": {
+		singleRow: true,
+		columns: []column{
+			{name: "xlog_location_b", kind: counterColumn, max: 64 << 20},
+			{name: "postmaster_uptime_s", kind: counterColumn, max: 60},
+			{name: "timeline", kind: gaugeColumn, min: 1, max: 1},
+			{name: "in_recovery", kind: boolColumn},
+		},
+	},
+	"replication": {
+		rows: 2,
+		columns: []column{
+			{name: "sent_lag_b", kind: gaugeColumn, min: 0, max: 1 << 20},
+			{name: "write_lag_b", kind: gaugeColumn, min: 0, max: 4 << 20},
+			{name: "flush_lag_b", kind: gaugeColumn, min: 0, max: 8 << 20},
+			{name: "replay_lag_b", kind: gaugeColumn, min: 0, max: 16 << 20},
+			{name: "write_lag_ms", kind: floatColumn, min: 0, max: 50},
+			{name: "flush_lag_ms", kind: floatColumn, min: 0, max: 100},
+			{name: "replay_lag_ms", kind: floatColumn, min: 0, max: 500},
+		},
+		tags: func(i int) map[string]any {
+			return map[string]any{
+				"tag_application_name": fmt.Sprintf("replica_%d", i),
+				"tag_client_info":      fmt.Sprintf("10.0.%d.%d", i/250, i%250+1),
+				"state":                "streaming",
+				"sync_state":           "async",
+			}
+		},
+	},
+	"locks": {
+		rows: len(locktypes) * len(lockmodes),
+		columns: []column{
+			{name: "count", kind: gaugeColumn, min: 0, max: 100},
+		},
+		tags: func(i int) map[string]any {
+			return map[string]any{
+				"tag_locktype": locktypes[i%len(locktypes)],
+				"tag_mode":     lockmodes[(i/len(locktypes))%len(lockmodes)],
+			}
+		},
+	},
+}
+
+// StandardMetrics lists the pgwatch metrics the Generator knows how to produce.
+var StandardMetrics = []string{"db_stats", "table_stats", "stat_statements", "wal", "replication", "locks"}
+
+// GeneratorOptions configures the data produced by a Generator.
+type GeneratorOptions struct {
+	// Sources are the DBNames to generate measurements for.
+	// If empty NumSources names of the form `source_<i>` are used.
+	Sources    []string
+	NumSources int
+	// Metrics to generate, defaults to StandardMetrics.
+	Metrics []string
+	// Cardinality overrides the number of rows per envelope
+	// for multi row metrics (table_stats, stat_statements, ...).
+	Cardinality int
+	// Churn is the fraction [0, 1] of row keys that get replaced
+	// by new ones (e.g. dropped tables, evicted statements) on every sample.
+	Churn float64
+	// CustomTags attached to every generated envelope.
+	CustomTags map[string]string
+	// Seed for the random source, 0 means a time based seed.
+	Seed int64
+}
+
+type rowState struct {
+	key      int
+	counters map[string]float64
+}
+
+// Generator produces realistic pgwatch measurement envelopes
+// with growing counters and `epoch_ns` timestamps.
+// It is safe for concurrent use.
+type Generator struct {
+	opts    GeneratorOptions
+	sources []string
+	metrics []string
+
+	mu      sync.Mutex
+	rnd     *rand.Rand
+	state   map[string][]*rowState // source/metric => rows
+	nextKey map[string]int
+	cursor  int
+}
+
+func NewGenerator(opts GeneratorOptions) (*Generator, error) {
+	sources := opts.Sources
+	if len(sources) == 0 {
+		if opts.NumSources <= 0 {
+			opts.NumSources = 1
+		}
+		for i := range opts.NumSources {
+			sources = append(sources, fmt.Sprintf("source_%d", i))
+		}
+	}
+
+	metrics := opts.Metrics
+	if len(metrics) == 0 {
+		metrics = StandardMetrics
+	}
+	for _, metric := range metrics {
+		if _, ok := metricDefs[metric]; !ok {
+			return nil, fmt.Errorf("unknown metric %q", metric)
+		}
+	}
+
+	if opts.Churn < 0 || opts.Churn > 1 {
+		return nil, fmt.Errorf("churn must be between 0 and 1, got %v", opts.Churn)
+	}
+
+	seed := opts.Seed
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+	}
+
+	return &Generator{
+		opts:    opts,
+		sources: sources,
+		metrics: metrics,
+		rnd:     rand.New(rand.NewSource(seed)),
+		state:   make(map[string][]*rowState),
+		nextKey: make(map[string]int),
+	}, nil
+}
+
+func (g *Generator) Sources() []string {
+	return g.sources
+}
+
+func (g *Generator) Metrics() []string {
+	return g.metrics
+}
+
+// Next returns the envelope for the next source/metric
+// pair, cycling over all of them in order.
+func (g *Generator) Next() *pb.MeasurementEnvelope {
+	g.mu.Lock()
+	i := g.cursor
+	g.cursor = (g.cursor + 1) % (len(g.sources) * len(g.metrics))
+	g.mu.Unlock()
+
+	return g.Envelope(g.sources[i/len(g.metrics)], g.metrics[i%len(g.metrics)])
+}
+
+// Envelope returns the next sample of metric for source. Every
+// envelope gets its own copy of CustomTags, receivers may modify it.
+func (g *Generator) Envelope(source, metric string) *pb.MeasurementEnvelope {
+	return &pb.MeasurementEnvelope{
+		DBName:     source,
+		MetricName: metric,
+		CustomTags: maps.Clone(g.opts.CustomTags),
+		Data:       g.Rows(source, metric, time.Now()),
+	}
+}
+
+// Rows returns the next sample of metric for source timestamped at ts.
+func (g *Generator) Rows(source, metric string, ts time.Time) []*structpb.Struct {
+	def, ok := metricDefs[metric]
+	if !ok {
+		return nil
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	rows := g.rowStates(source+"/"+metric, def)
+	data := make([]*structpb.Struct, 0, len(rows))
+	for _, row := range rows {
+		values := map[string]any{"epoch_ns": ts.UnixNano()}
+		if def.tags != nil {
+			for k, v := range def.tags(row.key) {
+				values[k] = v
+			}
+		}
+		for _, col := range def.columns {
+			values[col.name] = g.value(row, col)
+		}
+
+		st, err := structpb.NewStruct(values)
+		if err != nil {
+			panic(err)
+		}
+		data = append(data, st)
+	}
+	return data
+}
+
+func (g *Generator) rowStates(id string, def metricDef) []*rowState {
+	rows, ok := g.state[id]
+	if !ok {
+		n := 1
+		if !def.singleRow {
+			n = def.rows
+			if g.opts.Cardinality > 0 {
+				n = g.opts.Cardinality
+			}
+		}
+		for range n {
+			rows = append(rows, g.newRow(id))
+		}
+		g.state[id] = rows
+		return rows
+	}
+
+	if !def.singleRow && g.opts.Churn > 0 {
+		for i := range rows {
+			if g.rnd.Float64() < g.opts.Churn {
+				rows[i] = g.newRow(id)
+			}
+		}
+	}
+	return rows
+}
+
+func (g *Generator) newRow(id string) *rowState {
+	key := g.nextKey[id]
+	g.nextKey[id]++
+	return &rowState{key: key, counters: make(map[string]float64)}
+}
+
+func (g *Generator) value(row *rowState, col column) any {
+	switch col.kind {
+	case counterColumn:
+		row.counters[col.name] += float64(g.rnd.Int63n(int64(col.max) + 1))
+		return int64(row.counters[col.name])
+	case timeColumn:
+		row.counters[col.name] += g.rnd.Float64() * col.max
+		return row.counters[col.name]
+	case gaugeColumn:
+		return int64(col.min) + g.rnd.Int63n(int64(col.max-col.min)+1)
+	case floatColumn:
+		return col.min + g.rnd.Float64()*(col.max-col.min)
+	case boolColumn:
+		return false
+	}
+	return nil
+}
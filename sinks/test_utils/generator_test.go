@@ -0,0 +1,81 @@
+package testutils
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewGenerator(t *testing.T) {
+	g, err := NewGenerator(GeneratorOptions{NumSources: 3})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"source_0", "source_1", "source_2"}, g.Sources())
+	assert.Equal(t, StandardMetrics, g.Metrics())
+
+	_, err = NewGenerator(GeneratorOptions{Metrics: []string{"unknown"}})
+	assert.Error(t, err)
+
+	_, err = NewGenerator(GeneratorOptions{Churn: 2})
+	assert.Error(t, err)
+}
+
+func TestGeneratorNext(t *testing.T) {
+	g, err := NewGenerator(GeneratorOptions{
+		Sources:    []string{"main", "replica"},
+		Metrics:    []string{"db_stats", "locks"},
+		CustomTags: map[string]string{"env": "test"},
+		Seed:       1,
+	})
+	assert.NoError(t, err)
+
+	expected := [][2]string{{"main", "db_stats"}, {"main", "locks"}, {"replica", "db_stats"}, {"replica", "locks"}, {"main", "db_stats"}}
+	for _, e := range expected {
+		msg := g.Next()
+		assert.Equal(t, e[0], msg.GetDBName())
+		assert.Equal(t, e[1], msg.GetMetricName())
+		assert.Equal(t, "test", msg.GetCustomTags()["env"])
+		assert.NotEmpty(t, msg.GetData())
+	}
+
+	// envelopes don't share their tags
+	msg := g.Next()
+	msg.CustomTags["site"] = "eu1"
+	assert.NotContains(t, g.Next().GetCustomTags(), "site")
+}
+
+func TestGeneratorRows(t *testing.T) {
+	g, err := NewGenerator(GeneratorOptions{Cardinality: 10, Seed: 1})
+	assert.NoError(t, err)
+
+	ts := time.Now()
+	rows := g.Rows("main", "db_stats", ts)
+	assert.Len(t, rows, 1, "single row metrics should ignore Cardinality")
+	row := rows[0].AsMap()
+	assert.Equal(t, float64(ts.UnixNano()), row["epoch_ns"])
+	assert.IsType(t, float64(0), row["xact_commit"])
+	assert.IsType(t, false, row["in_recovery"])
+
+	rows = g.Rows("main", "table_stats", ts)
+	assert.Len(t, rows, 10)
+	assert.IsType(t, "", rows[0].AsMap()["tag_table_name"])
+
+	// counters never go backwards without churn
+	first := g.Rows("main", "stat_statements", ts)
+	second := g.Rows("main", "stat_statements", ts.Add(time.Minute))
+	for i := range first {
+		assert.Equal(t, first[i].AsMap()["tag_queryid"], second[i].AsMap()["tag_queryid"])
+		assert.GreaterOrEqual(t, second[i].AsMap()["calls"], first[i].AsMap()["calls"])
+	}
+}
+
+func TestGeneratorChurn(t *testing.T) {
+	g, err := NewGenerator(GeneratorOptions{Metrics: []string{"table_stats"}, Cardinality: 20, Churn: 1, Seed: 1})
+	assert.NoError(t, err)
+
+	first := g.Rows("main", "table_stats", time.Now())
+	second := g.Rows("main", "table_stats", time.Now())
+	for i := range first {
+		assert.NotEqual(t, first[i].AsMap()["tag_table_name"], second[i].AsMap()["tag_table_name"])
+	}
+}
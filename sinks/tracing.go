@@ -0,0 +1,160 @@
+package sinks
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/destrex271/pgwatch3_rpc_server/sinks/pb"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlpmetric/otlpmetricgrpc"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/propagation"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const tracerName = "github.com/destrex271/pgwatch3_rpc_server/sinks"
+
+// TracingEnabled reports whether traces should be exported, based on
+// the standard OTEL_* env variables: an OTLP endpoint or the otlp
+// exporter must be configured and the SDK must not be disabled
+func TracingEnabled() bool {
+	if strings.EqualFold(os.Getenv("OTEL_SDK_DISABLED"), "true") {
+		return false
+	}
+	switch os.Getenv("OTEL_TRACES_EXPORTER") {
+	case "none":
+		return false
+	case "otlp":
+		return true
+	}
+	return os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT") != "" || os.Getenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT") != ""
+}
+
+// SetupTracing installs a global tracer provider exporting spans over
+// OTLP/gRPC, configured through the standard OTEL_* env variables
+// (endpoint, headers, service name, sampler...). It is a noop unless
+// TracingEnabled, the returned function flushes pending spans.
+func SetupTracing(ctx context.Context) (func(context.Context) error, error) {
+	if !TracingEnabled() {
+		return func(context.Context) error { return nil }, nil
+	}
+
+	protocol := os.Getenv("OTEL_EXPORTER_OTLP_TRACES_PROTOCOL")
+	if protocol == "" {
+		protocol = os.Getenv("OTEL_EXPORTER_OTLP_PROTOCOL")
+	}
+	if protocol != "" && protocol != "grpc" {
+		return nil, fmt.Errorf("unsupported OTLP protocol %q, only grpc is supported", protocol)
+	}
+
+	exporter, err := otlptracegrpc.New(ctx)
+	if err != nil {
+		return nil, err
+	}
+	res, err := telemetryResource(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+	)
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+	log.Println("[INFO]: Exporting traces over OTLP")
+
+	return provider.Shutdown, nil
+}
+
+// MetricsEnabled reports whether metrics should be exported, based on
+// the standard OTEL_* env variables as for TracingEnabled
+func MetricsEnabled() bool {
+	if strings.EqualFold(os.Getenv("OTEL_SDK_DISABLED"), "true") {
+		return false
+	}
+	switch os.Getenv("OTEL_METRICS_EXPORTER") {
+	case "none":
+		return false
+	case "otlp":
+		return true
+	}
+	return os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT") != "" || os.Getenv("OTEL_EXPORTER_OTLP_METRICS_ENDPOINT") != ""
+}
+
+// SetupMetrics installs a global meter provider exporting the receiver's
+// metrics, e.g. sync queue, cardinality and shedding counters, over
+// OTLP/gRPC. It is a noop unless MetricsEnabled, the returned
+// function exports pending metrics.
+func SetupMetrics(ctx context.Context) (func(context.Context) error, error) {
+	if !MetricsEnabled() {
+		return func(context.Context) error { return nil }, nil
+	}
+
+	protocol := os.Getenv("OTEL_EXPORTER_OTLP_METRICS_PROTOCOL")
+	if protocol == "" {
+		protocol = os.Getenv("OTEL_EXPORTER_OTLP_PROTOCOL")
+	}
+	if protocol != "" && protocol != "grpc" {
+		return nil, fmt.Errorf("unsupported OTLP protocol %q, only grpc is supported", protocol)
+	}
+
+	exporter, err := otlpmetricgrpc.New(ctx)
+	if err != nil {
+		return nil, err
+	}
+	res, err := telemetryResource(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	// the export interval is read from OTEL_METRIC_EXPORT_INTERVAL
+	provider := sdkmetric.NewMeterProvider(
+		sdkmetric.WithReader(sdkmetric.NewPeriodicReader(exporter)),
+		sdkmetric.WithResource(res),
+	)
+	otel.SetMeterProvider(provider)
+	log.Println("[INFO]: Exporting metrics over OTLP")
+
+	return provider.Shutdown, nil
+}
+
+func telemetryResource(ctx context.Context) (*resource.Resource, error) {
+	res, err := resource.New(ctx, resource.WithFromEnv(), resource.WithTelemetrySDK(), resource.WithHost())
+	if err != nil {
+		return nil, err
+	}
+	return resource.Merge(resource.Default(), res)
+}
+
+// StartSpan starts a span as a child of the one in ctx, receivers use
+// it around their backend writes. It is a noop if tracing isn't set up
+func StartSpan(ctx context.Context, name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	return otel.Tracer(tracerName).Start(ctx, name, trace.WithAttributes(attrs...), trace.WithSpanKind(trace.SpanKindClient))
+}
+
+// EndSpan records err, if any, and ends the span
+func EndSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// MeasurementAttributes describes msg for span attributes
+func MeasurementAttributes(msg *pb.MeasurementEnvelope) []attribute.KeyValue {
+	return []attribute.KeyValue{
+		attribute.String("pgwatch.dbname", msg.GetDBName()),
+		attribute.String("pgwatch.metric_name", msg.GetMetricName()),
+		attribute.Int("pgwatch.rows", len(msg.GetData())),
+	}
+}
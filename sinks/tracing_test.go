@@ -0,0 +1,128 @@
+package sinks
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net"
+	"testing"
+
+	"github.com/destrex271/pgwatch3_rpc_server/sinks/pb"
+	testutils "github.com/destrex271/pgwatch3_rpc_server/sinks/test_utils"
+	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/contrib/instrumentation/google.golang.org/grpc/otelgrpc"
+	"go.opentelemetry.io/otel"
+	tracepb "go.opentelemetry.io/proto/otlp/trace/v1"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+)
+
+type tracedSink struct {
+	Sink
+}
+
+func (s *tracedSink) UpdateMeasurements(ctx context.Context, msg *pb.MeasurementEnvelope) (*pb.Reply, error) {
+	_, span := StartSpan(ctx, "backend.write", MeasurementAttributes(msg)...)
+	EndSpan(span, errors.New("backend down"))
+	return &pb.Reply{}, nil
+}
+
+func TestTracingEnabled(t *testing.T) {
+	assert.False(t, TracingEnabled())
+
+	t.Setenv("OTEL_EXPORTER_OTLP_ENDPOINT", "http://localhost:4317")
+	assert.True(t, TracingEnabled())
+
+	t.Setenv("OTEL_TRACES_EXPORTER", "none")
+	assert.False(t, TracingEnabled())
+
+	t.Setenv("OTEL_TRACES_EXPORTER", "otlp")
+	t.Setenv("OTEL_SDK_DISABLED", "true")
+	assert.False(t, TracingEnabled())
+}
+
+func TestMetricsEnabled(t *testing.T) {
+	assert.False(t, MetricsEnabled())
+
+	t.Setenv("OTEL_EXPORTER_OTLP_METRICS_ENDPOINT", "http://localhost:4317")
+	assert.True(t, MetricsEnabled())
+
+	t.Setenv("OTEL_METRICS_EXPORTER", "none")
+	assert.False(t, MetricsEnabled())
+}
+
+func TestSetupMetrics(t *testing.T) {
+	collector, err := testutils.NewMetricsCollector()
+	assert.NoError(t, err)
+	defer collector.Close()
+	t.Setenv("OTEL_EXPORTER_OTLP_ENDPOINT", collector.Endpoint)
+
+	shutdown, err := SetupMetrics(context.Background())
+	assert.NoError(t, err)
+	// created before the provider is installed, as the receiver's counters
+	counter, err := otel.Meter(tracerName).Int64Counter("pgwatch_rpc.test")
+	assert.NoError(t, err)
+	counter.Add(context.Background(), 1)
+
+	assert.NoError(t, shutdown(context.Background()))
+	assert.Contains(t, collector.Names(), "pgwatch_rpc.test")
+}
+
+func TestSetupTracing(t *testing.T) {
+	collector, err := testutils.NewTraceCollector()
+	assert.NoError(t, err)
+	defer collector.Close()
+
+	t.Setenv("OTEL_EXPORTER_OTLP_ENDPOINT", collector.Endpoint)
+	t.Setenv("OTEL_SERVICE_NAME", "test_receiver")
+
+	t.Setenv("OTEL_EXPORTER_OTLP_PROTOCOL", "http/protobuf")
+	_, err = SetupTracing(context.Background())
+	assert.Error(t, err)
+	t.Setenv("OTEL_EXPORTER_OTLP_PROTOCOL", "grpc")
+
+	shutdown, err := SetupTracing(context.Background())
+	assert.NoError(t, err)
+
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	server := NewServer(&tracedSink{}, &Listener{}, nil, grpc.StatsHandler(otelgrpc.NewServerHandler()))
+	go func() { _ = server.Serve(lis) }()
+	defer server.Stop()
+
+	// as pgwatch would, propagating its trace context
+	conn, err := grpc.NewClient(lis.Addr().String(),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+		grpc.WithStatsHandler(otelgrpc.NewClientHandler()),
+	)
+	assert.NoError(t, err)
+	defer func() { _ = conn.Close() }()
+	_, err = pb.NewReceiverClient(conn).UpdateMeasurements(context.Background(), testutils.GetTestMeasurementEnvelope())
+	assert.NoError(t, err)
+
+	// flushes pending spans
+	assert.NoError(t, shutdown(context.Background()))
+
+	clientSpan := collector.Span("Receiver/UpdateMeasurements")
+	assert.NotNil(t, clientSpan)
+	var serverSpan *tracepb.Span
+	for _, span := range collector.Spans() {
+		if span.GetName() == "Receiver/UpdateMeasurements" && span.GetKind() == tracepb.Span_SPAN_KIND_SERVER {
+			serverSpan = span
+		}
+	}
+	assert.NotNil(t, serverSpan)
+	assert.True(t, bytes.Equal(clientSpan.GetTraceId(), serverSpan.GetTraceId()))
+
+	writeSpan := collector.Span("backend.write")
+	assert.NotNil(t, writeSpan)
+	assert.True(t, bytes.Equal(serverSpan.GetSpanId(), writeSpan.GetParentSpanId()))
+	assert.Equal(t, tracepb.Status_STATUS_CODE_ERROR, writeSpan.GetStatus().GetCode())
+
+	attrs := map[string]string{}
+	for _, attr := range writeSpan.GetAttributes() {
+		attrs[attr.GetKey()] = attr.GetValue().GetStringValue()
+	}
+	assert.Equal(t, "test", attrs["pgwatch.dbname"])
+	assert.Equal(t, "testMetric", attrs["pgwatch.metric_name"])
+}
@@ -3,23 +3,141 @@ package sinks
 import (
 	"context"
 	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/destrex271/pgwatch3_rpc_server/sinks/pb"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/metric"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
 )
 
+// if set, overrides the sync queue capacity receivers ask for
+var SERVER_SYNC_QUEUE_SIZE = os.Getenv("PGWATCH_RPC_SERVER_SYNC_QUEUE_SIZE")
+
+// how long SyncMetric waits for room in a full queue before
+// dropping the request, defaults to 5s, 0s never waits
+var SERVER_SYNC_TIMEOUT = os.Getenv("PGWATCH_RPC_SERVER_SYNC_TIMEOUT")
+
+const defaultSyncTimeout = 5 * time.Second
+
+type syncKey struct {
+	dbName     string
+	metricName string
+}
+
+type syncItem struct {
+	req      *pb.SyncReq
+	consumed bool
+}
+
+// syncQueue is the state shared by the copies of a SyncMetricHandler
+type syncQueue struct {
+	timeout time.Duration
+
+	mu sync.Mutex
+	// queued requests not consumed yet, later ones are coalesced into
+	pending map[syncKey]*syncItem
+	// key of the latest queued request per DBName
+	latest map[string]syncKey
+
+	done      chan struct{}
+	closeOnce sync.Once
+
+	dropped   atomic.Int64
+	coalesced atomic.Int64
+}
+
+func (q *syncQueue) closed() bool {
+	select {
+	case <-q.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// SyncStats are the counts of sync requests dropped because the queue
+// stayed full, and coalesced into a queued request for the same metric
+type SyncStats struct {
+	Dropped   int64
+	Coalesced int64
+}
+
+var syncMetrics struct {
+	once      sync.Once
+	depth     metric.Int64UpDownCounter
+	dropped   metric.Int64Counter
+	coalesced metric.Int64Counter
+}
+
+func initSyncMetrics() {
+	syncMetrics.once.Do(func() {
+		meter := otel.Meter(tracerName)
+		syncMetrics.depth, _ = meter.Int64UpDownCounter("pgwatch_rpc.sync.queue_length",
+			metric.WithDescription("Sync requests waiting to be handled"))
+		syncMetrics.dropped, _ = meter.Int64Counter("pgwatch_rpc.sync.dropped",
+			metric.WithDescription("Sync requests dropped because the queue was full"))
+		syncMetrics.coalesced, _ = meter.Int64Counter("pgwatch_rpc.sync.coalesced",
+			metric.WithDescription("Sync requests coalesced into a queued request for the same metric"))
+	})
+}
+
 type SyncMetricHandler struct {
-	syncChannel chan *pb.SyncReq
+	syncChannel chan *syncItem
+	queue       *syncQueue
 	pb.UnimplementedReceiverServer
 }
 
-func NewSyncMetricHandler(chanSize int) SyncMetricHandler {
+// SyncOption customizes a SyncMetricHandler
+type SyncOption func(*syncQueue)
+
+// WithSyncTimeout sets how long SyncMetric waits for room in a full
+// queue, taking precedence over PGWATCH_RPC_SERVER_SYNC_TIMEOUT
+func WithSyncTimeout(timeout time.Duration) SyncOption {
+	return func(q *syncQueue) {
+		q.timeout = timeout
+	}
+}
+
+// NewSyncMetricHandler returns a handler queuing up to chanSize sync
+// requests, unless PGWATCH_RPC_SERVER_SYNC_QUEUE_SIZE is set
+func NewSyncMetricHandler(chanSize int, opts ...SyncOption) SyncMetricHandler {
 	if chanSize == 0 {
 		chanSize = 1024
 	}
-	return SyncMetricHandler{syncChannel: make(chan *pb.SyncReq, chanSize)}
+	if SERVER_SYNC_QUEUE_SIZE != "" {
+		if size, err := strconv.Atoi(SERVER_SYNC_QUEUE_SIZE); err != nil || size <= 0 {
+			log.Printf("[ERROR]: Invalid PGWATCH_RPC_SERVER_SYNC_QUEUE_SIZE: %q, using %d", SERVER_SYNC_QUEUE_SIZE, chanSize)
+		} else {
+			chanSize = size
+		}
+	}
+	timeout := defaultSyncTimeout
+	if SERVER_SYNC_TIMEOUT != "" {
+		if d, err := parseDurationEnv("PGWATCH_RPC_SERVER_SYNC_TIMEOUT", SERVER_SYNC_TIMEOUT); err != nil {
+			log.Printf("[ERROR]: %s, using %s", err, timeout)
+		} else {
+			timeout = d
+		}
+	}
+
+	queue := &syncQueue{
+		timeout: timeout,
+		pending: map[syncKey]*syncItem{},
+		latest:  map[string]syncKey{},
+		done:    make(chan struct{}),
+	}
+	for _, opt := range opts {
+		opt(queue)
+	}
+	initSyncMetrics()
+	return SyncMetricHandler{syncChannel: make(chan *syncItem, chanSize), queue: queue}
 }
 
 func (handler SyncMetricHandler) SyncMetric(ctx context.Context, req *pb.SyncReq) (*pb.Reply, error) {
@@ -30,31 +148,137 @@ func (handler SyncMetricHandler) SyncMetric(ctx context.Context, req *pb.SyncReq
 	if req.GetDBName() == "" {
 		return nil, status.Errorf(codes.InvalidArgument, "invalid sync request DBName can't be empty")
 	}
+	if handler.queue == nil {
+		return nil, status.Errorf(codes.Unimplemented, "receiver doesn't handle sync requests")
+	}
 
 	opName := "Add"
 	if req.GetOperation() == pb.SyncOp_DeleteOp {
 		opName = "Delete"
 	}
+	reply := &pb.Reply{
+		Logmsg: fmt.Sprintf("gRPC Receiver Synced: DBName %s MetricName %s Operation %s", req.GetDBName(), req.GetMetricName(), opName),
+	}
 
+	q := handler.queue
+	key := syncKey{req.GetDBName(), req.GetMetricName()}
+	q.mu.Lock()
+	// only the latest request of a DBName is coalesced into, so
+	// that e.g. a later database wide Delete isn't overtaken
+	if item, ok := q.pending[key]; ok && q.latest[key.dbName] == key {
+		item.req.Operation = req.GetOperation()
+		q.mu.Unlock()
+		q.coalesced.Add(1)
+		syncMetrics.coalesced.Add(ctx, 1)
+		return reply, nil
+	}
+	q.mu.Unlock()
+
+	if q.closed() {
+		return nil, status.Errorf(codes.Unavailable, "receiver is shutting down")
+	}
+	item := &syncItem{req: &pb.SyncReq{DBName: req.GetDBName(), MetricName: req.GetMetricName(), Operation: req.GetOperation()}}
 	select {
-	case handler.syncChannel <- req:
-		reply := &pb.Reply{
-			Logmsg: fmt.Sprintf("gRPC Receiver Synced: DBName %s MetricName %s Operation %s", req.GetDBName(), req.GetMetricName(), opName),
+	case handler.syncChannel <- item:
+	default:
+		// full, wait for room
+		if err := handler.waitForRoom(item); err != nil {
+			q.dropped.Add(1)
+			syncMetrics.dropped.Add(ctx, 1)
+			return nil, err
 		}
-		return reply, nil
-	case <-time.After(5 * time.Second):
-		return nil, status.Errorf(codes.DeadlineExceeded, "timeout while trying to sync metric")
 	}
+	syncMetrics.depth.Add(ctx, 1)
+
+	q.mu.Lock()
+	if !item.consumed {
+		q.pending[key] = item
+	}
+	q.latest[key.dbName] = key
+	q.mu.Unlock()
+	return reply, nil
 }
 
+func (handler SyncMetricHandler) waitForRoom(item *syncItem) error {
+	q := handler.queue
+	if q.timeout == 0 {
+		return status.Errorf(codes.ResourceExhausted, "sync queue is full, dropped the request")
+	}
+	timer := time.NewTimer(q.timeout)
+	defer timer.Stop()
+	select {
+	case handler.syncChannel <- item:
+		return nil
+	case <-q.done:
+		return status.Errorf(codes.Unavailable, "receiver is shutting down")
+	case <-timer.C:
+		return status.Errorf(codes.ResourceExhausted, "sync queue is full, dropped the request after %s", q.timeout)
+	}
+}
+
+// GetSyncChannelContent waits for the next sync request,
+// ok is false once CloseSync was called
 func (handler *SyncMetricHandler) GetSyncChannelContent() (*pb.SyncReq, bool) {
-	content, ok := <-handler.syncChannel
-	return content, ok
+	if handler.queue == nil || handler.queue.closed() {
+		return nil, false
+	}
+	var item *syncItem
+	select {
+	case item = <-handler.syncChannel:
+	case <-handler.queue.done:
+		return nil, false
+	}
+	syncMetrics.depth.Add(context.Background(), -1)
+
+	q := handler.queue
+	key := syncKey{item.req.GetDBName(), item.req.GetMetricName()}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	item.consumed = true
+	if q.pending[key] == item {
+		delete(q.pending, key)
+	}
+	if q.latest[key.dbName] == key && q.pending[key] == nil {
+		delete(q.latest, key.dbName)
+	}
+	return item.req, true
 }
 
-func (handler *SyncMetricHandler) HandleSyncMetric() {
+// HandleSyncMetricFunc calls handle for every sync request until
+// CloseSync is called, errors are logged
+func (handler *SyncMetricHandler) HandleSyncMetricFunc(handle func(*pb.SyncReq) error) {
 	for {
-		// default HandleSyncMetric = empty channel and do nothing
-		handler.GetSyncChannelContent()
+		req, ok := handler.GetSyncChannelContent()
+		if !ok {
+			return
+		}
+		if err := handle(req); err != nil {
+			log.Printf("[ERROR]: Unable to handle sync request for DBName %s MetricName %s: %s", req.GetDBName(), req.GetMetricName(), err)
+		}
 	}
-}
\ No newline at end of file
+}
+
+func (handler *SyncMetricHandler) HandleSyncMetric() {
+	// default HandleSyncMetric = empty channel and do nothing
+	handler.HandleSyncMetricFunc(func(*pb.SyncReq) error { return nil })
+}
+
+// CloseSync stops the sync handling loop, later
+// sync requests are answered with Unavailable
+func (handler SyncMetricHandler) CloseSync() {
+	if handler.queue != nil {
+		handler.queue.closeOnce.Do(func() { close(handler.queue.done) })
+	}
+}
+
+// SyncQueueLength returns the number of sync requests waiting to be handled
+func (handler SyncMetricHandler) SyncQueueLength() int {
+	return len(handler.syncChannel)
+}
+
+func (handler SyncMetricHandler) SyncStats() SyncStats {
+	if handler.queue == nil {
+		return SyncStats{}
+	}
+	return SyncStats{Dropped: handler.queue.dropped.Load(), Coalesced: handler.queue.coalesced.Load()}
+}
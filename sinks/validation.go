@@ -0,0 +1,184 @@
+package sinks
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/destrex271/pgwatch3_rpc_server/sinks/pb"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+)
+
+// limits enforced on incoming measurements, empty or 0 means no limit
+var SERVER_MAX_ROWS = os.Getenv("PGWATCH_RPC_SERVER_MAX_ROWS")
+var SERVER_MAX_ENVELOPE_SIZE = os.Getenv("PGWATCH_RPC_SERVER_MAX_ENVELOPE_SIZE")
+var SERVER_MAX_TAGS = os.Getenv("PGWATCH_RPC_SERVER_MAX_TAGS")
+var SERVER_MAX_TAG_KEY_LENGTH = os.Getenv("PGWATCH_RPC_SERVER_MAX_TAG_KEY_LENGTH")
+var SERVER_MAX_TAG_VALUE_LENGTH = os.Getenv("PGWATCH_RPC_SERVER_MAX_TAG_VALUE_LENGTH")
+var SERVER_MAX_ROW_FIELDS = os.Getenv("PGWATCH_RPC_SERVER_MAX_ROW_FIELDS")
+
+// regexp DBName and MetricName must match, on top of being
+// usable as a file name (see ValidPathComponent)
+var SERVER_NAME_PATTERN = os.Getenv("PGWATCH_RPC_SERVER_NAME_PATTERN")
+
+// max number of violations reported in an error
+const maxReportedViolations = 10
+
+// ValidationLimits are the checks IsValidMeasurement does on top
+// of rejecting empty envelopes, zero values mean no limit
+type ValidationLimits struct {
+	MaxRows           int
+	MaxEnvelopeSize   int
+	MaxTags           int
+	MaxTagKeyLength   int
+	MaxTagValueLength int
+	MaxRowFields      int
+	// names that can't be used as a file name are always rejected
+	NamePattern *regexp.Regexp
+}
+
+// LoadValidationLimits parses the limits from env variables
+func LoadValidationLimits() (*ValidationLimits, error) {
+	limits := &ValidationLimits{}
+	ints := []struct {
+		name  string
+		value string
+		field *int
+	}{
+		{"PGWATCH_RPC_SERVER_MAX_ROWS", SERVER_MAX_ROWS, &limits.MaxRows},
+		{"PGWATCH_RPC_SERVER_MAX_ENVELOPE_SIZE", SERVER_MAX_ENVELOPE_SIZE, &limits.MaxEnvelopeSize},
+		{"PGWATCH_RPC_SERVER_MAX_TAGS", SERVER_MAX_TAGS, &limits.MaxTags},
+		{"PGWATCH_RPC_SERVER_MAX_TAG_KEY_LENGTH", SERVER_MAX_TAG_KEY_LENGTH, &limits.MaxTagKeyLength},
+		{"PGWATCH_RPC_SERVER_MAX_TAG_VALUE_LENGTH", SERVER_MAX_TAG_VALUE_LENGTH, &limits.MaxTagValueLength},
+		{"PGWATCH_RPC_SERVER_MAX_ROW_FIELDS", SERVER_MAX_ROW_FIELDS, &limits.MaxRowFields},
+	}
+	for _, i := range ints {
+		if i.value == "" {
+			continue
+		}
+		value, err := strconv.Atoi(i.value)
+		if err != nil || value < 0 {
+			return nil, fmt.Errorf("invalid %s: %q", i.name, i.value)
+		}
+		*i.field = value
+	}
+
+	if SERVER_NAME_PATTERN != "" {
+		pattern, err := regexp.Compile(SERVER_NAME_PATTERN)
+		if err != nil {
+			return nil, fmt.Errorf("invalid PGWATCH_RPC_SERVER_NAME_PATTERN: %w", err)
+		}
+		limits.NamePattern = pattern
+	}
+	return limits, nil
+}
+
+// Validate returns an InvalidArgument error, with a BadRequest
+// detail listing the violations, if msg exceeds any limit
+func (l *ValidationLimits) Validate(msg *pb.MeasurementEnvelope) error {
+	violations := []*errdetails.BadRequest_FieldViolation{}
+	violate := func(field, format string, args ...any) {
+		violations = append(violations, &errdetails.BadRequest_FieldViolation{
+			Field:       field,
+			Description: fmt.Sprintf(format, args...),
+		})
+	}
+
+	for _, name := range [][2]string{{"DBName", msg.GetDBName()}, {"MetricName", msg.GetMetricName()}} {
+		field, value := name[0], name[1]
+		if err := ValidPathComponent(value); err != nil {
+			violate(field, "%s %s", field, err)
+		} else if l.NamePattern != nil && !l.NamePattern.MatchString(value) {
+			violate(field, "%s %q doesn't match %s", field, value, l.NamePattern)
+		}
+	}
+
+	if l.MaxEnvelopeSize > 0 {
+		if size := proto.Size(msg); size > l.MaxEnvelopeSize {
+			violate("", "envelope size %d exceeds %d bytes", size, l.MaxEnvelopeSize)
+		}
+	}
+
+	if l.MaxTags > 0 && len(msg.GetCustomTags()) > l.MaxTags {
+		violate("CustomTags", "%d tags exceed the limit of %d", len(msg.GetCustomTags()), l.MaxTags)
+	}
+	for key, value := range msg.GetCustomTags() {
+		if l.MaxTagKeyLength > 0 && len(key) > l.MaxTagKeyLength {
+			violate("CustomTags", "tag key %q exceeds %d characters", key, l.MaxTagKeyLength)
+		}
+		if l.MaxTagValueLength > 0 && len(value) > l.MaxTagValueLength {
+			violate("CustomTags["+key+"]", "tag value exceeds %d characters", l.MaxTagValueLength)
+		}
+	}
+
+	if l.MaxRows > 0 && len(msg.GetData()) > l.MaxRows {
+		violate("Data", "%d rows exceed the limit of %d", len(msg.GetData()), l.MaxRows)
+	}
+	if l.MaxRowFields > 0 {
+		for i, row := range msg.GetData() {
+			if fields := len(row.GetFields()); fields > l.MaxRowFields {
+				violate(fmt.Sprintf("Data[%d]", i), "%d fields exceed the limit of %d", fields, l.MaxRowFields)
+			}
+		}
+	}
+
+	if len(violations) == 0 {
+		return nil
+	}
+
+	descriptions := []string{}
+	for _, v := range violations[:min(len(violations), maxReportedViolations)] {
+		descriptions = append(descriptions, v.GetDescription())
+	}
+	if len(violations) > maxReportedViolations {
+		descriptions = append(descriptions, fmt.Sprintf("and %d more", len(violations)-maxReportedViolations))
+		violations = violations[:maxReportedViolations]
+	}
+
+	st := status.New(codes.InvalidArgument, "invalid measurement: "+strings.Join(descriptions, "; "))
+	if detailed, err := st.WithDetails(&errdetails.BadRequest{FieldViolations: violations}); err == nil {
+		st = detailed
+	}
+	return st.Err()
+}
+
+// UnaryInterceptor rejects measurements that aren't valid,
+// see IsValidMeasurement, or exceed any of the limits
+func (l *ValidationLimits) UnaryInterceptor(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+	if msg, ok := req.(*pb.MeasurementEnvelope); ok {
+		if err := checkMeasurement(msg); err != nil {
+			return nil, err
+		}
+		if err := l.Validate(msg); err != nil {
+			return nil, err
+		}
+	}
+	return handler(ctx, req)
+}
+
+// ValidPathComponent checks name can be used as a single file path
+// component, i.e. it can't escape the directory it's joined to
+func ValidPathComponent(name string) error {
+	switch {
+	case name == "":
+		return errors.New("is empty")
+	case name == "." || name == "..":
+		return fmt.Errorf("%q is not a valid name", name)
+	case strings.ContainsAny(name, `/\`):
+		return fmt.Errorf("%q contains a path separator", name)
+	}
+	for _, r := range name {
+		if r < 0x20 || r == 0x7f {
+			return fmt.Errorf("%q contains control characters", name)
+		}
+	}
+	return nil
+}
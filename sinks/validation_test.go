@@ -0,0 +1,120 @@
+package sinks
+
+import (
+	"context"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/destrex271/pgwatch3_rpc_server/sinks/pb"
+	testutils "github.com/destrex271/pgwatch3_rpc_server/sinks/test_utils"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+func violations(t *testing.T, err error) map[string]string {
+	st := status.Convert(err)
+	assert.Equal(t, codes.InvalidArgument, st.Code())
+	fields := map[string]string{}
+	for _, detail := range st.Details() {
+		if badRequest, ok := detail.(*errdetails.BadRequest); ok {
+			for _, v := range badRequest.GetFieldViolations() {
+				fields[v.GetField()] = v.GetDescription()
+			}
+		}
+	}
+	return fields
+}
+
+func TestValidationLimits(t *testing.T) {
+	limits := &ValidationLimits{}
+
+	msg := testutils.GetTestMeasurementEnvelope()
+	assert.NoError(t, limits.Validate(msg))
+
+	// names must be usable as file names
+	for _, name := range []string{"../../etc", "..", "a/b", `a\b`, "a\x00b"} {
+		msg.DBName = name
+		assert.Contains(t, violations(t, limits.Validate(msg)), "DBName", name)
+	}
+	msg.DBName = "test"
+
+	limits.NamePattern = regexp.MustCompile(`^[a-z_]+$`)
+	fields := violations(t, limits.Validate(msg))
+	assert.Len(t, fields, 1)
+	assert.Contains(t, fields["MetricName"], `"testMetric" doesn't match`)
+
+	// even if they match the pattern
+	limits.NamePattern = regexp.MustCompile(`.*`)
+	msg.DBName = "../x"
+	assert.Contains(t, violations(t, limits.Validate(msg)), "DBName")
+	msg.DBName = "test"
+
+	limits = &ValidationLimits{MaxRows: 1, MaxTags: 1, MaxTagKeyLength: 8, MaxTagValueLength: 8, MaxRowFields: 1}
+	assert.NoError(t, limits.Validate(testutils.GetTestMeasurementEnvelope()))
+
+	msg = testutils.GetTestMeasurementEnvelope()
+	msg.CustomTags["region"] = "eu-central-1"
+	row, _ := structpb.NewStruct(map[string]any{"a": 1, "b": 2})
+	msg.Data = append(msg.Data, row)
+	err := limits.Validate(msg)
+	fields = violations(t, err)
+	assert.Equal(t, "2 rows exceed the limit of 1", fields["Data"])
+	assert.Equal(t, "2 fields exceed the limit of 1", fields["Data[1]"])
+	assert.Contains(t, fields["CustomTags"], "exceed")
+	assert.Equal(t, "tag value exceeds 8 characters", fields["CustomTags[region]"])
+	assert.True(t, strings.HasPrefix(status.Convert(err).Message(), "invalid measurement: "))
+
+	limits = &ValidationLimits{MaxEnvelopeSize: 10}
+	assert.Contains(t, violations(t, limits.Validate(msg))[""], "envelope size")
+
+	// the number of reported violations is capped
+	limits = &ValidationLimits{MaxRowFields: 1}
+	msg.Data = nil
+	for range 20 {
+		msg.Data = append(msg.Data, row)
+	}
+	err = limits.Validate(msg)
+	assert.Len(t, violations(t, err), maxReportedViolations)
+	assert.Contains(t, status.Convert(err).Message(), "and 10 more")
+}
+
+func TestLoadValidationLimits(t *testing.T) {
+	limits, err := LoadValidationLimits()
+	assert.NoError(t, err)
+	assert.Equal(t, &ValidationLimits{}, limits)
+
+	SERVER_MAX_ROWS, SERVER_NAME_PATTERN = "100", "^[a-z]+$"
+	defer func() { SERVER_MAX_ROWS, SERVER_NAME_PATTERN = "", "" }()
+	limits, err = LoadValidationLimits()
+	assert.NoError(t, err)
+	assert.Equal(t, 100, limits.MaxRows)
+	assert.True(t, limits.NamePattern.MatchString("test"))
+
+	SERVER_MAX_ROWS = "-1"
+	_, err = LoadValidationLimits()
+	assert.Error(t, err)
+
+	SERVER_MAX_ROWS, SERVER_NAME_PATTERN = "", "("
+	_, err = LoadValidationLimits()
+	assert.Error(t, err)
+}
+
+func TestValidationLimits_UnaryInterceptor(t *testing.T) {
+	limits := &ValidationLimits{MaxRows: 1}
+	handler := func(ctx context.Context, req any) (any, error) { return &pb.Reply{}, nil }
+
+	msg := testutils.GetTestMeasurementEnvelope()
+	_, err := limits.UnaryInterceptor(context.Background(), msg, nil, handler)
+	assert.NoError(t, err)
+
+	msg.Data = append(msg.Data, msg.Data[0])
+	_, err = limits.UnaryInterceptor(context.Background(), msg, nil, handler)
+	assert.Equal(t, "2 rows exceed the limit of 1", violations(t, err)["Data"])
+
+	_, err = limits.UnaryInterceptor(context.Background(), &pb.MeasurementEnvelope{}, nil, handler)
+	assert.ErrorIs(t, err, status.Error(codes.InvalidArgument, "empty database name"))
+}